@@ -28,6 +28,24 @@ type Config struct {
 	Endpoints  Endpoints  `json:"endpoints"`
 	Sources    Sources    `json:"sources"`
 	Filters    Filters    `json:"filters"`
+
+	// HealthCheck, if present, checks endpoints when the agent starts.
+	HealthCheck *HealthCheck `json:"healthCheck"`
+
+	// MaxAgeSeconds, if positive, rejects reports whose end time is older than this many seconds.
+	MaxAgeSeconds int64 `json:"maxAgeSeconds"`
+
+	// Ingestion, if present, processes added reports with a pool of workers.
+	Ingestion *Ingestion `json:"ingestion"`
+
+	// Shutdown, if present, bounds the phases of the agent's shutdown.
+	Shutdown *Shutdown `json:"shutdown"`
+
+	// Liveness, if present, periodically sends a report about the agent to an endpoint.
+	Liveness *Liveness `json:"liveness"`
+
+	// Persistence, if present, keeps the state of some components in their own directories.
+	Persistence *Persistence `json:"persistence"`
 }
 
 // Validation
@@ -73,6 +91,24 @@ func (c *Config) Validate() error {
 	if err := c.Filters.Validate(c); err != nil {
 		return err
 	}
+	if err := c.HealthCheck.Validate(c); err != nil {
+		return err
+	}
+	if c.MaxAgeSeconds < 0 {
+		return errors.New("maxAgeSeconds must not be negative")
+	}
+	if err := c.Ingestion.Validate(c); err != nil {
+		return err
+	}
+	if err := c.Shutdown.Validate(c); err != nil {
+		return err
+	}
+	if err := c.Liveness.Validate(c); err != nil {
+		return err
+	}
+	if err := c.Persistence.Validate(c); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -635,6 +635,535 @@ endpoints:
 			t.Fatalf("wanted: %+v, got: %+v", want, got)
 		}
 	})
+
+	t.Run("status code classified as both transient and permanent", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: []config.Endpoint{
+				{
+					Name: "disk",
+					Disk: &config.DiskEndpoint{
+						ReportDir:     "/tmp",
+						ExpireSeconds: 10,
+					},
+					TransientStatusCodes: []int{429, 503},
+					PermanentStatusCodes: []int{400, 503},
+				},
+			},
+		}
+
+		if want, got := "endpoint disk: status code 503 is both transient and permanent", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("transport on a non-http endpoint", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: []config.Endpoint{
+				{
+					Name: "disk",
+					Disk: &config.DiskEndpoint{
+						ReportDir:     "/tmp",
+						ExpireSeconds: 10,
+					},
+					Transport: &config.Transport{MaxIdleConns: 5},
+				},
+			},
+		}
+
+		if want, got := "endpoint disk: transport is only supported by servicecontrol, forward, and datadog endpoints", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative transport setting", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:      "hub",
+				Forward:   &config.ForwardEndpoint{URL: "http://localhost:3456"},
+				Transport: &config.Transport{IdleTimeoutSeconds: -1},
+			}),
+		}
+
+		if want, got := "endpoint hub: transport settings must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid retry delays", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:    "hub",
+				Forward: &config.ForwardEndpoint{URL: "http://localhost:3456"},
+				Retry:   &config.Retry{MinDelaySeconds: 60, MaxDelaySeconds: 10},
+			}),
+		}
+
+		if want, got := "endpoint hub: retry minDelaySeconds must not exceed maxDelaySeconds", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative retry setting", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:    "hub",
+				Forward: &config.ForwardEndpoint{URL: "http://localhost:3456"},
+				Retry:   &config.Retry{MaxQueueSize: -1},
+			}),
+		}
+
+		if want, got := "endpoint hub: retry settings must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("batch on an endpoint without batches", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:    "hub",
+				Forward: &config.ForwardEndpoint{URL: "http://localhost:3456"},
+				Batch:   &config.Batch{MaxSize: 10},
+			}),
+		}
+
+		if want, got := "endpoint hub: batch is only supported by datadog endpoints", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative batch setting", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:    "dd",
+				Datadog: &config.DatadogEndpoint{APIKey: "key"},
+				Batch:   &config.Batch{FlushIntervalMillis: -1},
+			}),
+		}
+
+		if want, got := "endpoint dd: batch settings must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid health check policy", func(t *testing.T) {
+		c := &config.Config{
+			Identities:  goodIdentities,
+			Metrics:     goodMetrics,
+			Endpoints:   goodEndpoints,
+			HealthCheck: &config.HealthCheck{OnFailure: "ignore"},
+		}
+
+		if want, got := `healthCheck: invalid onFailure policy "ignore" (must be "fail" or "continue")`, c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid excluded labels policy", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.Aggregation = &config.Aggregation{BufferSeconds: 10, ExcludeLabels: []string{"request_id"}, ExcludedLabelPolicy: "keep"}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := `metric int-metric: invalid excludedLabelPolicy "keep" (must be "drop" or "annotate")`, c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid aggregation rate", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.Aggregation = &config.Aggregation{BufferSeconds: 10, Rate: "per_minute"}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := `metric int-metric: invalid rate "per_minute" (must be "replace" or "add")`, c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("raw endpoint on a passthrough metric", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.Aggregation = nil
+		metric.Passthrough = &config.Passthrough{}
+		metric.Endpoints = []config.MetricEndpoint{{Name: "disk", Raw: true}}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := "metric int-metric: endpoint disk: raw is only supported by aggregated metrics", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("only raw endpoints", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.Endpoints = []config.MetricEndpoint{{Name: "disk", Raw: true}}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := "metric int-metric: every endpoint is raw; use passthrough instead", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid precision", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.Precision = &config.Precision{Decimals: 16}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := "metric int-metric: precision: decimals must be between 0 and 15", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid sampling rate", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.Sampling = &config.Sampling{Rate: 1.5}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := "metric int-metric: sampling: rate must be > 0 and <= 1: 1.5", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid endpoint coercion", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.Endpoints = []config.MetricEndpoint{{Name: "disk", Coerce: &config.Coerce{Type: "string"}}}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := `metric int-metric: endpoint disk: coerce: invalid type "string" (must be "int" or "double")`, c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative metric ttl", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.TTLSeconds = -1
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := "metric int-metric: ttlSeconds must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("empty default label key", func(t *testing.T) {
+		metric := goodMetrics[0]
+		metric.DefaultLabels = map[string]string{"": "unknown"}
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    config.Metrics{metric},
+			Endpoints:  goodEndpoints,
+		}
+
+		if want, got := "metric int-metric: defaultLabels: empty label key", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative max age", func(t *testing.T) {
+		c := &config.Config{
+			Identities:    goodIdentities,
+			Metrics:       goodMetrics,
+			Endpoints:     goodEndpoints,
+			MaxAgeSeconds: -1,
+		}
+
+		if want, got := "maxAgeSeconds must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("missing datadog api key", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:    "datadog",
+				Datadog: &config.DatadogEndpoint{Site: "datadoghq.eu"},
+			}),
+		}
+
+		if want, got := "datadog: missing apiKey", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative datadog batch size", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:    "datadog",
+				Datadog: &config.DatadogEndpoint{APIKey: "key", BatchSize: -1},
+			}),
+		}
+
+		if want, got := "datadog: batchSize must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("failover with one endpoint", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name: "regions",
+				Failover: &config.FailoverEndpoint{Endpoints: []config.Endpoint{
+					{Name: "primary", Disk: &config.DiskEndpoint{ReportDir: "/tmp", ExpireSeconds: 3600}},
+				}},
+			}),
+		}
+
+		if want, got := "failover: at least two endpoints are required", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid failover member", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name: "regions",
+				Failover: &config.FailoverEndpoint{Endpoints: []config.Endpoint{
+					{Name: "primary", Disk: &config.DiskEndpoint{ReportDir: "/tmp", ExpireSeconds: 3600}},
+					{Name: "secondary", Datadog: &config.DatadogEndpoint{}},
+				}},
+			}),
+		}
+
+		if want, got := "failover: datadog: missing apiKey", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("ingestion without workers", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints:  goodEndpoints,
+			Ingestion:  &config.Ingestion{QueueSize: 10},
+		}
+
+		if want, got := "ingestion: workers must be positive", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("ingestion with a negative overflow", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints:  goodEndpoints,
+			Ingestion:  &config.Ingestion{Workers: 1, OverflowSize: -1},
+		}
+
+		if want, got := "ingestion: overflowSize must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("liveness with an unknown endpoint", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints:  goodEndpoints,
+			Liveness:   &config.Liveness{Endpoint: "missing", IntervalSeconds: 60},
+		}
+
+		if want, got := "liveness: endpoint does not exist: missing", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("persistence with a shared directory", func(t *testing.T) {
+		c := &config.Config{
+			Identities:  goodIdentities,
+			Metrics:     goodMetrics,
+			Endpoints:   goodEndpoints,
+			Persistence: &config.Persistence{Aggregation: "/var/lib/agent/aggregation", Queues: "/var/lib/agent/aggregation/"},
+		}
+
+		if want, got := "persistence: aggregation and queues use the same directory: /var/lib/agent/aggregation/", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative shutdown timeout", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints:  goodEndpoints,
+			Shutdown:   &config.Shutdown{DrainTimeoutSeconds: -1},
+		}
+
+		if want, got := "shutdown: timeouts must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid disk csv column", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: []config.Endpoint{
+				{
+					Name: "disk",
+					Disk: &config.DiskEndpoint{
+						ReportDir: "/tmp",
+						Format:    "csv",
+						Columns:   []string{"id", "labels.tenant", "tenant"},
+					},
+				},
+			},
+		}
+
+		if want, got := "disk: invalid csv column: tenant", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("negative prometheus expiration", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:       "scrape",
+				Prometheus: &config.PrometheusEndpoint{Address: ":9464", ExpireSeconds: -1},
+			}),
+		}
+
+		if want, got := "prometheus: expireSeconds must not be negative", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("missing websocket address", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name:      "live",
+				WebSocket: &config.WebSocketEndpoint{},
+			}),
+		}
+
+		if want, got := "websocket: missing address", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid websocket slow client policy", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name: "live",
+				WebSocket: &config.WebSocketEndpoint{
+					Address:    ":8080",
+					SlowClient: "block",
+				},
+			}),
+		}
+
+		if want, got := `websocket: invalid slowClient policy "block" (must be "drop" or "disconnect")`, c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid disk time format", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name: "on_disk_unix",
+				Disk: &config.DiskEndpoint{
+					ReportDir:  "/tmp/unix",
+					TimeFormat: "unixNanos",
+				},
+			}),
+		}
+
+		if want, got := "disk: invalid time format: unixNanos", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid forward url", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name: "hub",
+				Forward: &config.ForwardEndpoint{
+					URL: "localhost:3456",
+				},
+			}),
+		}
+
+		if want, got := "forward: invalid url: localhost:3456", c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
+
+	t.Run("invalid forward compression", func(t *testing.T) {
+		c := &config.Config{
+			Identities: goodIdentities,
+			Metrics:    goodMetrics,
+			Endpoints: append(goodEndpoints, config.Endpoint{
+				Name: "hub",
+				Forward: &config.ForwardEndpoint{
+					URL:         "http://localhost:3456",
+					Compression: "zstd",
+				},
+			}),
+		}
+
+		if want, got := `forward: invalid compression "zstd" (must be "none" or "gzip")`, c.Validate(); got == nil || want != got.Error() {
+			t.Fatalf("wanted: %+v, got: %+v", want, got)
+		}
+	})
 }
 
 func yamlEqual(want, got []byte) bool {
@@ -17,8 +17,11 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"reflect"
 	"strings"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 )
 
 // Type Endpoints is a Validatable collection of Endpoint objects.
@@ -54,6 +57,72 @@ type Endpoint struct {
 	Disk           *DiskEndpoint           `json:"disk"`
 	ServiceControl *ServiceControlEndpoint `json:"servicecontrol"`
 	PubSub         *PubSubEndpoint         `json:"pubsub"`
+	WebSocket      *WebSocketEndpoint      `json:"websocket"`
+	Prometheus     *PrometheusEndpoint     `json:"prometheus"`
+	Forward        *ForwardEndpoint        `json:"forward"`
+	Datadog        *DatadogEndpoint        `json:"datadog"`
+	Failover       *FailoverEndpoint       `json:"failover"`
+
+	// HTTP status codes whose errors are always (or never) retried, overriding the endpoint's own
+	// classification of send errors.
+	TransientStatusCodes []int `json:"transientStatusCodes"`
+	PermanentStatusCodes []int `json:"permanentStatusCodes"`
+
+	// Labels removed from reports before they're sent to this endpoint. If AllowedLabels is
+	// non-empty, only the labels it lists are sent; labels in RedactedLabels are never sent.
+	// Aggregation isn't affected.
+	AllowedLabels  []string `json:"allowedLabels"`
+	RedactedLabels []string `json:"redactedLabels"`
+
+	// A prefix, such as "teamA/", added to the name of each metric sent to this endpoint. Aggregation
+	// and the metric names used elsewhere in the configuration aren't affected.
+	MetricPrefix string `json:"metricPrefix"`
+
+	// Transport tunes connection reuse by an HTTP-based (servicecontrol, forward, or datadog)
+	// endpoint.
+	Transport *Transport `json:"transport"`
+
+	// Batch tunes how reports are batched for an endpoint that sends batches (datadog).
+	Batch *Batch `json:"batch"`
+
+	// Retry tunes how failed sends to the endpoint are retried, independently of other endpoints.
+	Retry *Retry `json:"retry"`
+}
+
+// Retry holds an endpoint's retry settings. Zero values use the agent's defaults.
+type Retry struct {
+	// The minimum and maximum number of seconds between retries of a failed send, which backs off
+	// exponentially.
+	MinDelaySeconds int64 `json:"minDelaySeconds"`
+	MaxDelaySeconds int64 `json:"maxDelaySeconds"`
+
+	// The maximum number of seconds a report is retried before it's dropped.
+	MaxQueueSeconds int64 `json:"maxQueueSeconds"`
+
+	// The maximum number of reports waiting to be sent; reports beyond it are rejected.
+	MaxQueueSize int `json:"maxQueueSize"`
+}
+
+// Transport holds HTTP connection settings. Zero values use the agent's defaults.
+type Transport struct {
+	// The maximum number of idle (keep-alive) connections kept for reuse.
+	MaxIdleConns int `json:"maxIdleConns"`
+
+	// The number of seconds an idle connection is kept before it's closed.
+	IdleTimeoutSeconds int64 `json:"idleTimeoutSeconds"`
+
+	// The maximum number of connections, active or idle, to a single host.
+	MaxConnsPerHost int `json:"maxConnsPerHost"`
+}
+
+// Batch holds an endpoint's batching settings. Zero values use the agent's defaults.
+type Batch struct {
+	// The maximum number of milliseconds a report waits for others to batch with before it's sent.
+	FlushIntervalMillis int64 `json:"flushIntervalMillis"`
+
+	// The maximum number of reports sent in a batch. It can't exceed a limit the endpoint has of its
+	// own, such as a datadog endpoint's batchSize. A maxSize of 1 disables batching.
+	MaxSize int `json:"maxSize"`
 }
 
 func (e *Endpoint) Validate(c *Config) error {
@@ -63,7 +132,7 @@ func (e *Endpoint) Validate(c *Config) error {
 	// TODO(volkman): determine other Name requirements (no '/'?)
 
 	types := 0
-	for _, v := range []Validatable{e.Disk, e.PubSub, e.ServiceControl} {
+	for _, v := range []Validatable{e.Disk, e.PubSub, e.ServiceControl, e.WebSocket, e.Prometheus, e.Forward, e.Datadog, e.Failover} {
 		if reflect.ValueOf(v).IsNil() {
 			continue
 		}
@@ -81,12 +150,75 @@ func (e *Endpoint) Validate(c *Config) error {
 		return errors.New(fmt.Sprintf("endpoint %v: multiple type configurations", e.Name))
 	}
 
+	transient := make(map[int]bool)
+	for _, code := range e.TransientStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("endpoint %v: invalid transient status code: %v", e.Name, code)
+		}
+		transient[code] = true
+	}
+	for _, code := range e.PermanentStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("endpoint %v: invalid permanent status code: %v", e.Name, code)
+		}
+		if transient[code] {
+			return fmt.Errorf("endpoint %v: status code %v is both transient and permanent", e.Name, code)
+		}
+	}
+
+	for _, label := range append(append([]string(nil), e.AllowedLabels...), e.RedactedLabels...) {
+		if label == "" {
+			return fmt.Errorf("endpoint %v: empty label name in allowedLabels or redactedLabels", e.Name)
+		}
+	}
+
+	if e.Transport != nil {
+		if e.ServiceControl == nil && e.Forward == nil && e.Datadog == nil {
+			return fmt.Errorf("endpoint %v: transport is only supported by servicecontrol, forward, and datadog endpoints", e.Name)
+		}
+		if e.Transport.MaxIdleConns < 0 || e.Transport.IdleTimeoutSeconds < 0 || e.Transport.MaxConnsPerHost < 0 {
+			return fmt.Errorf("endpoint %v: transport settings must not be negative", e.Name)
+		}
+	}
+
+	if e.Retry != nil {
+		r := e.Retry
+		if r.MinDelaySeconds < 0 || r.MaxDelaySeconds < 0 || r.MaxQueueSeconds < 0 || r.MaxQueueSize < 0 {
+			return fmt.Errorf("endpoint %v: retry settings must not be negative", e.Name)
+		}
+		if r.MaxDelaySeconds > 0 && r.MinDelaySeconds > r.MaxDelaySeconds {
+			return fmt.Errorf("endpoint %v: retry minDelaySeconds must not exceed maxDelaySeconds", e.Name)
+		}
+	}
+
+	if e.Batch != nil {
+		if e.Datadog == nil {
+			return fmt.Errorf("endpoint %v: batch is only supported by datadog endpoints", e.Name)
+		}
+		if e.Batch.FlushIntervalMillis < 0 || e.Batch.MaxSize < 0 {
+			return fmt.Errorf("endpoint %v: batch settings must not be negative", e.Name)
+		}
+	}
+
 	return nil
 }
 
 type DiskEndpoint struct {
 	ReportDir     string `json:"reportDir"`
 	ExpireSeconds int64  `json:"expireSeconds"`
+
+	// Format is either "json" (the default), which writes a file per report, or "csv", which appends
+	// a row per report to a CSV file.
+	Format string `json:"format"`
+
+	// Columns lists the CSV columns to write. Each is one of "id", "name", "startTime", "endTime",
+	// "value", "labels.<key>" for the value of a report label, "annotations.<key>" for the value of
+	// a report annotation, or "values.<name>" for a compound metric's named value.
+	Columns []string `json:"columns"`
+
+	// TimeFormat is the format of report times in the json format: "rfc3339" (the default), "unix",
+	// or "unixMillis".
+	TimeFormat string `json:"timeFormat"`
 }
 
 func (e *DiskEndpoint) Validate(c *Config) error {
@@ -96,6 +228,31 @@ func (e *DiskEndpoint) Validate(c *Config) error {
 	if e.ReportDir == "" {
 		return errors.New("disk: missing report directory")
 	}
+	switch e.Format {
+	case "", "json":
+		if len(e.Columns) > 0 {
+			return errors.New("disk: columns are only supported by the csv format")
+		}
+		if err := metrics.ValidateTimeFormat(e.TimeFormat); err != nil {
+			return fmt.Errorf("disk: %v", err)
+		}
+	case "csv":
+		if e.TimeFormat != "" {
+			return errors.New("disk: timeFormat is only supported by the json format")
+		}
+		for _, col := range e.Columns {
+			switch {
+			case col == "id", col == "name", col == "startTime", col == "endTime", col == "value":
+			case strings.HasPrefix(col, "labels.") && len(col) > len("labels."):
+			case strings.HasPrefix(col, "annotations.") && len(col) > len("annotations."):
+			case strings.HasPrefix(col, "values.") && len(col) > len("values."):
+			default:
+				return fmt.Errorf("disk: invalid csv column: %v", col)
+			}
+		}
+	default:
+		return fmt.Errorf("disk: invalid format: %v", e.Format)
+	}
 	return nil
 }
 
@@ -133,6 +290,138 @@ func (e *PubSubEndpoint) Validate(c *Config) error {
 	return nil
 }
 
+type WebSocketEndpoint struct {
+	Address    string `json:"address"`
+	Token      string `json:"token"`
+	BufferSize int    `json:"bufferSize"`
+	SlowClient string `json:"slowClient"`
+	TimeFormat string `json:"timeFormat"`
+}
+
+func (e *WebSocketEndpoint) Validate(c *Config) error {
+	if e.Address == "" {
+		return errors.New("websocket: missing address")
+	}
+	if e.BufferSize < 0 {
+		return errors.New("websocket: bufferSize must not be negative")
+	}
+	if e.SlowClient != "" && e.SlowClient != "drop" && e.SlowClient != "disconnect" {
+		return fmt.Errorf(`websocket: invalid slowClient policy %q (must be "drop" or "disconnect")`, e.SlowClient)
+	}
+	if err := metrics.ValidateTimeFormat(e.TimeFormat); err != nil {
+		return fmt.Errorf("websocket: %v", err)
+	}
+	return nil
+}
+
+// PrometheusEndpoint exposes the latest value sent for each metric and label set for Prometheus
+// to scrape, at the "/metrics/usage" path on Address. A series that hasn't been updated for
+// ExpireSeconds is no longer exposed; if ExpireSeconds is 0, series don't expire.
+type PrometheusEndpoint struct {
+	Address       string `json:"address"`
+	ExpireSeconds int64  `json:"expireSeconds"`
+}
+
+func (e *PrometheusEndpoint) Validate(c *Config) error {
+	if e.Address == "" {
+		return errors.New("prometheus: missing address")
+	}
+	if e.ExpireSeconds < 0 {
+		return errors.New("prometheus: expireSeconds must not be negative")
+	}
+	return nil
+}
+
+// ForwardEndpoint sends reports to another agent's HTTP ingestion API at URL, such as
+// "http://localhost:3456".
+type ForwardEndpoint struct {
+	URL string `json:"url"`
+
+	// Compression is "gzip" to compress reports when the receiver supports it, or "none" (the
+	// default).
+	Compression string `json:"compression"`
+}
+
+func (e *ForwardEndpoint) Validate(c *Config) error {
+	if e.URL == "" {
+		return errors.New("forward: missing url")
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("forward: invalid url: %v", e.URL)
+	}
+	switch e.Compression {
+	case "", "none", "gzip":
+	default:
+		return fmt.Errorf(`forward: invalid compression %q (must be "none" or "gzip")`, e.Compression)
+	}
+	return nil
+}
+
+// DatadogEndpoint sends reports to Datadog as custom metrics, authenticating with APIKey. Site is
+// the Datadog site, such as "datadoghq.com" (the default) or "datadoghq.eu".
+type DatadogEndpoint struct {
+	APIKey string `json:"apiKey"`
+	Site   string `json:"site"`
+
+	// The maximum number of reports whose series are sent in a single request. Defaults to 100.
+	BatchSize int `json:"batchSize"`
+}
+
+func (e *DatadogEndpoint) Validate(c *Config) error {
+	if e.APIKey == "" {
+		return errors.New("datadog: missing apiKey")
+	}
+	if strings.Contains(e.Site, "/") {
+		return fmt.Errorf("datadog: invalid site (must be a domain, such as datadoghq.com): %v", e.Site)
+	}
+	if e.BatchSize < 0 {
+		return errors.New("datadog: batchSize must not be negative")
+	}
+	return nil
+}
+
+// FailoverEndpoint is a group of endpoints, such as Service Control in two regions, that each
+// receive reports only while the endpoints before them are failing.
+type FailoverEndpoint struct {
+	// The group's endpoints, in order of preference. Reports are sent to the group's name; the names
+	// of its endpoints only identify them in logs.
+	Endpoints []Endpoint `json:"endpoints"`
+
+	// The number of seconds an endpoint is skipped after it fails, before it's tried again. Defaults
+	// to 60.
+	CooldownSeconds int64 `json:"cooldownSeconds"`
+}
+
+func (e *FailoverEndpoint) Validate(c *Config) error {
+	if len(e.Endpoints) < 2 {
+		return errors.New("failover: at least two endpoints are required")
+	}
+	if e.CooldownSeconds < 0 {
+		return errors.New("failover: cooldownSeconds must not be negative")
+	}
+	usedNames := make(map[string]bool)
+	for _, m := range e.Endpoints {
+		if usedNames[m.Name] {
+			return fmt.Errorf("failover: endpoint %v: multiple endpoints with the same name", m.Name)
+		}
+		usedNames[m.Name] = true
+		if m.Failover != nil {
+			return fmt.Errorf("failover: endpoint %v: failover groups can't be nested", m.Name)
+		}
+		if len(m.AllowedLabels) > 0 || len(m.RedactedLabels) > 0 || m.MetricPrefix != "" {
+			return fmt.Errorf("failover: endpoint %v: labels and metricPrefix must be set on the group", m.Name)
+		}
+		if m.Batch != nil || m.Retry != nil {
+			return fmt.Errorf("failover: endpoint %v: batch and retry must be set on the group", m.Name)
+		}
+		if err := m.Validate(c); err != nil {
+			return fmt.Errorf("failover: %v", err)
+		}
+	}
+	return nil
+}
+
 func validateGcpKey(identities Identities, endpointType, identity string) error {
 	if identity == "" {
 		return fmt.Errorf("%v: missing identity name", endpointType)
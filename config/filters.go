@@ -22,12 +22,13 @@ import (
 
 type Filter struct {
 	// oneof
-	AddLabels *AddLabels `json:"addLabels"`
+	AddLabels       *AddLabels       `json:"addLabels"`
+	NormalizeLabels *NormalizeLabels `json:"normalizeLabels"`
 }
 
 func (f *Filter) Validate(c *Config) error {
 	types := 0
-	for _, v := range []Validatable{f.AddLabels} {
+	for _, v := range []Validatable{f.AddLabels, f.NormalizeLabels} {
 		if reflect.ValueOf(v).IsNil() {
 			continue
 		}
@@ -83,3 +84,30 @@ func (f *AddLabels) IncludedLabels() map[string]string {
 	}
 	return included
 }
+
+// NormalizeLabels rewrites label keys so that equivalent keys aggregate together. CaseFold lowercases
+// keys, and the first of StripPrefixes that a key starts with is removed from it. TrimValues
+// separately trims whitespace from label values. When two keys of a report normalize to the same
+// key with different values, OnConflict determines the result: "reject" (the default) rejects the
+// report, and "first" keeps the value of the original key that sorts first.
+type NormalizeLabels struct {
+	CaseFold      bool     `json:"caseFold"`
+	StripPrefixes []string `json:"stripPrefixes"`
+	TrimValues    bool     `json:"trimValues"`
+	OnConflict    string   `json:"onConflict"`
+}
+
+func (f *NormalizeLabels) Validate(c *Config) error {
+	if !f.CaseFold && len(f.StripPrefixes) == 0 && !f.TrimValues {
+		return errors.New("normalizeLabels: no normalization configured")
+	}
+	for _, prefix := range f.StripPrefixes {
+		if prefix == "" {
+			return errors.New("normalizeLabels: empty prefix in stripPrefixes")
+		}
+	}
+	if f.OnConflict != "" && f.OnConflict != "reject" && f.OnConflict != "first" {
+		return fmt.Errorf(`normalizeLabels: invalid onConflict policy %q (must be "reject" or "first")`, f.OnConflict)
+	}
+	return nil
+}
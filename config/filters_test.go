@@ -89,6 +89,40 @@ func TestFilters_Validate(t *testing.T) {
 			t.Fatalf("validate error: want=%v, got=%v", expected, err.Error())
 		}
 	})
+
+	t.Run("valid: normalizeLabels", func(t *testing.T) {
+		c := conf
+		c.Filters = config.Filters{
+			{
+				NormalizeLabels: &config.NormalizeLabels{CaseFold: true, StripPrefixes: []string{"x-"}, OnConflict: "first"},
+			},
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("unexpected validate error: %v", err)
+		}
+	})
+
+	for _, tc := range []struct {
+		name      string
+		normalize config.NormalizeLabels
+		expected  string
+	}{
+		{"no normalization", config.NormalizeLabels{}, "normalizeLabels: no normalization configured"},
+		{"empty prefix", config.NormalizeLabels{StripPrefixes: []string{""}}, "normalizeLabels: empty prefix in stripPrefixes"},
+		{"bad onConflict", config.NormalizeLabels{CaseFold: true, OnConflict: "merge"}, `normalizeLabels: invalid onConflict policy "merge" (must be "reject" or "first")`},
+	} {
+		normalize := tc.normalize
+		expected := tc.expected
+		t.Run("invalid: "+tc.name, func(t *testing.T) {
+			c := conf
+			c.Filters = config.Filters{{NormalizeLabels: &normalize}}
+			if err := c.Validate(); err == nil {
+				t.Fatal("expected validate error, got nil")
+			} else if err.Error() != expected {
+				t.Fatalf("validate error: want=%v, got=%v", expected, err.Error())
+			}
+		})
+	}
 }
 
 func TestAddLabels_IncludedLabels(t *testing.T) {
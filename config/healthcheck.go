@@ -0,0 +1,51 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// HealthCheckFail causes the agent to fail to start if an endpoint's health check fails.
+	HealthCheckFail = "fail"
+
+	// HealthCheckContinue causes the agent to log failed endpoint health checks and start anyway.
+	HealthCheckContinue = "continue"
+)
+
+// HealthCheck configures an optional startup check of every endpoint that supports one, such as
+// servicecontrol, forward, and datadog endpoints.
+type HealthCheck struct {
+	// OnFailure is HealthCheckFail (the default) or HealthCheckContinue.
+	OnFailure string `json:"onFailure"`
+
+	// The number of seconds each endpoint's check may take. Defaults to 30.
+	TimeoutSeconds int64 `json:"timeoutSeconds"`
+}
+
+func (h *HealthCheck) Validate(c *Config) error {
+	if h == nil {
+		return nil
+	}
+	if h.OnFailure != "" && h.OnFailure != HealthCheckFail && h.OnFailure != HealthCheckContinue {
+		return fmt.Errorf(`healthCheck: invalid onFailure policy %q (must be "fail" or "continue")`, h.OnFailure)
+	}
+	if h.TimeoutSeconds < 0 {
+		return errors.New("healthCheck: timeoutSeconds must not be negative")
+	}
+	return nil
+}
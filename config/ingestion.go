@@ -0,0 +1,50 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+)
+
+// Ingestion configures an optional pool of workers that process added reports, limiting how many
+// are validated and transformed at once. Reports with the same metric name and labels are processed
+// in the order they're added.
+type Ingestion struct {
+	// The number of workers.
+	Workers int `json:"workers"`
+
+	// The number of reports each worker holds before AddReport blocks. Defaults to 100.
+	QueueSize int `json:"queueSize"`
+
+	// The number of reports each worker spills to disk once its queue is full, before AddReport
+	// blocks. Spilled reports are processed in order as the worker catches up. 0 disables spilling.
+	OverflowSize int `json:"overflowSize"`
+}
+
+func (i *Ingestion) Validate(c *Config) error {
+	if i == nil {
+		return nil
+	}
+	if i.Workers < 1 {
+		return errors.New("ingestion: workers must be positive")
+	}
+	if i.QueueSize < 0 {
+		return errors.New("ingestion: queueSize must not be negative")
+	}
+	if i.OverflowSize < 0 {
+		return errors.New("ingestion: overflowSize must not be negative")
+	}
+	return nil
+}
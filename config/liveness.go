@@ -0,0 +1,46 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Liveness configures a periodic report about the agent itself, sent directly to an endpoint so
+// that operators can detect an agent that has stopped running.
+type Liveness struct {
+	// The endpoint that receives liveness reports.
+	Endpoint string `json:"endpoint"`
+
+	// The number of seconds between liveness reports.
+	IntervalSeconds int64 `json:"intervalSeconds"`
+
+	// The name of the reported metric. Defaults to "agent-liveness".
+	Metric string `json:"metric"`
+}
+
+func (l *Liveness) Validate(c *Config) error {
+	if l == nil {
+		return nil
+	}
+	if !c.Endpoints.exists(l.Endpoint) {
+		return fmt.Errorf("liveness: endpoint does not exist: %v", l.Endpoint)
+	}
+	if l.IntervalSeconds <= 0 {
+		return errors.New("liveness: intervalSeconds must be positive")
+	}
+	return nil
+}
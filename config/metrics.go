@@ -17,6 +17,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
 
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
@@ -30,6 +31,28 @@ type Metric struct {
 	metrics.Definition `json:",inline"`
 	Endpoints          []MetricEndpoint `json:"endpoints"`
 
+	// ValueLabel optionally names a label that holds each report's value, instead of the report's
+	// value field. The label is parsed according to the metric's type and removed from the report.
+	ValueLabel string `json:"valueLabel"`
+
+	// Quantize optionally rounds each report's value to a multiple of a step before aggregation.
+	Quantize *Quantize `json:"quantize"`
+
+	// Sampling optionally passes only a fraction of the metric's reports to its endpoints.
+	Sampling *Sampling `json:"sampling"`
+
+	// Precision optionally rounds the double values of reports sent to the metric's endpoints, after
+	// any aggregation, to a number of decimal places.
+	Precision *Precision `json:"precision"`
+
+	// DefaultLabels are added to reports that don't have a label with the same key. Labels that a
+	// report does have are left as they are.
+	DefaultLabels map[string]string `json:"defaultLabels"`
+
+	// TTLSeconds optionally limits how long a report may wait to be sent, measured from when it was
+	// ingested. Reports still queued after this time are dropped.
+	TTLSeconds int64 `json:"ttlSeconds"`
+
 	// oneof - buffering configuration
 	Aggregation *Aggregation `json:"aggregation"`
 	Passthrough *Passthrough `json:"passthrough"`
@@ -39,6 +62,32 @@ func (m *Metric) Validate(c *Config) error {
 	if err := m.Definition.Validate(); err != nil {
 		return err
 	}
+	if m.ValueLabel != "" && m.IsCompound() {
+		return fmt.Errorf("metric %v: valueLabel can't be used with named values", m.Name)
+	}
+	if m.Quantize != nil {
+		if err := m.Quantize.Validate(m, c); err != nil {
+			return fmt.Errorf("metric %v: %v", m.Name, err)
+		}
+	}
+	if m.Sampling != nil {
+		if err := m.Sampling.Validate(); err != nil {
+			return fmt.Errorf("metric %v: %v", m.Name, err)
+		}
+	}
+	if m.Precision != nil {
+		if err := m.Precision.Validate(); err != nil {
+			return fmt.Errorf("metric %v: %v", m.Name, err)
+		}
+	}
+	if m.TTLSeconds < 0 {
+		return fmt.Errorf("metric %v: ttlSeconds must not be negative", m.Name)
+	}
+	for key := range m.DefaultLabels {
+		if key == "" {
+			return fmt.Errorf("metric %v: defaultLabels: empty label key", m.Name)
+		}
+	}
 	types := 0
 	for _, v := range []metricValidator{m.Aggregation, m.Passthrough} {
 		if reflect.ValueOf(v).IsNil() {
@@ -63,6 +112,7 @@ func (m *Metric) Validate(c *Config) error {
 	}
 
 	usedEndpoints := make(map[string]bool)
+	aggregated := false
 	for _, e := range m.Endpoints {
 		if e.Name == "" {
 			return fmt.Errorf("metric %v: endpoint missing name", m.Name)
@@ -74,6 +124,20 @@ func (m *Metric) Validate(c *Config) error {
 			return fmt.Errorf("metric %v: endpoint listed twice: %v", m.Name, e.Name)
 		}
 		usedEndpoints[e.Name] = true
+		if e.Raw && m.Aggregation == nil {
+			return fmt.Errorf("metric %v: endpoint %v: raw is only supported by aggregated metrics", m.Name, e.Name)
+		}
+		if !e.Raw {
+			aggregated = true
+		}
+		if e.Coerce != nil {
+			if err := e.Coerce.Validate(); err != nil {
+				return fmt.Errorf("metric %v: endpoint %v: %v", m.Name, e.Name, err)
+			}
+		}
+	}
+	if !aggregated {
+		return fmt.Errorf("metric %v: every endpoint is raw; use passthrough instead", m.Name)
 	}
 
 	return nil
@@ -81,11 +145,20 @@ func (m *Metric) Validate(c *Config) error {
 
 type Metrics []Metric
 
-// GetMetricDefinition returns the metrics.Definition with the given name, or nil if it does not
-// exist.
+// GetMetricDefinition returns the metrics.Definition that applies to the metric with the given
+// name, or nil if it does not exist. An exact definition takes precedence over wildcard pattern
+// definitions; see metrics.BestMatch.
 func (m Metrics) GetMetricDefinition(name string) *metrics.Definition {
+	names := make([]string, len(m))
+	for i := range m {
+		names[i] = m[i].Name
+	}
+	match, ok := metrics.BestMatch(name, names)
+	if !ok {
+		return nil
+	}
 	for i := range m {
-		if m[i].Name == name {
+		if m[i].Name == match {
 			return &m[i].Definition
 		}
 	}
@@ -110,20 +183,173 @@ func (m Metrics) Validate(c *Config) error {
 
 type MetricEndpoint struct {
 	Name string `json:"name"`
+
+	// Coerce optionally converts the values of reports sent to this endpoint to another type.
+	Coerce *Coerce `json:"coerce"`
+
+	// Raw sends this endpoint each report of an aggregated metric as it's added, before it's
+	// aggregated, rather than the aggregated reports. This allows raw reports to be archived alongside
+	// the aggregated ones.
+	Raw bool `json:"raw"`
+}
+
+// Coerce converts report values to Type, "int" or "double". Doubles are converted to integers
+// according to Rounding: "up" (the default), "down", or "nearest". Integers are converted to
+// doubles exactly; a report whose value is too large to convert exactly isn't sent.
+type Coerce struct {
+	Type     string `json:"type"`
+	Rounding string `json:"rounding"`
+}
+
+func (c *Coerce) Validate() error {
+	if c.Type != metrics.IntType && c.Type != metrics.DoubleType {
+		return fmt.Errorf(`coerce: invalid type %q (must be "int" or "double")`, c.Type)
+	}
+	if err := metrics.ValidateRounding(c.Rounding); err != nil {
+		return fmt.Errorf("coerce: %v", err)
+	}
+	return nil
 }
 
 type Aggregation struct {
 	// The number of seconds that metrics should be aggregated prior to forwarding
 	BufferSeconds int64 `json:"bufferSeconds"`
+
+	// If positive, an aggregated report (a single name and label set) is also forwarded as soon as
+	// its value, or any one of its named values, reaches FlushOnValue. Whatever remains is forwarded
+	// after BufferSeconds as usual.
+	FlushOnValue float64 `json:"flushOnValue"`
+
+	// If either is positive, reports being aggregated are persisted once PersistEvery reports have
+	// been added, or PersistIntervalSeconds have elapsed, since they were last persisted, rather than
+	// after every report. A crash loses at most the reports added since then.
+	PersistEvery           int   `json:"persistEvery"`
+	PersistIntervalSeconds int64 `json:"persistIntervalSeconds"`
+
+	// If positive, failing to persist reports being aggregated, such as while the disk is full,
+	// doesn't stop the agent. Instead, reports are kept in memory only and forwarded every
+	// DegradedBufferSeconds (if less than BufferSeconds), until persisting succeeds again.
+	DegradedBufferSeconds int64 `json:"degradedBufferSeconds"`
+
+	// FlushParallelism is the number of aggregated reports handed off concurrently when reports are
+	// forwarded. Defaults to 1.
+	FlushParallelism int `json:"flushParallelism"`
+
+	// ExcludeLabels lists label keys that don't split aggregation. They're removed from reports
+	// before aggregation, and with ExcludedLabelPolicy set to "annotate", kept as annotations instead.
+	// ExcludedLabelPolicy is "drop" (the default) or "annotate".
+	ExcludeLabels       []string `json:"excludeLabels"`
+	ExcludedLabelPolicy string   `json:"excludedLabelPolicy"`
+
+	// Rate, if set, sends aggregated values as per-second rates: each sum divided by the length of
+	// its report's window. It's "replace", which sends rates instead of sums, or "add", which sends
+	// each sum along with a report of its rate, named "<metric>.rate". Rates are doubles.
+	Rate string `json:"rate"`
+
+	// StaggerLabel, if set, forwards aggregated reports in groups by their value of this label, on
+	// staggered schedules: each group every BufferSeconds, at an offset within the interval given by
+	// a hash of its value. This spreads out the load of, for example, many tenants' reports.
+	StaggerLabel string `json:"staggerLabel"`
+
+	// FutureEndTime, if set, handles reports whose end time is in the future, such as from clients
+	// with skewed clocks. It's "reject", which rejects them; "clamp", which moves their end time back
+	// to the current time; or "window", which moves their end time back to when the reports being
+	// aggregated are forwarded. By default, they're aggregated as is.
+	FutureEndTime string `json:"futureEndTime"`
 }
 
 func (rm *Aggregation) Validate(m *Metric, c *Config) error {
 	if rm.BufferSeconds <= 0 {
 		return fmt.Errorf("bufferSeconds must be > 0")
 	}
+	if rm.FlushOnValue < 0 {
+		return fmt.Errorf("flushOnValue must not be negative")
+	}
+	if rm.PersistEvery < 0 || rm.PersistIntervalSeconds < 0 {
+		return fmt.Errorf("persistEvery and persistIntervalSeconds must not be negative")
+	}
+	if rm.DegradedBufferSeconds < 0 {
+		return fmt.Errorf("degradedBufferSeconds must not be negative")
+	}
+	if rm.FlushParallelism < 0 {
+		return fmt.Errorf("flushParallelism must not be negative")
+	}
+	for _, key := range rm.ExcludeLabels {
+		if key == "" {
+			return errors.New("excludeLabels: empty label key")
+		}
+	}
+	if rm.ExcludedLabelPolicy != "" && rm.ExcludedLabelPolicy != "drop" && rm.ExcludedLabelPolicy != "annotate" {
+		return fmt.Errorf(`invalid excludedLabelPolicy %q (must be "drop" or "annotate")`, rm.ExcludedLabelPolicy)
+	}
+	if rm.Rate != "" && rm.Rate != "replace" && rm.Rate != "add" {
+		return fmt.Errorf(`invalid rate %q (must be "replace" or "add")`, rm.Rate)
+	}
+	for _, key := range rm.ExcludeLabels {
+		if rm.StaggerLabel != "" && key == rm.StaggerLabel {
+			return fmt.Errorf("staggerLabel %q must not be excluded", rm.StaggerLabel)
+		}
+	}
+	if rm.FutureEndTime != "" && rm.FutureEndTime != "reject" && rm.FutureEndTime != "clamp" && rm.FutureEndTime != "window" {
+		return fmt.Errorf(`invalid futureEndTime %q (must be "reject", "clamp", or "window")`, rm.FutureEndTime)
+	}
+	return nil
+}
+
+// Quantize rounds report values to a multiple of Step. Rounding is "up" (the default), "down", or
+// "nearest". The Step of an int metric must be a whole number.
+type Quantize struct {
+	Step     float64 `json:"step"`
+	Rounding string  `json:"rounding"`
+}
+
+func (q *Quantize) Validate(m *Metric, c *Config) error {
+	if q.Step <= 0 {
+		return errors.New("quantize: step must be > 0")
+	}
+	if m.Type == metrics.IntType && q.Step != math.Trunc(q.Step) {
+		return fmt.Errorf("quantize: step must be a whole number for int metrics: %v", q.Step)
+	}
+	if err := metrics.ValidateRounding(q.Rounding); err != nil {
+		return fmt.Errorf("quantize: %v", err)
+	}
 	return nil
 }
 
+// Sampling passes the fraction Rate, greater than 0 and at most 1, of a metric's reports to its
+// endpoints. Each report is sampled once, before it's sent to any endpoint, so every endpoint
+// receives the same reports.
+type Sampling struct {
+	Rate float64 `json:"rate"`
+}
+
+func (s *Sampling) Validate() error {
+	if s.Rate <= 0 || s.Rate > 1 {
+		return fmt.Errorf("sampling: rate must be > 0 and <= 1: %v", s.Rate)
+	}
+	return nil
+}
+
+// Precision rounds double values to Decimals decimal places, from 0 to 15. Rounding is "up" (the
+// default), "down", or "nearest". Integer values aren't affected.
+type Precision struct {
+	Decimals int    `json:"decimals"`
+	Rounding string `json:"rounding"`
+}
+
+func (p *Precision) Validate() error {
+	if p.Decimals < 0 || p.Decimals > maxPrecisionDecimals {
+		return fmt.Errorf("precision: decimals must be between 0 and %v", maxPrecisionDecimals)
+	}
+	if err := metrics.ValidateRounding(p.Rounding); err != nil {
+		return fmt.Errorf("precision: %v", err)
+	}
+	return nil
+}
+
+// maxPrecisionDecimals is the most decimal places that a double reliably holds.
+const maxPrecisionDecimals = 15
+
 type Passthrough struct {
 }
 
@@ -15,6 +15,7 @@
 package config_test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/GoogleCloudPlatform/ubbagent/config"
@@ -221,6 +222,194 @@ func TestMetrics_Validate(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("invalid: duplicate value name", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition:  metrics.Definition{Name: "transfer", Type: "int", Values: []string{"bytes_in", "bytes_in"}},
+				Endpoints:   goodEndpoints,
+				Passthrough: &config.Passthrough{},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := "metric transfer: duplicate value name: bytes_in"; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("invalid: valueLabel with named values", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition:  metrics.Definition{Name: "transfer", Type: "int", Values: []string{"bytes_in"}},
+				ValueLabel:  "quantity",
+				Endpoints:   goodEndpoints,
+				Passthrough: &config.Passthrough{},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := "metric transfer: valueLabel can't be used with named values"; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("invalid: empty label name in labelValues", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name:        "int-metric",
+					Type:        "int",
+					LabelValues: map[string][]string{"": {"dev"}},
+				},
+				Endpoints:   goodEndpoints,
+				Passthrough: &config.Passthrough{},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := "metric int-metric: empty label name in labelValues"; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("invalid: unit with whitespace", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition:  metrics.Definition{Name: "int-metric", Type: "int", Unit: "k By"},
+				Endpoints:   goodEndpoints,
+				Passthrough: &config.Passthrough{},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := `metric int-metric: invalid unit: "k By"`; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("quantize: step must be a whole number for int metrics", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition:  metrics.Definition{Name: "int-metric", Type: "int"},
+				Quantize:    &config.Quantize{Step: 0.5},
+				Endpoints:   goodEndpoints,
+				Passthrough: &config.Passthrough{},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := "metric int-metric: quantize: step must be a whole number for int metrics: 0.5"; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("quantize: invalid rounding", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition:  metrics.Definition{Name: "double-metric", Type: "double"},
+				Quantize:    &config.Quantize{Step: 0.25, Rounding: "sideways"},
+				Endpoints:   goodEndpoints,
+				Passthrough: &config.Passthrough{},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := `metric double-metric: quantize: invalid rounding "sideways" (must be "up", "down", or "nearest")`; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("aggregation: persistEvery must not be negative", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition: metrics.Definition{Name: "int-metric", Type: "int"},
+				Endpoints:  goodEndpoints,
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 10,
+					PersistEvery:  -1,
+				},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := "metric int-metric: persistEvery and persistIntervalSeconds must not be negative"; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("aggregation: degradedBufferSeconds must not be negative", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition: metrics.Definition{Name: "int-metric", Type: "int"},
+				Endpoints:  goodEndpoints,
+				Aggregation: &config.Aggregation{
+					BufferSeconds:         10,
+					DegradedBufferSeconds: -1,
+				},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := "metric int-metric: degradedBufferSeconds must not be negative"; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("aggregation: staggerLabel must not be excluded", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition: metrics.Definition{Name: "int-metric", Type: "int"},
+				Endpoints:  goodEndpoints,
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 10,
+					ExcludeLabels: []string{"tenant"},
+					StaggerLabel:  "tenant",
+				},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := `metric int-metric: staggerLabel "tenant" must not be excluded`; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("aggregation: invalid futureEndTime", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition: metrics.Definition{Name: "int-metric", Type: "int"},
+				Endpoints:  goodEndpoints,
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 10,
+					FutureEndTime: "drop",
+				},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := `metric int-metric: invalid futureEndTime "drop" (must be "reject", "clamp", or "window")`; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
+
+	t.Run("aggregation: flushOnValue must not be negative", func(t *testing.T) {
+		invalid := config.Metrics{
+			{
+				Definition: metrics.Definition{Name: "int-metric", Type: "int"},
+				Endpoints:  goodEndpoints,
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 10,
+					FlushOnValue:  -1,
+				},
+			},
+		}
+
+		err := invalid.Validate(&conf)
+		if want := "metric int-metric: flushOnValue must not be negative"; err == nil || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+	})
 }
 
 func TestMetrics_GetMetricDefinition(t *testing.T) {
@@ -235,7 +424,7 @@ func TestMetrics_GetMetricDefinition(t *testing.T) {
 		Type: "int",
 	}
 	actual := validConfig.GetMetricDefinition("int-metric2")
-	if *actual != expected {
+	if !reflect.DeepEqual(*actual, expected) {
 		t.Fatalf("Expected: %s, got: %s", expected, actual)
 	}
 
@@ -244,3 +433,34 @@ func TestMetrics_GetMetricDefinition(t *testing.T) {
 		t.Fatalf("Expected: nil, got: %s", actual)
 	}
 }
+
+func TestMetrics_GetMetricDefinition_Wildcard(t *testing.T) {
+	validConfig := config.Metrics{
+		{Definition: metrics.Definition{Name: "requests_*", Type: "int"}},
+		{Definition: metrics.Definition{Name: "requests_cost", Type: "double"}},
+		{Definition: metrics.Definition{Name: "requests_*_bytes", Type: "double"}},
+	}
+
+	cases := []struct {
+		name     string
+		expected metrics.Definition
+	}{
+		{"requests_get", metrics.Definition{Name: "requests_*", Type: "int"}},
+		{"requests_post", metrics.Definition{Name: "requests_*", Type: "int"}},
+		{"requests_", metrics.Definition{Name: "requests_*", Type: "int"}},
+		// The exact definition takes precedence over the wildcard.
+		{"requests_cost", metrics.Definition{Name: "requests_cost", Type: "double"}},
+		// The longer, more specific pattern takes precedence.
+		{"requests_in_bytes", metrics.Definition{Name: "requests_*_bytes", Type: "double"}},
+	}
+	for _, c := range cases {
+		actual := validConfig.GetMetricDefinition(c.name)
+		if actual == nil || !reflect.DeepEqual(*actual, c.expected) {
+			t.Fatalf("%v: Expected: %v, got: %v", c.name, c.expected, actual)
+		}
+	}
+
+	if actual := validConfig.GetMetricDefinition("other_requests"); actual != nil {
+		t.Fatalf("Expected: nil, got: %s", actual)
+	}
+}
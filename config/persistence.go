@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Persistence assigns the state of some of the agent's components to their own state directories.
+// The state of every component without a directory is kept in the agent's state directory, so each
+// directory must differ from it and from each other. Export and import of the agent's state include
+// every directory.
+type Persistence struct {
+	// The directory holding pending aggregations.
+	Aggregation string `json:"aggregation"`
+
+	// The directory holding each endpoint's queue of sends, quarantine, and record of sent reports.
+	Queues string `json:"queues"`
+
+	// The directory holding the positions of sources, such as a tailed file's offset.
+	Sources string `json:"sources"`
+
+	// The directory holding reports spilled by ingestion workers.
+	Ingestion string `json:"ingestion"`
+}
+
+func (p *Persistence) Validate(c *Config) error {
+	if p == nil {
+		return nil
+	}
+	seen := make(map[string]string)
+	for _, d := range []struct{ component, dir string }{
+		{"aggregation", p.Aggregation},
+		{"queues", p.Queues},
+		{"sources", p.Sources},
+		{"ingestion", p.Ingestion},
+	} {
+		if d.dir == "" {
+			continue
+		}
+		dir := filepath.Clean(d.dir)
+		if other, ok := seen[dir]; ok {
+			return fmt.Errorf("persistence: %v and %v use the same directory: %v", other, d.component, d.dir)
+		}
+		seen[dir] = d.component
+	}
+	return nil
+}
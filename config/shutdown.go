@@ -0,0 +1,46 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+)
+
+// Shutdown configures how the agent shuts down. Shutdown happens in phases, in order: aggregated
+// reports are flushed from their buckets, the endpoints' retry queues are drained, and the endpoints
+// are closed. Each phase is bounded by its own timeout; a phase that times out doesn't stop the
+// later phases from running.
+type Shutdown struct {
+	// The maximum number of seconds to wait for aggregated reports to be flushed. 0 waits
+	// indefinitely.
+	FlushTimeoutSeconds int64 `json:"flushTimeoutSeconds"`
+
+	// The maximum number of seconds to keep sending queued reports. Reports that are still queued
+	// afterward are persisted, and sent once the agent restarts. 0 skips draining.
+	DrainTimeoutSeconds int64 `json:"drainTimeoutSeconds"`
+
+	// The maximum number of seconds to wait for endpoints to close. 0 waits indefinitely.
+	CloseTimeoutSeconds int64 `json:"closeTimeoutSeconds"`
+}
+
+func (s *Shutdown) Validate(c *Config) error {
+	if s == nil {
+		return nil
+	}
+	if s.FlushTimeoutSeconds < 0 || s.DrainTimeoutSeconds < 0 || s.CloseTimeoutSeconds < 0 {
+		return errors.New("shutdown: timeouts must not be negative")
+	}
+	return nil
+}
@@ -27,6 +27,7 @@ type Source struct {
 
 	// oneof
 	Heartbeat *Heartbeat `json:"heartbeat"`
+	FileTail  *FileTail  `json:"fileTail"`
 }
 
 func (s *Source) Validate(c *Config) error {
@@ -34,7 +35,7 @@ func (s *Source) Validate(c *Config) error {
 		return errors.New("missing source name")
 	}
 	types := 0
-	for _, v := range []Validatable{s.Heartbeat} {
+	for _, v := range []Validatable{s.Heartbeat, s.FileTail} {
 		if reflect.ValueOf(v).IsNil() {
 			continue
 		}
@@ -94,3 +95,22 @@ func (h *Heartbeat) Validate(c *Config) error {
 	}
 	return nil
 }
+
+// FileTail follows a file of newline-delimited JSON reports, in the format accepted by the HTTP
+// API, and adds each report appended to it. A rotated or truncated file is followed from its start.
+type FileTail struct {
+	Path string `json:"path"`
+
+	// How often the file is checked for new reports. Defaults to 1000.
+	PollIntervalMillis int64 `json:"pollIntervalMillis"`
+}
+
+func (f *FileTail) Validate(c *Config) error {
+	if f.Path == "" {
+		return errors.New("path must be specified")
+	}
+	if f.PollIntervalMillis < 0 {
+		return errors.New("pollIntervalMillis must not be negative")
+	}
+	return nil
+}
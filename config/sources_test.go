@@ -137,4 +137,17 @@ func TestSources_Validate(t *testing.T) {
 			t.Fatalf("Expected error, got: %v", err)
 		}
 	})
+
+	t.Run("fileTail: path must be specified", func(t *testing.T) {
+		valid := config.Source{Name: "test", FileTail: &config.FileTail{Path: "/var/log/usage.ndjson"}}
+		if err := valid.Validate(&conf); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		invalid := config.Source{Name: "test", FileTail: &config.FileTail{}}
+		err := invalid.Validate(&conf)
+		if err == nil || err.Error() != "source test: path must be specified" {
+			t.Fatalf("Expected error, got: %v", err)
+		}
+	})
 }
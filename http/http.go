@@ -15,12 +15,16 @@
 package http
 
 import (
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
 	"github.com/GoogleCloudPlatform/ubbagent/sdk"
 )
 
@@ -37,6 +41,9 @@ func NewHttpInterface(agent *sdk.Agent, port int) *HttpInterface {
 	h := &HttpInterface{agent: agent, port: port}
 	h.mux.HandleFunc("/report", h.handleAdd)
 	h.mux.HandleFunc("/status", h.handleStatus)
+	h.mux.HandleFunc("/state", h.handleState)
+	h.mux.HandleFunc("/pause", h.handlePause)
+	h.mux.HandleFunc("/resume", h.handleResume)
 	return h
 }
 
@@ -44,7 +51,25 @@ func (h *HttpInterface) handleAdd(w http.ResponseWriter, r *http.Request) {
 	// TODO(volkman): better error handling (internal vs client errors)
 	// TODO(volkman): request logging
 
-	reportData, err := ioutil.ReadAll(r.Body)
+	w.Header().Set("Accept-Encoding", "gzip")
+	var body io.Reader = r.Body
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	reportData, err := ioutil.ReadAll(body)
 	if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
@@ -52,7 +77,15 @@ func (h *HttpInterface) handleAdd(w http.ResponseWriter, r *http.Request) {
 	}
 
 	err = h.agent.AddReportJson(reportData)
-	if err != nil {
+	if errors.Is(err, pipeline.ErrValidation) || errors.Is(err, pipeline.ErrUnknownMetric) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	} else if errors.Is(err, pipeline.ErrBackpressure) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
 		w.WriteHeader(500)
 		w.Write([]byte(err.Error()))
 		return
@@ -61,7 +94,9 @@ func (h *HttpInterface) handleAdd(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleStatus also advertises, in its Accept-Encoding header, the encodings that handleAdd accepts.
 func (h *HttpInterface) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Encoding", "gzip")
 	text, err := h.agent.GetStatusJson()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -72,6 +107,39 @@ func (h *HttpInterface) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *HttpInterface) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	text, err := h.agent.ExportState()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	} else {
+		w.WriteHeader(http.StatusOK)
+		w.Write(text)
+	}
+}
+
+func (h *HttpInterface) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	h.agent.Pause()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *HttpInterface) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	h.agent.Resume()
+	w.WriteHeader(http.StatusOK)
+}
+
 // Start starts the HttpInterface in the background. It returns an error immediately if background
 // starting fails, but otherwise returns nil. The errHandler callback receives any errors returned
 // by the underlying call to ListenAndServe(). Note that the background service may fail quickly
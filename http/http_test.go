@@ -0,0 +1,334 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/builder"
+	"github.com/GoogleCloudPlatform/ubbagent/sdk"
+)
+
+const hubConfig = `
+metrics:
+- name: requests
+  type: int
+  passthrough: {}
+  endpoints:
+  - name: on_disk
+endpoints:
+- name: on_disk
+  disk:
+    reportDir: /unused
+`
+
+const edgeConfig = `
+metrics:
+- name: requests
+  type: int
+  passthrough: {}
+  endpoints:
+  - name: hub
+endpoints:
+- name: hub
+  forward:
+    url: {url}
+    compression: {compression}
+`
+
+func TestHttpInterface_Forward(t *testing.T) {
+	for _, compression := range []string{"none", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			testForward(t, compression)
+		})
+	}
+}
+
+// testForward tests that a report forwarded with the given compression reaches the hub agent
+// intact, and that the hub receives it with the matching Content-Encoding.
+func testForward(t *testing.T, compression string) {
+	// The hub agent runs in dry-run mode; its reports are observed through a subscription.
+	hub, err := sdk.NewAgent([]byte(hubConfig), "", builder.WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating hub agent: %+v", err)
+	}
+	reports, _ := hub.Subscribe()
+	h := NewHttpInterface(hub, 0)
+	encodings := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/report" {
+			encodings <- r.Header.Get("Content-Encoding")
+		}
+		h.mux.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	config := strings.NewReplacer("{url}", srv.URL, "{compression}", compression).Replace(edgeConfig)
+	edge, err := sdk.NewAgent([]byte(config), "")
+	if err != nil {
+		t.Fatalf("unexpected error creating edge agent: %+v", err)
+	}
+	report := metrics.MetricReport{
+		Name:      "requests",
+		StartTime: time.Unix(0, 0).UTC(),
+		EndTime:   time.Unix(1, 0).UTC(),
+		Labels:    map[string]string{"tenant": "a"},
+		Value: metrics.MetricValue{
+			Int64Value: 10,
+		},
+	}
+	if err := edge.AddReport(report); err != nil {
+		t.Fatalf("unexpected error adding report: %+v", err)
+	}
+
+	select {
+	case got := <-reports:
+		if !got.Equal(report) {
+			t.Fatalf("hub report: want=%+v, got=%+v", report, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hub agent didn't receive the forwarded report")
+	}
+	want := ""
+	if compression == "gzip" {
+		want = "gzip"
+	}
+	if got := <-encodings; got != want {
+		t.Fatalf("Content-Encoding: want=%q, got=%q", want, got)
+	}
+
+	if err := edge.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down edge agent: %+v", err)
+	}
+	if err := hub.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down hub agent: %+v", err)
+	}
+}
+
+const aggregatingConfig = `
+metrics:
+- name: requests
+  type: int
+  aggregation:
+    bufferSeconds: 3600
+  endpoints:
+  - name: on_disk
+endpoints:
+- name: on_disk
+  disk:
+    reportDir: /unused
+`
+
+func TestHttpInterface_State(t *testing.T) {
+	source, err := sdk.NewAgent([]byte(aggregatingConfig), "", builder.WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating source agent: %+v", err)
+	}
+	sourceReports, _ := source.Subscribe()
+	for i, tenant := range []string{"a", "b", "a"} {
+		if err := source.AddReport(metrics.MetricReport{
+			Name:      "requests",
+			StartTime: time.Unix(int64(i), 0),
+			EndTime:   time.Unix(int64(i+1), 0),
+			Labels:    map[string]string{"tenant": tenant},
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+
+	srv := httptest.NewServer(&NewHttpInterface(source, 0).mux)
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "/state")
+	if err != nil {
+		t.Fatalf("unexpected error exporting state: %+v", err)
+	}
+	state, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error reading state: %+v", err)
+	}
+	resp, err = srv.Client().Post(srv.URL+"/state", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("unexpected error posting /state: %+v", err)
+	}
+	resp.Body.Close()
+	if want, got := http.StatusMethodNotAllowed, resp.StatusCode; want != got {
+		t.Fatalf("POST /state status: want=%v, got=%v", want, got)
+	}
+
+	restored, err := sdk.NewAgent([]byte(aggregatingConfig), "", builder.WithDryRun(), builder.WithState(state))
+	if err != nil {
+		t.Fatalf("unexpected error creating restored agent: %+v", err)
+	}
+	restoredReports, _ := restored.Subscribe()
+
+	// The restored agent's state exports identically.
+	reexported, err := restored.ExportState()
+	if err != nil {
+		t.Fatalf("unexpected error exporting restored state: %+v", err)
+	}
+	if want, got := string(state), string(reexported); want != got {
+		t.Fatalf("restored state: want=%v, got=%v", want, got)
+	}
+
+	// Both agents flush the same aggregated reports.
+	if err := source.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down source agent: %+v", err)
+	}
+	if err := restored.Shutdown(); err != nil {
+		t.Fatalf("unexpected error shutting down restored agent: %+v", err)
+	}
+	want := collectReports(sourceReports)
+	got := collectReports(restoredReports)
+	if len(want) != 2 || len(got) != len(want) {
+		t.Fatalf("flushed reports: want=%+v, got=%+v", want, got)
+	}
+	for i := range want {
+		if !want[i].Equal(got[i]) {
+			t.Fatalf("flushed reports: want=%+v, got=%+v", want, got)
+		}
+	}
+
+	// State can't be imported into an agent that already has state.
+	stateDir, err := ioutil.TempDir("", "http_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(stateDir)
+	existing, err := sdk.NewAgent([]byte(aggregatingConfig), stateDir, builder.WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating agent: %+v", err)
+	}
+	existing.Shutdown()
+	if _, err := sdk.NewAgent([]byte(aggregatingConfig), stateDir, builder.WithDryRun(), builder.WithState(state)); err == nil {
+		t.Fatal("expected error importing state into an agent with existing state")
+	}
+}
+
+// collectReports reads reports from c until it's closed, ordered by tenant.
+func collectReports(c <-chan metrics.MetricReport) []metrics.MetricReport {
+	var reports []metrics.MetricReport
+	for r := range c {
+		reports = append(reports, r)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Labels["tenant"] < reports[j].Labels["tenant"]
+	})
+	return reports
+}
+
+const maxAgeConfig = `
+metrics:
+- name: requests
+  type: int
+  passthrough: {}
+  endpoints:
+  - name: on_disk
+endpoints:
+- name: on_disk
+  disk:
+    reportDir: /unused
+maxAgeSeconds: 3600
+`
+
+func TestHttpInterface_StaleReport(t *testing.T) {
+	agent, err := sdk.NewAgent([]byte(maxAgeConfig), "", builder.WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating agent: %+v", err)
+	}
+	defer agent.Shutdown()
+	srv := httptest.NewServer(&NewHttpInterface(agent, 0).mux)
+	defer srv.Close()
+
+	report := `{"name": "requests", "startTime": "2000-01-01T00:00:00Z", "endTime": "2000-01-01T01:00:00Z", "value": {"int64Value": 1}}`
+	resp, err := srv.Client().Post(srv.URL+"/report", "application/json", strings.NewReader(report))
+	if err != nil {
+		t.Fatalf("unexpected error posting report: %+v", err)
+	}
+	resp.Body.Close()
+	if want, got := http.StatusBadRequest, resp.StatusCode; want != got {
+		t.Fatalf("status: want=%v, got=%v", want, got)
+	}
+}
+
+func TestHttpInterface_UnknownMetric(t *testing.T) {
+	agent, err := sdk.NewAgent([]byte(maxAgeConfig), "", builder.WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating agent: %+v", err)
+	}
+	defer agent.Shutdown()
+	srv := httptest.NewServer(&NewHttpInterface(agent, 0).mux)
+	defer srv.Close()
+
+	report := `{"name": "unknown", "startTime": "2000-01-01T00:00:00Z", "endTime": "2000-01-01T01:00:00Z", "value": {"int64Value": 1}}`
+	resp, err := srv.Client().Post(srv.URL+"/report", "application/json", strings.NewReader(report))
+	if err != nil {
+		t.Fatalf("unexpected error posting report: %+v", err)
+	}
+	resp.Body.Close()
+	if want, got := http.StatusBadRequest, resp.StatusCode; want != got {
+		t.Fatalf("status: want=%v, got=%v", want, got)
+	}
+}
+
+func TestHttpInterface_Pause(t *testing.T) {
+	agent, err := sdk.NewAgent([]byte(hubConfig), "", builder.WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating agent: %+v", err)
+	}
+	defer agent.Shutdown()
+	srv := httptest.NewServer(&NewHttpInterface(agent, 0).mux)
+	defer srv.Close()
+
+	for _, step := range []struct {
+		path   string
+		paused bool
+	}{
+		{"/pause", true},
+		{"/resume", false},
+	} {
+		resp, err := srv.Client().Post(srv.URL+step.path, "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error posting to %v: %+v", step.path, err)
+		}
+		resp.Body.Close()
+		if want, got := http.StatusOK, resp.StatusCode; want != got {
+			t.Fatalf("%v status: want=%v, got=%v", step.path, want, got)
+		}
+		if want, got := step.paused, agent.GetStatus().Paused; want != got {
+			t.Fatalf("after %v, paused: want=%v, got=%v", step.path, want, got)
+		}
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/pause")
+	if err != nil {
+		t.Fatalf("unexpected error getting /pause: %+v", err)
+	}
+	resp.Body.Close()
+	if want, got := http.StatusMethodNotAllowed, resp.StatusCode; want != got {
+		t.Fatalf("GET /pause status: want=%v, got=%v", want, got)
+	}
+}
@@ -17,14 +17,17 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	httplib "net/http"
 	"os"
 	"os/signal"
 
 	"github.com/GoogleCloudPlatform/ubbagent/http"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/builder"
 	"github.com/GoogleCloudPlatform/ubbagent/sdk"
 	"github.com/golang/glog"
+	"github.com/hashicorp/go-multierror"
 )
 
 var configPath = flag.String("config", "", "configuration file")
@@ -32,6 +35,9 @@ var stateDir = flag.String("state-dir", "", "persistent state directory")
 var noState = flag.Bool("no-state", false, "do not store persistent state")
 var localPort = flag.Int("local-port", 0, "local HTTP daemon port")
 var noHttp = flag.Bool("no-http", false, "do not start the HTTP daemon")
+var dryRun = flag.Bool("dry-run", false, "validate, aggregate, and log reports without sending them to any endpoint")
+var importState = flag.String("import-state", "", "file containing state exported from another agent (via /state) to restore on startup")
+var validateConfig = flag.String("validate-config", "", "validate the given configuration file and exit, without starting the agent")
 
 // main is the entry point to the standalone agent. It constructs a new app.App with the config file
 // specified using the --config flag, and it starts the http interface. SIGINT will initiate a
@@ -39,18 +45,29 @@ var noHttp = flag.Bool("no-http", false, "do not start the HTTP daemon")
 func main() {
 	flag.Parse()
 
+	if *validateConfig != "" {
+		os.Exit(validateConfigFile(*validateConfig, os.Stdout))
+	}
+
 	if *configPath == "" {
 		fmt.Fprintln(os.Stderr, "configuration file must be specified")
 		flag.Usage()
 		os.Exit(2)
 	}
 
-	if *stateDir == "" && !*noState {
+	if *stateDir == "" && !*noState && !*dryRun {
 		fmt.Fprintln(os.Stderr, "state directory must be specified (or use --no-state)")
 		flag.Usage()
 		os.Exit(2)
 	}
 
+	// A dry run would otherwise drain the real agent's queues and aggregations into its log.
+	if *stateDir != "" && *dryRun {
+		fmt.Fprintln(os.Stderr, "state directory can't be used with --dry-run")
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	if *localPort <= 0 && !*noHttp {
 		fmt.Fprintln(os.Stderr, "local-port must be > 0 (or use --no-http)")
 		flag.Usage()
@@ -62,7 +79,22 @@ func main() {
 		exitf("startup: failed to read configuration file: %+v", err)
 	}
 
-	agent, err := sdk.NewAgent(configData, *stateDir)
+	var opts []builder.Option
+	if *dryRun {
+		opts = append(opts, builder.WithDryRun())
+		infof("Dry run: reports will be logged and not sent")
+	}
+
+	if *importState != "" {
+		stateData, err := ioutil.ReadFile(*importState)
+		if err != nil {
+			exitf("startup: failed to read state file: %+v", err)
+		}
+		opts = append(opts, builder.WithState(stateData))
+		infof("Importing state from %v", *importState)
+	}
+
+	agent, err := sdk.NewAgent(configData, *stateDir, opts...)
 	if err != nil {
 		exitf("startup: failed to create agent: %+v", err)
 	}
@@ -94,9 +126,35 @@ func main() {
 	if err := agent.Shutdown(); err != nil {
 		glog.Warningf("shutdown: %+v", err)
 	}
+	status := agent.ShutdownStatus()
+	infof("Shut down: flushed %v buckets (%v reports), sent %v reports, dropped %v reports, %v failed components",
+		status.FlushedBuckets, status.FlushedReports, status.Drained, status.Dropped, len(status.Failures))
 	glog.Flush()
 }
 
+// validateConfigFile validates the configuration file at path, including its endpoints' credentials,
+// and writes the result to out. It returns the process exit code: 0 if the configuration is valid,
+// or 1 otherwise.
+func validateConfigFile(path string, out io.Writer) int {
+	configData, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = sdk.ValidateConfig(configData)
+	}
+	if err == nil {
+		fmt.Fprintf(out, "%v: configuration is valid\n", path)
+		return 0
+	}
+	fmt.Fprintf(out, "%v: configuration is invalid:\n", path)
+	errs := []error{err}
+	if merr, ok := err.(*multierror.Error); ok {
+		errs = merr.Errors
+	}
+	for _, err := range errs {
+		fmt.Fprintf(out, "  %v\n", err)
+	}
+	return 1
+}
+
 // infof prints a message to stdout and also logs it to the INFO log.
 func infof(format string, args ...interface{}) {
 	msg := fmt.Sprintf(format, args...)
@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "main_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const metricsSection = `
+metrics:
+- name: requests
+  type: int
+  endpoints:
+  - name: on_disk
+  aggregation:
+    bufferSeconds: 60
+`
+	diskEndpoint := `
+endpoints:
+- name: on_disk
+  disk:
+    reportDir: ` + filepath.Join(dir, "reports") + `
+    expireSeconds: 3600
+`
+	validate := func(t *testing.T, name, data string) (int, string) {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Unable to write config: %+v", err)
+		}
+		var out bytes.Buffer
+		code := validateConfigFile(path, &out)
+		return code, out.String()
+	}
+	expectInvalid := func(t *testing.T, code int, out string, messages ...string) {
+		if code != 1 {
+			t.Fatalf("Expected exit code 1, got %v: %v", code, out)
+		}
+		for _, msg := range messages {
+			if !strings.Contains(out, msg) {
+				t.Fatalf("Expected output to contain %q, got: %v", msg, out)
+			}
+		}
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		code, out := validate(t, "valid.yaml", metricsSection+diskEndpoint)
+		if code != 0 || !strings.Contains(out, "configuration is valid") {
+			t.Fatalf("Expected a valid configuration, got %v: %v", code, out)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		var out bytes.Buffer
+		code := validateConfigFile(filepath.Join(dir, "missing.yaml"), &out)
+		expectInvalid(t, code, out.String(), "missing.yaml: configuration is invalid", "no such file")
+	})
+
+	t.Run("no metrics", func(t *testing.T) {
+		code, out := validate(t, "nometrics.yaml", diskEndpoint)
+		expectInvalid(t, code, out, "no metrics defined")
+	})
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		code, out := validate(t, "unknown.yaml", strings.Replace(metricsSection, "name: on_disk", "name: missing", 1)+diskEndpoint)
+		expectInvalid(t, code, out, "metric requests: endpoint does not exist: missing")
+	})
+
+	t.Run("invalid credentials", func(t *testing.T) {
+		// The key is valid base64, but not a service account key.
+		code, out := validate(t, "credentials.yaml", metricsSection+diskEndpoint+`
+- name: servicecontrol
+  servicecontrol:
+    identity: gcp
+    serviceName: test-service.appspot.com
+    consumerId: project:some-project
+identities:
+- name: gcp
+  gcp:
+    encodedServiceAccountKey: e30=
+`)
+		expectInvalid(t, code, out, "endpoint servicecontrol: google: read JWT from JSON credentials")
+	})
+}
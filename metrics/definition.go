@@ -17,6 +17,9 @@ package metrics
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"unicode"
 )
 
 const (
@@ -24,10 +27,56 @@ const (
 	DoubleType = "double"
 )
 
-// Definition describes a single reportable metric's name and type.
+const (
+	// FirstAnnotations keeps the first value seen for each annotation when reports are merged.
+	FirstAnnotations = "first"
+
+	// CollectAnnotations keeps every distinct value seen for each annotation when reports are merged,
+	// joined by commas in the order they were seen.
+	CollectAnnotations = "collect"
+)
+
+// Definition describes a single reportable metric's name and type. A Name containing one or more
+// '*' characters is a wildcard pattern that defines every metric whose name matches it.
+// AnnotationMerge determines how the annotations of merged reports are combined, and is one of
+// FirstAnnotations (the default) or CollectAnnotations. A non-empty Values lists the names of the
+// values carried by each report of a compound metric; see MetricReport.Values. LabelValues maps
+// label names to the values that reports may give them; a label with an empty set, or without an
+// entry, may have any value. Unit optionally names the unit of the metric's values, such as "By",
+// "s", or "{request}", for endpoints that can represent it; it must not contain whitespace.
 type Definition struct {
-	Name string
-	Type string
+	Name            string
+	Type            string
+	AnnotationMerge string
+	Values          []string
+	LabelValues     map[string][]string
+	Unit            string
+}
+
+// IsCompound returns true if this Definition declares named values.
+func (m *Definition) IsCompound() bool {
+	return len(m.Values) > 0
+}
+
+// HasValue returns true if this Definition declares a value with the given name.
+func (m *Definition) HasValue(name string) bool {
+	for _, v := range m.Values {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPattern returns true if this Definition's name is a wildcard pattern.
+func (m *Definition) IsPattern() bool {
+	return strings.Contains(m.Name, "*")
+}
+
+// Matches returns true if this Definition applies to the metric with the given name: either the
+// names are equal, or this Definition's name is a pattern that matches name.
+func (m *Definition) Matches(name string) bool {
+	return MatchPattern(m.Name, name)
 }
 
 func (m *Definition) Validate() error {
@@ -37,5 +86,161 @@ func (m *Definition) Validate() error {
 	if m.Type != IntType && m.Type != DoubleType {
 		return fmt.Errorf("metric %v: invalid value type: %v", m.Name, m.Type)
 	}
+	if m.AnnotationMerge != "" && m.AnnotationMerge != FirstAnnotations && m.AnnotationMerge != CollectAnnotations {
+		return fmt.Errorf("metric %v: invalid annotation merge policy: %v", m.Name, m.AnnotationMerge)
+	}
+	usedValues := make(map[string]bool)
+	for _, v := range m.Values {
+		if v == "" {
+			return fmt.Errorf("metric %v: empty value name", m.Name)
+		}
+		if usedValues[v] {
+			return fmt.Errorf("metric %v: duplicate value name: %v", m.Name, v)
+		}
+		usedValues[v] = true
+	}
+	for label := range m.LabelValues {
+		if label == "" {
+			return fmt.Errorf("metric %v: empty label name in labelValues", m.Name)
+		}
+	}
+	if strings.IndexFunc(m.Unit, unicode.IsSpace) >= 0 {
+		return fmt.Errorf("metric %v: invalid unit: %q", m.Name, m.Unit)
+	}
 	return nil
 }
+
+// AllowsLabelValue returns true if this Definition's LabelValues permit the given label value.
+func (m *Definition) AllowsLabelValue(label, value string) bool {
+	allowed := m.LabelValues[label]
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, v := range allowed {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeAnnotations returns the result of merging the annotations of a report, src, into those of
+// the report it's being merged with, dst, according to the given policy (FirstAnnotations or
+// CollectAnnotations; an empty policy is FirstAnnotations). The dst map is modified in place if
+// non-nil.
+func MergeAnnotations(policy string, dst, src map[string]string) map[string]string {
+	for k, v := range src {
+		if dst == nil {
+			dst = make(map[string]string)
+		}
+		existing, exists := dst[k]
+		if !exists {
+			dst[k] = v
+			continue
+		}
+		if policy != CollectAnnotations || existing == v {
+			continue
+		}
+		found := false
+		for _, e := range strings.Split(existing, ",") {
+			if e == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst[k] = existing + "," + v
+		}
+	}
+	return dst
+}
+
+// MatchPattern returns true if the given metric name matches pattern. Each '*' in pattern matches
+// any sequence of characters, including an empty one. A pattern without '*' matches only an
+// identical name.
+func MatchPattern(pattern, name string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == name
+	}
+	return newNamePattern(pattern).match(name)
+}
+
+// BestMatch returns the candidate (a metric name or pattern) that applies to the metric with the
+// given name. An exact match takes precedence over patterns. If multiple patterns match, the longest
+// one is considered the most specific and is chosen; ties are broken by lexical order. The ok result
+// is false if no candidate matches. A Matcher is more efficient when matching many names.
+func BestMatch(name string, candidates []string) (match string, ok bool) {
+	return NewMatcher(candidates).Match(name)
+}
+
+// Matcher matches metric names against a fixed set of candidate names and patterns, following the
+// precedence rules of BestMatch. Patterns are parsed once, when the Matcher is created, and exact
+// names are found with a single map lookup.
+type Matcher struct {
+	exact map[string]bool
+
+	// Patterns, in order of precedence.
+	patterns []namePattern
+}
+
+// Match returns the candidate that applies to the metric with the given name, as BestMatch does.
+func (m *Matcher) Match(name string) (match string, ok bool) {
+	if m.exact[name] {
+		return name, true
+	}
+	for _, p := range m.patterns {
+		if p.match(name) {
+			return p.text, true
+		}
+	}
+	return "", false
+}
+
+// NewMatcher creates a Matcher for the given candidate names and patterns.
+func NewMatcher(candidates []string) *Matcher {
+	m := &Matcher{exact: make(map[string]bool)}
+	for _, c := range candidates {
+		if strings.Contains(c, "*") {
+			m.patterns = append(m.patterns, newNamePattern(c))
+		} else {
+			m.exact[c] = true
+		}
+	}
+	sort.Slice(m.patterns, func(i, j int) bool {
+		a, b := m.patterns[i].text, m.patterns[j].text
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return m
+}
+
+// namePattern is a parsed wildcard pattern: the literal text between each '*'.
+type namePattern struct {
+	text  string
+	parts []string
+}
+
+func newNamePattern(pattern string) namePattern {
+	return namePattern{text: pattern, parts: strings.Split(pattern, "*")}
+}
+
+// match returns true if name matches the pattern. The first and last parts must be a prefix and a
+// suffix of name, and the parts in between must appear in order; matching each of them as early as
+// possible leaves the most room for the rest.
+func (p namePattern) match(name string) bool {
+	first, last := p.parts[0], p.parts[len(p.parts)-1]
+	if len(name) < len(first)+len(last) || !strings.HasPrefix(name, first) || !strings.HasSuffix(name, last) {
+		return false
+	}
+	rest := name[len(first) : len(name)-len(last)]
+	for _, part := range p.parts[1 : len(p.parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+)
+
+func TestMatcher(t *testing.T) {
+	m := NewMatcher([]string{"requests", "requests_*", "requests_*_total", "*_errors", "a*b*c"})
+	for _, tc := range []struct {
+		name  string
+		match string
+	}{
+		{"requests", "requests"},
+		{"requests_get", "requests_*"},
+		{"requests_get_total", "requests_*_total"},
+		{"requests_errors", "requests_*"},
+		{"disk_errors", "*_errors"},
+		{"abc", "a*b*c"},
+		{"axxbyybc", "a*b*c"},
+		{"ab", ""},
+		{"requestz", ""},
+	} {
+		match, ok := m.Match(tc.name)
+		if want, got := tc.match, match; want != got || ok != (want != "") {
+			t.Fatalf("Match(%q): want=%q, got=%q (ok=%v)", tc.name, want, got, ok)
+		}
+		if best, _ := BestMatch(tc.name, []string{"requests", "requests_*", "requests_*_total", "*_errors", "a*b*c"}); best != match {
+			t.Fatalf("BestMatch(%q): want=%q, got=%q", tc.name, match, best)
+		}
+	}
+
+	// A pattern's prefix and suffix can't overlap.
+	if MatchPattern("ab*ba", "aba") {
+		t.Fatal("MatchPattern(\"ab*ba\", \"aba\"): want=false, got=true")
+	}
+}
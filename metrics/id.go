@@ -0,0 +1,65 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// IDGenerator generates the unique identifiers with which MetricReports are stamped.
+type IDGenerator interface {
+	Generate(report MetricReport) string
+}
+
+// IDGeneratorFunc is a function that implements IDGenerator.
+type IDGeneratorFunc func(report MetricReport) string
+
+func (f IDGeneratorFunc) Generate(report MetricReport) string {
+	return f(report)
+}
+
+// NewUUIDGenerator returns an IDGenerator that generates a random UUID for each report. It's the
+// default IDGenerator.
+func NewUUIDGenerator() IDGenerator {
+	return IDGeneratorFunc(func(MetricReport) string {
+		id, err := uuid.NewRandom()
+		if err != nil {
+			panic(fmt.Sprintf("cannot create uuid for report: %+v", err))
+		}
+		return id.String()
+	})
+}
+
+// NewHashGenerator returns an IDGenerator that generates an ID from a SHA-256 hash of a report's
+// name, times, labels, value, and annotations. Identical reports get the same ID, so a report
+// that's added more than once is only sent once within the retention of senders' sent-ID ledgers.
+func NewHashGenerator() IDGenerator {
+	return IDGeneratorFunc(func(report MetricReport) string {
+		// Times are normalized so that the same instant in different locations hashes identically.
+		report.StartTime = report.StartTime.UTC()
+		report.EndTime = report.EndTime.UTC()
+		jsontext, err := json.Marshal(report)
+		if err != nil {
+			panic(fmt.Sprintf("cannot hash report: %+v", err))
+		}
+		sum := sha256.Sum256(jsontext)
+		return hex.EncodeToString(sum[:])
+	})
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+)
+
+func TestIDGenerators(t *testing.T) {
+	report := metrics.MetricReport{
+		Name:      "int-metric",
+		StartTime: time.Unix(0, 0),
+		EndTime:   time.Unix(1, 0),
+		Labels:    map[string]string{"foo": "bar", "baz": "qux"},
+		Value: metrics.MetricValue{
+			Int64Value: 10,
+		},
+	}
+
+	t.Run("UUID", func(t *testing.T) {
+		ids := metrics.NewUUIDGenerator()
+		id1, id2 := ids.Generate(report), ids.Generate(report)
+		if id1 == "" || id1 == id2 {
+			t.Fatalf("expected distinct non-empty IDs, got: %v, %v", id1, id2)
+		}
+	})
+
+	t.Run("Hash", func(t *testing.T) {
+		ids := metrics.NewHashGenerator()
+		id := ids.Generate(report)
+		if id == "" {
+			t.Fatal("expected non-empty ID")
+		}
+
+		same := report
+		same.StartTime = report.StartTime.In(time.FixedZone("test", 3600))
+		same.Labels = map[string]string{"baz": "qux", "foo": "bar"}
+		if got := ids.Generate(same); got != id {
+			t.Fatalf("identical report: want=%v, got=%v", id, got)
+		}
+
+		different := report
+		different.Value.Int64Value = 11
+		if got := ids.Generate(different); got == id {
+			t.Fatalf("expected a different ID for a different report, got: %v", got)
+		}
+	})
+
+	t.Run("StampMetricReport", func(t *testing.T) {
+		ids := metrics.IDGeneratorFunc(func(mr metrics.MetricReport) string {
+			return "id-" + mr.Name
+		})
+		stamped := metrics.StampMetricReport(report, ids)
+		if stamped.Id != "id-int-metric" {
+			t.Fatalf("stamped.Id: want=%v, got=%v", "id-int-metric", stamped.Id)
+		}
+		if !stamped.MetricReport.Equal(report) {
+			t.Fatalf("stamped.MetricReport: want=%+v, got=%+v", report, stamped.MetricReport)
+		}
+	})
+}
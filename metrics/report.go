@@ -16,10 +16,9 @@ package metrics
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 // MetricValue holds a single named metric value. Only one of the individual type fields should
@@ -41,18 +40,33 @@ func (mv MetricValue) Validate(def Definition) error {
 		if mv.Int64Value != 0 {
 			return fmt.Errorf("integer value specified for double metric: %v", mv.Int64Value)
 		}
+		// NaN and infinities would poison every aggregate they're summed into.
+		if math.IsNaN(mv.DoubleValue) || math.IsInf(mv.DoubleValue, 0) {
+			return fmt.Errorf("non-finite value specified for double metric: %v", mv.DoubleValue)
+		}
 		break
 	}
 	return nil
 }
 
 // MetricReport represents an aggregated interval for a unique metric + labels combination.
+// Annotations hold metadata, such as a trace ID, that's carried along with the report but, unlike
+// Labels, isn't used to distinguish reports during aggregation. A report of a compound metric
+// carries its quantities in Values, keyed by the value names in the metric's Definition, instead of
+// in Value.
 type MetricReport struct {
-	Name      string            `json:"name"`
-	StartTime time.Time         `json:"startTime"`
-	EndTime   time.Time         `json:"endTime"`
-	Labels    map[string]string `json:"labels"`
-	Value     MetricValue       `json:"value"`
+	Name        string                 `json:"name"`
+	StartTime   time.Time              `json:"startTime"`
+	EndTime     time.Time              `json:"endTime"`
+	Labels      map[string]string      `json:"labels"`
+	Value       MetricValue            `json:"value"`
+	Values      map[string]MetricValue `json:"values,omitempty"`
+	Annotations map[string]string      `json:"annotations,omitempty"`
+
+	// IngestTime is when the agent received the report, or for an aggregated report, the earliest
+	// time any of its constituent reports were received. It's used to measure the latency of sends
+	// and is never serialized.
+	IngestTime time.Time `json:"-"`
 }
 
 // Equal returns if the two MetricReports are the same.
@@ -64,21 +78,30 @@ func (mr MetricReport) Equal(other MetricReport) bool {
 		mr.StartTime.Equal(other.StartTime) &&
 		mr.EndTime.Equal(other.EndTime) &&
 		reflect.DeepEqual(mr.Labels, other.Labels) &&
-		reflect.DeepEqual(mr.Value, other.Value)
+		reflect.DeepEqual(mr.Value, other.Value) &&
+		reflect.DeepEqual(mr.Values, other.Values) &&
+		reflect.DeepEqual(mr.Annotations, other.Annotations)
 }
 
-// Validate returns an error if the report does not match its definition.
-func (mr MetricReport) Validate(def Definition) error {
-	if mr.Name != def.Name {
-		return fmt.Errorf("incorrect metric name: %v", mr.Name)
-	}
-	if mr.StartTime.After(mr.EndTime) {
-		return fmt.Errorf("metric %v: StartTime > EndTime: %v > %v", mr.Name, mr.StartTime, mr.EndTime)
-	}
-	if err := mr.Value.Validate(def); err != nil {
-		return fmt.Errorf("metric %v: %v", mr.Name, err)
+// MergeValues returns the result of summing the named values of a report, src, into those of the
+// report it's being merged with, dst. The dst map is modified in place if non-nil.
+func MergeValues(dst, src map[string]MetricValue) map[string]MetricValue {
+	for k, v := range src {
+		if dst == nil {
+			dst = make(map[string]MetricValue)
+		}
+		sum := dst[k]
+		sum.Int64Value += v.Int64Value
+		sum.DoubleValue += v.DoubleValue
+		dst[k] = sum
 	}
-	return nil
+	return dst
+}
+
+// Validate returns an error if the report does not match its definition. It applies the validators
+// returned by DefaultValidators.
+func (mr MetricReport) Validate(def Definition) error {
+	return Validate(mr, DefaultValidators(def))
 }
 
 // StampedMetricReport is a MetricReport stamped with a unique identifier.
@@ -89,14 +112,12 @@ type StampedMetricReport struct {
 
 // NewStampedMetricReport creates a new StampedMetricReport with a random, unique identifier.
 func NewStampedMetricReport(report MetricReport) StampedMetricReport {
-	var stamped StampedMetricReport
-	id, err := uuid.NewRandom()
-	if err != nil {
-		panic(fmt.Sprintf("cannot create uuid for report: %+v", err))
-	}
-	stamped.Id = id.String()
-	stamped.MetricReport = report
-	return stamped
+	return StampMetricReport(report, NewUUIDGenerator())
+}
+
+// StampMetricReport creates a new StampedMetricReport with an identifier created by ids.
+func StampMetricReport(report MetricReport, ids IDGenerator) StampedMetricReport {
+	return StampedMetricReport{MetricReport: report, Id: ids.Generate(report)}
 }
 
 // Equal returns if the two StampedMetricReports are the same.
@@ -15,6 +15,7 @@
 package metrics_test
 
 import (
+	"math"
 	"strings"
 	"testing"
 	"time"
@@ -106,4 +107,21 @@ func TestMetricReport_Validate(t *testing.T) {
 			t.Fatalf("Expected error containing \"integer value specified\", got: %+v", err)
 		}
 	})
+
+	t.Run("Invalid value: non-finite double", func(t *testing.T) {
+		for _, v := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+			m := metrics.MetricReport{
+				Name:      "double-metric",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Labels:    map[string]string{"Key": "Value"},
+				Value: metrics.MetricValue{
+					DoubleValue: v,
+				},
+			}
+			if err := m.Validate(double_metric); err == nil || !strings.Contains(err.Error(), "non-finite value specified") {
+				t.Fatalf("Value %v: expected error containing \"non-finite value specified\", got: %+v", v, err)
+			}
+		}
+	})
 }
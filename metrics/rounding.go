@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// RoundUp rounds values to the next multiple of a step.
+	RoundUp = "up"
+
+	// RoundDown rounds values to the previous multiple of a step.
+	RoundDown = "down"
+
+	// RoundNearest rounds values to the nearest multiple of a step, rounding halfway values up (that
+	// is, towards positive infinity).
+	RoundNearest = "nearest"
+)
+
+// roundTolerance is the distance, relative to the number of steps, within which a value is treated
+// as an exact multiple of the step. It absorbs float error: 1.1/0.1 is slightly more than 11, and
+// would otherwise round up to 1.2.
+const roundTolerance = 1e-9
+
+// ValidateRounding returns an error if rounding isn't RoundUp, RoundDown, RoundNearest, or empty
+// (meaning RoundUp).
+func ValidateRounding(rounding string) error {
+	switch rounding {
+	case "", RoundUp, RoundDown, RoundNearest:
+		return nil
+	}
+	return fmt.Errorf("invalid rounding %q (must be %q, %q, or %q)", rounding, RoundUp, RoundDown, RoundNearest)
+}
+
+// Round rounds v to a multiple of step according to rounding: RoundUp (the default), RoundDown, or
+// RoundNearest. Values within roundTolerance of a multiple are treated as that multiple.
+func Round(v, step float64, rounding string) float64 {
+	steps := v / step
+	if nearest := math.Floor(steps + 0.5); math.Abs(steps-nearest) <= roundTolerance*math.Max(1, math.Abs(steps)) {
+		steps = nearest
+	} else {
+		switch rounding {
+		case RoundDown:
+			steps = math.Floor(steps)
+		case RoundNearest:
+			steps = math.Floor(steps + 0.5)
+		default:
+			steps = math.Ceil(steps)
+		}
+	}
+	// A decimal step such as 0.1 isn't exact, so multiplying by it adds error (3*0.1 is slightly more
+	// than 0.3). Dividing by its inverse, which is an exact integer, doesn't.
+	if inverse := math.Floor(1/step + 0.5); inverse > 1 && math.Abs(1/step-inverse) <= roundTolerance*inverse {
+		return steps / inverse
+	}
+	return steps * step
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"testing"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+)
+
+func TestRound(t *testing.T) {
+	for _, tc := range []struct {
+		value    float64
+		step     float64
+		rounding string
+		want     float64
+	}{
+		{1.2, 1, "", 2},
+		{1.2, 1, metrics.RoundUp, 2},
+		{-1.8, 1, metrics.RoundUp, -1},
+		{1.8, 1, metrics.RoundDown, 1},
+		{-1.2, 1, metrics.RoundDown, -2},
+		{1.5, 1, metrics.RoundNearest, 2},
+		{-1.5, 1, metrics.RoundNearest, -1},
+		{-2.5, 1, metrics.RoundNearest, -2},
+		{1.1, 0.25, metrics.RoundUp, 1.25},
+		{1.1, 0.1, metrics.RoundUp, 1.1},
+		{0.3, 0.1, metrics.RoundDown, 0.3},
+		{-0.3, 0.1, metrics.RoundUp, -0.3},
+		{0.07, 0.01, metrics.RoundUp, 0.07},
+		{0.29, 0.01, metrics.RoundDown, 0.29},
+	} {
+		if got := metrics.Round(tc.value, tc.step, tc.rounding); got != tc.want {
+			t.Errorf("Round(%v, %v, %q): want=%v, got=%v", tc.value, tc.step, tc.rounding, tc.want, got)
+		}
+	}
+}
+
+func TestValidateRounding(t *testing.T) {
+	for _, rounding := range []string{"", metrics.RoundUp, metrics.RoundDown, metrics.RoundNearest} {
+		if err := metrics.ValidateRounding(rounding); err != nil {
+			t.Errorf("ValidateRounding(%q): unexpected error: %+v", rounding, err)
+		}
+	}
+	want := `invalid rounding "sideways" (must be "up", "down", or "nearest")`
+	if err := metrics.ValidateRounding("sideways"); err == nil || err.Error() != want {
+		t.Errorf("ValidateRounding(\"sideways\"): want error %q, got: %v", want, err)
+	}
+}
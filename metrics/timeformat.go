@@ -0,0 +1,97 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Time formats for the StartTime and EndTime fields of serialized reports.
+const (
+	// TimeFormatRFC3339 serializes times as RFC 3339 strings with nanosecond precision. It's the
+	// default format, used when the format is empty.
+	TimeFormatRFC3339 = "rfc3339"
+
+	// TimeFormatUnix serializes times as integer seconds since the Unix epoch.
+	TimeFormatUnix = "unix"
+
+	// TimeFormatUnixMillis serializes times as integer milliseconds since the Unix epoch.
+	TimeFormatUnixMillis = "unixMillis"
+)
+
+// epochReport shadows the StampedMetricReport's time fields with integer epoch offsets.
+type epochReport struct {
+	StampedMetricReport
+	StartTime int64 `json:"startTime"`
+	EndTime   int64 `json:"endTime"`
+}
+
+// ValidateTimeFormat returns an error if format isn't empty or one of the TimeFormat constants.
+func ValidateTimeFormat(format string) error {
+	_, err := epochUnit(format)
+	return err
+}
+
+// MarshalReport serializes report as JSON, writing its StartTime and EndTime in the given format.
+func MarshalReport(report StampedMetricReport, format string) ([]byte, error) {
+	unit, err := epochUnit(format)
+	if err != nil {
+		return nil, err
+	}
+	if unit == 0 {
+		return json.Marshal(report)
+	}
+	return json.Marshal(epochReport{
+		StampedMetricReport: report,
+		StartTime:           report.StartTime.UnixNano() / int64(unit),
+		EndTime:             report.EndTime.UnixNano() / int64(unit),
+	})
+}
+
+// UnmarshalReport parses a report serialized by MarshalReport with the same format.
+func UnmarshalReport(data []byte, format string) (StampedMetricReport, error) {
+	unit, err := epochUnit(format)
+	if err != nil {
+		return StampedMetricReport{}, err
+	}
+	if unit == 0 {
+		var report StampedMetricReport
+		err := json.Unmarshal(data, &report)
+		return report, err
+	}
+	var er epochReport
+	if err := json.Unmarshal(data, &er); err != nil {
+		return StampedMetricReport{}, err
+	}
+	report := er.StampedMetricReport
+	report.StartTime = time.Unix(0, er.StartTime*int64(unit)).UTC()
+	report.EndTime = time.Unix(0, er.EndTime*int64(unit)).UTC()
+	return report, nil
+}
+
+// epochUnit returns the epoch unit of an integer time format, or 0 for TimeFormatRFC3339.
+func epochUnit(format string) (time.Duration, error) {
+	switch format {
+	case "", TimeFormatRFC3339:
+		return 0, nil
+	case TimeFormatUnix:
+		return time.Second, nil
+	case TimeFormatUnixMillis:
+		return time.Millisecond, nil
+	}
+	return 0, fmt.Errorf("invalid time format: %v", format)
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMarshalReport(t *testing.T) {
+	report := StampedMetricReport{
+		Id: "report1",
+		MetricReport: MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(1500000000, 123000000).UTC(),
+			EndTime:   time.Unix(1500000060, 456000000).UTC(),
+			Labels:    map[string]string{"foo": "bar"},
+			Value:     MetricValue{Int64Value: 10},
+		},
+	}
+
+	tests := []struct {
+		format    string
+		startTime interface{}
+		truncate  time.Duration
+	}{
+		{"", "2017-07-14T02:40:00.123Z", 0},
+		{TimeFormatRFC3339, "2017-07-14T02:40:00.123Z", 0},
+		{TimeFormatUnix, float64(1500000000), time.Second},
+		{TimeFormatUnixMillis, float64(1500000000123), time.Millisecond},
+	}
+	for _, tc := range tests {
+		t.Run(tc.format, func(t *testing.T) {
+			data, err := MarshalReport(report, tc.format)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			if want, got := tc.startTime, fields["startTime"]; want != got {
+				t.Fatalf("startTime: want=%v, got=%v", want, got)
+			}
+
+			parsed, err := UnmarshalReport(data, tc.format)
+			if err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+			want := report
+			if tc.truncate > 0 {
+				want.StartTime = want.StartTime.Truncate(tc.truncate)
+				want.EndTime = want.EndTime.Truncate(tc.truncate)
+			}
+			if !parsed.Equal(want) {
+				t.Fatalf("parsed report: want=%+v, got=%+v", want, parsed)
+			}
+		})
+	}
+
+	t.Run("ingest time isn't serialized", func(t *testing.T) {
+		ingested := report
+		ingested.IngestTime = time.Unix(1500000100, 0)
+		data, err := MarshalReport(ingested, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		expected, _ := MarshalReport(report, "")
+		if want, got := string(expected), string(data); want != got {
+			t.Fatalf("serialized report: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("invalid format", func(t *testing.T) {
+		if _, err := MarshalReport(report, "unixNanos"); err == nil {
+			t.Fatal("expected error for invalid format")
+		}
+		if err := ValidateTimeFormat("unixNanos"); err == nil {
+			t.Fatal("expected error for invalid format")
+		}
+	})
+}
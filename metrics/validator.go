@@ -0,0 +1,126 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+)
+
+// Validator checks a single MetricReport at ingestion. Validate returns an error if the report
+// should be rejected.
+type Validator interface {
+	Validate(report MetricReport) error
+}
+
+// ValidatorFunc is a function that implements Validator.
+type ValidatorFunc func(report MetricReport) error
+
+func (f ValidatorFunc) Validate(report MetricReport) error {
+	return f(report)
+}
+
+// NewNameValidator returns a Validator that rejects reports whose name doesn't match def. If def is
+// a wildcard pattern, any matching name is accepted.
+func NewNameValidator(def Definition) Validator {
+	return ValidatorFunc(func(mr MetricReport) error {
+		if !def.Matches(mr.Name) {
+			return fmt.Errorf("incorrect metric name: %v", mr.Name)
+		}
+		return nil
+	})
+}
+
+// NewTimestampValidator returns a Validator that rejects reports whose StartTime is after their
+// EndTime.
+func NewTimestampValidator() Validator {
+	return ValidatorFunc(func(mr MetricReport) error {
+		if mr.StartTime.After(mr.EndTime) {
+			return fmt.Errorf("metric %v: StartTime > EndTime: %v > %v", mr.Name, mr.StartTime, mr.EndTime)
+		}
+		return nil
+	})
+}
+
+// NewTypeValidator returns a Validator that rejects reports whose value type doesn't match def.
+func NewTypeValidator(def Definition) Validator {
+	return ValidatorFunc(func(mr MetricReport) error {
+		if err := mr.Value.Validate(def); err != nil {
+			return fmt.Errorf("metric %v: %v", mr.Name, err)
+		}
+		return nil
+	})
+}
+
+// NewValuesValidator returns a Validator that rejects reports whose named values don't match def:
+// a compound metric's reports may only carry the value names it declares, each matching its type,
+// and must omit Value; other metrics' reports must not carry named values.
+func NewValuesValidator(def Definition) Validator {
+	return ValidatorFunc(func(mr MetricReport) error {
+		if !def.IsCompound() {
+			if len(mr.Values) > 0 {
+				return fmt.Errorf("metric %v: named values specified for non-compound metric", mr.Name)
+			}
+			return nil
+		}
+		if mr.Value != (MetricValue{}) {
+			return fmt.Errorf("metric %v: value must be omitted for compound metric", mr.Name)
+		}
+		for name, v := range mr.Values {
+			if !def.HasValue(name) {
+				return fmt.Errorf("metric %v: undeclared value name: %v", mr.Name, name)
+			}
+			if err := v.Validate(def); err != nil {
+				return fmt.Errorf("metric %v: value %v: %v", mr.Name, name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// NewLabelValuesValidator returns a Validator that rejects reports with a label value that isn't in
+// the label's allowed set in def.LabelValues.
+func NewLabelValuesValidator(def Definition) Validator {
+	return ValidatorFunc(func(mr MetricReport) error {
+		for k, v := range mr.Labels {
+			if !def.AllowsLabelValue(k, v) {
+				return fmt.Errorf("metric %v: label %v: value not allowed: %q", mr.Name, k, v)
+			}
+		}
+		return nil
+	})
+}
+
+// DefaultValidators returns the built-in validators for the given metric definition, in the order
+// in which they're applied.
+func DefaultValidators(def Definition) []Validator {
+	return []Validator{
+		NewNameValidator(def),
+		NewTimestampValidator(),
+		NewTypeValidator(def),
+		NewValuesValidator(def),
+		NewLabelValuesValidator(def),
+	}
+}
+
+// Validate runs each of the given validators against report in order. It returns the error from the
+// first validator that fails, and no subsequent validators are run.
+func Validate(report MetricReport, validators []Validator) error {
+	for _, v := range validators {
+		if err := v.Validate(report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+)
+
+func TestValidate(t *testing.T) {
+	def := metrics.Definition{
+		Name: "int-metric",
+		Type: "int",
+	}
+	report := metrics.MetricReport{
+		Name:      "int-metric",
+		StartTime: time.Unix(0, 0),
+		EndTime:   time.Unix(1, 0),
+		Labels:    map[string]string{"team": "a"},
+		Value: metrics.MetricValue{
+			Int64Value: 10,
+		},
+	}
+
+	// recorder returns a Validator that records its name when called and returns err.
+	var called []string
+	recorder := func(name string, err error) metrics.Validator {
+		return metrics.ValidatorFunc(func(metrics.MetricReport) error {
+			called = append(called, name)
+			return err
+		})
+	}
+	requireTeam := metrics.ValidatorFunc(func(mr metrics.MetricReport) error {
+		if mr.Labels["team"] == "" {
+			return errors.New("missing team label")
+		}
+		return nil
+	})
+
+	t.Run("Custom validator alongside defaults", func(t *testing.T) {
+		validators := append(metrics.DefaultValidators(def), requireTeam)
+		if err := metrics.Validate(report, validators); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+
+		noTeam := report
+		noTeam.Labels = nil
+		if err := metrics.Validate(noTeam, validators); err == nil || err.Error() != "missing team label" {
+			t.Fatalf("Expected error with message \"missing team label\", got: %+v", err)
+		}
+
+		// Built-in validators run first, so a report failing both returns the built-in error.
+		noTeam.StartTime = time.Unix(10, 0)
+		if err := metrics.Validate(noTeam, validators); err == nil || !strings.Contains(err.Error(), "StartTime > EndTime") {
+			t.Fatalf("Expected error containing \"StartTime > EndTime\", got: %+v", err)
+		}
+	})
+
+	t.Run("Validators run in order", func(t *testing.T) {
+		called = nil
+		validators := []metrics.Validator{recorder("first", nil), recorder("second", nil), recorder("third", nil)}
+		if err := metrics.Validate(report, validators); err != nil {
+			t.Fatalf("Unexpected error: %+v", err)
+		}
+		if want := []string{"first", "second", "third"}; !reflect.DeepEqual(want, called) {
+			t.Fatalf("called: want=%+v, got=%+v", want, called)
+		}
+	})
+
+	t.Run("First failure short-circuits", func(t *testing.T) {
+		called = nil
+		validators := []metrics.Validator{
+			recorder("first", nil),
+			recorder("second", errors.New("second failed")),
+			recorder("third", errors.New("third failed")),
+		}
+		if err := metrics.Validate(report, validators); err == nil || err.Error() != "second failed" {
+			t.Fatalf("Expected error with message \"second failed\", got: %+v", err)
+		}
+		if want := []string{"first", "second"}; !reflect.DeepEqual(want, called) {
+			t.Fatalf("called: want=%+v, got=%+v", want, called)
+		}
+	})
+}
+
+func TestValuesValidator(t *testing.T) {
+	compound := metrics.Definition{
+		Name:   "transfer",
+		Type:   "int",
+		Values: []string{"bytes_in", "bytes_out"},
+	}
+	simple := metrics.Definition{
+		Name: "int-metric",
+		Type: "int",
+	}
+
+	tests := []struct {
+		name   string
+		def    metrics.Definition
+		report metrics.MetricReport
+		want   string
+	}{
+		{
+			name:   "declared values",
+			def:    compound,
+			report: metrics.MetricReport{Name: "transfer", Values: map[string]metrics.MetricValue{"bytes_in": {Int64Value: 1}}},
+		},
+		{
+			name:   "undeclared value name",
+			def:    compound,
+			report: metrics.MetricReport{Name: "transfer", Values: map[string]metrics.MetricValue{"bytes_lost": {Int64Value: 1}}},
+			want:   "metric transfer: undeclared value name: bytes_lost",
+		},
+		{
+			name:   "named value of the wrong type",
+			def:    compound,
+			report: metrics.MetricReport{Name: "transfer", Values: map[string]metrics.MetricValue{"bytes_in": {DoubleValue: 1.5}}},
+			want:   "metric transfer: value bytes_in: double value specified for integer metric: 1.5",
+		},
+		{
+			name:   "value for compound metric",
+			def:    compound,
+			report: metrics.MetricReport{Name: "transfer", Value: metrics.MetricValue{Int64Value: 1}},
+			want:   "metric transfer: value must be omitted for compound metric",
+		},
+		{
+			name:   "named values for non-compound metric",
+			def:    simple,
+			report: metrics.MetricReport{Name: "int-metric", Values: map[string]metrics.MetricValue{"bytes_in": {Int64Value: 1}}},
+			want:   "metric int-metric: named values specified for non-compound metric",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := metrics.NewValuesValidator(tt.def).Validate(tt.report)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %+v", err)
+				}
+			} else if err == nil || err.Error() != tt.want {
+				t.Fatalf("Expected error %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLabelValuesValidator(t *testing.T) {
+	def := metrics.Definition{
+		Name: "int-metric",
+		Type: "int",
+		LabelValues: map[string][]string{
+			"env":  {"dev", "staging", "prod"},
+			"team": {},
+		},
+	}
+	validator := metrics.NewLabelValuesValidator(def)
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{
+			name:   "in-enum value",
+			labels: map[string]string{"env": "prod"},
+		},
+		{
+			name:   "out-of-enum value",
+			labels: map[string]string{"env": "qa"},
+			want:   `metric int-metric: label env: value not allowed: "qa"`,
+		},
+		{
+			name:   "empty allowed set",
+			labels: map[string]string{"team": "anything"},
+		},
+		{
+			name:   "unrestricted label",
+			labels: map[string]string{"region": "us-east1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.Validate(metrics.MetricReport{Name: "int-metric", Labels: tt.labels})
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %+v", err)
+				}
+			} else if err == nil || err.Error() != tt.want {
+				t.Fatalf("Expected error %q, got: %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -20,23 +20,66 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"sync"
 )
 
 // Type diskPersistence is a Persistence implementation that stores values and queues as json text
 // files in a hierarchy under a specified filesystem directory.
 type diskPersistence struct {
-	directory string
-	mutex     sync.RWMutex
+	directory  string
+	migrations []Migration
+	mutex      sync.RWMutex
 }
 
 // NewDiskPersistence creates a diskPersistence that stores data under the given filesystem
-// directory.
+// directory. Data stored by an older version of the agent is migrated to the current format; data
+// from a newer version results in an error.
 func NewDiskPersistence(directory string) (Persistence, error) {
+	return newDiskPersistence(directory, migrations)
+}
+
+func newDiskPersistence(directory string, migrations []Migration) (Persistence, error) {
 	if err := os.MkdirAll(directory, directoryMode); err != nil {
 		return nil, errors.New("persistence: could not create directory: " + directory + ": " + err.Error())
 	}
-	return &diskPersistence{directory: directory}, nil
+	p := &diskPersistence{directory: directory, migrations: migrations}
+	if err := p.upgrade(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// upgrade migrates the stored state to the current version of the format, removing Values and
+// Queues that a migration deleted.
+func (p *diskPersistence) upgrade() error {
+	state, err := p.Export()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(state))
+	for name := range state {
+		names = append(names, name)
+	}
+	if changed, err := upgrade(state, p.migrations); err != nil || !changed {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, data := range state {
+		if err := (&diskValue{p: p, name: name}).store(data); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if _, ok := state[name]; !ok {
+			if err := (&diskValue{p: p, name: name}).remove(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (p *diskPersistence) Value(name string) Value {
@@ -47,6 +90,52 @@ func (p *diskPersistence) Queue(name string) Queue {
 	return &valueQueue{&diskValue{p: p, name: name}}
 }
 
+func (p *diskPersistence) Export() (map[string]json.RawMessage, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	state := make(map[string]json.RawMessage)
+	err := filepath.Walk(p.directory, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(file, ".json") {
+			return nil
+		}
+		rel, err := filepath.Rel(p.directory, file)
+		if err != nil {
+			return err
+		}
+		jsontext, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		state[strings.TrimSuffix(filepath.ToSlash(rel), ".json")] = jsontext
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return exportable(state), nil
+}
+
+func (p *diskPersistence) Import(state map[string]json.RawMessage) error {
+	if err := checkImportNames(state); err != nil {
+		return err
+	}
+	state, err := upgradeCopy(state, p.migrations)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, data := range state {
+		if err := (&diskValue{p: p, name: name}).store(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type diskValue struct {
 	p    *diskPersistence
 	name string
@@ -80,10 +169,34 @@ func (v *diskValue) store(obj interface{}) error {
 	if err = os.MkdirAll(dirname, directoryMode); err != nil {
 		return err
 	}
-	if err = ioutil.WriteFile(filename, jsontext, fileMode); err != nil {
+	return writeFileAtomic(filename, jsontext)
+}
+
+// writeFileAtomic replaces filename with data by writing a temporary file in the same directory and
+// renaming it, so that a crash leaves either the previous or the new contents, never a partial
+// file. Temporary files don't have the ".json" suffix, so a leftover one is never loaded.
+func writeFileAtomic(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(filename), path.Base(filename)+".tmp")
+	if err != nil {
 		return err
 	}
-	return nil
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), fileMode)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
 func (v *diskValue) remove() error {
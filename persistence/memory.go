@@ -22,14 +22,22 @@ import (
 // Type memoryPersistence is a Persistence implementation that stores values and queues json-encoded
 // data in an in-memory map. This implementations does not offer persistence across restarts.
 type memoryPersistence struct {
-	items map[string][]byte
-	mutex sync.RWMutex
+	items      map[string][]byte
+	migrations []Migration
+	mutex      sync.RWMutex
 }
 
 // NewMemoryPersistence constructs a new Persistence that stores objects in memory.
 func NewMemoryPersistence() Persistence {
+	return newMemoryPersistence(migrations)
+}
+
+func newMemoryPersistence(migrations []Migration) Persistence {
 	var mp memoryPersistence
 	mp.items = make(map[string][]byte)
+	mp.migrations = migrations
+	// Mark the empty state with the current version, so that it's exported along with the state.
+	mp.items[stateVersionName], _ = json.Marshal(stateVersion{Version: len(migrations) + 1})
 	return &mp
 }
 
@@ -41,6 +49,34 @@ func (p *memoryPersistence) Queue(name string) Queue {
 	return &valueQueue{&memoryValue{p: p, name: name}}
 }
 
+func (p *memoryPersistence) Export() (map[string]json.RawMessage, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	state := make(map[string]json.RawMessage, len(p.items))
+	for name, data := range p.items {
+		state[name] = append(json.RawMessage(nil), data...)
+	}
+	return exportable(state), nil
+}
+
+func (p *memoryPersistence) Import(state map[string]json.RawMessage) error {
+	if err := checkImportNames(state); err != nil {
+		return err
+	}
+	state, err := upgradeCopy(state, p.migrations)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for name, data := range state {
+		if err := (&memoryValue{p: p, name: name}).store(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type memoryValue struct {
 	p    *memoryPersistence
 	name string
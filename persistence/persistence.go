@@ -14,7 +14,13 @@
 
 package persistence
 
-import "errors"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
 
 const (
 	fileMode      = 0644 // Mode bits used when creating files
@@ -41,6 +47,30 @@ type Persistence interface {
 	// times with the same name and all returned instances will operate on the same data in a
 	// threadsafe manner.
 	Queue(name string) Queue
+
+	// Export returns the stored contents of every Value and Queue, as json text keyed by name, along
+	// with a record of the version of their format. It can be used to move state to another
+	// Persistence using Import. Export returns an empty map if nothing is stored.
+	Export() (map[string]json.RawMessage, error)
+
+	// Import stores each of the given contents, as returned by Export, under its name. Existing
+	// Values and Queues with the same names are replaced. State exported by an older version of the
+	// agent is migrated to the current format first. Import fails without storing anything if a name
+	// isn't one that Export could have returned, or if the state is from a newer version.
+	Import(state map[string]json.RawMessage) error
+}
+
+// checkImportNames returns an error if any name in state isn't a relative, slash-separated path
+// without "." or ".." elements. Imported state may come from anywhere, and names become file paths.
+func checkImportNames(state map[string]json.RawMessage) error {
+	for name := range state {
+		invalid := path.Clean(name) != name || path.IsAbs(name) || name == "." || name == ".." ||
+			strings.HasPrefix(name, "../") || strings.ContainsRune(name, '\\')
+		if invalid {
+			return fmt.Errorf("persistence: invalid name in imported state: %q", name)
+		}
+	}
+	return nil
 }
 
 // Value stores and loads a single value.
@@ -15,8 +15,10 @@
 package persistence
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -35,6 +37,44 @@ func TestMemoryPersistence(t *testing.T) {
 	p := NewMemoryPersistence()
 	testPersistence(p, t)
 	testQueue(p.Queue("test_queue"), t)
+	testExportImport(p, NewMemoryPersistence(), t)
+}
+
+// TestRoutingPersistence tests that a routing Persistence stores each Value and Queue in the
+// Persistence routed to its name, and exports and imports the state of all of them together.
+func TestRoutingPersistence(t *testing.T) {
+	newRouting := func() (Persistence, Persistence, Persistence) {
+		def, queues := NewMemoryPersistence(), NewMemoryPersistence()
+		return NewRoutingPersistence(def, Route{Prefixes: []string{"export/queue", "test_queue"}, Persistence: queues}), def, queues
+	}
+	p, def, queues := newRouting()
+	testPersistence(p, t)
+	testQueue(p.Queue("test_queue"), t)
+	dst, dstDef, dstQueues := newRouting()
+	testExportImport(p, dst, t)
+
+	// Each store holds only the state routed to it.
+	for _, s := range []struct {
+		name              string
+		p                 Persistence
+		stored, notStored string
+	}{
+		{"default", def, "export/value", "export/queue"},
+		{"queues", queues, "export/queue", "export/value"},
+		{"imported default", dstDef, "export/value", "export/queue"},
+		{"imported queues", dstQueues, "export/queue", "export/value"},
+	} {
+		state, err := s.p.Export()
+		if err != nil {
+			t.Fatalf("%v: unexpected error exporting state: %+v", s.name, err)
+		}
+		if _, ok := state[s.stored]; !ok {
+			t.Fatalf("%v: expected %v to be stored, got=%s", s.name, s.stored, state)
+		}
+		if _, ok := state[s.notStored]; ok {
+			t.Fatalf("%v: expected %v not to be stored, got=%s", s.name, s.notStored, state)
+		}
+	}
 }
 
 func TestDiskPersistence(t *testing.T) {
@@ -49,6 +89,59 @@ func TestDiskPersistence(t *testing.T) {
 	}
 	testPersistence(p, t)
 	testQueue(p.Queue("test_queue"), t)
+
+	tmpdir2, err := ioutil.TempDir("", "persistence_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir2)
+	p2, err := NewDiskPersistence(tmpdir2)
+	if err != nil {
+		t.Fatalf("Unexpected error creating DiskPersistence: %+v", err)
+	}
+	testExportImport(p, p2, t)
+}
+
+func TestDiskPersistence_AtomicStore(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "persistence_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	p, err := NewDiskPersistence(tmpdir)
+	if err != nil {
+		t.Fatalf("Unexpected error creating DiskPersistence: %+v", err)
+	}
+
+	v := p.Value("atomic")
+	for i := 0; i < 3; i++ {
+		if err := v.Store(i); err != nil {
+			t.Fatalf("Unexpected error storing value: %+v", err)
+		}
+	}
+	files, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatalf("Unexpected error listing directory: %+v", err)
+	}
+	if len(files) != 2 || files[0].Name() != "atomic.json" || files[1].Name() != stateVersionName+".json" {
+		t.Fatalf("expected only atomic.json and the version record after stores, got: %v", files)
+	}
+
+	// A temporary file left by a crash mid-write is ignored; the last complete value is loaded.
+	if err := ioutil.WriteFile(filepath.Join(tmpdir, "atomic.json.tmp123"), []byte("{partial"), 0644); err != nil {
+		t.Fatalf("Unexpected error writing file: %+v", err)
+	}
+	var loaded int
+	if err := v.Load(&loaded); err != nil || loaded != 2 {
+		t.Fatalf("Load: want=%v, got=%v (err=%v)", 2, loaded, err)
+	}
+	state, err := p.Export()
+	if err != nil {
+		t.Fatalf("Unexpected error exporting: %+v", err)
+	}
+	if _, ok := state["atomic"]; !ok || len(state) != 2 {
+		t.Fatalf("expected only the complete value and the version record to be exported, got: %v", state)
+	}
 }
 
 func testPersistence(p Persistence, t *testing.T) {
@@ -176,9 +269,42 @@ func testQueue(q Queue, t *testing.T) {
 		t.Fatalf("Unexpected value for value 2: %+v", v)
 	}
 
+	// Update replaces value 2 at the head of the queue.
+	updated2 := value{A: 22, B: "foo22"}
+	if err := q.Update(&updated2); err != nil {
+		t.Fatalf("Unexpected error updating head: %+v", err)
+	}
+	if err := q.Peek(&v); err != nil {
+		t.Fatalf("Unexpected error getting updated value 2: %+v", err)
+	}
+	if !reflect.DeepEqual(v, updated2) {
+		t.Fatalf("Unexpected value for updated value 2: %+v", v)
+	}
+	value2 = updated2
+
 	if err := q.Enqueue(&value3); err != nil {
 		t.Fatalf("Unexpected error adding queue value 3: %+v", err)
 	}
+	if l, err := q.Len(); err != nil {
+		t.Fatalf("Unexpected error getting queue length: %+v", err)
+	} else if l != 2 {
+		t.Fatalf("Queue length: want=%v, got=%v", 2, l)
+	}
+
+	var vs []value
+	if err := q.PeekN(5, &vs); err != nil {
+		t.Fatalf("Unexpected error getting queue values: %+v", err)
+	}
+	if !reflect.DeepEqual(vs, []value{value2, value3}) {
+		t.Fatalf("Unexpected values: %+v", vs)
+	}
+	vs = nil
+	if err := q.PeekN(1, &vs); err != nil {
+		t.Fatalf("Unexpected error getting queue values: %+v", err)
+	}
+	if !reflect.DeepEqual(vs, []value{value2}) {
+		t.Fatalf("Unexpected values: %+v", vs)
+	}
 
 	// At this point we should still have value 2 and value 3 in the queue.
 	if err := q.Peek(&v); err != nil {
@@ -212,4 +338,177 @@ func testQueue(q Queue, t *testing.T) {
 	if err := q.Peek(&v); err != ErrNotFound {
 		t.Fatalf("Expected ErrNotFound, got %+v", err)
 	}
+	if err := q.PeekN(1, &vs); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %+v", err)
+	}
+	if err := q.Update(&v); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound, got %+v", err)
+	}
+	if l, err := q.Len(); err != nil || l != 0 {
+		t.Fatalf("Expected empty queue, got length %v, error %+v", l, err)
+	}
+}
+
+// testExportImport exports the state of src after storing a value and a queue, imports it into dst,
+// and verifies that dst contains the same objects.
+func testExportImport(src, dst Persistence, t *testing.T) {
+	input := Outer{Value1: 1, Value2: 2, Foo: Inner{ValueMap: map[string]string{"foo": "bar"}}}
+	if err := src.Value("export/value").Store(&input); err != nil {
+		t.Fatalf("Unexpected error storing value: %+v", err)
+	}
+	if err := src.Queue("export/queue").Enqueue(&input); err != nil {
+		t.Fatalf("Unexpected error adding queue value: %+v", err)
+	}
+
+	state, err := src.Export()
+	if err != nil {
+		t.Fatalf("Unexpected error exporting state: %+v", err)
+	}
+	if err := dst.Import(state); err != nil {
+		t.Fatalf("Unexpected error importing state: %+v", err)
+	}
+
+	var output Outer
+	if err := dst.Value("export/value").Load(&output); err != nil {
+		t.Fatalf("Unexpected error loading imported value: %+v", err)
+	}
+	if !reflect.DeepEqual(input, output) {
+		t.Fatalf("Imported value: want=%+v, got=%+v", input, output)
+	}
+	output = Outer{}
+	if err := dst.Queue("export/queue").Peek(&output); err != nil {
+		t.Fatalf("Unexpected error loading imported queue: %+v", err)
+	}
+	if !reflect.DeepEqual(input, output) {
+		t.Fatalf("Imported queue value: want=%+v, got=%+v", input, output)
+	}
+
+	// Exporting the imported state reproduces it exactly.
+	reexported, err := dst.Export()
+	if err != nil {
+		t.Fatalf("Unexpected error exporting state: %+v", err)
+	}
+	if !reflect.DeepEqual(state, reexported) {
+		t.Fatalf("Re-exported state: want=%s, got=%s", state, reexported)
+	}
+
+	// Names that could escape the persistence's directory are rejected.
+	for _, name := range []string{"", "../escape", "export/../../escape", "/escape", "./escape", "..", `export\escape`} {
+		bad := map[string]json.RawMessage{"export/other": state["export/value"], name: state["export/value"]}
+		if err := dst.Import(bad); err == nil {
+			t.Fatalf("Expected error importing name %q", name)
+		}
+		if err := dst.Value("export/other").Load(&output); err != ErrNotFound {
+			t.Fatalf("Expected nothing imported along with name %q, got: %+v", name, err)
+		}
+	}
+}
+
+// TestMigration tests that state stored in an older format is migrated when it's loaded, and that
+// state from a newer format is rejected.
+func TestMigration(t *testing.T) {
+	// Version 2 of this test's format renames version 1's "Count" field to "Total".
+	var migrated int
+	testMigrations := []Migration{
+		func(state map[string]json.RawMessage) error {
+			migrated++
+			for name, data := range state {
+				var v1 struct{ Count int }
+				if err := json.Unmarshal(data, &v1); err != nil {
+					return err
+				}
+				data, err := json.Marshal(struct{ Total int }{v1.Count})
+				if err != nil {
+					return err
+				}
+				state[name] = data
+			}
+			return nil
+		},
+	}
+	type v2 struct{ Total int }
+
+	t.Run("Disk", func(t *testing.T) {
+		tmpdir, err := ioutil.TempDir("", "persistence_test")
+		if err != nil {
+			t.Fatalf("Unable to create temp directory: %+v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+		if err := os.MkdirAll(filepath.Join(tmpdir, "agg"), directoryMode); err != nil {
+			t.Fatalf("Unexpected error creating directory: %+v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(tmpdir, "agg", "metric.json"), []byte(`{"Count": 5}`), fileMode); err != nil {
+			t.Fatalf("Unexpected error writing version 1 state: %+v", err)
+		}
+
+		migrated = 0
+		for i := 0; i < 2; i++ {
+			p, err := newDiskPersistence(tmpdir, testMigrations)
+			if err != nil {
+				t.Fatalf("Unexpected error creating DiskPersistence: %+v", err)
+			}
+			var v v2
+			if err := p.Value("agg/metric").Load(&v); err != nil {
+				t.Fatalf("Unexpected error loading migrated value: %+v", err)
+			}
+			if want, got := (v2{Total: 5}), v; want != got {
+				t.Fatalf("Migrated value: want=%+v, got=%+v", want, got)
+			}
+		}
+		// Migrated state is stored, so it's only migrated once.
+		if want, got := 1, migrated; want != got {
+			t.Fatalf("Migrations: want=%v, got=%v", want, got)
+		}
+
+		// State from a newer version is rejected.
+		if err := ioutil.WriteFile(filepath.Join(tmpdir, stateVersionName+".json"), []byte(`{"version": 3}`), fileMode); err != nil {
+			t.Fatalf("Unexpected error writing version record: %+v", err)
+		}
+		if _, err := newDiskPersistence(tmpdir, testMigrations); err == nil || err.Error() != "persistence: state version 3 is newer than the newest supported version, 2" {
+			t.Fatalf("Expected an unsupported version error, got: %+v", err)
+		}
+	})
+
+	t.Run("Empty directory", func(t *testing.T) {
+		tmpdir, err := ioutil.TempDir("", "persistence_test")
+		if err != nil {
+			t.Fatalf("Unable to create temp directory: %+v", err)
+		}
+		defer os.RemoveAll(tmpdir)
+
+		migrated = 0
+		p, err := newDiskPersistence(tmpdir, testMigrations)
+		if err != nil {
+			t.Fatalf("Unexpected error creating DiskPersistence: %+v", err)
+		}
+		if err := p.Value("agg/metric").Store(&v2{Total: 5}); err != nil {
+			t.Fatalf("Unexpected error storing value: %+v", err)
+		}
+		if _, err := newDiskPersistence(tmpdir, testMigrations); err != nil {
+			t.Fatalf("Unexpected error creating DiskPersistence: %+v", err)
+		}
+		// New state is already current, so it's never migrated.
+		if want, got := 0, migrated; want != got {
+			t.Fatalf("Migrations: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("Import", func(t *testing.T) {
+		p := newMemoryPersistence(testMigrations)
+		if err := p.Import(map[string]json.RawMessage{"agg/metric": json.RawMessage(`{"Count": 5}`)}); err != nil {
+			t.Fatalf("Unexpected error importing version 1 state: %+v", err)
+		}
+		var v v2
+		if err := p.Value("agg/metric").Load(&v); err != nil {
+			t.Fatalf("Unexpected error loading migrated value: %+v", err)
+		}
+		if want, got := (v2{Total: 5}), v; want != got {
+			t.Fatalf("Migrated value: want=%+v, got=%+v", want, got)
+		}
+
+		future := map[string]json.RawMessage{stateVersionName: json.RawMessage(`{"version": 3}`)}
+		if err := p.Import(future); err == nil {
+			t.Fatal("Expected an error importing state from a newer version")
+		}
+	})
 }
@@ -28,6 +28,11 @@ type Queue interface {
 	// I/O errors may be returned in the event of I/O failures.
 	Peek(obj interface{}) error
 
+	// PeekN loads up to n objects from the front of this Queue into the slice pointed to by objs,
+	// without removing them. ErrNotFound is returned if the queue is empty or does not exist. Other
+	// I/O errors may be returned in the event of I/O failures.
+	PeekN(n int, objs interface{}) error
+
 	// Dequeue removes the front of this Queue. If successful, nil is returned. ErrNotFound is
 	// returned if the queue is empty or does not exist. Other I/O errors may be returned in the event
 	// of I/O failures. If obj is non-nil, it will contain removed value upon success.
@@ -36,6 +41,15 @@ type Queue interface {
 	// Enqueue stores obj at the back of this Queue. Returns nil if the object was stored, or an error
 	// if something failed.
 	Enqueue(obj interface{}) error
+
+	// Update replaces the object at the head of this Queue with obj. If successful, nil is returned.
+	// ErrNotFound is returned if the queue is empty or does not exist. Other I/O errors may be
+	// returned in the event of I/O failures.
+	Update(obj interface{}) error
+
+	// Len returns the number of objects in this Queue. A queue that does not exist has a length of 0.
+	// I/O errors may be returned in the event of I/O failures.
+	Len() (int, error)
 }
 
 // Type valueQueue is a Queue that stores its state within a single value. Queue state is stored as
@@ -64,6 +78,29 @@ func (vq *valueQueue) Peek(obj interface{}) error {
 	return nil
 }
 
+func (vq *valueQueue) PeekN(n int, objs interface{}) error {
+	var queue []json.RawMessage
+	// Grab the value's associated persistence read lock and load the queue
+	vq.value.mutex().RLock()
+	err := vq.value.load(&queue)
+	vq.value.mutex().RUnlock()
+	if err != nil {
+		return err
+	}
+	if len(queue) == 0 {
+		return ErrNotFound
+	}
+	if n < len(queue) {
+		queue = queue[:n]
+	}
+	// Re-encode the front of the queue as a json array and unmarshal it into objs.
+	bytes, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, objs)
+}
+
 func (vq *valueQueue) Dequeue(obj interface{}) error {
 	var queue []json.RawMessage
 	// Grab the value's associated persistence lock
@@ -119,3 +156,44 @@ func (vq *valueQueue) Enqueue(obj interface{}) error {
 	}
 	return nil
 }
+
+func (vq *valueQueue) Update(obj interface{}) error {
+	var queue []json.RawMessage
+	var err error
+	var bytes []byte
+	// First marshal the given object into json text.
+	if bytes, err = json.Marshal(obj); err != nil {
+		return err
+	}
+	// Grab the value's associated persistence lock
+	vq.value.mutex().Lock()
+	defer vq.value.mutex().Unlock()
+	// Load the existing queue in preparation for updating
+	if err = vq.value.load(&queue); err != nil {
+		return err
+	}
+	// If the queue exists but is somehow empty, we return ErrNotFound
+	if len(queue) == 0 {
+		return ErrNotFound
+	}
+	// Replace the front of the queue, and store the result.
+	queue[0] = bytes
+	if err := vq.value.store(queue); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (vq *valueQueue) Len() (int, error) {
+	var queue []json.RawMessage
+	// Grab the value's associated persistence read lock and load the queue
+	vq.value.mutex().RLock()
+	err := vq.value.load(&queue)
+	vq.value.mutex().RUnlock()
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return len(queue), nil
+}
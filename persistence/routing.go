@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Route directs the Values and Queues whose names start with any of Prefixes to Persistence.
+type Route struct {
+	Prefixes    []string
+	Persistence Persistence
+}
+
+// routingPersistence is a Persistence that stores each of its Values and Queues in the Persistence
+// of the first route matching its name, or in a default Persistence if no route matches.
+type routingPersistence struct {
+	def    Persistence
+	routes []Route
+}
+
+// NewRoutingPersistence constructs a new Persistence that stores Values and Queues in the
+// Persistence of the first of routes matching their names, and all others in def. Export merges the
+// state of every Persistence, and Import divides state among them by the same rules, so that the
+// state can be moved as a whole. Each Persistence should have its own backing store.
+func NewRoutingPersistence(def Persistence, routes ...Route) Persistence {
+	return &routingPersistence{def: def, routes: routes}
+}
+
+// route returns the index of the route for name, or -1 for the default Persistence.
+func (p *routingPersistence) route(name string) int {
+	for i, r := range p.routes {
+		for _, prefix := range r.Prefixes {
+			if strings.HasPrefix(name, prefix) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func (p *routingPersistence) target(i int) Persistence {
+	if i < 0 {
+		return p.def
+	}
+	return p.routes[i].Persistence
+}
+
+func (p *routingPersistence) Value(name string) Value {
+	return p.target(p.route(name)).Value(name)
+}
+
+func (p *routingPersistence) Queue(name string) Queue {
+	return p.target(p.route(name)).Queue(name)
+}
+
+func (p *routingPersistence) Export() (map[string]json.RawMessage, error) {
+	merged := make(map[string]json.RawMessage)
+	for i := -1; i < len(p.routes); i++ {
+		state, err := p.target(i).Export()
+		if err != nil {
+			return nil, err
+		}
+		for name, data := range state {
+			// A store only contributes the names routed to it, and every store records the same
+			// version.
+			if name == stateVersionName || p.route(name) == i {
+				merged[name] = data
+			}
+		}
+	}
+	return merged, nil
+}
+
+// Import upgrades state before dividing it, so that every Persistence receives the same version
+// record and an unsupported version fails before anything is stored. A failure storing one part of
+// state may leave other parts imported.
+func (p *routingPersistence) Import(state map[string]json.RawMessage) error {
+	if err := checkImportNames(state); err != nil {
+		return err
+	}
+	state, err := upgradeCopy(state, migrations)
+	if err != nil {
+		return err
+	}
+	parts := make([]map[string]json.RawMessage, len(p.routes)+1)
+	for i := range parts {
+		parts[i] = map[string]json.RawMessage{stateVersionName: state[stateVersionName]}
+	}
+	for name, data := range state {
+		parts[p.route(name)+1][name] = data
+	}
+	for i, part := range parts {
+		if len(part) == 1 {
+			continue
+		}
+		if err := p.target(i - 1).Import(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// stateVersionName is the name of the Value holding the version of the stored state's format.
+const stateVersionName = "stateversion"
+
+// Migration upgrades stored state, as returned by Export, from one version of the format to the next.
+// It modifies state in place, and may add, replace, or delete any of its Values and Queues.
+type Migration func(state map[string]json.RawMessage) error
+
+// migrations upgrade state from each version of the format to the next: migrations[i] upgrades
+// version i+1 to version i+2. The current version is len(migrations)+1.
+var migrations = []Migration{
+	// Version 2 adds the state version record; state is otherwise unchanged.
+	func(state map[string]json.RawMessage) error { return nil },
+}
+
+type stateVersion struct {
+	Version int `json:"version"`
+}
+
+// upgrade migrates state, as returned by Export, to the current version of the format, returning
+// true if state was changed. State without a version record is version 1, unless it's empty, in which
+// case it's simply marked with the current version. State from a newer version, which this agent
+// can't read, results in an error.
+func upgrade(state map[string]json.RawMessage, migrations []Migration) (bool, error) {
+	current := len(migrations) + 1
+	version := 1
+	if data, ok := state[stateVersionName]; ok {
+		var sv stateVersion
+		if err := json.Unmarshal(data, &sv); err != nil {
+			return false, fmt.Errorf("persistence: loading state version: %v", err)
+		}
+		version = sv.Version
+	} else if len(state) == 0 {
+		version = current
+	}
+	if version > current {
+		return false, fmt.Errorf("persistence: state version %v is newer than the newest supported version, %v", version, current)
+	}
+	if version < 1 {
+		return false, fmt.Errorf("persistence: invalid state version: %v", version)
+	}
+	if _, ok := state[stateVersionName]; ok && version == current {
+		return false, nil
+	}
+	for ; version < current; version++ {
+		if err := migrations[version-1](state); err != nil {
+			return false, fmt.Errorf("persistence: migrating state from version %v: %v", version, err)
+		}
+	}
+	data, err := json.Marshal(stateVersion{Version: current})
+	if err != nil {
+		return false, err
+	}
+	state[stateVersionName] = data
+	return true, nil
+}
+
+// upgradeCopy returns a copy of state upgraded to the current version of the format, leaving state
+// itself unchanged.
+func upgradeCopy(state map[string]json.RawMessage, migrations []Migration) (map[string]json.RawMessage, error) {
+	upgraded := make(map[string]json.RawMessage, len(state))
+	for name, data := range state {
+		upgraded[name] = data
+	}
+	if _, err := upgrade(upgraded, migrations); err != nil {
+		return nil, err
+	}
+	return upgraded, nil
+}
+
+// exportable returns state, as returned by Export, or an empty map if state holds nothing but its
+// version record. The record is only exported along with the state it describes, so that empty state
+// exports as empty.
+func exportable(state map[string]json.RawMessage) map[string]json.RawMessage {
+	if _, ok := state[stateVersionName]; ok && len(state) == 1 {
+		return make(map[string]json.RawMessage)
+	}
+	return state
+}
@@ -15,11 +15,18 @@
 package builder
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/agentid"
 	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 	"github.com/GoogleCloudPlatform/ubbagent/persistence"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline/endpoints"
@@ -27,39 +34,302 @@ import (
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline/senders"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline/sources"
 	"github.com/GoogleCloudPlatform/ubbagent/stats"
+	"github.com/golang/glog"
 	"github.com/hashicorp/go-multierror"
 )
 
+const defaultHealthCheckTimeout = 30 * time.Second
+
+const defaultFailoverCooldown = 60 * time.Second
+
+const defaultIngestionQueueSize = 100
+
+// importRecordName is the persistence name of the record of the last state imported by WithState.
+const importRecordName = "importedstate"
+
+// Option configures optional behavior of a pipeline created by Build.
+type Option func(*options)
+
+type options struct {
+	validators []metrics.Validator
+	dryRun     bool
+	publisher  *inputs.Publisher
+	state      []byte
+	ids        metrics.IDGenerator
+	pause      *senders.Switch
+	persister  *inputs.Persister
+	httpClient *http.Client
+
+	shutdownStatus *ShutdownStatus
+}
+
+// WithValidators registers custom report validators. For each metric, the custom validators run
+// in the order given, after the metric's built-in validators (see metrics.DefaultValidators).
+func WithValidators(validators ...metrics.Validator) Option {
+	return func(o *options) {
+		o.validators = append(o.validators, validators...)
+	}
+}
+
+// WithDryRun replaces every configured endpoint with an endpoints.LoggingEndpoint of the same name.
+// Reports are validated, aggregated and routed as usual, but they're only logged, never sent.
+// Queues and aggregations still use the Persistence passed to Build, so a dry run must not share
+// persistent state with a real agent; use persistence.NewMemoryPersistence.
+func WithDryRun() Option {
+	return func(o *options) {
+		o.dryRun = true
+	}
+}
+
+// WithPublisher publishes each report flushed to the pipeline's endpoints (that is, after any
+// aggregation) to the given Publisher.
+func WithPublisher(publisher *inputs.Publisher) Option {
+	return func(o *options) {
+		o.publisher = publisher
+	}
+}
+
+// WithIDGenerator stamps reports with IDs created by ids, such as metrics.NewHashGenerator, rather
+// than random UUIDs.
+func WithIDGenerator(ids metrics.IDGenerator) Option {
+	return func(o *options) {
+		o.ids = ids
+	}
+}
+
+// WithPauseSwitch pauses sending to every endpoint while pause is paused. Reports are still
+// accepted, aggregated, and queued.
+func WithPauseSwitch(pause *senders.Switch) Option {
+	return func(o *options) {
+		o.pause = pause
+	}
+}
+
+// WithPersister adds each Aggregator in the pipeline to persister, so that their open buckets can be
+// persisted on demand, such as before calling ExportState.
+func WithPersister(persister *inputs.Persister) Option {
+	return func(o *options) {
+		o.persister = persister
+	}
+}
+
+// WithShutdownStatus records what the pipeline's shutdown does in status, such as the reports it
+// flushed and sent and the components that failed, for when an error from Release isn't enough.
+func WithShutdownStatus(status *ShutdownStatus) Option {
+	return func(o *options) {
+		o.shutdownStatus = status
+	}
+}
+
+// WithHTTPClient makes HTTP-based (servicecontrol, forward, and datadog) endpoints send with client,
+// such as one configured for a proxy, mutual TLS, or custom root CAs, rather than a client of their
+// own. Endpoints' transport settings are ignored. If the client has no timeout, each endpoint's
+// default timeout applies.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithState imports agent state, as exported by ExportState from another agent, before the pipeline
+// is built. The state can only be imported into an agent without existing state, except that
+// importing state that the agent has already imported is skipped, so that an agent can be restarted
+// with the same option. The exporting agent must be stopped before its state is imported: reports
+// that it sends after exporting would be sent again by the importing agent.
+func WithState(state []byte) Option {
+	return func(o *options) {
+		o.state = state
+	}
+}
+
+// ExportState exports the complete state stored in p, including the agent's ID, pending
+// aggregations, and queued sends, as a single JSON document. Queues are persisted as they change, but
+// an Aggregator may hold reports that it hasn't persisted yet (see inputs.PersistPolicy); to include
+// them in the export of a running pipeline, built using WithPersister, first call Persister.Persist.
+func ExportState(p persistence.Persistence) ([]byte, error) {
+	state, err := p.Export()
+	if err != nil {
+		return nil, err
+	}
+	// The record of an earlier import describes this agent, not the state being exported.
+	delete(state, importRecordName)
+	return json.Marshal(state)
+}
+
+// componentPrefixes lists the prefixes of the names that each component configurable in
+// config.Persistence stores its state under.
+var componentPrefixes = struct{ aggregation, queues, sources, ingestion []string }{
+	aggregation: []string{"aggregator/"},
+	queues:      []string{"epqueue/", "quarantine/", "sentids/"},
+	sources:     []string{"filetail/"},
+	ingestion:   []string{"ingestion/"},
+}
+
+// NewPersistence returns the Persistence to build cfg's pipeline with: shared, with the state of
+// each component assigned a directory in cfg.Persistence stored in that directory instead. Callers
+// should export the pipeline's state from the returned Persistence. A dry run doesn't write to the
+// configured directories, so it uses shared alone.
+func NewPersistence(cfg *config.Config, shared persistence.Persistence, opts ...Option) (persistence.Persistence, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if cfg.Persistence == nil || o.dryRun {
+		return shared, nil
+	}
+	var routes []persistence.Route
+	for _, c := range []struct {
+		dir      string
+		prefixes []string
+	}{
+		{cfg.Persistence.Aggregation, componentPrefixes.aggregation},
+		{cfg.Persistence.Queues, componentPrefixes.queues},
+		{cfg.Persistence.Sources, componentPrefixes.sources},
+		{cfg.Persistence.Ingestion, componentPrefixes.ingestion},
+	} {
+		if c.dir == "" {
+			continue
+		}
+		p, err := persistence.NewDiskPersistence(c.dir)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, persistence.Route{Prefixes: c.prefixes, Persistence: p})
+	}
+	return persistence.NewRoutingPersistence(shared, routes...), nil
+}
+
+// importRecord identifies imported state by its SHA-256 digest.
+type importRecord struct {
+	Digest string
+}
+
+func importState(p persistence.Persistence, data []byte) error {
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("importing state: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	record := importRecord{Digest: hex.EncodeToString(sum[:])}
+	existing, err := p.Export()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		var previous importRecord
+		if err := p.Value(importRecordName).Load(&previous); err == nil && previous == record {
+			glog.Infof("importing state: state was already imported; skipping")
+			return nil
+		}
+		return errors.New("importing state: agent already has state")
+	}
+	if err := p.Import(state); err != nil {
+		return err
+	}
+	return p.Value(importRecordName).Store(&record)
+}
+
 // Build builds pipeline containing a configured Aggregator and all of the resources
 // (persistence, endpoints) behind it. It returns the pipeline.Input.
-func Build(cfg *config.Config, p persistence.Persistence, r stats.Recorder) (pipeline.Input, error) {
+func Build(cfg *config.Config, p persistence.Persistence, r stats.Recorder, opts ...Option) (pipeline.Input, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r = o.shutdownStatus.recorder(r)
+	if o.state != nil {
+		if err := importState(p, o.state); err != nil {
+			return nil, err
+		}
+	}
 	agentId, err := agentid.CreateOrGet(p)
 	if err != nil {
 		return nil, err
 	}
-	endpointList, err := createEndpoints(cfg, agentId)
+	endpointList, err := createEndpoints(cfg, agentId, o.dryRun, o.httpClient)
 	if err != nil {
 		return nil, err
 	}
+	// Every metric is listed, including those without a TTL, so that the senders match each report
+	// to the same definition that the selector does.
+	ttls := make(map[string]time.Duration)
+	for _, metric := range cfg.Metrics {
+		ttls[metric.Name] = time.Duration(metric.TTLSeconds) * time.Second
+	}
 	endpointSenders := make(map[string]pipeline.Sender)
+	var drainers []drainer
 	for i := range endpointList {
-		endpointSenders[endpointList[i].Name()] = senders.NewRetryingSender(endpointList[i], p, r)
+		rs := senders.NewRetryingSender(endpointList[i], p, r, ttls, retrySettings(&cfg.Endpoints[i]), batchSettings(&cfg.Endpoints[i]), o.pause)
+		endpointSenders[endpointList[i].Name()] = rs
+		drainers = append(drainers, rs)
 	}
 
 	// Inputs for the resultant Selector.
 	selectorInputs := make(map[string]pipeline.Input)
 	for _, metric := range cfg.Metrics {
-		var msenders []pipeline.Sender
+		var msenders, rawSenders []pipeline.Sender
 		for _, me := range metric.Endpoints {
-			msenders = append(msenders, endpointSenders[me.Name])
+			var s pipeline.Sender = endpointSenders[me.Name]
+			if me.Coerce != nil {
+				s = senders.NewCoercingSender(s, me.Coerce.Type, me.Coerce.Rounding, r)
+			}
+			if me.Raw {
+				rawSenders = append(rawSenders, s)
+			} else {
+				msenders = append(msenders, s)
+			}
+		}
+		var di pipeline.Input = &pipeline.InputAdapter{Sender: senders.NewDispatcher(msenders, r), IDs: o.ids}
+		if o.publisher != nil {
+			di = inputs.NewPublishingInput(di, o.publisher)
 		}
-		di := &pipeline.InputAdapter{Sender: senders.NewDispatcher(msenders, r)}
+		if metric.Precision != nil {
+			di = inputs.NewPrecisionInput(di, metric.Precision.Decimals, metric.Precision.Rounding)
+		}
+		var metricInput pipeline.Input
 		if metric.Aggregation != nil {
 			bufferTime := time.Duration(metric.Aggregation.BufferSeconds) * time.Second
-			selectorInputs[metric.Name] = inputs.NewAggregator(metric.Definition, bufferTime, di, p)
+			persist := inputs.PersistPolicy{
+				Adds:             metric.Aggregation.PersistEvery,
+				Interval:         time.Duration(metric.Aggregation.PersistIntervalSeconds) * time.Second,
+				DegradedInterval: time.Duration(metric.Aggregation.DegradedBufferSeconds) * time.Second,
+			}
+			var aggOutput pipeline.Input = di
+			if metric.Aggregation.Rate != "" {
+				aggOutput = inputs.NewRateInput(di, metric.Aggregation.Rate)
+			}
+			aggOutput = o.shutdownStatus.flushInput(aggOutput)
+			agg := inputs.NewAggregator(metric.Definition, bufferTime, metric.Aggregation.FlushOnValue, metric.Aggregation.StaggerLabel, metric.Aggregation.FutureEndTime, persist, aggOutput, p, r, metric.Aggregation.FlushParallelism)
+			o.persister.Add(agg)
+			metricInput = agg
+			if len(metric.Aggregation.ExcludeLabels) > 0 {
+				metricInput = inputs.NewLabelExclusionInput(metricInput, metric.Aggregation.ExcludeLabels, metric.Aggregation.ExcludedLabelPolicy)
+			}
 		} else if metric.Passthrough != nil {
-			selectorInputs[metric.Name] = di
+			metricInput = di
+		}
+		if metric.Quantize != nil {
+			metricInput = inputs.NewQuantizingInput(metricInput, metric.Quantize.Step, metric.Quantize.Rounding)
 		}
+		if len(rawSenders) > 0 {
+			// Raw endpoints receive reports as they're added, before quantization or aggregation.
+			raw := &pipeline.InputAdapter{Sender: senders.NewDispatcher(rawSenders, r), IDs: o.ids}
+			metricInput = inputs.NewTeeInput(raw, metricInput)
+		}
+		if metric.Sampling != nil {
+			// Reports are sampled before they fan out to the raw and aggregated endpoints, so that
+			// every endpoint receives the same reports.
+			metricInput = inputs.NewSamplingInput(metricInput, metric.Sampling.Rate)
+		}
+		validators := append(metrics.DefaultValidators(metric.Definition), o.validators...)
+		metricInput = inputs.NewValidatingInput(metricInput, validators...)
+		if metric.ValueLabel != "" {
+			metricInput = inputs.NewValueLabelInput(metricInput, metric.Definition, metric.ValueLabel)
+		}
+		if len(metric.DefaultLabels) > 0 {
+			metricInput = inputs.NewDefaultLabelsInput(metricInput, metric.DefaultLabels)
+		}
+		selectorInputs[metric.Name] = metricInput
 	}
 
 	head := inputs.NewSelector(selectorInputs)
@@ -71,14 +341,47 @@ func Build(cfg *config.Config, p persistence.Persistence, r stats.Recorder) (pip
 		if f.AddLabels != nil {
 			head = inputs.NewLabelingInput(head, f.AddLabels.IncludedLabels())
 		}
+		if f.NormalizeLabels != nil {
+			head = inputs.NewNormalizingInput(head, inputs.LabelNormalization{
+				CaseFold:      f.NormalizeLabels.CaseFold,
+				StripPrefixes: f.NormalizeLabels.StripPrefixes,
+				TrimValues:    f.NormalizeLabels.TrimValues,
+				OnConflict:    f.NormalizeLabels.OnConflict,
+			})
+		}
+	}
+
+	if cfg.MaxAgeSeconds > 0 {
+		head = inputs.NewMaxAgeInput(head, time.Duration(cfg.MaxAgeSeconds)*time.Second)
+	}
+
+	if cfg.Ingestion != nil {
+		queueSize := defaultIngestionQueueSize
+		if cfg.Ingestion.QueueSize > 0 {
+			queueSize = cfg.Ingestion.QueueSize
+		}
+		overflow := inputs.Overflow{Persistence: p, Size: cfg.Ingestion.OverflowSize}
+		head = inputs.NewWorkerPoolInput(head, cfg.Ingestion.Workers, queueSize, overflow)
 	}
 
+	// Reports are stamped with their ingest time before anything else, so that send latency covers
+	// the whole pipeline, including any wait for a worker.
+	head = inputs.NewIngestTimeInput(head)
+
 	// Defined metric sources.
 	var sourcesList []pipeline.Source
+	if cfg.Liveness != nil {
+		liveness := sources.NewLiveness(*cfg.Liveness, endpointSenders[cfg.Liveness.Endpoint])
+		head = liveness.Count(head)
+		sourcesList = append(sourcesList, liveness)
+	}
 	for _, src := range cfg.Sources {
 		if src.Heartbeat != nil {
 			sourcesList = append(sourcesList, sources.NewHeartbeat(*src.Heartbeat, head))
 		}
+		if src.FileTail != nil {
+			sourcesList = append(sourcesList, sources.NewFileTail(src.Name, *src.FileTail, head, p))
+		}
 	}
 
 	cb := func() error {
@@ -89,28 +392,79 @@ func Build(cfg *config.Config, p persistence.Persistence, r stats.Recorder) (pip
 		return err.ErrorOrNil()
 	}
 
-	return inputs.NewCallbackInput(head, cb), nil
+	return newShutdownInput(inputs.NewCallbackInput(head, cb), drainers, cfg.Shutdown, o.shutdownStatus), nil
 }
 
-func createEndpoints(config *config.Config, agentId string) ([]pipeline.Endpoint, error) {
+// metricUnits maps the name of each of cfg's metrics to its unit. Every metric is listed, including
+// those without a unit, so that a report is matched to the same definition that the selector does.
+func metricUnits(cfg *config.Config) map[string]string {
+	units := make(map[string]string)
+	for _, metric := range cfg.Metrics {
+		units[metric.Name] = metric.Unit
+	}
+	return units
+}
+
+func createEndpoints(config *config.Config, agentId string, dryRun bool, httpClient *http.Client) ([]pipeline.Endpoint, error) {
 	var eps []pipeline.Endpoint
 	for _, cfgep := range config.Endpoints {
-		ep, err := createEndpoint(config, &cfgep, agentId)
-		if err != nil {
-			// TODO(volkman): close already-created endpoints in event of error?
-			return nil, err
+		var ep pipeline.Endpoint
+		if dryRun {
+			ep = endpoints.NewLoggingEndpoint(cfgep.Name)
+		} else {
+			var err error
+			ep, err = createEndpoint(config, &cfgep, &cfgep, agentId, httpClient)
+			if err != nil {
+				// TODO(volkman): close already-created endpoints in event of error?
+				return nil, err
+			}
+			if err := checkHealth(ep, config.HealthCheck); err != nil {
+				return nil, err
+			}
+		}
+		// Redaction and prefixing also apply in dry run mode, so that logged reports match what would
+		// be sent.
+		if len(cfgep.AllowedLabels) > 0 || len(cfgep.RedactedLabels) > 0 {
+			ep = endpoints.NewRedactingEndpoint(ep, cfgep.AllowedLabels, cfgep.RedactedLabels)
+		}
+		if cfgep.MetricPrefix != "" {
+			ep = endpoints.NewPrefixingEndpoint(ep, cfgep.MetricPrefix)
 		}
 		eps = append(eps, ep)
 	}
 	return eps, nil
 }
 
-func createEndpoint(config *config.Config, cfgep *config.Endpoint, agentId string) (pipeline.Endpoint, error) {
+// createEndpoint creates the endpoint configured by cfgep, wrapped to apply its status code
+// overrides. Metrics are routed to it under the name of route, which is cfgep itself unless cfgep is
+// a member of a failover group. HTTP-based endpoints send with httpClient, if it isn't nil.
+func createEndpoint(config *config.Config, cfgep, route *config.Endpoint, agentId string, httpClient *http.Client) (pipeline.Endpoint, error) {
+	ep, err := createBaseEndpoint(config, cfgep, route, agentId, httpClient)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfgep.TransientStatusCodes) > 0 || len(cfgep.PermanentStatusCodes) > 0 {
+		classifier := endpoints.NewStatusCodeClassifier(cfgep.TransientStatusCodes, cfgep.PermanentStatusCodes)
+		ep = endpoints.NewClassifyingEndpoint(ep, classifier)
+	}
+	return ep, nil
+}
+
+func createBaseEndpoint(config *config.Config, cfgep, route *config.Endpoint, agentId string, httpClient *http.Client) (pipeline.Endpoint, error) {
+	if cfgep.Disk != nil && cfgep.Disk.Format == "csv" {
+		return endpoints.NewCSVDiskEndpoint(
+			cfgep.Name,
+			cfgep.Disk.ReportDir,
+			time.Duration(cfgep.Disk.ExpireSeconds)*time.Second,
+			cfgep.Disk.Columns,
+		), nil
+	}
 	if cfgep.Disk != nil {
 		return endpoints.NewDiskEndpoint(
 			cfgep.Name,
 			cfgep.Disk.ReportDir,
 			time.Duration(cfgep.Disk.ExpireSeconds)*time.Second,
+			cfgep.Disk.TimeFormat,
 		), nil
 	}
 	if cfgep.ServiceControl != nil {
@@ -120,8 +474,142 @@ func createEndpoint(config *config.Config, cfgep *config.Endpoint, agentId strin
 			agentId,
 			cfgep.ServiceControl.ConsumerId,
 			config.Identities.Get(cfgep.ServiceControl.Identity).GCP.GetServiceAccountKey(),
+			transportOptions(cfgep, httpClient),
+		)
+	}
+	if cfgep.WebSocket != nil {
+		return endpoints.NewWebSocketEndpoint(
+			cfgep.Name,
+			cfgep.WebSocket.Address,
+			cfgep.WebSocket.Token,
+			cfgep.WebSocket.BufferSize,
+			cfgep.WebSocket.SlowClient,
+			cfgep.WebSocket.TimeFormat,
 		)
 	}
+	if cfgep.Prometheus != nil {
+		return endpoints.NewPrometheusEndpoint(
+			cfgep.Name,
+			cfgep.Prometheus.Address,
+			time.Duration(cfgep.Prometheus.ExpireSeconds)*time.Second,
+			metricUnits(config),
+		)
+	}
+	if cfgep.Forward != nil {
+		return endpoints.NewForwardEndpoint(cfgep.Name, cfgep.Forward.URL, cfgep.Forward.Compression == "gzip", transportOptions(cfgep, httpClient)), nil
+	}
+	if cfgep.Datadog != nil {
+		return endpoints.NewDatadogEndpoint(
+			cfgep.Name,
+			cfgep.Datadog.APIKey,
+			cfgep.Datadog.Site,
+			cfgep.Datadog.BatchSize,
+			datadogKinds(config, route),
+			transportOptions(cfgep, httpClient),
+		), nil
+	}
+	if cfgep.Failover != nil {
+		var members []pipeline.Endpoint
+		for i := range cfgep.Failover.Endpoints {
+			member, err := createEndpoint(config, &cfgep.Failover.Endpoints[i], route, agentId, httpClient)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, member)
+		}
+		cooldown := defaultFailoverCooldown
+		if cfgep.Failover.CooldownSeconds > 0 {
+			cooldown = time.Duration(cfgep.Failover.CooldownSeconds) * time.Second
+		}
+		return endpoints.NewFailoverEndpoint(cfgep.Name, members, cooldown), nil
+	}
 	// TODO(volkman): support pubsub
 	return nil, errors.New("unsupported endpoint")
 }
+
+// checkHealth probes ep if health checks are configured and ep is a pipeline.Prober. A failed probe
+// is returned as an error unless the health check's policy is to continue.
+func checkHealth(ep pipeline.Endpoint, hc *config.HealthCheck) error {
+	prober, ok := ep.(pipeline.Prober)
+	if hc == nil || !ok {
+		return nil
+	}
+	timeout := defaultHealthCheckTimeout
+	if hc.TimeoutSeconds > 0 {
+		timeout = time.Duration(hc.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := prober.Probe(ctx); err != nil {
+		if hc.OnFailure == config.HealthCheckContinue {
+			glog.Warningf("endpoint %v: health check failed; continuing: %+v", ep.Name(), err)
+			return nil
+		}
+		return fmt.Errorf("endpoint %v: health check failed: %v", ep.Name(), err)
+	}
+	return nil
+}
+
+// datadogKinds returns the Datadog series type for each metric sent to cfgep: counts for aggregated
+// metrics, and gauges for passthrough metrics and aggregated rates.
+func datadogKinds(config *config.Config, cfgep *config.Endpoint) map[string]string {
+	kinds := make(map[string]string)
+	for _, metric := range config.Metrics {
+		for _, me := range metric.Endpoints {
+			if me.Name != cfgep.Name {
+				continue
+			}
+			// The endpoint sees metric names with its prefix, if any. Rates are gauges.
+			name := cfgep.MetricPrefix + metric.Name
+			var rate string
+			if metric.Aggregation != nil {
+				rate = metric.Aggregation.Rate
+			}
+			if metric.Passthrough != nil || rate == inputs.RateReplace {
+				kinds[name] = endpoints.DatadogGauge
+			} else {
+				kinds[name] = endpoints.DatadogCount
+			}
+			if rate == inputs.RateAdd {
+				kinds[name+inputs.RateSuffix] = endpoints.DatadogGauge
+			}
+		}
+	}
+	return kinds
+}
+
+func retrySettings(cfgep *config.Endpoint) senders.RetrySettings {
+	if cfgep.Retry == nil {
+		return senders.RetrySettings{}
+	}
+	return senders.RetrySettings{
+		MinDelay:     time.Duration(cfgep.Retry.MinDelaySeconds) * time.Second,
+		MaxDelay:     time.Duration(cfgep.Retry.MaxDelaySeconds) * time.Second,
+		MaxQueueTime: time.Duration(cfgep.Retry.MaxQueueSeconds) * time.Second,
+		MaxQueueSize: cfgep.Retry.MaxQueueSize,
+	}
+}
+
+func batchSettings(cfgep *config.Endpoint) senders.BatchSettings {
+	if cfgep.Batch == nil {
+		return senders.BatchSettings{}
+	}
+	return senders.BatchSettings{
+		Delay:   time.Duration(cfgep.Batch.FlushIntervalMillis) * time.Millisecond,
+		MaxSize: cfgep.Batch.MaxSize,
+	}
+}
+
+func transportOptions(cfgep *config.Endpoint, httpClient *http.Client) endpoints.TransportOptions {
+	if httpClient != nil {
+		return endpoints.TransportOptions{Client: httpClient}
+	}
+	if cfgep.Transport == nil {
+		return endpoints.TransportOptions{}
+	}
+	return endpoints.TransportOptions{
+		MaxIdleConns:    cfgep.Transport.MaxIdleConns,
+		IdleConnTimeout: time.Duration(cfgep.Transport.IdleTimeoutSeconds) * time.Second,
+		MaxConnsPerHost: cfgep.Transport.MaxConnsPerHost,
+	}
+}
@@ -15,15 +15,27 @@
 package builder
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/config"
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/endpoints"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/inputs"
 	"github.com/GoogleCloudPlatform/ubbagent/stats"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
 )
 
 // TestBuild tests that a Pipeline can be created and shutdown successfully.
@@ -96,3 +108,899 @@ func TestBuild(t *testing.T) {
 
 	a.Release()
 }
+
+// TestBuild_ImportState tests that imported state is applied once, so that an agent can be restarted
+// with the same state to import, and that it can't replace other state.
+func TestBuild_ImportState(t *testing.T) {
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 10,
+				},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "on_disk"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "on_disk",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     "/unused",
+					ExpireSeconds: 3600,
+				},
+			},
+		},
+	}
+	source := persistence.NewMemoryPersistence()
+	a, err := Build(cfg, source, stats.NewNoopRecorder(), WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	a.Release()
+	state, err := ExportState(source)
+	if err != nil {
+		t.Fatalf("unexpected error exporting state: %+v", err)
+	}
+
+	p := persistence.NewMemoryPersistence()
+	for i := 0; i < 2; i++ {
+		a, err := Build(cfg, p, stats.NewNoopRecorder(), WithDryRun(), WithState(state))
+		if err != nil {
+			t.Fatalf("start %v: unexpected error importing state: %+v", i, err)
+		}
+		a.Release()
+	}
+	// The record of the import isn't part of the agent's exported state.
+	if exported, err := ExportState(p); err != nil || strings.Contains(string(exported), importRecordName) {
+		t.Fatalf("exported state: expected no %v, got=%s (err: %+v)", importRecordName, exported, err)
+	}
+
+	if _, err := Build(cfg, p, stats.NewNoopRecorder(), WithDryRun(), WithState([]byte("{}"))); err == nil || !strings.Contains(err.Error(), "already has state") {
+		t.Fatalf("expected error importing different state, got: %+v", err)
+	}
+}
+
+// TestBuild_DryRun tests that a dry-run pipeline aggregates and "sends" reports without writing
+// anything to the configured endpoint.
+func TestBuild_DryRun(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	reportDir := filepath.Join(tmpdir, "reports")
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 3600,
+				},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "on_disk"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "on_disk",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     reportDir,
+					ExpireSeconds: 3600,
+				},
+			},
+		},
+	}
+
+	sr := testlib.NewMockStatsRecorder()
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), sr, WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	for i := int64(0); i < 2; i++ {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(i, 0),
+			EndTime:   time.Unix(i+1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+
+	// Releasing the pipeline flushes the aggregated report, which the stand-in endpoint handles.
+	a.Release()
+
+	if want, got := 1, len(sr.Succeeded()); want != got {
+		t.Fatalf("succeeded sends: want=%v, got=%v", want, got)
+	}
+	if got := sr.Succeeded()[0].Handler; got != "on_disk" {
+		t.Fatalf("succeeded send handler: want=on_disk, got=%v", got)
+	}
+	if _, err := os.Stat(reportDir); !os.IsNotExist(err) {
+		t.Fatalf("expected disk endpoint not to write reports, got: %+v", err)
+	}
+}
+
+// TestBuild_Persistence tests that components assigned their own state directories store their
+// state there, that the rest stays in the shared store, and that the exported state includes all of it.
+func TestBuild_Persistence(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	stateDir := filepath.Join(tmpdir, "state")
+	shared, err := persistence.NewDiskPersistence(stateDir)
+	if err != nil {
+		t.Fatalf("Unable to create disk persistence: %+v", err)
+	}
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 3600,
+				},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "on_disk"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "on_disk",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     filepath.Join(tmpdir, "reports"),
+					ExpireSeconds: 3600,
+				},
+			},
+		},
+		Persistence: &config.Persistence{
+			Aggregation: filepath.Join(tmpdir, "aggregation"),
+			Queues:      filepath.Join(tmpdir, "queues"),
+		},
+	}
+
+	p, err := NewPersistence(cfg, shared)
+	if err != nil {
+		t.Fatalf("unexpected error creating persistence: %+v", err)
+	}
+	a, err := Build(cfg, p, stats.NewNoopRecorder())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	if err := a.AddReport(metrics.MetricReport{
+		Name:      "int-metric",
+		StartTime: time.Unix(0, 0),
+		EndTime:   time.Unix(1, 0),
+		Value: metrics.MetricValue{
+			Int64Value: 10,
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error adding report: %+v", err)
+	}
+	a.Release()
+
+	exported, err := p.Export()
+	if err != nil {
+		t.Fatalf("unexpected error exporting state: %+v", err)
+	}
+	if want, got := []string{"agentid", "aggregator/int-metric", "sentids/on_disk", "stateversion"}, names(exported); !reflect.DeepEqual(want, got) {
+		t.Fatalf("exported state: want=%v, got=%v", want, got)
+	}
+	// Each store holds only its own components' state.
+	for _, s := range []struct {
+		dir  string
+		want []string
+	}{
+		{stateDir, []string{"agentid", "stateversion"}},
+		{cfg.Persistence.Aggregation, []string{"aggregator/int-metric", "stateversion"}},
+		{cfg.Persistence.Queues, []string{"sentids/on_disk", "stateversion"}},
+	} {
+		store, err := persistence.NewDiskPersistence(s.dir)
+		if err != nil {
+			t.Fatalf("Unable to open disk persistence: %+v", err)
+		}
+		state, err := store.Export()
+		if err != nil {
+			t.Fatalf("%v: unexpected error exporting state: %+v", s.dir, err)
+		}
+		if got := names(state); !reflect.DeepEqual(s.want, got) {
+			t.Fatalf("%v: stored state: want=%v, got=%v", s.dir, s.want, got)
+		}
+	}
+}
+
+// names returns the sorted names in state.
+func names(state map[string]json.RawMessage) []string {
+	var names []string
+	for name := range state {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestBuild_Sampling tests that a sampled metric's reports are sampled once for all of its
+// endpoints: each sampled-in report reaches every endpoint, raw or not, and each sampled-out report
+// reaches none.
+func TestBuild_Sampling(t *testing.T) {
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Passthrough: &config.Passthrough{},
+				Sampling:    &config.Sampling{Rate: 0.5},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "disk1"},
+					{Name: "disk2"},
+					{Name: "archive", Raw: true},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{Name: "disk1", Disk: &config.DiskEndpoint{ReportDir: "/unused", ExpireSeconds: 3600}},
+			{Name: "disk2", Disk: &config.DiskEndpoint{ReportDir: "/unused", ExpireSeconds: 3600}},
+			{Name: "archive", Disk: &config.DiskEndpoint{ReportDir: "/unused", ExpireSeconds: 3600}},
+		},
+	}
+
+	sr := testlib.NewMockStatsRecorder()
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), sr, WithDryRun())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	const added = 40
+	for i := 0; i < added; i++ {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Labels:    map[string]string{"tenant": fmt.Sprintf("tenant-%v", i)},
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+	a.Release()
+
+	// The non-raw endpoints receive the same reports, with the same IDs, from a single dispatch.
+	ids := make(map[string][]string)
+	for _, e := range sr.Succeeded() {
+		ids[e.Handler] = append(ids[e.Handler], e.Id)
+	}
+	for _, handler := range []string{"disk1", "disk2", "archive"} {
+		sort.Strings(ids[handler])
+	}
+	sampled := len(ids["disk1"])
+	if sampled == 0 || sampled == added {
+		t.Fatalf("sampled reports: expected some but not all of %v, got %v", added, sampled)
+	}
+	if !reflect.DeepEqual(ids["disk1"], ids["disk2"]) {
+		t.Fatalf("expected disk1 and disk2 to receive the same reports: %v, %v", ids["disk1"], ids["disk2"])
+	}
+	if got := len(ids["archive"]); got != sampled {
+		t.Fatalf("raw endpoint reports: want=%v, got=%v", sampled, got)
+	}
+}
+
+// TestBuild_RawEndpoints tests that raw endpoints receive each report as it's added, while the
+// metric's other endpoints receive only its aggregates.
+func TestBuild_RawEndpoints(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	archiveDir := filepath.Join(tmpdir, "archive")
+	billingDir := filepath.Join(tmpdir, "billing")
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 3600,
+				},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "archive", Raw: true},
+					{Name: "billing"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "archive",
+				Disk: &config.DiskEndpoint{ReportDir: archiveDir, ExpireSeconds: 3600},
+			},
+			{
+				Name: "billing",
+				Disk: &config.DiskEndpoint{ReportDir: billingDir, ExpireSeconds: 3600},
+			},
+		},
+	}
+
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	for i := int64(0); i < 3; i++ {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(i, 0),
+			EndTime:   time.Unix(i+1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+
+	// Releasing the pipeline flushes the aggregated report.
+	a.Release()
+
+	readReports := func(dir string) (values []int64) {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("reading %v: %+v", dir, err)
+		}
+		for _, f := range files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				t.Fatalf("reading %v: %+v", f.Name(), err)
+			}
+			var report metrics.StampedMetricReport
+			if err := json.Unmarshal(data, &report); err != nil {
+				t.Fatalf("decoding %v: %+v", f.Name(), err)
+			}
+			values = append(values, report.Value.Int64Value)
+		}
+		return
+	}
+	if want, got := []int64{10, 10, 10}, readReports(archiveDir); !reflect.DeepEqual(want, got) {
+		t.Fatalf("archived values: want=%v, got=%v", want, got)
+	}
+	if want, got := []int64{30}, readReports(billingDir); !reflect.DeepEqual(want, got) {
+		t.Fatalf("billed values: want=%v, got=%v", want, got)
+	}
+}
+
+// TestBuild_Precision tests that the double values of flushed aggregates are rounded to the metric's
+// precision.
+func TestBuild_Precision(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+	reportDir := filepath.Join(tmpdir, "reports")
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "double-metric",
+					Type: "double",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 3600,
+				},
+				Precision: &config.Precision{Decimals: 2, Rounding: "nearest"},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "on_disk"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "on_disk",
+				Disk: &config.DiskEndpoint{ReportDir: reportDir, ExpireSeconds: 3600},
+			},
+		},
+	}
+
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	// The sum of these values isn't exactly 0.6.
+	for i, v := range []float64{0.1, 0.2, 0.3} {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "double-metric",
+			StartTime: time.Unix(int64(i), 0),
+			EndTime:   time.Unix(int64(i)+1, 0),
+			Value: metrics.MetricValue{
+				DoubleValue: v,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+
+	// Releasing the pipeline flushes the aggregated report.
+	a.Release()
+
+	files, err := ioutil.ReadDir(reportDir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one report in %v, got: %v (%v)", reportDir, len(files), err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(reportDir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("reading report: %+v", err)
+	}
+	var report metrics.StampedMetricReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("decoding report: %+v", err)
+	}
+	if want, got := 0.6, report.Value.DoubleValue; want != got {
+		t.Fatalf("flushed value: want=%v, got=%v", want, got)
+	}
+}
+
+// TestBuild_Publisher tests that aggregated reports are published to subscribers when flushed.
+func TestBuild_Publisher(t *testing.T) {
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 3600,
+				},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "on_disk"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "on_disk",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     "/unused",
+					ExpireSeconds: 3600,
+				},
+			},
+		},
+	}
+
+	publisher := inputs.NewPublisher(10)
+	sub1, _ := publisher.Subscribe()
+	sub2, _ := publisher.Subscribe()
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), stats.NewNoopRecorder(), WithDryRun(), WithPublisher(publisher))
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	for i := int64(0); i < 2; i++ {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(i, 0),
+			EndTime:   time.Unix(i+1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+	a.Release()
+	publisher.Close()
+
+	for _, sub := range []<-chan metrics.MetricReport{sub1, sub2} {
+		var received []metrics.MetricReport
+		for r := range sub {
+			received = append(received, r)
+		}
+		if len(received) != 1 || received[0].Value.Int64Value != 20 {
+			t.Fatalf("expected a single aggregated report with value 20, got: %+v", received)
+		}
+	}
+}
+
+// TestBuild_Redaction tests that endpoints receive differently-redacted copies of the same
+// aggregated reports.
+func TestBuild_Redaction(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 3600,
+				},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "billing"},
+					{Name: "analytics"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "billing",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     filepath.Join(tmpdir, "billing"),
+					ExpireSeconds: 3600,
+				},
+			},
+			{
+				Name: "analytics",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     filepath.Join(tmpdir, "analytics"),
+					ExpireSeconds: 3600,
+				},
+				RedactedLabels: []string{"user"},
+			},
+		},
+	}
+
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	for _, user := range []string{"alice", "bob"} {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Labels:    map[string]string{"tenant": "a", "user": user},
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+	a.Release()
+
+	// Both endpoints receive a report per user, since redaction doesn't affect aggregation, but only
+	// the billing endpoint sees the user label.
+	for _, ep := range []struct {
+		name  string
+		users []string
+	}{
+		{"billing", []string{"alice", "bob"}},
+		{"analytics", []string{"", ""}},
+	} {
+		reports, err := endpoints.LoadDiskReports(filepath.Join(tmpdir, ep.name), "")
+		if err != nil {
+			t.Fatalf("unexpected error loading %v reports: %+v", ep.name, err)
+		}
+		var users []string
+		for _, r := range reports {
+			if r.Labels["tenant"] != "a" || r.Value.Int64Value != 10 {
+				t.Fatalf("%v: unexpected report: %+v", ep.name, r)
+			}
+			users = append(users, r.Labels["user"])
+		}
+		sort.Strings(users)
+		if !reflect.DeepEqual(ep.users, users) {
+			t.Fatalf("%v users: want=%v, got=%v", ep.name, ep.users, users)
+		}
+	}
+}
+
+// TestBuild_MetricPrefix tests that an endpoint with a metric prefix receives prefixed metric names,
+// while aggregation uses the original names.
+func TestBuild_MetricPrefix(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Aggregation: &config.Aggregation{
+					BufferSeconds: 3600,
+				},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "local"},
+					{Name: "shared"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "local",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     filepath.Join(tmpdir, "local"),
+					ExpireSeconds: 3600,
+				},
+			},
+			{
+				Name: "shared",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     filepath.Join(tmpdir, "shared"),
+					ExpireSeconds: 3600,
+				},
+				MetricPrefix: "teamA/",
+			},
+		},
+	}
+
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(int64(i), 0),
+			EndTime:   time.Unix(int64(i+1), 0),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+	a.Release()
+
+	// Both reports are aggregated under the original name, and only the shared endpoint sees the
+	// prefix.
+	for _, ep := range []struct {
+		name       string
+		metricName string
+	}{
+		{"local", "int-metric"},
+		{"shared", "teamA/int-metric"},
+	} {
+		reports, err := endpoints.LoadDiskReports(filepath.Join(tmpdir, ep.name), "")
+		if err != nil {
+			t.Fatalf("unexpected error loading %v reports: %+v", ep.name, err)
+		}
+		if len(reports) != 1 || reports[0].Name != ep.metricName || reports[0].Value.Int64Value != 20 {
+			t.Fatalf("%v: expected a single aggregated report named %v with value 20, got: %+v", ep.name, ep.metricName, reports)
+		}
+	}
+}
+
+// TestBuild_IDGenerator tests that reports are stamped with IDs from a configured IDGenerator.
+func TestBuild_IDGenerator(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "build_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Passthrough: &config.Passthrough{},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "on_disk"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name: "on_disk",
+				Disk: &config.DiskEndpoint{
+					ReportDir:     tmpdir,
+					ExpireSeconds: 3600,
+				},
+			},
+		},
+	}
+
+	ids := metrics.IDGeneratorFunc(func(mr metrics.MetricReport) string {
+		return fmt.Sprintf("r%v-%v", mr.StartTime.Unix(), mr.Name)
+	})
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), stats.NewNoopRecorder(), WithIDGenerator(ids))
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	for i := int64(0); i < 2; i++ {
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(i, 0),
+			EndTime:   time.Unix(i+1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+	}
+	a.Release()
+
+	reports, err := endpoints.LoadDiskReports(tmpdir, "")
+	if err != nil {
+		t.Fatalf("unexpected error loading reports: %+v", err)
+	}
+	var got []string
+	for _, r := range reports {
+		got = append(got, r.Id)
+	}
+	sort.Strings(got)
+	if want := []string{"r0-int-metric", "r1-int-metric"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("report IDs: want=%v, got=%v", want, got)
+	}
+}
+
+// TestBuild_HealthCheck tests that a failed endpoint health check fails the build, or is ignored,
+// according to the configured policy.
+func TestBuild_HealthCheck(t *testing.T) {
+	healthy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	newConfig := func(hc *config.HealthCheck) *config.Config {
+		return &config.Config{
+			Metrics: config.Metrics{
+				{
+					Definition: metrics.Definition{
+						Name: "int-metric",
+						Type: "int",
+					},
+					Passthrough: &config.Passthrough{},
+					Endpoints: []config.MetricEndpoint{
+						{Name: "hub"},
+					},
+				},
+			},
+			Endpoints: []config.Endpoint{
+				{
+					Name:    "hub",
+					Forward: &config.ForwardEndpoint{URL: srv.URL},
+				},
+			},
+			HealthCheck: hc,
+		}
+	}
+
+	t.Run("Healthy endpoint", func(t *testing.T) {
+		healthy = true
+		a, err := Build(newConfig(&config.HealthCheck{}), persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+		if err != nil {
+			t.Fatalf("unexpected error creating App: %+v", err)
+		}
+		a.Release()
+	})
+
+	t.Run("Failing probe fails fast", func(t *testing.T) {
+		healthy = false
+		_, err := Build(newConfig(&config.HealthCheck{OnFailure: config.HealthCheckFail}), persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+		if err == nil || !strings.Contains(err.Error(), "endpoint hub: health check failed") {
+			t.Fatalf("expected health check error, got: %+v", err)
+		}
+	})
+
+	t.Run("Failing probe with continue policy", func(t *testing.T) {
+		healthy = false
+		a, err := Build(newConfig(&config.HealthCheck{OnFailure: config.HealthCheckContinue}), persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+		if err != nil {
+			t.Fatalf("unexpected error creating App: %+v", err)
+		}
+		a.Release()
+	})
+
+	t.Run("No health check configured", func(t *testing.T) {
+		healthy = false
+		a, err := Build(newConfig(nil), persistence.NewMemoryPersistence(), stats.NewNoopRecorder())
+		if err != nil {
+			t.Fatalf("unexpected error creating App: %+v", err)
+		}
+		a.Release()
+	})
+}
+
+// recordingTransport is an http.RoundTripper that records the path of each request it sends.
+type recordingTransport struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.paths = append(rt.paths, req.URL.Path)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (rt *recordingTransport) recorded() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return append([]string(nil), rt.paths...)
+}
+
+// TestBuild_HTTPClient tests that HTTP-based endpoints send with a client given by WithHTTPClient.
+func TestBuild_HTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cfg := &config.Config{
+		Metrics: config.Metrics{
+			{
+				Definition: metrics.Definition{
+					Name: "int-metric",
+					Type: "int",
+				},
+				Passthrough: &config.Passthrough{},
+				Endpoints: []config.MetricEndpoint{
+					{Name: "hub"},
+				},
+			},
+		},
+		Endpoints: []config.Endpoint{
+			{
+				Name:      "hub",
+				Forward:   &config.ForwardEndpoint{URL: srv.URL},
+				Transport: &config.Transport{MaxIdleConns: 1},
+			},
+		},
+	}
+
+	rt := &recordingTransport{}
+	sr := testlib.NewMockStatsRecorder()
+	a, err := Build(cfg, persistence.NewMemoryPersistence(), sr, WithHTTPClient(&http.Client{Transport: rt}))
+	if err != nil {
+		t.Fatalf("unexpected error creating App: %+v", err)
+	}
+	if err := a.AddReport(metrics.MetricReport{
+		Name:      "int-metric",
+		StartTime: time.Unix(0, 0),
+		EndTime:   time.Unix(1, 0),
+		Value: metrics.MetricValue{
+			Int64Value: 10,
+		},
+	}); err != nil {
+		t.Fatalf("unexpected error adding report: %+v", err)
+	}
+	a.Release()
+
+	if want, got := 1, len(sr.Succeeded()); want != got {
+		t.Fatalf("succeeded sends: want=%v, got=%v", want, got)
+	}
+	if want, got := []string{"/report"}, rt.recorded(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("requests sent with the custom client: want=%v, got=%v", want, got)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/hashicorp/go-multierror"
+)
+
+// CheckEndpoints constructs each of cfg's endpoints, as Build does, and releases it, returning the
+// errors of those that can't be constructed, such as those with invalid credentials. cfg must have
+// been validated. Health checks are skipped and nothing is sent. WebSocket and Prometheus endpoints
+// aren't constructed, since that listens on their address; the address is only resolved.
+func CheckEndpoints(cfg *config.Config) error {
+	var err *multierror.Error
+	for i := range cfg.Endpoints {
+		err = multierror.Append(err, checkEndpoint(cfg, &cfg.Endpoints[i]))
+	}
+	return err.ErrorOrNil()
+}
+
+func checkEndpoint(cfg *config.Config, cfgep *config.Endpoint) error {
+	if cfgep.Failover != nil {
+		var err *multierror.Error
+		for i := range cfgep.Failover.Endpoints {
+			err = multierror.Append(err, checkEndpoint(cfg, &cfgep.Failover.Endpoints[i]))
+		}
+		return err.ErrorOrNil()
+	}
+	var address string
+	if cfgep.WebSocket != nil {
+		address = cfgep.WebSocket.Address
+	} else if cfgep.Prometheus != nil {
+		address = cfgep.Prometheus.Address
+	}
+	if address != "" {
+		if _, err := net.ResolveTCPAddr("tcp", address); err != nil {
+			return fmt.Errorf("endpoint %v: %v", cfgep.Name, err)
+		}
+		return nil
+	}
+	ep, err := createEndpoint(cfg, cfgep, cfgep, "", nil)
+	if err != nil {
+		return fmt.Errorf("endpoint %v: %v", cfgep.Name, err)
+	}
+	return ep.Release()
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/stats"
+	"github.com/golang/glog"
+	"github.com/hashicorp/go-multierror"
+)
+
+// drainer is a sender whose queued reports can be drained before it's released. See
+// senders.RetryingSender.Drain.
+type drainer interface {
+	pipeline.Component
+	Drain(timeout time.Duration) error
+	Endpoints() []string
+}
+
+// ShutdownResult describes what a pipeline's shutdown did.
+type ShutdownResult struct {
+	// The number of aggregated buckets, one per aggregated metric with reports, flushed when the
+	// pipeline was released, and the number of reports they held.
+	FlushedBuckets int `json:"flushedBuckets"`
+	FlushedReports int `json:"flushedReports"`
+
+	// The number of reports sent to endpoints during the shutdown.
+	Drained int `json:"drained"`
+
+	// The number of reports that endpoints failed to send during the shutdown, or dropped as stale.
+	// Failed reports aren't retried, but may have been quarantined.
+	Dropped int `json:"dropped"`
+
+	// The components that failed, or didn't finish before their phase's timeout, in the order
+	// they were detected.
+	Failures []ShutdownFailure `json:"failures,omitempty"`
+}
+
+// Clean returns true if every component shut down successfully.
+func (r ShutdownResult) Clean() bool {
+	return len(r.Failures) == 0
+}
+
+// ShutdownFailure describes a component that failed during a phase of the shutdown: "flush" (for
+// the pipeline's inputs), "drain", or "close" (for an endpoint's sender).
+type ShutdownFailure struct {
+	Phase     string `json:"phase"`
+	Component string `json:"component"`
+	Error     string `json:"error"`
+}
+
+// ShutdownStatus records the shutdown of a pipeline built using WithShutdownStatus.
+type ShutdownStatus struct {
+	mu           sync.Mutex
+	shuttingDown bool
+	result       ShutdownResult
+}
+
+// NewShutdownStatus creates a new ShutdownStatus.
+func NewShutdownStatus() *ShutdownStatus {
+	return &ShutdownStatus{}
+}
+
+// Result returns what the shutdown has done so far. It's complete once the pipeline's Release has
+// returned.
+func (s *ShutdownStatus) Result() ShutdownResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := s.result
+	result.Failures = append([]ShutdownFailure(nil), s.result.Failures...)
+	return result
+}
+
+func (s *ShutdownStatus) begin() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+}
+
+// update applies f to the result if the shutdown has begun.
+func (s *ShutdownStatus) update(f func(r *ShutdownResult)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.shuttingDown {
+		f(&s.result)
+	}
+	s.mu.Unlock()
+}
+
+func (s *ShutdownStatus) fail(phase, component string, err error) {
+	s.update(func(r *ShutdownResult) {
+		r.Failures = append(r.Failures, ShutdownFailure{Phase: phase, Component: component, Error: err.Error()})
+	})
+}
+
+// recorder returns a stats.Recorder that counts the sends that r records during the shutdown.
+func (s *ShutdownStatus) recorder(r stats.Recorder) stats.Recorder {
+	if s == nil {
+		return r
+	}
+	return &shutdownRecorder{Recorder: r, status: s}
+}
+
+// flushInput returns an Input that counts the reports that an Aggregator flushes into delegate
+// during the shutdown.
+func (s *ShutdownStatus) flushInput(delegate pipeline.Input) pipeline.Input {
+	if s == nil {
+		return delegate
+	}
+	return &flushCountingInput{Component: delegate, delegate: delegate, status: s}
+}
+
+type shutdownRecorder struct {
+	stats.Recorder
+	status *ShutdownStatus
+}
+
+func (r *shutdownRecorder) SendSucceeded(id string, handler string) {
+	r.status.update(func(r *ShutdownResult) { r.Drained++ })
+	r.Recorder.SendSucceeded(id, handler)
+}
+
+func (r *shutdownRecorder) SendFailed(id string, handler string) {
+	r.status.update(func(r *ShutdownResult) { r.Dropped++ })
+	r.Recorder.SendFailed(id, handler)
+}
+
+func (r *shutdownRecorder) SendStale(id string, handler string) {
+	r.status.update(func(r *ShutdownResult) { r.Dropped++ })
+	r.Recorder.SendStale(id, handler)
+}
+
+// flushCountingInput counts a bucket when the first of its reports is added during the shutdown.
+// An Aggregator flushes a single bucket when it's released.
+type flushCountingInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	status   *ShutdownStatus
+	counted  bool
+}
+
+func (i *flushCountingInput) AddReport(report metrics.MetricReport) error {
+	i.status.update(func(r *ShutdownResult) {
+		if !i.counted {
+			r.FlushedBuckets++
+			i.counted = true
+		}
+		r.FlushedReports++
+	})
+	return i.delegate.AddReport(report)
+}
+
+// shutdownInput is the head of a built pipeline. Releasing it shuts the pipeline down in phases,
+// each of which completes before the next begins:
+//
+//  1. Flush: the pipeline's sources are stopped and its inputs released, flushing aggregated
+//     reports into the senders' queues. The senders are held, so they aren't released yet.
+//  2. Drain: the senders send their queued reports, if a drain timeout is configured.
+//  3. Close: the senders are released, closing their endpoints.
+//
+// A phase that times out adds an error, but the later phases still run, and what the earlier
+// phases delivered stays delivered.
+type shutdownInput struct {
+	pipeline.Input
+	senders      []drainer
+	status       *ShutdownStatus
+	flushTimeout time.Duration
+	drainTimeout time.Duration
+	closeTimeout time.Duration
+	tracker      pipeline.UsageTracker
+}
+
+func newShutdownInput(head pipeline.Input, senders []drainer, cfg *config.Shutdown, status *ShutdownStatus) *shutdownInput {
+	head.Use()
+	for _, s := range senders {
+		s.Use()
+	}
+	si := &shutdownInput{Input: head, senders: senders, status: status}
+	if cfg != nil {
+		si.flushTimeout = time.Duration(cfg.FlushTimeoutSeconds) * time.Second
+		si.drainTimeout = time.Duration(cfg.DrainTimeoutSeconds) * time.Second
+		si.closeTimeout = time.Duration(cfg.CloseTimeoutSeconds) * time.Second
+	}
+	return si
+}
+
+func (si *shutdownInput) Use() {
+	si.tracker.Use()
+}
+
+func (si *shutdownInput) Release() error {
+	return si.tracker.Release(func() error {
+		si.status.begin()
+		var err *multierror.Error
+		if ferr := runPhase("flush", si.flushTimeout, si.Input.Release); ferr != nil {
+			si.status.fail("flush", "pipeline", ferr)
+			err = multierror.Append(err, ferr)
+		}
+		if si.drainTimeout > 0 {
+			drain := func(s drainer) error { return s.Drain(si.drainTimeout) }
+			if derr := si.runSenders("drain", si.drainTimeout, drain); derr != nil {
+				err = multierror.Append(err, derr)
+			}
+		}
+		release := func(s drainer) error { return s.Release() }
+		if cerr := si.runSenders("close", si.closeTimeout, release); cerr != nil {
+			err = multierror.Append(err, cerr)
+		}
+		return err.ErrorOrNil()
+	})
+}
+
+// runSenders runs a shutdown phase that applies f to every sender in parallel, returning their
+// errors, or an error if they don't all complete within timeout. A timeout of 0 waits indefinitely.
+// Each sender that fails or is still running at the timeout is recorded as a failure; those still
+// running keep running in the background.
+func (si *shutdownInput) runSenders(phase string, timeout time.Duration, f func(drainer) error) error {
+	glog.V(2).Infof("shutdown: %v phase starting", phase)
+	type result struct {
+		index int
+		err   error
+	}
+	results := make(chan result, len(si.senders))
+	for i, s := range si.senders {
+		go func(i int, s drainer) {
+			results <- result{i, f(s)}
+		}(i, s)
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	done := make([]bool, len(si.senders))
+	var err *multierror.Error
+	for remaining := len(si.senders); remaining > 0; remaining-- {
+		select {
+		case r := <-results:
+			done[r.index] = true
+			if r.err != nil {
+				si.status.fail(phase, senderName(si.senders[r.index]), r.err)
+				err = multierror.Append(err, r.err)
+			}
+		case <-expired:
+			glog.Warningf("shutdown: %v phase timed out after %v", phase, timeout)
+			terr := fmt.Errorf("shutdown: %v phase timed out after %v", phase, timeout)
+			for i, s := range si.senders {
+				if !done[i] {
+					si.status.fail(phase, senderName(s), terr)
+				}
+			}
+			return multierror.Append(err, terr).ErrorOrNil()
+		}
+	}
+	return err.ErrorOrNil()
+}
+
+func senderName(s drainer) string {
+	return strings.Join(s.Endpoints(), ",")
+}
+
+// runPhase runs a shutdown phase, returning its error, or an error if it doesn't complete within
+// timeout. A timeout of 0 waits indefinitely. A phase that times out keeps running in the
+// background.
+func runPhase(name string, timeout time.Duration, phase func() error) error {
+	glog.V(2).Infof("shutdown: %v phase starting", name)
+	if timeout <= 0 {
+		return phase()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- phase()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		glog.Warningf("shutdown: %v phase timed out after %v", name, timeout)
+		return fmt.Errorf("shutdown: %v phase timed out after %v", name, timeout)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/senders"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+// phaseLog records the shutdown steps taken by test components.
+type phaseLog struct {
+	mu    sync.Mutex
+	steps []string
+}
+
+func (l *phaseLog) add(step string) {
+	l.mu.Lock()
+	l.steps = append(l.steps, step)
+	l.mu.Unlock()
+}
+
+func (l *phaseLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.steps...)
+}
+
+// flushingInput runs flush when it's released, standing in for the aggregators of a pipeline.
+type flushingInput struct {
+	*testlib.MockInput
+	flush func()
+}
+
+func (i *flushingInput) Release() error {
+	i.flush()
+	return i.MockInput.Release()
+}
+
+type loggingDrainer struct {
+	name string
+	log  *phaseLog
+}
+
+func (d *loggingDrainer) Use() {}
+
+func (d *loggingDrainer) Release() error {
+	d.log.add("close " + d.name)
+	return nil
+}
+
+func (d *loggingDrainer) Drain(timeout time.Duration) error {
+	d.log.add("drain " + d.name)
+	return nil
+}
+
+func (d *loggingDrainer) Endpoints() []string {
+	return []string{d.name}
+}
+
+// stuckEndpoint is a batching endpoint whose Release blocks until unblocked.
+type stuckEndpoint struct {
+	*testlib.MockEndpoint
+	unblock chan struct{}
+}
+
+func (ep *stuckEndpoint) SendBatch(reports []pipeline.EndpointReport) error {
+	for _, r := range reports {
+		if err := ep.Send(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ep *stuckEndpoint) MaxBatch() int {
+	return 10
+}
+
+func (ep *stuckEndpoint) Release() error {
+	<-ep.unblock
+	return ep.MockEndpoint.Release()
+}
+
+func TestShutdownInput(t *testing.T) {
+	t.Run("phases run in order", func(t *testing.T) {
+		log := &phaseLog{}
+		head := &flushingInput{MockInput: testlib.NewMockInput(), flush: func() { log.add("flush") }}
+		drainers := []drainer{&loggingDrainer{"a", log}, &loggingDrainer{"b", log}}
+		si := newShutdownInput(head, drainers, &config.Shutdown{DrainTimeoutSeconds: 10}, nil)
+		if err := si.Release(); err != nil {
+			t.Fatalf("unexpected release error: %+v", err)
+		}
+
+		// Senders drain and close in parallel, so the order within each phase varies.
+		steps := log.get()
+		if len(steps) != 5 || steps[0] != "flush" {
+			t.Fatalf("expected a flush followed by 4 steps, got: %v", steps)
+		}
+		sort.Strings(steps[1:3])
+		sort.Strings(steps[3:5])
+		expected := []string{"flush", "drain a", "drain b", "close a", "close b"}
+		for i := range expected {
+			if steps[i] != expected[i] {
+				t.Fatalf("steps: expected %v, got %v", expected, steps)
+			}
+		}
+	})
+
+	t.Run("drain is skipped without a drain timeout", func(t *testing.T) {
+		log := &phaseLog{}
+		head := &flushingInput{MockInput: testlib.NewMockInput(), flush: func() { log.add("flush") }}
+		si := newShutdownInput(head, []drainer{&loggingDrainer{"a", log}}, nil, nil)
+		if err := si.Release(); err != nil {
+			t.Fatalf("unexpected release error: %+v", err)
+		}
+		if want, got := []string{"flush", "close a"}, log.get(); strings.Join(want, ",") != strings.Join(got, ",") {
+			t.Fatalf("steps: expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("a close timeout keeps drained reports delivered", func(t *testing.T) {
+		ep := &stuckEndpoint{MockEndpoint: testlib.NewMockEndpoint("stuck"), unblock: make(chan struct{})}
+		defer close(ep.unblock)
+		r := testlib.NewMockStatsRecorder()
+		status := NewShutdownStatus()
+		// Queued reports wait for a batch until they're drained.
+		rs := senders.NewRetryingSender(ep, persistence.NewMemoryPersistence(), status.recorder(r), nil, senders.RetrySettings{}, senders.BatchSettings{Delay: time.Hour}, nil)
+		report := metrics.MetricReport{
+			Name:      "int-metric",
+			Value:     metrics.MetricValue{Int64Value: 10},
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+		}
+		// The head stands in for an Aggregator, flushing a bucket holding the report.
+		flushed := status.flushInput(&pipeline.InputAdapter{Sender: rs})
+		head := &flushingInput{MockInput: testlib.NewMockInput(), flush: func() {
+			if err := flushed.AddReport(report); err != nil {
+				t.Errorf("unexpected send error: %+v", err)
+			}
+		}}
+		si := newShutdownInput(head, []drainer{rs}, &config.Shutdown{DrainTimeoutSeconds: 10, CloseTimeoutSeconds: 1}, status)
+
+		err := si.Release()
+		if err == nil || !strings.Contains(err.Error(), "close phase timed out") {
+			t.Fatalf("expected a close timeout, got: %+v", err)
+		}
+		if len(ep.Reports()) != 1 {
+			t.Fatalf("expected the flushed report to be drained to the endpoint")
+		}
+		if succeeded := r.Succeeded(); len(succeeded) != 1 {
+			t.Fatalf("expected the drained report to be recorded as sent, got: %v", succeeded)
+		}
+		if failed := r.Failed(); len(failed) != 0 {
+			t.Fatalf("expected no failed reports, got: %v", failed)
+		}
+		want := ShutdownResult{
+			FlushedBuckets: 1,
+			FlushedReports: 1,
+			Drained:        1,
+			Failures:       []ShutdownFailure{{Phase: "close", Component: "stuck", Error: "shutdown: close phase timed out after 1s"}},
+		}
+		if got := status.Result(); !reflect.DeepEqual(want, got) || got.Clean() {
+			t.Fatalf("shutdown result: want=%+v, got=%+v", want, got)
+		}
+	})
+
+	t.Run("a flush timeout doesn't stop later phases", func(t *testing.T) {
+		log := &phaseLog{}
+		unblock := make(chan struct{})
+		defer close(unblock)
+		head := &flushingInput{MockInput: testlib.NewMockInput(), flush: func() { <-unblock }}
+		si := newShutdownInput(head, []drainer{&loggingDrainer{"a", log}}, &config.Shutdown{FlushTimeoutSeconds: 1, DrainTimeoutSeconds: 10}, nil)
+
+		err := si.Release()
+		if err == nil || !strings.Contains(err.Error(), "flush phase timed out") {
+			t.Fatalf("expected a flush timeout, got: %+v", err)
+		}
+		if want, got := []string{"drain a", "close a"}, log.get(); strings.Join(want, ",") != strings.Join(got, ",") {
+			t.Fatalf("steps: expected %v, got %v", want, got)
+		}
+	})
+}
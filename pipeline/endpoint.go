@@ -15,7 +15,10 @@
 package pipeline
 
 import (
+	"context"
 	"encoding/json"
+	"time"
+
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 )
 
@@ -69,3 +72,32 @@ type Endpoint interface {
 	// transient error and can be retried.
 	IsTransient(error) bool
 }
+
+// Prober is implemented by Endpoints that can verify, before any reports are sent, that they're
+// able to reach their reporting service with valid credentials.
+type Prober interface {
+	// Probe checks the endpoint's connectivity and permissions, returning an error if reports
+	// are unlikely to be sent successfully.
+	Probe(ctx context.Context) error
+}
+
+// RetryAdvisor is implemented by Endpoints whose reporting service can ask for a failed send to be
+// retried no sooner than some delay, such as with a rate-limiting response's Retry-After header. An
+// Endpoint's RetryingSender waits at least that long before its next attempt.
+type RetryAdvisor interface {
+	// RetryAfter returns the delay that err, returned by Send or SendBatch, asks for before the next
+	// attempt, measured from now. The ok result is false if err doesn't ask for a delay.
+	RetryAfter(err error, now time.Time) (delay time.Duration, ok bool)
+}
+
+// Batcher is implemented by Endpoints that can send several reports in a single request. An
+// Endpoint's RetryingSender sends up to MaxBatch queued reports at a time with SendBatch.
+type Batcher interface {
+	// SendBatch sends reports, each built by BuildReport, as a unit. A returned error applies to
+	// every report in the batch.
+	SendBatch(reports []EndpointReport) error
+
+	// MaxBatch returns the largest number of reports that SendBatch accepts. A value of 1 or less
+	// disables batching.
+	MaxBatch() int
+}
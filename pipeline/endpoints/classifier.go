@@ -0,0 +1,155 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrorClassifier classifies a send error as transient (retryable) or permanent. If ok is false,
+// the classifier has no opinion about the error.
+type ErrorClassifier func(err error) (transient bool, ok bool)
+
+// NewStatusCodeClassifier returns an ErrorClassifier for HTTP errors returned by Google API
+// clients. Errors with a status code in transient are classified as transient, and those with a
+// status code in permanent are classified as permanent. Other errors are left unclassified.
+func NewStatusCodeClassifier(transient, permanent []int) ErrorClassifier {
+	return func(err error) (bool, bool) {
+		apiErr, isApiErr := err.(*googleapi.Error)
+		if !isApiErr {
+			return false, false
+		}
+		for _, code := range transient {
+			if apiErr.Code == code {
+				return true, true
+			}
+		}
+		for _, code := range permanent {
+			if apiErr.Code == code {
+				return false, true
+			}
+		}
+		return false, false
+	}
+}
+
+// isTransientHTTPError returns false for client errors, which fail the same way if retried, and true
+// for everything else: server errors, request timeouts (408), rate limiting (429), and failures to
+// reach the server at all.
+func isTransientHTTPError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		code := apiErr.Code
+		return code < 400 || code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// retryAfterHTTPError returns the delay requested by the Retry-After header of a rate-limiting (429)
+// or unavailable (503) response, as returned by googleapi.CheckResponse. The header holds either a
+// number of seconds or an HTTP date; a date in the past requests no delay.
+func retryAfterHTTPError(err error, now time.Time) (time.Duration, bool) {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok || (apiErr.Code != http.StatusTooManyRequests && apiErr.Code != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	value := strings.TrimSpace(apiErr.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+// retryAfter returns ep's RetryAfter if ep is a pipeline.RetryAdvisor, or no delay otherwise.
+func retryAfter(ep pipeline.Endpoint, err error, now time.Time) (time.Duration, bool) {
+	if a, ok := ep.(pipeline.RetryAdvisor); ok {
+		return a.RetryAfter(err, now)
+	}
+	return 0, false
+}
+
+// sendBatch sends reports with ep's SendBatch if ep is a pipeline.Batcher, or one at a time
+// otherwise. It lets wrapping endpoints forward batches to the endpoints they wrap.
+func sendBatch(ep pipeline.Endpoint, reports []pipeline.EndpointReport) error {
+	if b, ok := ep.(pipeline.Batcher); ok {
+		return b.SendBatch(reports)
+	}
+	for _, r := range reports {
+		if err := ep.Send(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxBatch returns ep's MaxBatch if ep is a pipeline.Batcher, or 1 otherwise.
+func maxBatch(ep pipeline.Endpoint) int {
+	if b, ok := ep.(pipeline.Batcher); ok {
+		return b.MaxBatch()
+	}
+	return 1
+}
+
+type classifyingEndpoint struct {
+	pipeline.Endpoint
+	classifier ErrorClassifier
+}
+
+func (ep *classifyingEndpoint) IsTransient(err error) bool {
+	if transient, ok := ep.classifier(err); ok {
+		return transient
+	}
+	return ep.Endpoint.IsTransient(err)
+}
+
+func (ep *classifyingEndpoint) SendBatch(reports []pipeline.EndpointReport) error {
+	return sendBatch(ep.Endpoint, reports)
+}
+
+func (ep *classifyingEndpoint) MaxBatch() int {
+	return maxBatch(ep.Endpoint)
+}
+
+func (ep *classifyingEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	return retryAfter(ep.Endpoint, err, now)
+}
+
+// NewClassifyingEndpoint creates an Endpoint that overrides delegate's classification of send
+// errors with the given classifier. Errors that classifier doesn't classify are passed to
+// delegate's own IsTransient.
+func NewClassifyingEndpoint(delegate pipeline.Endpoint, classifier ErrorClassifier) pipeline.Endpoint {
+	return &classifyingEndpoint{Endpoint: delegate, classifier: classifier}
+}
@@ -0,0 +1,51 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+	"google.golang.org/api/googleapi"
+)
+
+func TestClassifyingEndpoint(t *testing.T) {
+	// The mock endpoint considers every error other than "FATAL" transient.
+	ep := NewClassifyingEndpoint(testlib.NewMockEndpoint("mockep"), NewStatusCodeClassifier([]int{409}, []int{429, 503}))
+
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"overridden transient code", &googleapi.Error{Code: 409}, true},
+		{"overridden permanent code", &googleapi.Error{Code: 503}, false},
+		{"second overridden permanent code", &googleapi.Error{Code: 429}, false},
+		{"unclassified code", &googleapi.Error{Code: 500}, true},
+		{"non-status error", errors.New("FATAL"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if want, got := tt.transient, ep.IsTransient(tt.err); want != got {
+				t.Fatalf("IsTransient(%v): want=%v, got=%v", tt.err, want, got)
+			}
+		})
+	}
+
+	if want, got := "mockep", ep.Name(); want != got {
+		t.Fatalf("Name(): want=%v, got=%v", want, got)
+	}
+}
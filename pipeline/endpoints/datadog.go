@@ -0,0 +1,254 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// DatadogCount sends a metric's reports as Datadog count series. It suits aggregated metrics,
+	// whose reports sum usage over an interval.
+	DatadogCount = "count"
+
+	// DatadogGauge sends a metric's reports as Datadog gauge series. It suits passthrough metrics,
+	// whose reports are individual measurements.
+	DatadogGauge = "gauge"
+
+	defaultDatadogSite      = "datadoghq.com"
+	defaultDatadogBatchSize = 100
+	datadogSeriesPath       = "/api/v1/series"
+	datadogValidatePath     = "/api/v1/validate"
+	datadogTimeout          = 60 * time.Second
+)
+
+// DatadogEndpoint is an Endpoint that sends reports to Datadog as custom metrics. Each report becomes
+// a series named after the metric, with a point at the report's end time and a tag for each label;
+// a compound metric's report becomes a series per named value, named "<metric>.<value name>".
+// DatadogEndpoint is a pipeline.Batcher: the series of up to its batch size of queued reports are
+// sent in a single request.
+type DatadogEndpoint struct {
+	name        string
+	url         string
+	validateURL string
+	apiKey      string
+	batchSize   int
+	kinds       map[string]string
+	names       *metrics.Matcher
+	client      *http.Client
+}
+
+type datadogPayload struct {
+	Series []datadogSeries `json:"series"`
+}
+
+type datadogSeries struct {
+	Metric   string       `json:"metric"`
+	Points   [][2]float64 `json:"points"`
+	Type     string       `json:"type"`
+	Interval int64        `json:"interval,omitempty"`
+	Tags     []string     `json:"tags,omitempty"`
+}
+
+// NewDatadogEndpoint creates a new DatadogEndpoint that sends to the Datadog site (such as
+// "datadoghq.com" or "datadoghq.eu"; the former if empty) with the given API key. The kinds map
+// gives the series type, DatadogCount or DatadogGauge, for each metric name or wildcard pattern;
+// metrics without a kind are sent as counts. Up to batchSize reports (100 if 0) are sent per request.
+// Connections are reused according to transport.
+func NewDatadogEndpoint(name, apiKey, site string, batchSize int, kinds map[string]string, transport TransportOptions) *DatadogEndpoint {
+	if site == "" {
+		site = defaultDatadogSite
+	}
+	if batchSize == 0 {
+		batchSize = defaultDatadogBatchSize
+	}
+	return newDatadogEndpoint(name, "https://api."+site, apiKey, batchSize, kinds, newClient(transport, datadogTimeout))
+}
+
+func newDatadogEndpoint(name, baseURL, apiKey string, batchSize int, kinds map[string]string, client *http.Client) *DatadogEndpoint {
+	var names []string
+	for k := range kinds {
+		names = append(names, k)
+	}
+	return &DatadogEndpoint{
+		name:        name,
+		url:         strings.TrimSuffix(baseURL, "/") + datadogSeriesPath,
+		validateURL: strings.TrimSuffix(baseURL, "/") + datadogValidatePath,
+		apiKey:      apiKey,
+		batchSize:   batchSize,
+		kinds:       kinds,
+		names:       metrics.NewMatcher(names),
+		client:      client,
+	}
+}
+
+func (ep *DatadogEndpoint) Name() string {
+	return ep.name
+}
+
+func (ep *DatadogEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	return pipeline.NewEndpointReport(r, nil)
+}
+
+// Send posts the report's series to Datadog. A response with a status other than 2xx results in a
+// *googleapi.Error containing the status code, so that status-based error classification applies.
+func (ep *DatadogEndpoint) Send(r pipeline.EndpointReport) error {
+	return ep.SendBatch([]pipeline.EndpointReport{r})
+}
+
+// SendBatch posts the series of all of the given reports to Datadog in a single request. Errors are
+// the same as Send's.
+// See pipeline.Batcher.
+func (ep *DatadogEndpoint) SendBatch(reports []pipeline.EndpointReport) error {
+	var payload datadogPayload
+	for _, r := range reports {
+		payload.Series = append(payload.Series, ep.format(r.MetricReport)...)
+	}
+	jsontext, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", ep.url, bytes.NewReader(jsontext))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return ep.do(req)
+}
+
+// MaxBatch returns the endpoint's batch size.
+// See pipeline.Batcher.
+func (ep *DatadogEndpoint) MaxBatch() int {
+	return ep.batchSize
+}
+
+// Probe validates the endpoint's API key with Datadog.
+// See pipeline.Prober.
+func (ep *DatadogEndpoint) Probe(ctx context.Context) error {
+	req, err := http.NewRequest("GET", ep.validateURL, nil)
+	if err != nil {
+		return err
+	}
+	return ep.do(req.WithContext(ctx))
+}
+
+func (ep *DatadogEndpoint) do(req *http.Request) error {
+	req.Header.Set("DD-API-KEY", ep.apiKey)
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// The body is drained so that the connection can be reused.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	return googleapi.CheckResponse(resp)
+}
+
+func (ep *DatadogEndpoint) format(r metrics.MetricReport) []datadogSeries {
+	kind := DatadogCount
+	if match, ok := ep.names.Match(r.Name); ok {
+		kind = ep.kinds[match]
+	}
+	var interval int64
+	if kind == DatadogCount {
+		interval = int64(r.EndTime.Sub(r.StartTime) / time.Second)
+	}
+	tags := datadogTags(r.Labels)
+	series := func(metric string, v metrics.MetricValue) datadogSeries {
+		return datadogSeries{
+			Metric:   metric,
+			Points:   [][2]float64{{float64(r.EndTime.Unix()), float64(v.Int64Value) + v.DoubleValue}},
+			Type:     kind,
+			Interval: interval,
+			Tags:     tags,
+		}
+	}
+
+	if len(r.Values) == 0 {
+		return []datadogSeries{series(r.Name, r.Value)}
+	}
+	names := make([]string, 0, len(r.Values))
+	for name := range r.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var all []datadogSeries
+	for _, name := range names {
+		all = append(all, series(r.Name+"."+name, r.Values[name]))
+	}
+	return all
+}
+
+// datadogTags converts labels to sorted Datadog "key:value" tags. Tags are lowercased by Datadog, and
+// characters that Datadog doesn't allow in tags are replaced with underscores. Colons are allowed in
+// values, such as URLs, since Datadog splits a tag at its first colon; they're only replaced in keys.
+func datadogTags(labels map[string]string) []string {
+	var tags []string
+	for k, v := range labels {
+		tags = append(tags, datadogTagText(k, false)+":"+datadogTagText(v, true))
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func datadogTagText(s string, value bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_', r == '-', r == '.', r == '/':
+			return r
+		case r == ':' && value:
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, s)
+}
+
+// Use is a no-op. DatadogEndpoint doesn't track usage.
+func (ep *DatadogEndpoint) Use() {}
+
+// Release is a no-op. DatadogEndpoint doesn't track usage.
+func (ep *DatadogEndpoint) Release() error {
+	return nil
+}
+
+// IsTransient returns false for 4xx responses other than 408 (request timeout) and 429 (rate
+// limit), such as 403 for an invalid API key, which indicate reports that will never be accepted.
+// Other responses and failures to reach Datadog, including every network error, are retried.
+func (ep *DatadogEndpoint) IsTransient(err error) bool {
+	return isTransientHTTPError(err)
+}
+
+// RetryAfter returns the delay requested by the Retry-After header of a 429 or 503 response.
+// See pipeline.RetryAdvisor.
+func (ep *DatadogEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	return retryAfterHTTPError(err, now)
+}
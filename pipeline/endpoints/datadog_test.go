@@ -0,0 +1,236 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"google.golang.org/api/googleapi"
+)
+
+// mockDatadogIntake records the payloads posted to it, responding with status.
+type mockDatadogIntake struct {
+	status   int
+	apiKey   string
+	payloads []datadogPayload
+}
+
+func (h *mockDatadogIntake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == datadogValidatePath {
+		if r.Header.Get("DD-API-KEY") != "secret-key" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return
+	}
+	if r.URL.Path != datadogSeriesPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.apiKey = r.Header.Get("DD-API-KEY")
+	body, _ := ioutil.ReadAll(r.Body)
+	var payload datadogPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.payloads = append(h.payloads, payload)
+	w.WriteHeader(h.status)
+	w.Write([]byte(`{"status": "ok"}`))
+}
+
+func TestDatadogEndpoint(t *testing.T) {
+	kinds := map[string]string{
+		"requests":   DatadogCount,
+		"instance-*": DatadogGauge,
+	}
+	newTestDatadogEndpoint := func(status int) (*DatadogEndpoint, *mockDatadogIntake, func()) {
+		intake := &mockDatadogIntake{status: status}
+		srv := httptest.NewServer(intake)
+		return newDatadogEndpoint("datadog", srv.URL, "secret-key", 2, kinds, srv.Client()), intake, srv.Close
+	}
+	build := func(t *testing.T, ep *DatadogEndpoint, report metrics.MetricReport) pipeline.EndpointReport {
+		r, err := ep.BuildReport(metrics.StampedMetricReport{Id: "report1", MetricReport: report})
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		return r
+	}
+	send := func(t *testing.T, ep *DatadogEndpoint, report metrics.MetricReport) error {
+		return ep.Send(build(t, ep, report))
+	}
+
+	t.Run("Count series with tags", func(t *testing.T) {
+		ep, intake, done := newTestDatadogEndpoint(http.StatusAccepted)
+		defer done()
+
+		if err := send(t, ep, metrics.MetricReport{
+			Name:      "requests",
+			StartTime: time.Unix(100, 0),
+			EndTime:   time.Unix(160, 0),
+			Labels:    map[string]string{"Tenant": "Acme Corp", "env": "prod", "site:url": "http://example.com"},
+			Value:     metrics.MetricValue{Int64Value: 42},
+		}); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+
+		if intake.apiKey != "secret-key" {
+			t.Fatalf("DD-API-KEY: want=%v, got=%v", "secret-key", intake.apiKey)
+		}
+		want := []datadogPayload{{Series: []datadogSeries{{
+			Metric:   "requests",
+			Points:   [][2]float64{{160, 42}},
+			Type:     DatadogCount,
+			Interval: 60,
+			Tags:     []string{"env:prod", "site_url:http://example.com", "tenant:acme_corp"},
+		}}}}
+		if !reflect.DeepEqual(want, intake.payloads) {
+			t.Fatalf("payloads: want=%+v, got=%+v", want, intake.payloads)
+		}
+	})
+
+	t.Run("Gauge series", func(t *testing.T) {
+		ep, intake, done := newTestDatadogEndpoint(http.StatusAccepted)
+		defer done()
+
+		if err := send(t, ep, metrics.MetricReport{
+			Name:      "instance-seconds",
+			StartTime: time.Unix(100, 0),
+			EndTime:   time.Unix(160, 0),
+			Value:     metrics.MetricValue{DoubleValue: 1.5},
+		}); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+
+		want := []datadogPayload{{Series: []datadogSeries{{
+			Metric: "instance-seconds",
+			Points: [][2]float64{{160, 1.5}},
+			Type:   DatadogGauge,
+		}}}}
+		if !reflect.DeepEqual(want, intake.payloads) {
+			t.Fatalf("payloads: want=%+v, got=%+v", want, intake.payloads)
+		}
+	})
+
+	t.Run("Compound values are batched", func(t *testing.T) {
+		ep, intake, done := newTestDatadogEndpoint(http.StatusAccepted)
+		defer done()
+
+		if err := send(t, ep, metrics.MetricReport{
+			Name:      "transfer",
+			StartTime: time.Unix(100, 0),
+			EndTime:   time.Unix(110, 0),
+			Values: map[string]metrics.MetricValue{
+				"bytes_out": {Int64Value: 5},
+				"bytes_in":  {Int64Value: 10},
+			},
+		}); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+
+		want := []datadogPayload{{Series: []datadogSeries{
+			{Metric: "transfer.bytes_in", Points: [][2]float64{{110, 10}}, Type: DatadogCount, Interval: 10},
+			{Metric: "transfer.bytes_out", Points: [][2]float64{{110, 5}}, Type: DatadogCount, Interval: 10},
+		}}}
+		if !reflect.DeepEqual(want, intake.payloads) {
+			t.Fatalf("payloads: want=%+v, got=%+v", want, intake.payloads)
+		}
+	})
+
+	t.Run("Reports are sent in batches", func(t *testing.T) {
+		ep, intake, done := newTestDatadogEndpoint(http.StatusAccepted)
+		defer done()
+
+		if want, got := 2, ep.MaxBatch(); want != got {
+			t.Fatalf("MaxBatch: want=%v, got=%v", want, got)
+		}
+		if err := ep.SendBatch([]pipeline.EndpointReport{
+			build(t, ep, metrics.MetricReport{Name: "instance-seconds", EndTime: time.Unix(160, 0), Value: metrics.MetricValue{DoubleValue: 1.5}}),
+			build(t, ep, metrics.MetricReport{Name: "instance-seconds", EndTime: time.Unix(220, 0), Value: metrics.MetricValue{DoubleValue: 2.5}}),
+		}); err != nil {
+			t.Fatalf("error sending batch: %+v", err)
+		}
+
+		want := []datadogPayload{{Series: []datadogSeries{
+			{Metric: "instance-seconds", Points: [][2]float64{{160, 1.5}}, Type: DatadogGauge},
+			{Metric: "instance-seconds", Points: [][2]float64{{220, 2.5}}, Type: DatadogGauge},
+		}}}
+		if !reflect.DeepEqual(want, intake.payloads) {
+			t.Fatalf("payloads: want=%+v, got=%+v", want, intake.payloads)
+		}
+	})
+
+	t.Run("Probe validates API key", func(t *testing.T) {
+		ep, _, done := newTestDatadogEndpoint(http.StatusAccepted)
+		defer done()
+		if err := ep.Probe(context.Background()); err != nil {
+			t.Fatalf("unexpected probe error: %+v", err)
+		}
+		ep.apiKey = "wrong-key"
+		if err := ep.Probe(context.Background()); err == nil {
+			t.Fatal("expected probe with wrong key to fail")
+		}
+	})
+
+	t.Run("API errors", func(t *testing.T) {
+		for _, tt := range []struct {
+			status    int
+			transient bool
+		}{
+			{http.StatusForbidden, false},
+			{http.StatusRequestEntityTooLarge, false},
+			{http.StatusRequestTimeout, true},
+			{http.StatusTooManyRequests, true},
+			{http.StatusServiceUnavailable, true},
+		} {
+			ep, _, done := newTestDatadogEndpoint(tt.status)
+			err := send(t, ep, metrics.MetricReport{Name: "requests", Value: metrics.MetricValue{Int64Value: 1}})
+			done()
+			if gerr, ok := err.(*googleapi.Error); !ok || gerr.Code != tt.status {
+				t.Fatalf("status %v: expected *googleapi.Error with code %v, got: %+v", tt.status, tt.status, err)
+			}
+			if ep.IsTransient(err) != tt.transient {
+				t.Fatalf("status %v: IsTransient: want=%v, got=%v", tt.status, tt.transient, !tt.transient)
+			}
+		}
+	})
+}
+
+func TestDatadogEndpoint_IsTransient(t *testing.T) {
+	ep := newDatadogEndpoint("datadog", "http://localhost", "secret-key", 1, nil, http.DefaultClient)
+	for _, err := range []error{
+		&url.Error{Op: "Post", URL: "http://localhost", Err: errors.New("connection refused")},
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("no route to host")},
+		errors.New("unexpected EOF"),
+	} {
+		if !ep.IsTransient(err) {
+			t.Fatalf("%v: expected a transient error", err)
+		}
+	}
+	if ep.IsTransient(nil) {
+		t.Fatal("nil: expected a non-transient error")
+	}
+}
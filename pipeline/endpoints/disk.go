@@ -15,7 +15,7 @@
 package endpoints
 
 import (
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
@@ -48,7 +48,9 @@ type DiskEndpoint struct {
 	clock      clock.Clock
 	wait       sync.WaitGroup
 	tracker    pipeline.UsageTracker
-	closed     bool // used for testing
+	timeFormat string
+	csv        *csvWriter // nil when writing JSON
+	closed     bool       // used for testing
 }
 
 type diskContext struct {
@@ -56,17 +58,33 @@ type diskContext struct {
 }
 
 // NewDiskEndpoint creates a new DiskEndpoint and starts a goroutine that cleans up expired reports
-// on disk.
-func NewDiskEndpoint(name string, path string, expiration time.Duration) *DiskEndpoint {
-	return newDiskEndpoint(name, path, expiration, clock.NewClock())
+// on disk. Report times are written in the given metrics time format; see metrics.MarshalReport.
+func NewDiskEndpoint(name string, path string, expiration time.Duration, timeFormat string) *DiskEndpoint {
+	return newDiskEndpoint(name, path, expiration, timeFormat, clock.NewClock())
 }
 
-func newDiskEndpoint(name string, path string, expiration time.Duration, clock clock.Clock) *DiskEndpoint {
+// NewCSVDiskEndpoint creates a new DiskEndpoint that appends reports as rows to a CSV file rather
+// than writing a JSON file per report. The file begins with a header row naming the given columns,
+// each of which is "id", "name", "startTime", "endTime", "value", "labels.<key>" for the value of a
+// report label, "annotations.<key>" for the value of a report annotation, or "values.<name>" for a
+// compound metric's named value; DefaultCSVColumns are used if columns is empty. A new file is started
+// each time the endpoint is created, and the current file is flushed and closed on Release.
+func NewCSVDiskEndpoint(name string, path string, expiration time.Duration, columns []string) *DiskEndpoint {
+	return newDiskEndpointWithWriter(name, path, expiration, newCSVWriter(columns), "", clock.NewClock())
+}
+
+func newDiskEndpoint(name string, path string, expiration time.Duration, timeFormat string, clock clock.Clock) *DiskEndpoint {
+	return newDiskEndpointWithWriter(name, path, expiration, nil, timeFormat, clock)
+}
+
+func newDiskEndpointWithWriter(name string, path string, expiration time.Duration, csv *csvWriter, timeFormat string, clock clock.Clock) *DiskEndpoint {
 	ep := &DiskEndpoint{
 		name:       name,
 		path:       path,
 		expiration: expiration,
 		clock:      clock,
+		csv:        csv,
+		timeFormat: timeFormat,
 		quit:       make(chan bool, 1),
 	}
 	ep.wait.Add(1)
@@ -83,12 +101,15 @@ func (ep *DiskEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.End
 }
 
 func (ep *DiskEndpoint) Send(r pipeline.EndpointReport) error {
+	if ep.csv != nil {
+		return ep.csv.write(ep.path, r.StampedMetricReport, ep.clock.Now())
+	}
 	dctx := diskContext{}
 	err := r.UnmarshalContext(&dctx)
 	if err != nil {
 		return err
 	}
-	jsontext, err := json.Marshal(r.StampedMetricReport)
+	jsontext, err := metrics.MarshalReport(r.StampedMetricReport, ep.timeFormat)
 	if err != nil {
 		return err
 	}
@@ -120,6 +141,9 @@ func (ep *DiskEndpoint) Release() error {
 			ep.closed = true
 		})
 		ep.wait.Wait()
+		if ep.csv != nil {
+			return ep.csv.close()
+		}
 		return nil
 	})
 }
@@ -145,6 +169,10 @@ func (ep *DiskEndpoint) cleanup() {
 	cutoff := ep.clock.Now().Add(-ep.expiration)
 	files, _ := ioutil.ReadDir(ep.path)
 	for _, f := range files {
+		if ep.csv != nil && ep.csv.active(f.Name()) {
+			// Never remove the CSV file that's still being written.
+			continue
+		}
 		if isExpired(f.Name(), cutoff) {
 			if err := os.Remove(filepath.Join(ep.path, f.Name())); err != nil {
 				glog.Warningf("error removing expired disk report: %v", f)
@@ -153,21 +181,48 @@ func (ep *DiskEndpoint) cleanup() {
 	}
 }
 
+// LoadDiskReports reads the JSON reports written to dir by a DiskEndpoint, such as for replaying
+// them to another endpoint. Reports are ordered by the time they were written, and their times are
+// parsed in the given metrics time format, which must match the one the reports were written with.
+func LoadDiskReports(dir string, timeFormat string) ([]metrics.StampedMetricReport, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var reports []metrics.StampedMetricReport
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), reportPrefix) || !strings.HasSuffix(f.Name(), reportSuffix) {
+			continue
+		}
+		jsontext, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		report, err := metrics.UnmarshalReport(jsontext, timeFormat)
+		if err != nil {
+			return nil, fmt.Errorf("disk: reading %v: %v", f.Name(), err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
 func reportName(report metrics.StampedMetricReport, reportTime time.Time) string {
-	var random string
-	if len(report.Id) < randomLength {
-		random = report.Id
-	} else {
-		random = report.Id[0:5]
+	return reportPrefix + "_" + reportTime.UTC().Format(time.RFC3339) + "_" + shortId(report.Id) + reportSuffix
+}
+
+func shortId(id string) string {
+	if len(id) < randomLength {
+		return id
 	}
-	return reportPrefix + "_" + reportTime.UTC().Format(time.RFC3339) + "_" + random + reportSuffix
+	return id[0:randomLength]
 }
 
 func isExpired(name string, cutoff time.Time) bool {
 	if !strings.HasPrefix(name, reportPrefix) {
 		return false
 	}
-	if !strings.HasSuffix(name, reportSuffix) {
+	if !strings.HasSuffix(name, reportSuffix) && !strings.HasSuffix(name, csvSuffix) {
 		return false
 	}
 
@@ -15,9 +15,12 @@
 package endpoints
 
 import (
+	"encoding/csv"
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
@@ -34,7 +37,7 @@ func TestDiskEndpoint(t *testing.T) {
 
 	mc := testlib.NewMockClock()
 	mc.SetNow(parseTime("2017-06-19T12:00:00Z"))
-	ep := newDiskEndpoint("disk", tmpdir, 10*time.Minute, mc)
+	ep := newDiskEndpoint("disk", tmpdir, 10*time.Minute, "", mc)
 
 	// Make sure we start with an empty dir
 	if files, err := ioutil.ReadDir(tmpdir); err != nil {
@@ -114,6 +117,163 @@ func TestDiskEndpoint(t *testing.T) {
 	}
 }
 
+func TestLoadDiskReports(t *testing.T) {
+	reports := []metrics.StampedMetricReport{
+		{
+			Id: "report1",
+			MetricReport: metrics.MetricReport{
+				Name:      "int-metric1",
+				StartTime: time.Unix(0, 0).UTC(),
+				EndTime:   time.Unix(1, 0).UTC(),
+				Value: metrics.MetricValue{
+					Int64Value: 10,
+				},
+			},
+		},
+		{
+			Id: "report2",
+			MetricReport: metrics.MetricReport{
+				Name:      "int-metric1",
+				StartTime: time.Unix(2, 0).UTC(),
+				EndTime:   time.Unix(3, 0).UTC(),
+				Value: metrics.MetricValue{
+					Int64Value: 20,
+				},
+			},
+		},
+	}
+
+	for _, format := range []string{metrics.TimeFormatRFC3339, metrics.TimeFormatUnix, metrics.TimeFormatUnixMillis} {
+		t.Run(format, func(t *testing.T) {
+			tmpdir, err := ioutil.TempDir("", "disk_endpoint_test")
+			if err != nil {
+				t.Fatalf("Unable to create temp directory: %+v", err)
+			}
+			defer os.RemoveAll(tmpdir)
+
+			mc := testlib.NewMockClock()
+			mc.SetNow(parseTime("2017-06-19T12:00:00Z"))
+			ep := newDiskEndpoint("disk", tmpdir, 10*time.Minute, format, mc)
+			for i, r := range reports {
+				mc.SetNow(parseTime("2017-06-19T12:00:00Z").Add(time.Duration(i) * time.Second))
+				epr, err := ep.BuildReport(r)
+				if err != nil {
+					t.Fatalf("error building report: %+v", err)
+				}
+				if err := ep.Send(epr); err != nil {
+					t.Fatalf("error sending report: %+v", err)
+				}
+			}
+			ep.Release()
+
+			loaded, err := LoadDiskReports(tmpdir, format)
+			if err != nil {
+				t.Fatalf("error loading reports: %+v", err)
+			}
+			if len(loaded) != len(reports) {
+				t.Fatalf("loaded reports: want=%+v, got=%+v", reports, loaded)
+			}
+			for i := range reports {
+				if !loaded[i].Equal(reports[i]) {
+					t.Fatalf("loaded report: want=%+v, got=%+v", reports[i], loaded[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCSVDiskEndpoint(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "disk_endpoint_test")
+	if err != nil {
+		t.Fatalf("Unable to create temp directory: %+v", err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	mc := testlib.NewMockClock()
+	mc.SetNow(parseTime("2017-06-19T12:00:00Z"))
+	columns := []string{"id", "name", "endTime", "value", "labels.tenant", "labels.region", "annotations.trace"}
+	ep := newDiskEndpointWithWriter("disk", tmpdir, 10*time.Minute, newCSVWriter(columns), "", mc)
+	ep.Use()
+
+	reports := []metrics.StampedMetricReport{
+		{
+			Id: "report1",
+			MetricReport: metrics.MetricReport{
+				Name:        "int-metric1",
+				StartTime:   time.Unix(0, 0),
+				EndTime:     time.Unix(1, 0),
+				Labels:      map[string]string{"tenant": "a", "region": "us"},
+				Value:       metrics.MetricValue{Int64Value: 10},
+				Annotations: map[string]string{"trace": "t1"},
+			},
+		},
+		{
+			Id: "report2",
+			MetricReport: metrics.MetricReport{
+				Name:      "double-metric1",
+				StartTime: time.Unix(1, 0),
+				EndTime:   time.Unix(2, 0),
+				Labels:    map[string]string{"tenant": "b,c", "other": "x"},
+				Value:     metrics.MetricValue{DoubleValue: 1.5},
+			},
+		},
+		{
+			Id: "report3",
+			MetricReport: metrics.MetricReport{
+				Name:      "int-metric1",
+				StartTime: time.Unix(2, 0),
+				EndTime:   time.Unix(3, 0),
+				Value:     metrics.MetricValue{Int64Value: 3},
+			},
+		},
+	}
+	for _, r := range reports {
+		epr, err := ep.BuildReport(r)
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		if err := ep.Send(epr); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+	}
+
+	// All reports go to a single file, which is retained by cleanup while it's being written.
+	mc.SetNow(parseTime("2017-06-19T12:11:00Z"))
+	ep.cleanup()
+	if err := ep.Release(); err != nil {
+		t.Fatalf("error releasing endpoint: %+v", err)
+	}
+	files, err := ioutil.ReadDir(tmpdir)
+	if err != nil {
+		t.Fatalf("error listing output directory: %+v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("output directory contains %v files, expected 1", len(files))
+	}
+	if want, got := "report_2017-06-19T12:00:00Z_repor.csv", files[0].Name(); want != got {
+		t.Fatalf("csv file name: want=%v, got=%v", want, got)
+	}
+
+	f, err := os.Open(filepath.Join(tmpdir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("error opening csv file: %+v", err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("error reading csv file: %+v", err)
+	}
+	expected := [][]string{
+		{"id", "name", "endTime", "value", "labels.tenant", "labels.region", "annotations.trace"},
+		{"report1", "int-metric1", "1970-01-01T00:00:01Z", "10", "a", "us", "t1"},
+		{"report2", "double-metric1", "1970-01-01T00:00:02Z", "1.5", "b,c", "", ""},
+		{"report3", "int-metric1", "1970-01-01T00:00:03Z", "3", "", "", ""},
+	}
+	if !reflect.DeepEqual(expected, rows) {
+		t.Fatalf("csv rows: want=%v, got=%v", expected, rows)
+	}
+}
+
 func parseTime(ts string) time.Time {
 	t, err := time.Parse(time.RFC3339, ts)
 	if err != nil {
@@ -0,0 +1,145 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"encoding/csv"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+)
+
+const (
+	csvSuffix           = ".csv"
+	csvLabelPrefix      = "labels."
+	csvAnnotationPrefix = "annotations."
+	csvValuesPrefix     = "values."
+	csvIdColumn         = "id"
+	csvNameColumn       = "name"
+	csvStartColumn      = "startTime"
+	csvEndColumn        = "endTime"
+	csvValueColumn      = "value"
+)
+
+// DefaultCSVColumns are the columns written by a CSV DiskEndpoint when none are configured.
+var DefaultCSVColumns = []string{csvIdColumn, csvNameColumn, csvStartColumn, csvEndColumn, csvValueColumn}
+
+// csvWriter appends reports as rows to a single CSV file, which is created, with a header row, when
+// the first report is written.
+type csvWriter struct {
+	columns []string
+	file    *os.File
+	writer  *csv.Writer
+	name    string
+	mu      sync.Mutex
+}
+
+func newCSVWriter(columns []string) *csvWriter {
+	if len(columns) == 0 {
+		columns = DefaultCSVColumns
+	}
+	return &csvWriter{columns: columns}
+}
+
+func (w *csvWriter) write(dir string, report metrics.StampedMetricReport, now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writer == nil {
+		if err := os.MkdirAll(dir, directoryMode); err != nil {
+			return err
+		}
+		name := reportPrefix + "_" + now.UTC().Format(time.RFC3339) + "_" + shortId(report.Id) + csvSuffix
+		file, err := os.OpenFile(path.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, fileMode)
+		if err != nil {
+			return err
+		}
+		w.file = file
+		w.name = name
+		w.writer = csv.NewWriter(file)
+		w.writer.Write(w.columns)
+	}
+	w.writer.Write(w.row(report))
+	// Rows are flushed as they're written, since a successful send dequeues the report.
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *csvWriter) row(report metrics.StampedMetricReport) []string {
+	row := make([]string, len(w.columns))
+	for i, column := range w.columns {
+		switch column {
+		case csvIdColumn:
+			row[i] = report.Id
+		case csvNameColumn:
+			row[i] = report.Name
+		case csvStartColumn:
+			row[i] = report.StartTime.UTC().Format(time.RFC3339Nano)
+		case csvEndColumn:
+			row[i] = report.EndTime.UTC().Format(time.RFC3339Nano)
+		case csvValueColumn:
+			row[i] = formatCSVValue(report.Value)
+		default:
+			// Labels, annotations, and named values missing from the report produce an empty cell.
+			if strings.HasPrefix(column, csvValuesPrefix) {
+				if v, ok := report.Values[strings.TrimPrefix(column, csvValuesPrefix)]; ok {
+					row[i] = formatCSVValue(v)
+				}
+			} else if strings.HasPrefix(column, csvAnnotationPrefix) {
+				row[i] = report.Annotations[strings.TrimPrefix(column, csvAnnotationPrefix)]
+			} else {
+				row[i] = report.Labels[strings.TrimPrefix(column, csvLabelPrefix)]
+			}
+		}
+	}
+	return row
+}
+
+// active returns whether name is the file currently being written.
+func (w *csvWriter) active(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer != nil && w.name == name
+}
+
+// formatCSVValue formats a single named value of a compound metric for a CSV column. Only one of
+// its fields is non-zero; a zero value is written as "0".
+func formatCSVValue(v metrics.MetricValue) string {
+	if v.DoubleValue != 0 {
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	}
+	return strconv.FormatInt(v.Int64Value, 10)
+}
+
+// close flushes and closes the current file. A subsequent write starts a new file.
+func (w *csvWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.writer == nil {
+		return nil
+	}
+	w.writer.Flush()
+	err := w.writer.Error()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	w.writer = nil
+	w.file = nil
+	return err
+}
@@ -0,0 +1,216 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/clock"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+)
+
+// failoverEndpoint is an Endpoint that sends each report to the first of its members that's healthy,
+// in order of preference. A member that fails with a transient error is unhealthy for a cooldown
+// period, during which it's skipped; afterwards it's tried again, and traffic returns to it once a
+// send succeeds. If every member is unhealthy, all are tried.
+type failoverEndpoint struct {
+	name     string
+	members  []pipeline.Endpoint
+	cooldown time.Duration
+	clock    clock.Clock
+
+	mu      sync.Mutex
+	retryAt []time.Time // When each unhealthy member is next tried, or zero if it's healthy.
+}
+
+// failoverContext holds the context built by each member, keyed by member name, so that a report can
+// be sent by whichever member is healthy when it's sent or retried.
+type failoverContext struct {
+	Contexts map[string]json.RawMessage
+}
+
+// failoverError is a send error from one of a failoverEndpoint's members, along with that member's
+// classification of it.
+type failoverError struct {
+	endpoint  string
+	err       error
+	transient bool
+}
+
+func (e *failoverError) Error() string {
+	return fmt.Sprintf("failover: endpoint %v: %v", e.endpoint, e.err)
+}
+
+// NewFailoverEndpoint creates an Endpoint that sends each report to one of members, preferring them
+// in the given order and skipping a member for cooldown after it fails with a transient error. This
+// differs from sending to several endpoints, which delivers every report to each of them.
+func NewFailoverEndpoint(name string, members []pipeline.Endpoint, cooldown time.Duration) pipeline.Endpoint {
+	return newFailoverEndpoint(name, members, cooldown, clock.NewClock())
+}
+
+func newFailoverEndpoint(name string, members []pipeline.Endpoint, cooldown time.Duration, clock clock.Clock) *failoverEndpoint {
+	return &failoverEndpoint{
+		name:     name,
+		members:  members,
+		cooldown: cooldown,
+		clock:    clock,
+		retryAt:  make([]time.Time, len(members)),
+	}
+}
+
+func (ep *failoverEndpoint) Name() string {
+	return ep.name
+}
+
+// BuildReport builds r with each member, keeping the context that each attaches.
+func (ep *failoverEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	ctx := failoverContext{Contexts: make(map[string]json.RawMessage)}
+	for _, m := range ep.members {
+		mr, err := m.BuildReport(r)
+		if err != nil {
+			return pipeline.EndpointReport{}, err
+		}
+		if mr.Context != nil {
+			ctx.Contexts[m.Name()] = mr.Context
+		}
+	}
+	return pipeline.NewEndpointReport(r, ctx)
+}
+
+// Send sends r to the first healthy member. A transient error moves on to the next member; if every
+// member fails, the last error is returned. A permanent error is returned immediately, since the
+// report would be rejected by the other members too.
+func (ep *failoverEndpoint) Send(r pipeline.EndpointReport) error {
+	var ctx failoverContext
+	if err := r.UnmarshalContext(&ctx); err != nil {
+		return err
+	}
+	var last error
+	for _, i := range ep.candidates() {
+		m := ep.members[i]
+		mr := r
+		mr.Context = ctx.Contexts[m.Name()]
+		err := m.Send(mr)
+		if err == nil {
+			ep.setRetryAt(i, time.Time{})
+			return nil
+		}
+		if !m.IsTransient(err) {
+			return &failoverError{endpoint: m.Name(), err: err, transient: false}
+		}
+		glog.Warningf("failover %v: endpoint %v failed; trying the next endpoint: %+v", ep.name, m.Name(), err)
+		ep.setRetryAt(i, ep.clock.Now().Add(ep.cooldown))
+		last = &failoverError{endpoint: m.Name(), err: err, transient: true}
+	}
+	return last
+}
+
+// candidates returns the indexes of the members to try, in order: the healthy ones, or every member
+// if none is healthy.
+func (ep *failoverEndpoint) candidates() []int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	now := ep.clock.Now()
+	var healthy, all []int
+	for i, t := range ep.retryAt {
+		if !now.Before(t) {
+			healthy = append(healthy, i)
+		}
+		all = append(all, i)
+	}
+	if len(healthy) == 0 {
+		return all
+	}
+	return healthy
+}
+
+func (ep *failoverEndpoint) setRetryAt(i int, t time.Time) {
+	ep.mu.Lock()
+	ep.retryAt[i] = t
+	ep.mu.Unlock()
+}
+
+// Probe succeeds if any member is likely to be reachable: if it isn't a pipeline.Prober, or if its
+// probe succeeds. A member whose probe fails starts out unhealthy.
+// See pipeline.Prober.
+func (ep *failoverEndpoint) Probe(ctx context.Context) error {
+	var first error
+	reachable := false
+	for i, m := range ep.members {
+		prober, ok := m.(pipeline.Prober)
+		if !ok {
+			reachable = true
+			continue
+		}
+		if err := prober.Probe(ctx); err != nil {
+			ep.setRetryAt(i, ep.clock.Now().Add(ep.cooldown))
+			if first == nil {
+				first = &failoverError{endpoint: m.Name(), err: err}
+			}
+			continue
+		}
+		reachable = true
+	}
+	if reachable {
+		return nil
+	}
+	return first
+}
+
+// IsTransient returns the failing member's classification of err.
+func (ep *failoverEndpoint) IsTransient(err error) bool {
+	if fe, ok := err.(*failoverError); ok {
+		return fe.transient
+	}
+	return false
+}
+
+// RetryAfter returns the delay requested by the failing member's error.
+func (ep *failoverEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	fe, ok := err.(*failoverError)
+	if !ok {
+		return 0, false
+	}
+	for _, m := range ep.members {
+		if m.Name() == fe.endpoint {
+			return retryAfter(m, fe.err, now)
+		}
+	}
+	return 0, false
+}
+
+// Use increments the usage count of each member.
+// See pipeline.Component.Use.
+func (ep *failoverEndpoint) Use() {
+	for _, m := range ep.members {
+		m.Use()
+	}
+}
+
+// Release decrements the usage count of each member.
+// See pipeline.Component.Release.
+func (ep *failoverEndpoint) Release() error {
+	components := make([]pipeline.Component, len(ep.members))
+	for i, m := range ep.members {
+		components[i] = m
+	}
+	return pipeline.ReleaseAll(components)
+}
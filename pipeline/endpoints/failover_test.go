@@ -0,0 +1,130 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestFailoverEndpoint(t *testing.T) {
+	report := metrics.StampedMetricReport{
+		Id: "report1",
+		MetricReport: metrics.MetricReport{
+			Name:      "int-metric1",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Value:     metrics.MetricValue{Int64Value: 10},
+		},
+	}
+	newTestFailoverEndpoint := func() (*failoverEndpoint, *testlib.MockEndpoint, *testlib.MockEndpoint, testlib.MockClock) {
+		primary := testlib.NewMockEndpoint("primary")
+		secondary := testlib.NewMockEndpoint("secondary")
+		mc := testlib.NewMockClock()
+		mc.SetNow(time.Unix(1000, 0))
+		return newFailoverEndpoint("regions", []pipeline.Endpoint{primary, secondary}, time.Minute, mc), primary, secondary, mc
+	}
+	send := func(t *testing.T, ep *failoverEndpoint) error {
+		r, err := ep.BuildReport(report)
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		return ep.Send(r)
+	}
+
+	t.Run("Healthy primary receives reports", func(t *testing.T) {
+		ep, primary, secondary, _ := newTestFailoverEndpoint()
+		if err := send(t, ep); err != nil {
+			t.Fatalf("unexpected send error: %+v", err)
+		}
+		if want, got := 1, len(primary.Reports()); want != got {
+			t.Fatalf("primary reports: want=%v, got=%v", want, got)
+		}
+		if want, got := 0, len(secondary.Reports()); want != got {
+			t.Fatalf("secondary reports: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("Failing primary routes to secondary until it recovers", func(t *testing.T) {
+		ep, primary, secondary, mc := newTestFailoverEndpoint()
+		primary.SetSendErr(errors.New("unavailable"))
+		if err := send(t, ep); err != nil {
+			t.Fatalf("unexpected send error: %+v", err)
+		}
+		if want, got := 1, len(secondary.Reports()); want != got {
+			t.Fatalf("secondary reports: want=%v, got=%v", want, got)
+		}
+
+		// The primary is skipped while it's unhealthy.
+		if err := send(t, ep); err != nil {
+			t.Fatalf("unexpected send error: %+v", err)
+		}
+		if want, got := int32(1), primary.Calls(); want != got {
+			t.Fatalf("primary calls: want=%v, got=%v", want, got)
+		}
+		if want, got := 1, len(secondary.Reports()); want != got {
+			t.Fatalf("secondary reports: want=%v, got=%v", want, got)
+		}
+
+		// Once the cooldown passes, the recovered primary receives reports again.
+		primary.SetSendErr(nil)
+		mc.SetNow(time.Unix(1000, 0).Add(time.Minute))
+		for i := 0; i < 2; i++ {
+			if err := send(t, ep); err != nil {
+				t.Fatalf("unexpected send error: %+v", err)
+			}
+		}
+		if want, got := 2, len(primary.Reports()); want != got {
+			t.Fatalf("primary reports: want=%v, got=%v", want, got)
+		}
+		if want, got := 0, len(secondary.Reports()); want != got {
+			t.Fatalf("secondary reports: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("Permanent errors don't fail over", func(t *testing.T) {
+		ep, primary, secondary, _ := newTestFailoverEndpoint()
+		primary.SetSendErr(errors.New("FATAL"))
+		err := send(t, ep)
+		if err == nil || ep.IsTransient(err) {
+			t.Fatalf("expected a permanent error, got: %+v", err)
+		}
+		if want, got := int32(0), secondary.Calls(); want != got {
+			t.Fatalf("secondary calls: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("All members failing is transient", func(t *testing.T) {
+		ep, primary, secondary, _ := newTestFailoverEndpoint()
+		primary.SetSendErr(errors.New("unavailable"))
+		secondary.SetSendErr(errors.New("unavailable"))
+		if err := send(t, ep); err == nil || !ep.IsTransient(err) {
+			t.Fatalf("expected a transient error, got: %+v", err)
+		}
+
+		// Every member is unhealthy, so both are tried again.
+		if err := send(t, ep); err == nil {
+			t.Fatal("expected a send error")
+		}
+		if want, got := int32(2), primary.Calls(); want != got {
+			t.Fatalf("primary calls: want=%v, got=%v", want, got)
+		}
+	})
+}
@@ -0,0 +1,243 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	forwardPath       = "/report"
+	forwardStatusPath = "/status"
+	forwardTimeout    = 60 * time.Second
+
+	gzipEncoding     = "gzip"
+	identityEncoding = "identity"
+)
+
+// ForwardEndpoint is an Endpoint that forwards each report to another ubbagent instance through
+// that agent's HTTP ingestion API. Reports are posted in the same JSON format that clients use to
+// report to an agent, so chaining agents is transparent to the receiving agent. Each report also
+// carries its Id, so that a receiver can discard a report it has already accepted.
+//
+// A ForwardEndpoint may compress reports with gzip. It only does so once the receiving agent has
+// advertised, in the Accept-Encoding header of its status response, that it accepts gzip; otherwise,
+// or if the receiver later rejects a compressed report, reports are sent uncompressed.
+type ForwardEndpoint struct {
+	name      string
+	url       string
+	statusURL string
+	client    *http.Client
+	compress  bool
+
+	// encoding is the negotiated encoding of request bodies: empty until negotiated, then
+	// gzipEncoding or identityEncoding.
+	encoding string
+	mutex    sync.Mutex
+}
+
+// NewForwardEndpoint creates a new ForwardEndpoint that sends reports to the agent at the given
+// base URL, such as "http://localhost:3456". If compress is true, reports are compressed with gzip
+// when the receiver supports it. Connections are reused according to transport.
+func NewForwardEndpoint(name, url string, compress bool, transport TransportOptions) *ForwardEndpoint {
+	return newForwardEndpoint(name, url, compress, newClient(transport, forwardTimeout))
+}
+
+func newForwardEndpoint(name, url string, compress bool, client *http.Client) *ForwardEndpoint {
+	return &ForwardEndpoint{
+		name:      name,
+		url:       strings.TrimSuffix(url, "/") + forwardPath,
+		statusURL: strings.TrimSuffix(url, "/") + forwardStatusPath,
+		client:    client,
+		compress:  compress,
+	}
+}
+
+func (ep *ForwardEndpoint) Name() string {
+	return ep.name
+}
+
+func (ep *ForwardEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	return pipeline.NewEndpointReport(r, nil)
+}
+
+// Send posts the report to the receiving agent. A response with a status other than 200 results in
+// a *googleapi.Error containing the status code, so that status-based error classification applies.
+func (ep *ForwardEndpoint) Send(r pipeline.EndpointReport) error {
+	jsontext, err := json.Marshal(r.StampedMetricReport)
+	if err != nil {
+		return err
+	}
+	if ep.requestEncoding() == gzipEncoding {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(jsontext); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		resp, err := ep.post(buf.Bytes(), gzipEncoding)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusUnsupportedMediaType {
+			return ep.checkResponse(resp)
+		}
+		ep.checkResponse(resp)
+		glog.Warningf("forward %v: receiver rejected a compressed report; sending uncompressed", ep.name)
+		ep.setEncoding(identityEncoding)
+	}
+	resp, err := ep.post(jsontext, identityEncoding)
+	if err != nil {
+		return err
+	}
+	return ep.checkResponse(resp)
+}
+
+func (ep *ForwardEndpoint) post(body []byte, encoding string) (*http.Response, error) {
+	req, err := http.NewRequest("POST", ep.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != identityEncoding {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	return ep.client.Do(req)
+}
+
+// requestEncoding returns the encoding to send the next report with, first negotiating it with the
+// receiver if compression is enabled. An encoding that can't be negotiated yet, because the
+// receiver's status can't be read, is retried with the next report.
+func (ep *ForwardEndpoint) requestEncoding() string {
+	if !ep.compress {
+		return identityEncoding
+	}
+	ep.mutex.Lock()
+	encoding := ep.encoding
+	ep.mutex.Unlock()
+	if encoding != "" {
+		return encoding
+	}
+	req, err := http.NewRequest("GET", ep.statusURL, nil)
+	if err != nil {
+		return identityEncoding
+	}
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return identityEncoding
+	}
+	if ep.checkResponse(resp) != nil {
+		return identityEncoding
+	}
+	encoding = identityEncoding
+	if acceptsEncoding(resp.Header, gzipEncoding) {
+		encoding = gzipEncoding
+	} else {
+		glog.Warningf("forward %v: receiver doesn't accept compressed reports; sending uncompressed", ep.name)
+	}
+	ep.setEncoding(encoding)
+	return encoding
+}
+
+func (ep *ForwardEndpoint) setEncoding(encoding string) {
+	ep.mutex.Lock()
+	ep.encoding = encoding
+	ep.mutex.Unlock()
+}
+
+// acceptsEncoding returns true if the Accept-Encoding values in header include encoding with a
+// non-zero quality.
+func acceptsEncoding(header http.Header, encoding string) bool {
+	for _, value := range header["Accept-Encoding"] {
+		for _, item := range strings.Split(value, ",") {
+			params := strings.Split(item, ";")
+			if !strings.EqualFold(strings.TrimSpace(params[0]), encoding) {
+				continue
+			}
+			rejected := false
+			for _, param := range params[1:] {
+				// A quality of zero, such as "q=0" or "q=0.000", rejects the encoding.
+				if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") && strings.Trim(q[2:], "0.") == "" {
+					rejected = true
+				}
+			}
+			if !rejected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Probe requests the receiving agent's status, failing if it can't be reached or doesn't respond
+// successfully.
+// See pipeline.Prober.
+func (ep *ForwardEndpoint) Probe(ctx context.Context) error {
+	req, err := http.NewRequest("GET", ep.statusURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ep.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return ep.checkResponse(resp)
+}
+
+func (ep *ForwardEndpoint) checkResponse(resp *http.Response) error {
+	defer func() {
+		// The body is drained so that the connection can be reused.
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	return googleapi.CheckResponse(resp)
+}
+
+// Use is a no-op. ForwardEndpoint doesn't track usage.
+func (ep *ForwardEndpoint) Use() {}
+
+// Release is a no-op. ForwardEndpoint doesn't track usage.
+func (ep *ForwardEndpoint) Release() error {
+	return nil
+}
+
+// IsTransient returns false if the receiving agent rejected the report with a client error, other
+// than a request timeout or rate limit. Any other failure is retried: the receiving agent may be
+// restarting or unreachable.
+func (ep *ForwardEndpoint) IsTransient(err error) bool {
+	return isTransientHTTPError(err)
+}
+
+// RetryAfter returns the delay requested by the Retry-After header of a 429 or 503 response.
+// See pipeline.RetryAdvisor.
+func (ep *ForwardEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	return retryAfterHTTPError(err, now)
+}
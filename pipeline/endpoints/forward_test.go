@@ -0,0 +1,256 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"google.golang.org/api/googleapi"
+)
+
+func TestForwardEndpoint(t *testing.T) {
+	report := metrics.StampedMetricReport{
+		Id: "report1",
+		MetricReport: metrics.MetricReport{
+			Name:      "int-metric1",
+			StartTime: time.Unix(0, 0).UTC(),
+			EndTime:   time.Unix(1, 0).UTC(),
+			Labels:    map[string]string{"foo": "bar"},
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		},
+	}
+
+	t.Run("Posts report JSON", func(t *testing.T) {
+		var received metrics.StampedMetricReport
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/report" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &received); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+		defer srv.Close()
+
+		ep := NewForwardEndpoint("forward", srv.URL+"/", false, TransportOptions{})
+		r, err := ep.BuildReport(report)
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		if err := ep.Send(r); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+		if !received.Equal(report) {
+			t.Fatalf("received report: expected %+v, got %+v", report, received)
+		}
+	})
+
+	t.Run("Compresses reports for a receiver that accepts gzip", func(t *testing.T) {
+		for _, tc := range []struct {
+			name           string
+			acceptEncoding string
+			rejectGzip     bool
+			want           string
+		}{
+			{"accepted", "gzip", false, "gzip"},
+			{"not advertised", "", false, ""},
+			{"rejected by quality", "gzip;q=0", false, ""},
+			{"rejected by the receiver", "gzip", true, ""},
+		} {
+			var received metrics.StampedMetricReport
+			var encodings []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.acceptEncoding != "" {
+					w.Header().Set("Accept-Encoding", tc.acceptEncoding)
+				}
+				if r.URL.Path != "/report" {
+					return
+				}
+				encoding := r.Header.Get("Content-Encoding")
+				encodings = append(encodings, encoding)
+				var body io.Reader = r.Body
+				if encoding == "gzip" {
+					if tc.rejectGzip {
+						w.WriteHeader(http.StatusUnsupportedMediaType)
+						return
+					}
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+					body = zr
+				}
+				data, _ := ioutil.ReadAll(body)
+				if err := json.Unmarshal(data, &received); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			}))
+
+			ep := NewForwardEndpoint("forward", srv.URL, true, TransportOptions{})
+			for i := 0; i < 2; i++ {
+				received = metrics.StampedMetricReport{}
+				r, err := ep.BuildReport(report)
+				if err != nil {
+					t.Fatalf("%v: error building report: %+v", tc.name, err)
+				}
+				if err := ep.Send(r); err != nil {
+					t.Fatalf("%v: error sending report: %+v", tc.name, err)
+				}
+				if !received.Equal(report) {
+					t.Fatalf("%v: received report: expected %+v, got %+v", tc.name, report, received)
+				}
+			}
+			srv.Close()
+
+			// A receiver that rejects a compressed report receives it again, uncompressed, and
+			// every later report uncompressed.
+			want := []string{tc.want, tc.want}
+			if tc.rejectGzip {
+				want = []string{"gzip", "", ""}
+			}
+			if !reflect.DeepEqual(want, encodings) {
+				t.Fatalf("%v: Content-Encoding: expected %q, got %q", tc.name, want, encodings)
+			}
+		}
+	})
+
+	t.Run("Sends with a custom client", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer srv.Close()
+
+		var sent []string
+		client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			sent = append(sent, req.URL.Path)
+			return http.DefaultTransport.RoundTrip(req)
+		})}
+		ep := NewForwardEndpoint("forward", srv.URL, false, TransportOptions{Client: client})
+		r, err := ep.BuildReport(report)
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		if err := ep.Send(r); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+		if len(sent) != 1 || sent[0] != "/report" {
+			t.Fatalf("requests sent with the custom client: expected [/report], got %v", sent)
+		}
+		if ep.client.Timeout != forwardTimeout {
+			t.Fatalf("client timeout: expected %v, got %v", forwardTimeout, ep.client.Timeout)
+		}
+		if client.Timeout != 0 {
+			t.Fatalf("expected the custom client not to be modified, got timeout %v", client.Timeout)
+		}
+	})
+
+	t.Run("Error status is retryable", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer srv.Close()
+
+		ep := NewForwardEndpoint("forward", srv.URL, false, TransportOptions{})
+		r, err := ep.BuildReport(report)
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		err = ep.Send(r)
+		if gerr, ok := err.(*googleapi.Error); !ok || gerr.Code != http.StatusInternalServerError {
+			t.Fatalf("expected googleapi.Error with status 500, got: %+v", err)
+		}
+		if !ep.IsTransient(err) {
+			t.Fatal("expected error to be transient")
+		}
+	})
+
+	t.Run("Client errors are permanent", func(t *testing.T) {
+		for code, transient := range map[int]bool{
+			http.StatusBadRequest:      false,
+			http.StatusForbidden:       false,
+			http.StatusRequestTimeout:  true,
+			http.StatusTooManyRequests: true,
+		} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(code)
+			}))
+			ep := NewForwardEndpoint("forward", srv.URL, false, TransportOptions{})
+			r, err := ep.BuildReport(report)
+			if err != nil {
+				t.Fatalf("error building report: %+v", err)
+			}
+			err = ep.Send(r)
+			srv.Close()
+			if got := ep.IsTransient(err); got != transient {
+				t.Fatalf("status %v: IsTransient: want=%v, got=%v", code, transient, got)
+			}
+		}
+	})
+
+	t.Run("Rate limit responses ask for a retry delay", func(t *testing.T) {
+		now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+		for _, tc := range []struct {
+			code       int
+			retryAfter string
+			want       time.Duration
+			wantOk     bool
+		}{
+			{http.StatusTooManyRequests, "30", 30 * time.Second, true},
+			{http.StatusServiceUnavailable, "5", 5 * time.Second, true},
+			{http.StatusTooManyRequests, now.Add(2 * time.Minute).Format(http.TimeFormat), 2 * time.Minute, true},
+			{http.StatusTooManyRequests, now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+			{http.StatusTooManyRequests, "", 0, false},
+			{http.StatusTooManyRequests, "soon", 0, false},
+			{http.StatusInternalServerError, "30", 0, false},
+		} {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(tc.code)
+			}))
+			ep := NewForwardEndpoint("forward", srv.URL, false, TransportOptions{})
+			r, err := ep.BuildReport(report)
+			if err != nil {
+				t.Fatalf("error building report: %+v", err)
+			}
+			err = ep.Send(r)
+			srv.Close()
+			got, ok := ep.RetryAfter(err, now)
+			if got != tc.want || ok != tc.wantOk {
+				t.Fatalf("status %v, Retry-After %q: want=%v,%v, got=%v,%v", tc.code, tc.retryAfter, tc.want, tc.wantOk, got, ok)
+			}
+		}
+	})
+}
+
+// roundTripperFunc is an http.RoundTripper implemented by a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
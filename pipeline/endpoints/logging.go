@@ -0,0 +1,68 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+)
+
+// LoggingEndpoint is an Endpoint that logs each report it's asked to send, and sends nothing. It
+// stands in for real endpoints when the agent runs in dry-run mode.
+type LoggingEndpoint struct {
+	name string
+	logf func(format string, args ...interface{})
+}
+
+// NewLoggingEndpoint creates a new LoggingEndpoint that logs reports to the INFO log.
+func NewLoggingEndpoint(name string) *LoggingEndpoint {
+	return newLoggingEndpoint(name, glog.Infof)
+}
+
+func newLoggingEndpoint(name string, logf func(format string, args ...interface{})) *LoggingEndpoint {
+	return &LoggingEndpoint{name: name, logf: logf}
+}
+
+func (ep *LoggingEndpoint) Name() string {
+	return ep.name
+}
+
+func (ep *LoggingEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	return pipeline.NewEndpointReport(r, nil)
+}
+
+func (ep *LoggingEndpoint) Send(r pipeline.EndpointReport) error {
+	if len(r.Values) > 0 {
+		ep.logf("dry run: endpoint %v: report %v: %v %v-%v labels=%v values=%+v", ep.name, r.Id, r.Name,
+			r.StartTime, r.EndTime, r.Labels, r.Values)
+		return nil
+	}
+	ep.logf("dry run: endpoint %v: report %v: %v %v-%v labels=%v value=%+v", ep.name, r.Id, r.Name,
+		r.StartTime, r.EndTime, r.Labels, r.Value)
+	return nil
+}
+
+// Use is a no-op. LoggingEndpoint doesn't track usage.
+func (ep *LoggingEndpoint) Use() {}
+
+// Release is a no-op. LoggingEndpoint doesn't track usage.
+func (ep *LoggingEndpoint) Release() error {
+	return nil
+}
+
+func (ep *LoggingEndpoint) IsTransient(err error) bool {
+	return false
+}
@@ -0,0 +1,58 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+)
+
+func TestLoggingEndpoint(t *testing.T) {
+	var logged []string
+	ep := newLoggingEndpoint("dryrun", func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	})
+
+	report, err := ep.BuildReport(metrics.StampedMetricReport{
+		Id: "report1",
+		MetricReport: metrics.MetricReport{
+			Name:      "int-metric1",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error building report: %+v", err)
+	}
+	if err := ep.Send(report); err != nil {
+		t.Fatalf("error sending report: %+v", err)
+	}
+
+	if len(logged) != 1 {
+		t.Fatalf("expected 1 log entry, got %v", len(logged))
+	}
+	for _, s := range []string{"dryrun", "report1", "int-metric1"} {
+		if !strings.Contains(logged[0], s) {
+			t.Fatalf("expected log entry to contain %q, got: %v", s, logged[0])
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+)
+
+type prefixingEndpoint struct {
+	pipeline.Endpoint
+	prefix string
+}
+
+// BuildReport passes delegate a copy of r whose metric name begins with the endpoint's prefix.
+func (ep *prefixingEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	r.Name = ep.prefix + r.Name
+	return ep.Endpoint.BuildReport(r)
+}
+
+func (ep *prefixingEndpoint) SendBatch(reports []pipeline.EndpointReport) error {
+	return sendBatch(ep.Endpoint, reports)
+}
+
+func (ep *prefixingEndpoint) MaxBatch() int {
+	return maxBatch(ep.Endpoint)
+}
+
+func (ep *prefixingEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	return retryAfter(ep.Endpoint, err, now)
+}
+
+// NewPrefixingEndpoint creates an Endpoint that adds prefix to the metric name of each report before
+// it's built by delegate, so that metrics from several agents sharing a backend don't collide.
+// Reports are copied, so the prefix doesn't affect other endpoints or aggregation.
+func NewPrefixingEndpoint(delegate pipeline.Endpoint, prefix string) pipeline.Endpoint {
+	return &prefixingEndpoint{Endpoint: delegate, prefix: prefix}
+}
@@ -0,0 +1,53 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestPrefixingEndpoint(t *testing.T) {
+	report := metrics.StampedMetricReport{
+		Id: "report1",
+		MetricReport: metrics.MetricReport{
+			Name:      "int-metric1",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Value:     metrics.MetricValue{Int64Value: 10},
+		},
+	}
+
+	mock := testlib.NewMockEndpoint("mock")
+	ep := NewPrefixingEndpoint(mock, "teamA/")
+	r, err := ep.BuildReport(report)
+	if err != nil {
+		t.Fatalf("error building report: %+v", err)
+	}
+	if err := ep.Send(r); err != nil {
+		t.Fatalf("error sending report: %+v", err)
+	}
+	if want, got := "teamA/int-metric1", mock.Reports()[0].Name; want != got {
+		t.Fatalf("name: want=%v, got=%v", want, got)
+	}
+
+	// The original report is unchanged.
+	if want, got := "int-metric1", report.Name; want != got {
+		t.Fatalf("original name: want=%v, got=%v", want, got)
+	}
+}
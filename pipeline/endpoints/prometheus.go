@@ -0,0 +1,234 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/clock"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+)
+
+const prometheusPath = "/metrics/usage"
+
+// PrometheusEndpoint is an Endpoint that keeps the latest value sent for each metric and label set,
+// and exposes them for Prometheus to scrape, as gauges in the Prometheus text exposition format. A
+// compound metric's named values are exposed as separate series, named "<metric>_<value name>".
+// Metric and label names are changed, if needed, to valid Prometheus names by replacing invalid
+// characters with underscores. A metric's unit, if its definition has one, is exposed in a "# UNIT"
+// line, which Prometheus's text format parser treats as a comment.
+type PrometheusEndpoint struct {
+	name       string
+	expiration time.Duration
+	units      map[string]string
+	matcher    *metrics.Matcher
+	clock      clock.Clock
+	addr       net.Addr
+	srv        *http.Server
+	series     map[string]*prometheusSeries
+	mu         sync.Mutex
+	tracker    pipeline.UsageTracker
+}
+
+type prometheusSeries struct {
+	name    string
+	unit    string
+	labels  string // Formatted, e.g. {key="value"}.
+	value   float64
+	updated time.Time
+}
+
+// NewPrometheusEndpoint creates a new PrometheusEndpoint that serves the "/metrics/usage" path on
+// the given address. If expiration is positive, a series is no longer exposed once that long has
+// passed since a report last updated it. Units maps metric names and patterns, as defined in
+// metric definitions, to their units; a report's unit is that of the best match for its name (see
+// metrics.BestMatch).
+func NewPrometheusEndpoint(name, address string, expiration time.Duration, units map[string]string) (*PrometheusEndpoint, error) {
+	return newPrometheusEndpoint(name, address, expiration, units, clock.NewClock())
+}
+
+func newPrometheusEndpoint(name, address string, expiration time.Duration, units map[string]string, clock clock.Clock) (*PrometheusEndpoint, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(units))
+	for name := range units {
+		names = append(names, name)
+	}
+	ep := &PrometheusEndpoint{
+		name:       name,
+		expiration: expiration,
+		units:      units,
+		matcher:    metrics.NewMatcher(names),
+		clock:      clock,
+		addr:       listener.Addr(),
+		series:     make(map[string]*prometheusSeries),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(prometheusPath, ep.handleScrape)
+	ep.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := ep.srv.Serve(listener); err != http.ErrServerClosed {
+			glog.Errorf("PrometheusEndpoint %v: %+v", name, err)
+		}
+	}()
+	return ep, nil
+}
+
+func (ep *PrometheusEndpoint) Name() string {
+	return ep.name
+}
+
+// Addr returns the address on which the PrometheusEndpoint is listening.
+func (ep *PrometheusEndpoint) Addr() net.Addr {
+	return ep.addr
+}
+
+func (ep *PrometheusEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	return pipeline.NewEndpointReport(r, nil)
+}
+
+// Send replaces the value of the report's series, or of each of its named values' series.
+func (ep *PrometheusEndpoint) Send(r pipeline.EndpointReport) error {
+	name := prometheusName(r.Name, false)
+	labels := prometheusLabels(r.Labels)
+	var unit string
+	if match, ok := ep.matcher.Match(r.Name); ok {
+		unit = ep.units[match]
+	}
+	now := ep.clock.Now()
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if len(r.Values) == 0 {
+		ep.update(name, unit, labels, prometheusValue(r.Value), now)
+		return nil
+	}
+	for valueName, v := range r.Values {
+		ep.update(name+"_"+prometheusName(valueName, false), unit, labels, prometheusValue(v), now)
+	}
+	return nil
+}
+
+// update sets the value of a series. The caller must hold ep.mu.
+func (ep *PrometheusEndpoint) update(name, unit, labels string, value float64, now time.Time) {
+	ep.series[name+labels] = &prometheusSeries{name: name, unit: unit, labels: labels, value: value, updated: now}
+}
+
+func (ep *PrometheusEndpoint) handleScrape(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(ep.exposition())
+}
+
+// exposition removes expired series, and formats the rest in the text exposition format, grouped by
+// name.
+func (ep *PrometheusEndpoint) exposition() []byte {
+	ep.mu.Lock()
+	var series []*prometheusSeries
+	for key, s := range ep.series {
+		if ep.expiration > 0 && ep.clock.Now().Sub(s.updated) >= ep.expiration {
+			delete(ep.series, key)
+			continue
+		}
+		series = append(series, s)
+	}
+	ep.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+	var buf bytes.Buffer
+	for i, s := range series {
+		if i == 0 || series[i-1].name != s.name {
+			fmt.Fprintf(&buf, "# TYPE %v gauge\n", s.name)
+			if s.unit != "" {
+				fmt.Fprintf(&buf, "# UNIT %v %v\n", s.name, s.unit)
+			}
+		}
+		fmt.Fprintf(&buf, "%v%v %v\n", s.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+	return buf.Bytes()
+}
+
+func prometheusValue(v metrics.MetricValue) float64 {
+	if v.DoubleValue != 0 {
+		return v.DoubleValue
+	}
+	return float64(v.Int64Value)
+}
+
+// prometheusLabels formats labels, sorted by key, as a Prometheus label set.
+func prometheusLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf(`%v="%v"`, prometheusName(k, true), escaper.Replace(labels[k]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// prometheusName replaces the characters of name that aren't valid in a Prometheus metric name, or
+// a label name if label is true, with underscores.
+func prometheusName(name string, label bool) string {
+	var b strings.Builder
+	for i, c := range name {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9') || (!label && c == ':')
+		if valid {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// Use increments the PrometheusEndpoint's usage count.
+// See pipeline.Component.Use.
+func (ep *PrometheusEndpoint) Use() {
+	ep.tracker.Use()
+}
+
+// Release decrements the PrometheusEndpoint's usage count. If it reaches 0, Release stops the HTTP
+// server.
+// See pipeline.Component.Release.
+func (ep *PrometheusEndpoint) Release() error {
+	return ep.tracker.Release(func() error {
+		return ep.srv.Close()
+	})
+}
+
+func (ep *PrometheusEndpoint) IsTransient(err error) bool {
+	return false
+}
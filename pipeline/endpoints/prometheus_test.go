@@ -0,0 +1,167 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestPrometheusEndpoint(t *testing.T) {
+	newReport := func(name string, labels map[string]string, value metrics.MetricValue) metrics.StampedMetricReport {
+		return metrics.StampedMetricReport{
+			Id: "report1",
+			MetricReport: metrics.MetricReport{
+				Name:      name,
+				StartTime: time.Unix(0, 0).UTC(),
+				EndTime:   time.Unix(1, 0).UTC(),
+				Labels:    labels,
+				Value:     value,
+			},
+		}
+	}
+	send := func(t *testing.T, ep *PrometheusEndpoint, r metrics.StampedMetricReport) {
+		er, err := ep.BuildReport(r)
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		if err := ep.Send(er); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+	}
+	scrape := func(t *testing.T, ep *PrometheusEndpoint) string {
+		resp, err := http.Get("http://" + ep.Addr().String() + prometheusPath)
+		if err != nil {
+			t.Fatalf("error scraping: %+v", err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("error reading scrape: %+v", err)
+		}
+		return string(body)
+	}
+
+	t.Run("Sent reports are exposed", func(t *testing.T) {
+		mc := testlib.NewMockClock()
+		ep, err := newPrometheusEndpoint("prometheus", "localhost:0", time.Hour, nil, mc)
+		if err != nil {
+			t.Fatalf("error creating endpoint: %+v", err)
+		}
+		ep.Use()
+		defer ep.Release()
+
+		send(t, ep, newReport("requests", map[string]string{"tenant": "a", "region": "us"}, metrics.MetricValue{Int64Value: 10}))
+		send(t, ep, newReport("requests", map[string]string{"tenant": "b"}, metrics.MetricValue{Int64Value: 3}))
+		// A later report replaces the series' value.
+		send(t, ep, newReport("requests", map[string]string{"tenant": "b"}, metrics.MetricValue{Int64Value: 4}))
+		send(t, ep, newReport("cpu.seconds", map[string]string{"user-id": `x"y`}, metrics.MetricValue{DoubleValue: 1.5}))
+
+		expected := "# TYPE cpu_seconds gauge\n" +
+			`cpu_seconds{user_id="x\"y"} 1.5` + "\n" +
+			"# TYPE requests gauge\n" +
+			`requests{region="us",tenant="a"} 10` + "\n" +
+			`requests{tenant="b"} 4` + "\n"
+		if got := scrape(t, ep); got != expected {
+			t.Fatalf("exposition: expected:\n%v\ngot:\n%v", expected, got)
+		}
+	})
+
+	t.Run("Named values are separate series", func(t *testing.T) {
+		ep, err := newPrometheusEndpoint("prometheus", "localhost:0", 0, nil, testlib.NewMockClock())
+		if err != nil {
+			t.Fatalf("error creating endpoint: %+v", err)
+		}
+		ep.Use()
+		defer ep.Release()
+
+		r := newReport("usage", nil, metrics.MetricValue{})
+		r.Values = map[string]metrics.MetricValue{"cpu": {DoubleValue: 0.5}, "memory": {Int64Value: 64}}
+		send(t, ep, r)
+
+		expected := "# TYPE usage_cpu gauge\nusage_cpu 0.5\n# TYPE usage_memory gauge\nusage_memory 64\n"
+		if got := string(ep.exposition()); got != expected {
+			t.Fatalf("exposition: expected:\n%v\ngot:\n%v", expected, got)
+		}
+	})
+
+	t.Run("Units from metric definitions are exposed", func(t *testing.T) {
+		units := map[string]string{"requests": "{request}", "transfer.*": "By", "transfer.errors": "", "usage": "s"}
+		ep, err := newPrometheusEndpoint("prometheus", "localhost:0", 0, units, testlib.NewMockClock())
+		if err != nil {
+			t.Fatalf("error creating endpoint: %+v", err)
+		}
+		ep.Use()
+		defer ep.Release()
+
+		send(t, ep, newReport("requests", nil, metrics.MetricValue{Int64Value: 10}))
+		// A wildcard definition's unit applies to the metrics it matches, unless a more specific
+		// definition has none.
+		send(t, ep, newReport("transfer.in", nil, metrics.MetricValue{Int64Value: 512}))
+		send(t, ep, newReport("transfer.errors", nil, metrics.MetricValue{Int64Value: 1}))
+		// Each of a compound metric's series has the metric's unit.
+		r := newReport("usage", nil, metrics.MetricValue{})
+		r.Values = map[string]metrics.MetricValue{"cpu": {DoubleValue: 0.5}}
+		send(t, ep, r)
+		// A metric without a definition has no unit.
+		send(t, ep, newReport("other", nil, metrics.MetricValue{Int64Value: 2}))
+
+		expected := "# TYPE other gauge\nother 2\n" +
+			"# TYPE requests gauge\n# UNIT requests {request}\nrequests 10\n" +
+			"# TYPE transfer_errors gauge\ntransfer_errors 1\n" +
+			"# TYPE transfer_in gauge\n# UNIT transfer_in By\ntransfer_in 512\n" +
+			"# TYPE usage_cpu gauge\n# UNIT usage_cpu s\nusage_cpu 0.5\n"
+		if got := scrape(t, ep); got != expected {
+			t.Fatalf("exposition: expected:\n%v\ngot:\n%v", expected, got)
+		}
+	})
+
+	t.Run("Stale series expire", func(t *testing.T) {
+		mc := testlib.NewMockClock()
+		ep, err := newPrometheusEndpoint("prometheus", "localhost:0", time.Hour, nil, mc)
+		if err != nil {
+			t.Fatalf("error creating endpoint: %+v", err)
+		}
+		ep.Use()
+		defer ep.Release()
+
+		start := mc.Now()
+		send(t, ep, newReport("requests", map[string]string{"tenant": "a"}, metrics.MetricValue{Int64Value: 1}))
+		mc.SetNow(start.Add(30 * time.Minute))
+		send(t, ep, newReport("requests", map[string]string{"tenant": "b"}, metrics.MetricValue{Int64Value: 2}))
+
+		mc.SetNow(start.Add(59 * time.Minute))
+		expected := "# TYPE requests gauge\n" + `requests{tenant="a"} 1` + "\n" + `requests{tenant="b"} 2` + "\n"
+		if got := string(ep.exposition()); got != expected {
+			t.Fatalf("exposition before expiry: expected:\n%v\ngot:\n%v", expected, got)
+		}
+
+		mc.SetNow(start.Add(time.Hour))
+		expected = "# TYPE requests gauge\n" + `requests{tenant="b"} 2` + "\n"
+		if got := string(ep.exposition()); got != expected {
+			t.Fatalf("exposition after expiry: expected:\n%v\ngot:\n%v", expected, got)
+		}
+
+		mc.SetNow(start.Add(90 * time.Minute))
+		if got := string(ep.exposition()); got != "" {
+			t.Fatalf("exposition after all expired: expected nothing, got:\n%v", got)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+)
+
+type redactingEndpoint struct {
+	pipeline.Endpoint
+	allowed  map[string]bool
+	redacted map[string]bool
+}
+
+// BuildReport passes delegate a copy of r from which disallowed labels have been removed.
+func (ep *redactingEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	labels := make(map[string]string, len(r.Labels))
+	for k, v := range r.Labels {
+		if ep.redacted[k] || (ep.allowed != nil && !ep.allowed[k]) {
+			continue
+		}
+		labels[k] = v
+	}
+	r.Labels = labels
+	return ep.Endpoint.BuildReport(r)
+}
+
+func (ep *redactingEndpoint) SendBatch(reports []pipeline.EndpointReport) error {
+	return sendBatch(ep.Endpoint, reports)
+}
+
+func (ep *redactingEndpoint) MaxBatch() int {
+	return maxBatch(ep.Endpoint)
+}
+
+func (ep *redactingEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	return retryAfter(ep.Endpoint, err, now)
+}
+
+// NewRedactingEndpoint creates an Endpoint that removes labels from each report before it's built
+// by delegate. If allowed is non-empty, only the labels it lists are kept; labels listed in redacted
+// are always removed. Reports are copied, so redaction doesn't affect other endpoints or
+// aggregation.
+func NewRedactingEndpoint(delegate pipeline.Endpoint, allowed, redacted []string) pipeline.Endpoint {
+	ep := &redactingEndpoint{Endpoint: delegate, redacted: make(map[string]bool)}
+	if len(allowed) > 0 {
+		ep.allowed = make(map[string]bool)
+		for _, k := range allowed {
+			ep.allowed[k] = true
+		}
+	}
+	for _, k := range redacted {
+		ep.redacted[k] = true
+	}
+	return ep
+}
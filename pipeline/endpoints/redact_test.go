@@ -0,0 +1,98 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestRedactingEndpoint(t *testing.T) {
+	report := metrics.StampedMetricReport{
+		Id: "report1",
+		MetricReport: metrics.MetricReport{
+			Name:      "int-metric1",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Labels:    map[string]string{"tenant": "a", "user": "alice", "region": "us"},
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		},
+	}
+
+	billing := testlib.NewMockEndpoint("billing")
+	analytics := testlib.NewMockEndpoint("analytics")
+	eps := []struct {
+		ep       *testlib.MockEndpoint
+		redacted pipeline.Endpoint
+		expected map[string]string
+	}{
+		{billing, NewRedactingEndpoint(billing, nil, []string{"region"}), map[string]string{"tenant": "a", "user": "alice"}},
+		{analytics, NewRedactingEndpoint(analytics, []string{"tenant", "region"}, nil), map[string]string{"tenant": "a", "region": "us"}},
+	}
+	for _, e := range eps {
+		r, err := e.redacted.BuildReport(report)
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+		if err := e.redacted.Send(r); err != nil {
+			t.Fatalf("error sending report: %+v", err)
+		}
+		if want, got := e.expected, e.ep.Reports()[0].Labels; !reflect.DeepEqual(want, got) {
+			t.Fatalf("%v labels: want=%v, got=%v", e.ep.Name(), want, got)
+		}
+	}
+
+	// The original report, shared with aggregation, is unchanged.
+	if want, got := map[string]string{"tenant": "a", "user": "alice", "region": "us"}, report.Labels; !reflect.DeepEqual(want, got) {
+		t.Fatalf("original labels: want=%v, got=%v", want, got)
+	}
+}
+
+func TestRedactingEndpoint_Batches(t *testing.T) {
+	report := metrics.StampedMetricReport{
+		Id:           "report1",
+		MetricReport: metrics.MetricReport{Name: "int-metric1", Labels: map[string]string{"user": "alice"}},
+	}
+
+	// An endpoint that doesn't batch is sent each report of a batch individually.
+	mock := testlib.NewMockEndpoint("mock")
+	redacted := NewRedactingEndpoint(mock, nil, []string{"user"}).(pipeline.Batcher)
+	if want, got := 1, redacted.MaxBatch(); want != got {
+		t.Fatalf("MaxBatch: want=%v, got=%v", want, got)
+	}
+	r, err := redacted.(pipeline.Endpoint).BuildReport(report)
+	if err != nil {
+		t.Fatalf("error building report: %+v", err)
+	}
+	if err := redacted.SendBatch([]pipeline.EndpointReport{r, r}); err != nil {
+		t.Fatalf("error sending batch: %+v", err)
+	}
+	if want, got := 2, len(mock.Reports()); want != got {
+		t.Fatalf("len(mock.Reports()): want=%v, got=%v", want, got)
+	}
+
+	// A batching endpoint's batch size is passed through.
+	dd := NewDatadogEndpoint("datadog", "key", "", 0, nil, TransportOptions{})
+	if want, got := defaultDatadogBatchSize, NewRedactingEndpoint(dd, nil, nil).(pipeline.Batcher).MaxBatch(); want != got {
+		t.Fatalf("MaxBatch: want=%v, got=%v", want, got)
+	}
+}
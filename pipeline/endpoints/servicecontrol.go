@@ -18,6 +18,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
+	"sort"
 	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
@@ -25,6 +27,7 @@ import (
 	"github.com/GoogleCloudPlatform/ubbagent/clock"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
 	"github.com/golang/glog"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/servicecontrol/v1"
@@ -48,13 +51,17 @@ type ServiceControlEndpoint struct {
 	clock       clock.Clock
 }
 
-// NewServiceControlEndpoint creates a new ServiceControlEndpoint.
-func NewServiceControlEndpoint(name, serviceName, agentId string, consumerId string, jsonKey []byte) (*ServiceControlEndpoint, error) {
+// NewServiceControlEndpoint creates a new ServiceControlEndpoint. Connections are reused according
+// to transport.
+func NewServiceControlEndpoint(name, serviceName, agentId string, consumerId string, jsonKey []byte, transport TransportOptions) (*ServiceControlEndpoint, error) {
 	config, err := google.JWTConfigFromJSON(jsonKey, servicecontrol.ServicecontrolScope)
 	if err != nil {
 		return nil, err
 	}
-	client := config.Client(context.Background())
+	// The oauth2 client, including its token requests, uses the HTTP client found in the context. The
+	// oauth2 client's own timeout applies to sends.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, newClient(transport, 0))
+	client := config.Client(ctx)
 	client.Timeout = timeout
 	service, err := servicecontrol.New(client)
 	if err != nil {
@@ -117,31 +124,57 @@ func (ep *ServiceControlEndpoint) BuildReport(r metrics.StampedMetricReport) (pi
 	return pipeline.NewEndpointReport(r, nil)
 }
 
-func (ep *ServiceControlEndpoint) format(r pipeline.EndpointReport) *servicecontrol.Operation {
-	value := servicecontrol.MetricValue{
-		StartTime: r.StartTime.UTC().Format(time.RFC3339Nano),
-		EndTime:   r.EndTime.UTC().Format(time.RFC3339Nano),
+// Probe sends a Check request for an empty operation, which verifies that the service exists and
+// that the agent's credentials permit reporting for the consumer.
+// See pipeline.Prober.
+func (ep *ServiceControlEndpoint) Probe(ctx context.Context) error {
+	now := ep.clock.Now().UTC().Format(time.RFC3339Nano)
+	checkReq := &servicecontrol.CheckRequest{
+		Operation: &servicecontrol.Operation{
+			OperationId:   "probe-" + ep.agentId,
+			OperationName: fmt.Sprintf("%v/report", ep.serviceName),
+			StartTime:     now,
+			EndTime:       now,
+			ConsumerId:    ep.consumerId,
+		},
 	}
-	if r.Value.Int64Value != 0 {
-		value.Int64Value = &r.Value.Int64Value
-	} else if r.Value.DoubleValue != 0 {
-		value.DoubleValue = &r.Value.DoubleValue
+	resp, err := ep.service.Services.Check(ep.serviceName, checkReq).Context(ctx).Do()
+	if err != nil && !googleapi.IsNotModified(err) {
+		return err
+	}
+	if resp != nil && len(resp.CheckErrors) > 0 {
+		return fmt.Errorf("servicecontrol: check failed: %v: %v", resp.CheckErrors[0].Code, resp.CheckErrors[0].Detail)
+	}
+	return nil
+}
+
+// format converts r to a ServiceControl Operation. A report of a compound metric produces a
+// MetricValueSet for each of its named values, whose metric name is suffixed with the value name.
+func (ep *ServiceControlEndpoint) format(r pipeline.EndpointReport) *servicecontrol.Operation {
+	var valueSets []*servicecontrol.MetricValueSet
+	if len(r.Values) == 0 {
+		valueSets = append(valueSets, ep.valueSet(r, fmt.Sprintf("%v/%v", ep.serviceName, r.Name), r.Value))
+	} else {
+		names := make([]string, 0, len(r.Values))
+		for name := range r.Values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			metricName := fmt.Sprintf("%v/%v/%v", ep.serviceName, r.Name, name)
+			valueSets = append(valueSets, ep.valueSet(r, metricName, r.Values[name]))
+		}
 	}
 
 	op := &servicecontrol.Operation{
 		OperationId: r.Id,
 		// ServiceControl requires this field but doesn't indicate what it's supposed to be.
-		OperationName: fmt.Sprintf("%v/report", ep.serviceName),
-		StartTime:     r.StartTime.UTC().Format(time.RFC3339Nano),
-		EndTime:       r.EndTime.UTC().Format(time.RFC3339Nano),
-		ConsumerId:    ep.consumerId,
-		UserLabels:    r.Labels,
-		MetricValueSets: []*servicecontrol.MetricValueSet{
-			{
-				MetricName:   fmt.Sprintf("%v/%v", ep.serviceName, r.Name),
-				MetricValues: []*servicecontrol.MetricValue{&value},
-			},
-		},
+		OperationName:   fmt.Sprintf("%v/report", ep.serviceName),
+		StartTime:       r.StartTime.UTC().Format(time.RFC3339Nano),
+		EndTime:         r.EndTime.UTC().Format(time.RFC3339Nano),
+		ConsumerId:      ep.consumerId,
+		UserLabels:      r.Labels,
+		MetricValueSets: valueSets,
 	}
 
 	if op.UserLabels == nil {
@@ -154,6 +187,22 @@ func (ep *ServiceControlEndpoint) format(r pipeline.EndpointReport) *servicecont
 	return op
 }
 
+func (ep *ServiceControlEndpoint) valueSet(r pipeline.EndpointReport, metricName string, mv metrics.MetricValue) *servicecontrol.MetricValueSet {
+	value := servicecontrol.MetricValue{
+		StartTime: r.StartTime.UTC().Format(time.RFC3339Nano),
+		EndTime:   r.EndTime.UTC().Format(time.RFC3339Nano),
+	}
+	if mv.Int64Value != 0 {
+		value.Int64Value = &mv.Int64Value
+	} else if mv.DoubleValue != 0 {
+		value.DoubleValue = &mv.DoubleValue
+	}
+	return &servicecontrol.MetricValueSet{
+		MetricName:   metricName,
+		MetricValues: []*servicecontrol.MetricValue{&value},
+	}
+}
+
 // Use is a no-op. ServiceControlEndpoint doesn't track usage.
 func (ep *ServiceControlEndpoint) Use() {}
 
@@ -162,14 +211,20 @@ func (ep *ServiceControlEndpoint) Release() error {
 	return nil
 }
 
+// RetryAfter returns the delay requested by the Retry-After header of a 429 or 503 response.
+// See pipeline.RetryAdvisor.
+func (ep *ServiceControlEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	return retryAfterHTTPError(err, now)
+}
+
 func (ep *ServiceControlEndpoint) IsTransient(err error) bool {
 	if err == nil {
 		return false
 	}
 	switch v := err.(type) {
 	case *googleapi.Error:
-		// Return true if this is an http error with a 5xx code.
-		return v.Code >= 500 && v.Code < 600
+		// Return true if this is an http error with a 5xx code, or a rate limit.
+		return (v.Code >= 500 && v.Code < 600) || v.Code == http.StatusTooManyRequests
 	case net.Error:
 		// Return true if this error is considered temporary or a timeout.
 		return v.Temporary() || v.Timeout()
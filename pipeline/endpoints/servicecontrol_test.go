@@ -15,6 +15,7 @@
 package endpoints
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
@@ -266,6 +267,55 @@ func TestServiceControlEndpoint(t *testing.T) {
 		}
 	})
 
+	t.Run("Compound metric values", func(t *testing.T) {
+		report, err := ep.BuildReport(metrics.StampedMetricReport{
+			Id: "report2",
+			MetricReport: metrics.MetricReport{
+				Name:      "transfer",
+				StartTime: time.Unix(2, 0),
+				EndTime:   time.Unix(3, 0),
+				Values: map[string]metrics.MetricValue{
+					"bytes_out": {Int64Value: 5},
+					"bytes_in":  {Int64Value: 10},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("error building report: %+v", err)
+		}
+
+		op := ep.format(report)
+		var names []string
+		var values []int64
+		for _, vs := range op.MetricValueSets {
+			names = append(names, vs.MetricName)
+			values = append(values, *vs.MetricValues[0].Int64Value)
+		}
+		if want := []string{"test-service.appspot.com/transfer/bytes_in", "test-service.appspot.com/transfer/bytes_out"}; !reflect.DeepEqual(want, names) {
+			t.Fatalf("metric names: want=%v, got=%v", want, names)
+		}
+		if want := []int64{10, 5}; !reflect.DeepEqual(want, values) {
+			t.Fatalf("metric values: want=%v, got=%v", want, values)
+		}
+	})
+
+	t.Run("Probe sends a check", func(t *testing.T) {
+		checks := handler.checkCount
+		if err := ep.Probe(context.Background()); err != nil {
+			t.Fatalf("error probing: %+v", err)
+		}
+		if handler.checkCount != checks+1 {
+			t.Fatalf("checkCount: want=%v, got=%v", checks+1, handler.checkCount)
+		}
+		req := servicecontrol.CheckRequest{}
+		if err := json.Unmarshal(handler.body, &req); err != nil {
+			t.Fatalf("unmarshalling request: %+v", err)
+		}
+		if req.Operation.ConsumerId != "project_number:1234567" {
+			t.Fatalf("ConsumerId: want=%v, got=%v", "project_number:1234567", req.Operation.ConsumerId)
+		}
+	})
+
 	t.Run("IsTransient tests", func(t *testing.T) {
 		cases := []struct {
 			err       error
@@ -275,6 +325,7 @@ func TestServiceControlEndpoint(t *testing.T) {
 			{errors.New("foo"), true},
 			{&googleapi.Error{Code: 404}, false},
 			{&googleapi.Error{Code: 401}, false},
+			{&googleapi.Error{Code: 429}, true},
 			{&googleapi.Error{Code: 500}, true},
 			{&googleapi.Error{Code: 503}, true},
 			{&googleapi.Error{Code: 599}, true},
@@ -0,0 +1,94 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultMaxIdleConns    = 10
+	defaultIdleConnTimeout = 90 * time.Second
+	defaultMaxConnsPerHost = 10
+)
+
+// TransportOptions tunes connection reuse by the HTTP transport of an HTTP-based endpoint. Zero
+// fields use defaults suited to an endpoint that sends a steady stream of reports to a single host:
+// up to 10 idle connections, kept for 90 seconds, and at most 10 connections in total.
+type TransportOptions struct {
+	// MaxIdleConns is the maximum number of idle (keep-alive) connections kept for reuse.
+	MaxIdleConns int
+
+	// IdleConnTimeout is how long an idle connection is kept before it's closed.
+	IdleConnTimeout time.Duration
+
+	// MaxConnsPerHost limits the number of connections, active or idle, to a single host.
+	MaxConnsPerHost int
+
+	// Client, if set, is used instead of a client with a transport built from the other options, such
+	// as to send through a proxy or to trust custom root CAs. If its Timeout is zero, the endpoint's
+	// default timeout applies.
+	Client *http.Client
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// newTransport creates an http.Transport with the given options that opens connections with dial.
+func newTransport(opts TransportOptions, dial dialFunc) *http.Transport {
+	if opts.MaxIdleConns <= 0 {
+		opts.MaxIdleConns = defaultMaxIdleConns
+	}
+	if opts.IdleConnTimeout <= 0 {
+		opts.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if opts.MaxConnsPerHost <= 0 {
+		opts.MaxConnsPerHost = defaultMaxConnsPerHost
+	}
+	return &http.Transport{
+		Proxy:       http.ProxyFromEnvironment,
+		DialContext: dial,
+		// Endpoints send to a single host, so all idle connections may be kept for it rather than
+		// the default of 2 per host.
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConns,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		MaxConnsPerHost:       opts.MaxConnsPerHost,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewTransport creates an http.Transport for an HTTP-based endpoint with the given options. It
+// doesn't use opts.Client.
+func NewTransport(opts TransportOptions) *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return newTransport(opts, dialer.DialContext)
+}
+
+// newClient returns the http.Client used by an endpoint with the given options and default timeout:
+// a copy of opts.Client, if set, or a client with a transport created by NewTransport.
+func newClient(opts TransportOptions, timeout time.Duration) *http.Client {
+	if opts.Client == nil {
+		return &http.Client{Timeout: timeout, Transport: NewTransport(opts)}
+	}
+	client := *opts.Client
+	if client.Timeout == 0 {
+		client.Timeout = timeout
+	}
+	return &client
+}
@@ -0,0 +1,108 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+)
+
+// countingDialer counts the connections opened through it.
+type countingDialer struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (d *countingDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.count++
+	d.mu.Unlock()
+	return (&net.Dialer{}).DialContext(ctx, network, addr)
+}
+
+func (d *countingDialer) dials() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.count
+}
+
+func TestTransport(t *testing.T) {
+	report, err := pipeline.NewEndpointReport(metrics.StampedMetricReport{
+		Id: "report1",
+		MetricReport: metrics.MetricReport{
+			Name:      "int-metric1",
+			StartTime: time.Unix(0, 0).UTC(),
+			EndTime:   time.Unix(1, 0).UTC(),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("error building report: %+v", err)
+	}
+
+	t.Run("Connections are reused across sends", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("{}"))
+		}))
+		defer srv.Close()
+
+		dialer := &countingDialer{}
+		client := &http.Client{Transport: newTransport(TransportOptions{MaxIdleConns: 1}, dialer.dial)}
+		ep := newForwardEndpoint("forward", srv.URL, false, client)
+		for i := 0; i < 10; i++ {
+			if err := ep.Send(report); err != nil {
+				t.Fatalf("error sending report: %+v", err)
+			}
+		}
+		if dialer.dials() != 1 {
+			t.Fatalf("dials: want=%v, got=%v", 1, dialer.dials())
+		}
+	})
+
+	t.Run("Connections per host are limited", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(10 * time.Millisecond)
+		}))
+		defer srv.Close()
+
+		dialer := &countingDialer{}
+		client := &http.Client{Transport: newTransport(TransportOptions{MaxIdleConns: 2, MaxConnsPerHost: 2}, dialer.dial)}
+		ep := newForwardEndpoint("forward", srv.URL, false, client)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := ep.Send(report); err != nil {
+					t.Errorf("error sending report: %+v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if dialer.dials() > 2 {
+			t.Fatalf("dials: want at most %v, got=%v", 2, dialer.dials())
+		}
+	})
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// WebSocketDrop drops reports for a client whose buffer is full.
+	WebSocketDrop = "drop"
+
+	// WebSocketDisconnect disconnects a client whose buffer is full.
+	WebSocketDisconnect = "disconnect"
+
+	webSocketPath              = "/reports"
+	defaultWebSocketBufferSize = 100
+)
+
+// WebSocketEndpoint is an Endpoint that streams each report it sends, as JSON, to all WebSocket
+// clients connected to it. Reports are not stored: a client only receives reports sent while it's
+// connected. Each client has a buffer of pending reports; when a client can't keep up and its buffer
+// fills, the endpoint either drops reports for that client or disconnects it.
+type WebSocketEndpoint struct {
+	name       string
+	token      string
+	bufferSize int
+	slowClient string
+	timeFormat string
+	addr       net.Addr
+	srv        *http.Server
+	clients    map[*webSocketClient]bool
+	mu         sync.Mutex
+	tracker    pipeline.UsageTracker
+}
+
+type webSocketClient struct {
+	messages chan []byte
+}
+
+// NewWebSocketEndpoint creates a new WebSocketEndpoint that listens on the given address. Clients
+// connect to the "/reports" path. If token is non-empty, clients must provide it either as a
+// "token" query parameter or as a bearer token in the Authorization header. The slowClient policy
+// is one of WebSocketDrop (the default) or WebSocketDisconnect. Report times are written in the
+// given metrics time format; see metrics.MarshalReport.
+func NewWebSocketEndpoint(name, address, token string, bufferSize int, slowClient, timeFormat string) (*WebSocketEndpoint, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if bufferSize <= 0 {
+		bufferSize = defaultWebSocketBufferSize
+	}
+	if slowClient == "" {
+		slowClient = WebSocketDrop
+	}
+	ep := &WebSocketEndpoint{
+		name:       name,
+		token:      token,
+		bufferSize: bufferSize,
+		slowClient: slowClient,
+		timeFormat: timeFormat,
+		addr:       listener.Addr(),
+		clients:    make(map[*webSocketClient]bool),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(webSocketPath, ep.handleConnect)
+	ep.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := ep.srv.Serve(listener); err != http.ErrServerClosed {
+			glog.Errorf("WebSocketEndpoint %v: %+v", name, err)
+		}
+	}()
+	return ep, nil
+}
+
+func (ep *WebSocketEndpoint) Name() string {
+	return ep.name
+}
+
+// Addr returns the address on which the WebSocketEndpoint is listening.
+func (ep *WebSocketEndpoint) Addr() net.Addr {
+	return ep.addr
+}
+
+func (ep *WebSocketEndpoint) BuildReport(r metrics.StampedMetricReport) (pipeline.EndpointReport, error) {
+	return pipeline.NewEndpointReport(r, nil)
+}
+
+// Send streams the report to each connected client. It never blocks on a client, and it only
+// returns an error if the report can't be serialized.
+func (ep *WebSocketEndpoint) Send(r pipeline.EndpointReport) error {
+	jsontext, err := metrics.MarshalReport(r.StampedMetricReport, ep.timeFormat)
+	if err != nil {
+		return err
+	}
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for c := range ep.clients {
+		select {
+		case c.messages <- jsontext:
+		default:
+			if ep.slowClient == WebSocketDisconnect {
+				glog.Warningf("WebSocketEndpoint %v: disconnecting slow client", ep.name)
+				ep.removeClient(c)
+			} else {
+				glog.Warningf("WebSocketEndpoint %v: dropping report %v for slow client", ep.name, r.Id)
+			}
+		}
+	}
+	return nil
+}
+
+func (ep *WebSocketEndpoint) handleConnect(w http.ResponseWriter, r *http.Request) {
+	if !ep.authorized(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// The default websocket.Handler rejects requests without a valid Origin. Access is controlled by
+	// the token instead, so any origin is accepted.
+	websocket.Server{Handler: ep.serveClient}.ServeHTTP(w, r)
+}
+
+func (ep *WebSocketEndpoint) authorized(r *http.Request) bool {
+	if ep.token == "" {
+		return true
+	}
+	provided := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		provided = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(ep.token)) == 1
+}
+
+func (ep *WebSocketEndpoint) serveClient(ws *websocket.Conn) {
+	c := ep.addClient()
+	defer func() {
+		ep.mu.Lock()
+		ep.removeClient(c)
+		ep.mu.Unlock()
+	}()
+	for msg := range c.messages {
+		if err := websocket.Message.Send(ws, string(msg)); err != nil {
+			glog.V(2).Infof("WebSocketEndpoint %v: client write failed: %+v", ep.name, err)
+			return
+		}
+	}
+}
+
+func (ep *WebSocketEndpoint) addClient() *webSocketClient {
+	c := &webSocketClient{messages: make(chan []byte, ep.bufferSize)}
+	ep.mu.Lock()
+	ep.clients[c] = true
+	ep.mu.Unlock()
+	return c
+}
+
+// removeClient unregisters c and closes its message channel, which ends its connection. The caller
+// must hold ep.mu.
+func (ep *WebSocketEndpoint) removeClient(c *webSocketClient) {
+	if ep.clients[c] {
+		delete(ep.clients, c)
+		close(c.messages)
+	}
+}
+
+// Use increments the WebSocketEndpoint's usage count.
+// See pipeline.Component.Use.
+func (ep *WebSocketEndpoint) Use() {
+	ep.tracker.Use()
+}
+
+// Release decrements the WebSocketEndpoint's usage count. If it reaches 0, Release disconnects all
+// clients and stops the WebSocket server.
+// See pipeline.Component.Release.
+func (ep *WebSocketEndpoint) Release() error {
+	return ep.tracker.Release(func() error {
+		ep.mu.Lock()
+		for c := range ep.clients {
+			ep.removeClient(c)
+		}
+		ep.mu.Unlock()
+		return ep.srv.Close()
+	})
+}
+
+func (ep *WebSocketEndpoint) IsTransient(err error) bool {
+	return false
+}
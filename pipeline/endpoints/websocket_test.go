@@ -0,0 +1,174 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocketEndpoint(t *testing.T) {
+	report := metrics.StampedMetricReport{
+		Id: "report1",
+		MetricReport: metrics.MetricReport{
+			Name:      "int-metric1",
+			StartTime: time.Unix(0, 0).UTC(),
+			EndTime:   time.Unix(1, 0).UTC(),
+			Labels:    map[string]string{"foo": "bar"},
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		},
+	}
+
+	t.Run("Streams reports", func(t *testing.T) {
+		ep := newTestWebSocketEndpoint(t, "", 10, WebSocketDrop)
+		defer ep.Release()
+
+		ws, err := websocket.Dial(webSocketURL(ep, ""), "", "http://localhost/")
+		if err != nil {
+			t.Fatalf("error connecting: %+v", err)
+		}
+		defer ws.Close()
+		if err := waitForClientCount(ep, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		sendWebSocketReport(t, ep, report)
+
+		var received metrics.StampedMetricReport
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if err := websocket.JSON.Receive(ws, &received); err != nil {
+			t.Fatalf("error receiving report: %+v", err)
+		}
+		if !received.Equal(report) {
+			t.Fatalf("received report: expected %+v, got %+v", report, received)
+		}
+	})
+
+	t.Run("Token authentication", func(t *testing.T) {
+		ep := newTestWebSocketEndpoint(t, "secret", 10, WebSocketDrop)
+		defer ep.Release()
+
+		if _, err := websocket.Dial(webSocketURL(ep, ""), "", "http://localhost/"); err == nil {
+			t.Fatal("expected connection without token to fail")
+		}
+		if _, err := websocket.Dial(webSocketURL(ep, "wrong"), "", "http://localhost/"); err == nil {
+			t.Fatal("expected connection with wrong token to fail")
+		}
+
+		ws, err := websocket.Dial(webSocketURL(ep, "secret"), "", "http://localhost/")
+		if err != nil {
+			t.Fatalf("error connecting with query token: %+v", err)
+		}
+		ws.Close()
+
+		cfg, err := websocket.NewConfig(webSocketURL(ep, ""), "http://localhost/")
+		if err != nil {
+			t.Fatalf("error creating config: %+v", err)
+		}
+		cfg.Header = http.Header{"Authorization": {"Bearer secret"}}
+		ws, err = websocket.DialConfig(cfg)
+		if err != nil {
+			t.Fatalf("error connecting with header token: %+v", err)
+		}
+		ws.Close()
+	})
+
+	t.Run("Slow client dropped reports", func(t *testing.T) {
+		ep := newTestWebSocketEndpoint(t, "", 1, WebSocketDrop)
+		defer ep.Release()
+
+		// A client registered directly is never drained, so its buffer fills after one report.
+		c := ep.addClient()
+		sendWebSocketReport(t, ep, report)
+		sendWebSocketReport(t, ep, report)
+
+		ep.mu.Lock()
+		registered := ep.clients[c]
+		ep.mu.Unlock()
+		if !registered {
+			t.Fatal("expected slow client to remain connected")
+		}
+		if len(c.messages) != 1 {
+			t.Fatalf("slow client buffer: expected 1 report, got %v", len(c.messages))
+		}
+	})
+
+	t.Run("Slow client disconnected", func(t *testing.T) {
+		ep := newTestWebSocketEndpoint(t, "", 1, WebSocketDisconnect)
+		defer ep.Release()
+
+		c := ep.addClient()
+		sendWebSocketReport(t, ep, report)
+		sendWebSocketReport(t, ep, report)
+
+		if err := waitForClientCount(ep, 0); err != nil {
+			t.Fatal(err)
+		}
+		// The remaining buffered report is still readable, after which the channel is closed.
+		<-c.messages
+		if _, ok := <-c.messages; ok {
+			t.Fatal("expected slow client's channel to be closed")
+		}
+	})
+}
+
+func newTestWebSocketEndpoint(t *testing.T, token string, bufferSize int, slowClient string) *WebSocketEndpoint {
+	ep, err := NewWebSocketEndpoint("websocket", "localhost:0", token, bufferSize, slowClient, "")
+	if err != nil {
+		t.Fatalf("error creating endpoint: %+v", err)
+	}
+	ep.Use()
+	return ep
+}
+
+func webSocketURL(ep *WebSocketEndpoint, token string) string {
+	url := fmt.Sprintf("ws://%v%v", ep.Addr(), webSocketPath)
+	if token != "" {
+		url += "?token=" + token
+	}
+	return url
+}
+
+func sendWebSocketReport(t *testing.T, ep *WebSocketEndpoint, report metrics.StampedMetricReport) {
+	r, err := ep.BuildReport(report)
+	if err != nil {
+		t.Fatalf("error building report: %+v", err)
+	}
+	if err := ep.Send(r); err != nil {
+		t.Fatalf("error sending report: %+v", err)
+	}
+}
+
+func waitForClientCount(ep *WebSocketEndpoint, count int) error {
+	var current int
+	for i := 0; i < 100; i++ {
+		ep.mu.Lock()
+		current = len(ep.clients)
+		ep.mu.Unlock()
+		if current == count {
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return errors.New(fmt.Sprintf("expected %v connected clients, got %v", count, current))
+}
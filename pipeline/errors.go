@@ -0,0 +1,59 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pipeline
+
+import (
+	"errors"
+)
+
+// The kinds of failure returned by Input.AddReport. Errors that reject a report are a *ReportError,
+// or another error type with an Is method, that matches one of these with errors.Is.
+var (
+	// ErrUnknownMetric means that no metric is configured with the report's name.
+	ErrUnknownMetric = errors.New("unknown metric")
+
+	// ErrValidation means that the report is invalid, so adding it again would fail again.
+	ErrValidation = errors.New("invalid report")
+
+	// ErrBackpressure means that the report couldn't be accepted right now, such as because an
+	// endpoint's retry queue is full. It may be added again later.
+	ErrBackpressure = errors.New("backpressure")
+)
+
+// ReportError is an error that rejects a report. Its message is that of Err.
+type ReportError struct {
+	// Kind is ErrUnknownMetric, ErrValidation, or ErrBackpressure.
+	Kind error
+
+	// Name is the report's metric name.
+	Name string
+
+	// Err describes the failure.
+	Err error
+}
+
+func (e *ReportError) Error() string {
+	return e.Err.Error()
+}
+
+// Is returns true if target is the error's Kind.
+func (e *ReportError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns Err.
+func (e *ReportError) Unwrap() error {
+	return e.Err
+}
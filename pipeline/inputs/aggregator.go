@@ -15,8 +15,10 @@
 package inputs
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"reflect"
 	"sync"
 	"time"
@@ -25,6 +27,7 @@ import (
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 	"github.com/GoogleCloudPlatform/ubbagent/persistence"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/stats"
 	"github.com/golang/glog"
 )
 
@@ -32,23 +35,109 @@ const (
 	persistencePrefix = "aggregator/"
 )
 
+// PersistPolicy determines how often an Aggregator persists its open bucket between pushes. The
+// bucket is persisted once Adds reports have been added since it was last persisted, or once
+// Interval has elapsed since then, whichever comes first; a crash loses at most those reports. A
+// zero PersistPolicy persists the bucket after every added report.
+//
+// Failing to persist the bucket, such as while the disk is full, is fatal unless DegradedInterval
+// is positive. Then the Aggregator enters a degraded mode: it keeps the bucket in memory only, and
+// pushes it once DegradedInterval has elapsed since it was created (or after the usual buffer time,
+// if that's shorter), to limit the reports a crash could lose. Each push tries to persist the new
+// bucket, and the Aggregator leaves degraded mode once that succeeds.
+type PersistPolicy struct {
+	Adds             int
+	Interval         time.Duration
+	DegradedInterval time.Duration
+}
+
 type addMsg struct {
 	report metrics.MetricReport
 	result chan error
 }
 
+// FutureReportError is returned by an Aggregator that rejects reports whose EndTime is after the
+// current time.
+type FutureReportError struct {
+	Name    string
+	EndTime time.Time
+	Now     time.Time
+}
+
+func (e *FutureReportError) Error() string {
+	return fmt.Sprintf("metric %v: report ends in the future: end time %v is after %v", e.Name, e.EndTime, e.Now)
+}
+
+// Is returns true if target is pipeline.ErrValidation.
+func (e *FutureReportError) Is(target error) bool {
+	return target == pipeline.ErrValidation
+}
+
+// A Persister persists the open buckets of the Aggregators added to it on demand, regardless of
+// their PersistPolicy, such as before exporting the agent's state. A nil *Persister ignores added
+// Aggregators.
+type Persister struct {
+	mu          sync.Mutex
+	aggregators []*Aggregator
+}
+
+// NewPersister creates a new Persister with no Aggregators.
+func NewPersister() *Persister {
+	return &Persister{}
+}
+
+// Add adds an Aggregator whose open bucket is persisted by Persist.
+func (p *Persister) Add(a *Aggregator) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aggregators = append(p.aggregators, a)
+}
+
+// Persist persists the open bucket of each added Aggregator, returning once all are persisted.
+func (p *Persister) Persist() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range p.aggregators {
+		a.Persist()
+	}
+}
+
 // Aggregator is the head of the metrics reporting pipeline. It accepts reports from the reporting
 // client, buffers and aggregates for a configured amount of time, and sends them downstream.
 // See pipeline.Pipeline.
+//
+// An Aggregator is safe for concurrent use. Reports are added to the open bucket one at a time, in
+// the order their AddReport calls are handled, so concurrent reports with the same name and labels
+// are all summed and none are lost. A report is part of the pushed bucket if its AddReport call has
+// returned before the push begins; pushes and adds never interleave, so each pushed bucket is a
+// consistent snapshot. The aggregated time range covers every added report regardless of the order
+// in which they arrive.
 type Aggregator struct {
 	clock         clock.Clock
 	metric        metrics.Definition
 	bufferTime    time.Duration
+	flushOnValue  float64
+	staggerLabel  string
+	futureEndTime string
+	groupDue      map[string]time.Time // With a stagger label, when each group in the bucket is pushed.
+	persist       PersistPolicy
+	unpersisted   int
+	lastPersist   time.Time
+	degraded      bool // Whether persisting failed; see PersistPolicy.
+	recorder      stats.Recorder
+	parallelism   int
 	input         pipeline.Input
 	persistence   persistence.Persistence
 	currentBucket *bucket
 	pushTimer     *time.Timer
 	push          chan chan bool
+	persistNow    chan chan bool
 	add           chan addMsg
 	closed        bool
 	closeMutex    sync.RWMutex
@@ -56,24 +145,59 @@ type Aggregator struct {
 	tracker       pipeline.UsageTracker
 }
 
-// NewAggregator creates a new Aggregator instance and starts its goroutine.
-func NewAggregator(metric metrics.Definition, bufferTime time.Duration, input pipeline.Input, persistence persistence.Persistence) *Aggregator {
-	return newAggregator(metric, bufferTime, input, persistence, clock.NewClock())
+// NewAggregator creates a new Aggregator instance and starts its goroutine. A bucket is pushed once
+// bufferTime has elapsed. If flushOnValue is positive, an aggregated report (that is, a single name
+// and label set) is also sent as soon as its value, or any one of its named values, reaches
+// flushOnValue. When a bucket is pushed, up to parallelism of its aggregated reports (at least 1)
+// are handed to input concurrently. The open bucket is persisted according to persist,
+// and restored when an Aggregator for the same metric is created with the same persistence.
+// Failures to persist it are recorded with recorder.
+//
+// If staggerLabel is set, the bucket's reports are instead pushed in groups, by their value of that
+// label, so that groups don't all push at once. Each group is pushed every bufferTime, at an offset
+// within the interval given by a hash of its value (see staggerOffset).
+//
+// futureEndTime determines how a report whose EndTime is after the current time is handled; such
+// reports usually come from clients with skewed clocks. It's "reject", which returns a
+// FutureReportError; "clamp", which moves its EndTime back to the current time; or "window", which
+// moves its EndTime back to when the open bucket (or the report's group) is pushed, if it's later.
+// If it's empty, the report is aggregated as is, and extends the aggregated time range.
+func NewAggregator(metric metrics.Definition, bufferTime time.Duration, flushOnValue float64, staggerLabel, futureEndTime string, persist PersistPolicy, input pipeline.Input, persistence persistence.Persistence, recorder stats.Recorder, parallelism int) *Aggregator {
+	return newAggregator(metric, bufferTime, flushOnValue, staggerLabel, futureEndTime, persist, input, persistence, recorder, clock.NewClock(), parallelism)
 }
 
-func newAggregator(metric metrics.Definition, bufferTime time.Duration, input pipeline.Input, persistence persistence.Persistence, clock clock.Clock) *Aggregator {
+func newAggregator(metric metrics.Definition, bufferTime time.Duration, flushOnValue float64, staggerLabel, futureEndTime string, persist PersistPolicy, input pipeline.Input, persistence persistence.Persistence, recorder stats.Recorder, clock clock.Clock, parallelism int) *Aggregator {
+	if parallelism < 1 {
+		parallelism = 1
+	}
 	agg := &Aggregator{
-		metric:      metric,
-		bufferTime:  bufferTime,
-		input:       input,
-		persistence: persistence,
-		clock:       clock,
-		push:        make(chan chan bool),
-		add:         make(chan addMsg),
+		metric:        metric,
+		bufferTime:    bufferTime,
+		flushOnValue:  flushOnValue,
+		staggerLabel:  staggerLabel,
+		futureEndTime: futureEndTime,
+		persist:       persist,
+		lastPersist:   clock.Now(),
+		parallelism:   parallelism,
+		input:         input,
+		persistence:   persistence,
+		recorder:      recorder,
+		clock:         clock,
+		push:          make(chan chan bool),
+		persistNow:    make(chan chan bool),
+		add:           make(chan addMsg),
 	}
 	if !agg.loadState() {
 		agg.currentBucket = newBucket(clock.Now())
 	}
+	if staggerLabel != "" {
+		agg.groupDue = make(map[string]time.Time)
+		for _, namedReports := range agg.currentBucket.Reports {
+			for _, ar := range namedReports {
+				agg.scheduleGroup(ar.Labels, clock.Now())
+			}
+		}
+	}
 	input.Use()
 	agg.wait.Add(1)
 	go agg.run()
@@ -83,11 +207,9 @@ func newAggregator(metric metrics.Definition, bufferTime time.Duration, input pi
 // AddReport adds a report. Reports are aggregated when possible, during a time period defined by
 // the Aggregator's config object. Two reports can be aggregated if they have the same name, contain
 // the same labels, and don't contain overlapping time ranges denoted by StartTime and EndTme.
+// Reports aren't validated here; the pipeline validates them first (see NewValidatingInput).
 func (h *Aggregator) AddReport(report metrics.MetricReport) error {
 	glog.V(2).Infof("aggregator: received report: %v", report.Name)
-	if err := report.Validate(h.metric); err != nil {
-		return err
-	}
 	h.closeMutex.RLock()
 	defer h.closeMutex.RUnlock()
 	if h.closed {
@@ -101,6 +223,20 @@ func (h *Aggregator) AddReport(report metrics.MetricReport) error {
 	return <-msg.result
 }
 
+// Persist persists the open bucket now, if it holds reports that haven't been persisted, regardless
+// of the PersistPolicy. It returns once the bucket is persisted, or immediately if the Aggregator
+// has been released, since a released Aggregator has already pushed its reports.
+func (h *Aggregator) Persist() {
+	h.closeMutex.RLock()
+	defer h.closeMutex.RUnlock()
+	if h.closed {
+		return
+	}
+	done := make(chan bool)
+	h.persistNow <- done
+	<-done
+}
+
 // Use increments the Aggregator's usage count.
 // See pipeline.Component.Use.
 func (h *Aggregator) Use() {
@@ -130,26 +266,56 @@ func (h *Aggregator) Release() error {
 func (h *Aggregator) run() {
 	running := true
 	for running {
-		// Set a timer to fire when the current bucket should be pushed.
-		now := h.clock.Now()
-		nextFire := now.Add(h.bufferTime - now.Sub(h.currentBucket.CreateTime))
+		// Set a timer to fire when the current bucket should be pushed, or earlier if unpersisted
+		// reports are due to be persisted.
+		pushAt := h.pushTime()
+		nextFire := pushAt
+		if h.unpersisted > 0 && h.persist.Interval > 0 && !h.degraded {
+			if persistAt := h.lastPersist.Add(h.persist.Interval); persistAt.Before(nextFire) {
+				nextFire = persistAt
+			}
+		}
 		timer := h.clock.NewTimerAt(nextFire)
 		select {
 		case msg, ok := <-h.add:
 			if ok {
-				err := h.currentBucket.addReport(msg.report)
+				report, err := h.placeReport(msg.report)
+				var ar *aggregatedReport
+				if err == nil {
+					ar, err = h.currentBucket.addReport(report, h.metric)
+				}
 				if err == nil {
-					// TODO(volkman): possibly rate-limit persistence, or flush to disk at a defined interval.
-					// Perhaps a benchmark to determine whether eager persistence is a bottleneck.
-					h.persistState()
+					h.unpersisted++
+					if h.groupDue != nil {
+						h.scheduleGroup(msg.report.Labels, h.clock.Now())
+					}
+					if h.flushOnValue > 0 && ar.reaches(h.flushOnValue) {
+						// The aggregated report has reached the value threshold; send it early. The bucket's
+						// other reports are still pushed once its buffer time elapses.
+						h.currentBucket.remove(ar)
+						h.sendReport(*ar.metricReport())
+						h.persistState()
+					} else if !h.degraded && h.persistDue() {
+						h.persistState()
+					}
 				}
 				msg.result <- err
 			} else {
 				running = false
 			}
+		case done := <-h.persistNow:
+			if h.unpersisted > 0 {
+				h.persistState()
+			}
+			done <- true
 		case now := <-timer.GetC():
-			// Time to push the current bucket.
-			h.pushBucket(now)
+			if now.Before(pushAt) {
+				// Time to persist the current bucket's unpersisted reports.
+				h.persistState()
+			} else {
+				// Time to push the current bucket, or the groups that are due.
+				h.pushDue(now)
+			}
 		}
 		timer.Stop()
 	}
@@ -170,12 +336,144 @@ func (h *Aggregator) loadState() bool {
 	panic(fmt.Sprintf("error loading aggregator state: %+v", err))
 }
 
+// persistDue returns whether the current bucket should be persisted after a report is added.
+func (h *Aggregator) persistDue() bool {
+	if h.persist.Adds <= 0 && h.persist.Interval <= 0 {
+		return true
+	}
+	if h.persist.Adds > 0 && h.unpersisted >= h.persist.Adds {
+		return true
+	}
+	return h.persist.Interval > 0 && h.clock.Now().Sub(h.lastPersist) >= h.persist.Interval
+}
+
 func (h *Aggregator) persistState() {
 	// TODO(volkman): always persist a metric's previous end time, even if no bucket is persisted,
 	// so that the start time of the next report after a restart is validated.
 	if err := h.persistence.Value(h.persistenceName()).Store(h.currentBucket); err != nil {
-		panic(fmt.Sprintf("error persisting aggregator state: %+v", err))
+		h.recorder.PersistFailed(h.persistenceName())
+		if h.persist.DegradedInterval <= 0 {
+			panic(fmt.Sprintf("error persisting aggregator state: %+v", err))
+		}
+		if !h.degraded {
+			glog.Errorf("aggregator: persisting %v failed; keeping its reports in memory until persisting succeeds: %+v", h.metric.Name, err)
+			h.degraded = true
+		}
+		return
+	}
+	if h.degraded {
+		glog.Infof("aggregator: persisting %v succeeded; leaving degraded mode", h.metric.Name)
+		h.degraded = false
+	}
+	h.unpersisted = 0
+	h.lastPersist = h.clock.Now()
+}
+
+// placeReport applies the future EndTime policy to report. See NewAggregator.
+func (h *Aggregator) placeReport(report metrics.MetricReport) (metrics.MetricReport, error) {
+	now := h.clock.Now()
+	if h.futureEndTime == "" || !report.EndTime.After(now) {
+		return report, nil
+	}
+	end := now
+	switch h.futureEndTime {
+	case "reject":
+		return report, &FutureReportError{Name: report.Name, EndTime: report.EndTime, Now: now}
+	case "window":
+		end = h.currentBucket.CreateTime.Add(h.bufferTime)
+		if h.groupDue != nil {
+			h.scheduleGroup(report.Labels, now)
+			end = h.groupDue[report.Labels[h.staggerLabel]]
+		}
+		if !report.EndTime.After(end) {
+			return report, nil
+		}
+	}
+	report.EndTime = end
+	if report.StartTime.After(end) {
+		report.StartTime = end
 	}
+	return report, nil
+}
+
+// pushTime returns when the current bucket, or with a stagger label, its next group, should be
+// pushed.
+func (h *Aggregator) pushTime() time.Time {
+	pushAt := h.currentBucket.CreateTime.Add(h.bufferTime)
+	if len(h.groupDue) > 0 {
+		pushAt = time.Time{}
+		for _, due := range h.groupDue {
+			if pushAt.IsZero() || due.Before(pushAt) {
+				pushAt = due
+			}
+		}
+	}
+	if h.degraded {
+		if degradedAt := h.currentBucket.CreateTime.Add(h.persist.DegradedInterval); degradedAt.Before(pushAt) {
+			pushAt = degradedAt
+		}
+	}
+	return pushAt
+}
+
+// scheduleGroup schedules the push of the group of a report with the given labels, if it isn't
+// already scheduled, at the group's next staggered push time after now.
+func (h *Aggregator) scheduleGroup(labels map[string]string, now time.Time) {
+	group := labels[h.staggerLabel]
+	if _, ok := h.groupDue[group]; ok {
+		return
+	}
+	interval := int64(h.bufferTime)
+	offset := int64(staggerOffset(group, h.bufferTime))
+	// The next time after now that's offset past a multiple of the interval.
+	n := now.UnixNano() - offset
+	k := n / interval
+	if n < 0 && n%interval != 0 {
+		k--
+	}
+	h.groupDue[group] = time.Unix(0, (k+1)*interval+offset)
+}
+
+// staggerOffset returns the offset, within interval, of the pushes of the group of reports with the
+// given stagger label value.
+func staggerOffset(value string, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return time.Duration(h.Sum64() % uint64(interval))
+}
+
+// pushDue pushes the groups whose push time has come, or the whole bucket if it isn't pushed in
+// groups or it's due to be pushed in degraded mode.
+func (h *Aggregator) pushDue(now time.Time) {
+	if len(h.groupDue) == 0 || (h.degraded && !now.Before(h.currentBucket.CreateTime.Add(h.persist.DegradedInterval))) {
+		h.pushBucket(now)
+		return
+	}
+	due := make(map[string]bool)
+	for group, at := range h.groupDue {
+		if !now.Before(at) {
+			due[group] = true
+			delete(h.groupDue, group)
+		}
+	}
+	var pushed []*aggregatedReport
+	for _, namedReports := range h.currentBucket.Reports {
+		for _, ar := range namedReports {
+			if due[ar.Labels[h.staggerLabel]] {
+				pushed = append(pushed, ar)
+			}
+		}
+	}
+	reports := make([]metrics.MetricReport, len(pushed))
+	for i, ar := range pushed {
+		h.currentBucket.remove(ar)
+		reports[i] = *ar.metricReport()
+	}
+	h.sendReports(reports)
+	h.persistState()
 }
 
 // pushBucket sends currently-aggregated metrics to the configured MetricSender and resets the
@@ -185,28 +483,51 @@ func (h *Aggregator) pushBucket(now time.Time) {
 		h.currentBucket = newBucket(now)
 		return
 	}
-	var finishedReports []metrics.MetricReport
+	var reports []metrics.MetricReport
 	for _, namedReports := range h.currentBucket.Reports {
 		for _, report := range namedReports {
-			finishedReports = append(finishedReports, *report.metricReport())
+			reports = append(reports, *report.metricReport())
 		}
 	}
-	if len(finishedReports) > 0 {
-		if len(finishedReports) == 1 {
+	h.sendReports(reports)
+	h.currentBucket = newBucket(now)
+	if h.groupDue != nil {
+		h.groupDue = make(map[string]time.Time)
+	}
+	h.persistState()
+}
+
+// sendReports sends pushed reports. The bucket holds a single report per name and label set, and its
+// reports are sent concurrently, up to the Aggregator's parallelism. A push finishes before the next
+// one starts, so the reports for each name and label set are still sent in order.
+func (h *Aggregator) sendReports(reports []metrics.MetricReport) {
+	if count := len(reports); count > 0 {
+		if count == 1 {
 			glog.V(2).Infoln("aggregator: sending 1 report")
 		} else {
-			glog.V(2).Infof("aggregator: sending %v reports", len(finishedReports))
+			glog.V(2).Infof("aggregator: sending %v reports", count)
 		}
-		for _, r := range finishedReports {
-			err := h.input.AddReport(r)
-			if err != nil {
-				glog.Errorf("aggregator: error sending report: %+v", err)
-				continue
-			}
+		sem := make(chan bool, h.parallelism)
+		var wg sync.WaitGroup
+		for _, report := range reports {
+			sem <- true
+			wg.Add(1)
+			go func(report metrics.MetricReport) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				h.sendReport(report)
+			}(report)
 		}
+		wg.Wait()
+	}
+}
+
+func (h *Aggregator) sendReport(report metrics.MetricReport) {
+	if err := h.input.AddReport(report); err != nil {
+		glog.Errorf("aggregator: error sending report: %+v", err)
 	}
-	h.currentBucket = newBucket(now)
-	h.persistState()
 }
 
 func (h *Aggregator) persistenceName() string {
@@ -218,30 +539,90 @@ type bucket struct {
 	Reports    map[string][]*aggregatedReport
 }
 
+// remove removes the given aggregated report from the bucket.
+func (b *bucket) remove(ar *aggregatedReport) {
+	reports := b.Reports[ar.Name]
+	for i, r := range reports {
+		if r == ar {
+			reports = append(reports[:i], reports[i+1:]...)
+			break
+		}
+	}
+	if len(reports) == 0 {
+		delete(b.Reports, ar.Name)
+	} else {
+		b.Reports[ar.Name] = reports
+	}
+}
+
 // aggregatedReport is an extension of MetricReport that supports operations for combining reports.
 type aggregatedReport metrics.MetricReport
 
+// persistedReport is the serialized form of an aggregatedReport. IngestTime is stored separately
+// since it isn't serialized as part of the report.
+type persistedReport struct {
+	metrics.MetricReport
+	IngestTime time.Time `json:"ingestTime"`
+}
+
+// MarshalJSON encodes the report along with its IngestTime, so that a restored bucket reports
+// latency from the original ingestion rather than from the restart.
+func (ar *aggregatedReport) MarshalJSON() ([]byte, error) {
+	return json.Marshal(persistedReport{MetricReport: metrics.MetricReport(*ar), IngestTime: ar.IngestTime})
+}
+
+// UnmarshalJSON decodes a report written by MarshalJSON. State written before IngestTime was
+// persisted loads with a zero IngestTime.
+func (ar *aggregatedReport) UnmarshalJSON(data []byte) error {
+	var pr persistedReport
+	if err := json.Unmarshal(data, &pr); err != nil {
+		return err
+	}
+	*ar = aggregatedReport(pr.MetricReport)
+	ar.IngestTime = pr.IngestTime
+	return nil
+}
+
 // accept possibly aggregates the given MetricReport into this aggregatedReport. Returns true
-// if the report was aggregated, or false if the labels or name don't match.
-func (ar *aggregatedReport) accept(mr metrics.MetricReport) (bool, error) {
+// if the report was aggregated, or false if the labels or name don't match. Annotations don't affect
+// whether reports are aggregated; they're combined according to the metric's merge policy.
+func (ar *aggregatedReport) accept(mr metrics.MetricReport, def metrics.Definition) (bool, error) {
 	if mr.Name != ar.Name || !reflect.DeepEqual(mr.Labels, ar.Labels) {
 		return false, nil
 	}
+	ar.Annotations = metrics.MergeAnnotations(def.AnnotationMerge, ar.Annotations, mr.Annotations)
+	ar.IngestTime = earliestIngest(ar.IngestTime, mr.IngestTime)
 	// Only one of these values should be non-zero. We rely on prior validation to ensure the proper
 	// value (i.e., the one specified in the metrics.Definition) is provided.
 	ar.Value.Int64Value += mr.Value.Int64Value
 	ar.Value.DoubleValue += mr.Value.DoubleValue
+	// Each named value of a compound metric is summed independently.
+	ar.Values = metrics.MergeValues(ar.Values, mr.Values)
 	// Expand the aggregated start time if the given MetricReport has ealier start time.
 	if mr.StartTime.Before(ar.StartTime) {
 		ar.StartTime = mr.StartTime
 	}
 	// Expand the aggregated end time if the given MetricReport has later end time.
-	if mr.EndTime.After(ar.StartTime) {
+	if mr.EndTime.After(ar.EndTime) {
 		ar.EndTime = mr.EndTime
 	}
 	return true, nil
 }
 
+// reaches returns true if the report's value, or any one of its named values, is at least threshold.
+// Only the value of the metric's type is non-zero, so int and double values are never combined.
+func (ar *aggregatedReport) reaches(threshold float64) bool {
+	if float64(ar.Value.Int64Value)+ar.Value.DoubleValue >= threshold {
+		return true
+	}
+	for _, v := range ar.Values {
+		if float64(v.Int64Value)+v.DoubleValue >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
 func (ar *aggregatedReport) metricReport() *metrics.MetricReport {
 	return (*metrics.MetricReport)(ar)
 }
@@ -253,16 +634,28 @@ func newBucket(t time.Time) *bucket {
 	}
 }
 
-func (b *bucket) addReport(mr metrics.MetricReport) error {
+func (b *bucket) addReport(mr metrics.MetricReport, def metrics.Definition) (*aggregatedReport, error) {
 	for _, ar := range b.Reports[mr.Name] {
-		accepted, err := ar.accept(mr)
+		accepted, err := ar.accept(mr, def)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if accepted {
-			return nil
+			return ar, nil
 		}
 	}
-	b.Reports[mr.Name] = append(b.Reports[mr.Name], (*aggregatedReport)(&mr))
-	return nil
+	// Annotations and values are copied, since they may be modified by subsequent merges. Labels are
+	// copied, since the caller may reuse its map once AddReport returns.
+	mr.Annotations = metrics.MergeAnnotations(def.AnnotationMerge, nil, mr.Annotations)
+	mr.Values = metrics.MergeValues(nil, mr.Values)
+	if mr.Labels != nil {
+		labels := make(map[string]string, len(mr.Labels))
+		for k, v := range mr.Labels {
+			labels[k] = v
+		}
+		mr.Labels = labels
+	}
+	ar := (*aggregatedReport)(&mr)
+	b.Reports[mr.Name] = append(b.Reports[mr.Name], ar)
+	return ar, nil
 }
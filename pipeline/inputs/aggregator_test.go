@@ -15,12 +15,17 @@
 package inputs
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
 	"github.com/GoogleCloudPlatform/ubbagent/testlib"
 )
 
@@ -74,7 +79,7 @@ func TestNewAggregator(t *testing.T) {
 		mi := testlib.NewMockInput()
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
-		a := newAggregator(metric, bufTime, mi, p, mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, p, testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(report1); err != nil {
 			t.Fatalf("Unexpected error when adding report: %+v", err)
@@ -94,7 +99,7 @@ func TestNewAggregator(t *testing.T) {
 		mockClock.SetNow(time.Unix(0, 0))
 
 		// Construct a new aggregator using the same persistence.
-		a = newAggregator(metric, bufTime, mi, p, mockClock)
+		a = newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, p, testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		// Release the aggregator so that it flushes all of its current reports.
 		mi.DoAndWait(t, 2, func() {
@@ -111,7 +116,7 @@ func TestNewAggregator(t *testing.T) {
 		mockClock.SetNow(time.Unix(0, 0))
 
 		// Create one more aggregator and ensure it doesn't start with previous state.
-		a = newAggregator(metric, bufTime, mi, p, mockClock)
+		a = newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, p, testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(report3); err != nil {
 			t.Fatalf("Unexpected error when adding report: %+v", err)
@@ -127,6 +132,376 @@ func TestNewAggregator(t *testing.T) {
 			t.Fatalf("Aggregated reports: expected: %+v, got: %+v", expected, reports)
 		}
 	})
+
+	t.Run("Ingest time survives a restart", func(t *testing.T) {
+		p := persistence.NewMemoryPersistence()
+		metric := metrics.Definition{
+			Name: "int-metric",
+			Type: "int",
+		}
+		ingest := time.Unix(5, 0)
+		report := metrics.MetricReport{
+			Name:       "int-metric",
+			StartTime:  time.Unix(0, 0),
+			EndTime:    time.Unix(1, 0),
+			Value:      metrics.MetricValue{Int64Value: 10},
+			IngestTime: ingest,
+		}
+
+		mi := testlib.NewMockInput()
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a := newAggregator(metric, 10*time.Second, 0, "", "", PersistPolicy{}, mi, p, testlib.NewMockStatsRecorder(), mockClock, 1)
+		if err := a.AddReport(report); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+
+		mockClock = testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a = newAggregator(metric, 10*time.Second, 0, "", "", PersistPolicy{}, mi, p, testlib.NewMockStatsRecorder(), mockClock, 1)
+		mi.DoAndWait(t, 1, func() {
+			a.Release()
+		})
+
+		reports := mi.Reports()
+		if len(reports) != 1 {
+			t.Fatalf("Expected 1 report, got: %+v", reports)
+		}
+		if !reports[0].IngestTime.Equal(ingest) {
+			t.Fatalf("IngestTime: expected %v, got %v", ingest, reports[0].IngestTime)
+		}
+	})
+}
+
+func TestAggregator_PersistPolicy(t *testing.T) {
+	metric := metrics.Definition{
+		Name: "int-metric",
+		Type: "int",
+	}
+	bufTime := 60 * time.Second
+	newReport := func(value int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: value,
+			},
+		}
+	}
+
+	// restore simulates a restart after a crash: a new aggregator is created from the same
+	// persistence without releasing the old one, and released to flush whatever it restored.
+	restore := func(t *testing.T, p persistence.Persistence) []metrics.MetricReport {
+		mi := testlib.NewMockInput()
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, p, testlib.NewMockStatsRecorder(), mockClock, 1)
+		a.Release()
+		return mi.Reports()
+	}
+
+	t.Run("Every N adds", func(t *testing.T) {
+		p := persistence.NewMemoryPersistence()
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{Adds: 2}, testlib.NewMockInput(), p, testlib.NewMockStatsRecorder(), mockClock, 1)
+
+		for _, v := range []int64{1, 2, 4} {
+			if err := a.AddReport(newReport(v)); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+
+		// Only the first two reports were persisted; the third is lost in the crash.
+		expected := []metrics.MetricReport{newReport(3)}
+		if reports := restore(t, p); !equalUnordered(reports, expected) {
+			t.Fatalf("Restored reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("Every interval", func(t *testing.T) {
+		p := persistence.NewMemoryPersistence()
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{Interval: 5 * time.Second}, testlib.NewMockInput(), p, testlib.NewMockStatsRecorder(), mockClock, 1)
+
+		for _, v := range []int64{1, 2} {
+			if err := a.AddReport(newReport(v)); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+		var b bucket
+		if err := p.Value(persistencePrefix + metric.Name).Load(&b); err != persistence.ErrNotFound {
+			t.Fatalf("Expected no persisted bucket before the interval elapsed, got: %+v (err=%v)", b, err)
+		}
+
+		// The reports are persisted once the interval elapses, without a further add.
+		mockClock.SetNow(time.Unix(5, 0))
+		for i := 0; i < 100; i++ {
+			b = bucket{}
+			if p.Value(persistencePrefix+metric.Name).Load(&b) == nil && len(b.Reports[metric.Name]) == 1 && b.Reports[metric.Name][0].Value.Int64Value == 3 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		expected := []metrics.MetricReport{newReport(3)}
+		if reports := restore(t, p); !equalUnordered(reports, expected) {
+			t.Fatalf("Restored reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("On demand", func(t *testing.T) {
+		p := persistence.NewMemoryPersistence()
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{Adds: 100}, testlib.NewMockInput(), p, testlib.NewMockStatsRecorder(), mockClock, 1)
+		persister := NewPersister()
+		persister.Add(a)
+
+		for _, v := range []int64{1, 2} {
+			if err := a.AddReport(newReport(v)); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+		persister.Persist()
+
+		expected := []metrics.MetricReport{newReport(3)}
+		if reports := restore(t, p); !equalUnordered(reports, expected) {
+			t.Fatalf("Restored reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("Persist failures degrade until persisting recovers", func(t *testing.T) {
+		p := &failingPersistence{Persistence: persistence.NewMemoryPersistence()}
+		r := testlib.NewMockStatsRecorder()
+		mi := testlib.NewMockInput()
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{DegradedInterval: 5 * time.Second}, mi, p, r, mockClock, 1)
+
+		p.setFailing(true)
+		for _, v := range []int64{1, 2} {
+			if err := a.AddReport(newReport(v)); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+		// Only the first add tries to persist; degraded mode keeps reports in memory.
+		if want, got := []string{persistencePrefix + metric.Name}, r.PersistFailures(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("PersistFailures: expected: %v, got: %v", want, got)
+		}
+
+		// The bucket is pushed after the degraded interval rather than the buffer time. Persisting the
+		// next bucket fails again.
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(5, 0))
+		})
+		expected := []metrics.MetricReport{newReport(3)}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Pushed reports: expected: %+v, got: %+v", expected, reports)
+		}
+
+		// Adding a report waits for the push to finish persisting. Once persisting works, the next push
+		// leaves degraded mode, and adds are persisted again.
+		if err := a.AddReport(newReport(4)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		p.setFailing(false)
+		if want, got := 2, len(r.PersistFailures()); want != got {
+			t.Fatalf("len(PersistFailures): expected: %v, got: %v", want, got)
+		}
+		mi.DoAndWait(t, 2, func() {
+			mockClock.SetNow(time.Unix(10, 0))
+		})
+		if err := a.AddReport(newReport(8)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		expected = []metrics.MetricReport{newReport(8)}
+		if reports := restore(t, p); !equalUnordered(reports, expected) {
+			t.Fatalf("Restored reports: expected: %+v, got: %+v", expected, reports)
+		}
+		if want, got := 2, len(r.PersistFailures()); want != got {
+			t.Fatalf("len(PersistFailures): expected: %v, got: %v", want, got)
+		}
+	})
+}
+
+// failingPersistence is a Persistence whose Values fail to store while it's failing.
+type failingPersistence struct {
+	persistence.Persistence
+	mu      sync.Mutex
+	failing bool
+}
+
+func (p *failingPersistence) setFailing(failing bool) {
+	p.mu.Lock()
+	p.failing = failing
+	p.mu.Unlock()
+}
+
+func (p *failingPersistence) Value(name string) persistence.Value {
+	return &failingValue{Value: p.Persistence.Value(name), p: p}
+}
+
+type failingValue struct {
+	persistence.Value
+	p *failingPersistence
+}
+
+func (v *failingValue) Store(obj interface{}) error {
+	v.p.mu.Lock()
+	defer v.p.mu.Unlock()
+	if v.p.failing {
+		return fmt.Errorf("disk full")
+	}
+	return v.Value.Store(obj)
+}
+
+func TestAggregator_Stagger(t *testing.T) {
+	metric := metrics.Definition{
+		Name: "int-metric",
+		Type: "int",
+	}
+	bufTime := 60 * time.Second
+	newReport := func(tenant string, value int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: value,
+			},
+			Labels: map[string]string{
+				"tenant": tenant,
+			},
+		}
+	}
+
+	// Order the tenants by their offsets within the buffer time.
+	first, second := "tenant-a", "tenant-b"
+	if staggerOffset(second, bufTime) < staggerOffset(first, bufTime) {
+		first, second = second, first
+	}
+	firstOffset, secondOffset := staggerOffset(first, bufTime), staggerOffset(second, bufTime)
+	if firstOffset <= 0 || firstOffset == secondOffset {
+		t.Fatalf("Expected distinct, positive offsets, got: %v, %v", firstOffset, secondOffset)
+	}
+
+	mi := testlib.NewMockInput()
+	mockClock := testlib.NewMockClock()
+	mockClock.SetNow(time.Unix(0, 0))
+	a := newAggregator(metric, bufTime, 0, "tenant", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+	for _, r := range []metrics.MetricReport{newReport(first, 1), newReport(second, 2), newReport(first, 4)} {
+		if err := a.AddReport(r); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+	}
+
+	// Each tenant's reports are pushed at its own offset.
+	mi.DoAndWait(t, 1, func() {
+		mockClock.SetNow(time.Unix(0, 0).Add(firstOffset))
+	})
+	if expected, reports := []metrics.MetricReport{newReport(first, 5)}, mi.Reports(); !equalUnordered(reports, expected) {
+		t.Fatalf("Reports pushed at %v: expected: %+v, got: %+v", firstOffset, expected, reports)
+	}
+	mi.DoAndWait(t, 2, func() {
+		mockClock.SetNow(time.Unix(0, 0).Add(secondOffset))
+	})
+	if expected, reports := []metrics.MetricReport{newReport(second, 2)}, mi.Reports(); !equalUnordered(reports, expected) {
+		t.Fatalf("Reports pushed at %v: expected: %+v, got: %+v", secondOffset, expected, reports)
+	}
+
+	// A tenant's next reports are pushed at its offset in the next interval.
+	later := newReport(first, 8)
+	later.StartTime, later.EndTime = time.Unix(2, 0), time.Unix(3, 0)
+	if err := a.AddReport(later); err != nil {
+		t.Fatalf("Unexpected error when adding report: %+v", err)
+	}
+	mockClock.SetNow(time.Unix(0, 0).Add(bufTime + firstOffset - time.Millisecond))
+	if reports := mi.Reports(); len(reports) != 0 {
+		t.Fatalf("Expected no push before %v, got: %+v", bufTime+firstOffset, reports)
+	}
+	mi.DoAndWait(t, 3, func() {
+		mockClock.SetNow(time.Unix(0, 0).Add(bufTime + firstOffset))
+	})
+	if expected, reports := []metrics.MetricReport{later}, mi.Reports(); !equalUnordered(reports, expected) {
+		t.Fatalf("Reports pushed at %v: expected: %+v, got: %+v", bufTime+firstOffset, expected, reports)
+	}
+	a.Release()
+}
+
+func TestAggregator_FutureEndTime(t *testing.T) {
+	metric := metrics.Definition{
+		Name: "int-metric",
+		Type: "int",
+	}
+	bufTime := 60 * time.Second
+	// The bucket opens at 0 and is pushed at 60. The report ends at 100, after both.
+	future := metrics.MetricReport{
+		Name:      "int-metric",
+		StartTime: time.Unix(90, 0),
+		EndTime:   time.Unix(100, 0),
+		Value: metrics.MetricValue{
+			Int64Value: 2,
+		},
+	}
+	pushed := func(t *testing.T, policy string) []metrics.MetricReport {
+		mi := testlib.NewMockInput()
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		a := newAggregator(metric, bufTime, 0, "", policy, PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		mockClock.SetNow(time.Unix(30, 0))
+		if err := a.AddReport(future); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(60, 0))
+		})
+		a.Release()
+		return mi.Reports()
+	}
+	expectTimes := func(t *testing.T, reports []metrics.MetricReport, start, end int64) {
+		if len(reports) != 1 {
+			t.Fatalf("Expected 1 report, got: %+v", reports)
+		}
+		if want, got := time.Unix(start, 0), reports[0].StartTime; !want.Equal(got) {
+			t.Fatalf("StartTime: expected %v, got %v", want, got)
+		}
+		if want, got := time.Unix(end, 0), reports[0].EndTime; !want.Equal(got) {
+			t.Fatalf("EndTime: expected %v, got %v", want, got)
+		}
+	}
+
+	t.Run("unset", func(t *testing.T) {
+		expectTimes(t, pushed(t, ""), 90, 100)
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(30, 0))
+		a := newAggregator(metric, bufTime, 0, "", "reject", PersistPolicy{}, testlib.NewMockInput(), persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		defer a.Release()
+		err := a.AddReport(future)
+		if _, ok := err.(*FutureReportError); !ok || !errors.Is(err, pipeline.ErrValidation) {
+			t.Fatalf("Expected a FutureReportError, got: %+v", err)
+		}
+		// A report that ends now is accepted.
+		current := future
+		current.StartTime, current.EndTime = time.Unix(20, 0), time.Unix(30, 0)
+		if err := a.AddReport(current); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+	})
+
+	t.Run("clamp", func(t *testing.T) {
+		// The report starts after the current time too, so both times are moved back to it.
+		expectTimes(t, pushed(t, "clamp"), 30, 30)
+	})
+
+	t.Run("window", func(t *testing.T) {
+		expectTimes(t, pushed(t, "window"), 60, 60)
+	})
 }
 
 func TestAggregator_Use(t *testing.T) {
@@ -135,7 +510,7 @@ func TestAggregator_Use(t *testing.T) {
 	bufTime := 10 * time.Second
 
 	// Test multiple usages of the Aggregator.
-	a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), testlib.NewMockClock())
+	a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), testlib.NewMockClock(), 1)
 	a.Use()
 	a.Use()
 
@@ -162,7 +537,7 @@ func TestAggregator_AddReport(t *testing.T) {
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
 		mi := testlib.NewMockInput()
-		a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(metrics.MetricReport{
 			Name:      "int-metric",
@@ -200,7 +575,7 @@ func TestAggregator_AddReport(t *testing.T) {
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
 		mi := testlib.NewMockInput()
-		a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(metrics.MetricReport{
 			Name:      "int-metric",
@@ -243,12 +618,67 @@ func TestAggregator_AddReport(t *testing.T) {
 		}
 	})
 
+	// Each named value of a compound metric is summed independently
+	t.Run("Compound values", func(t *testing.T) {
+		compound := metrics.Definition{
+			Name:   "transfer",
+			Type:   "int",
+			Values: []string{"bytes_in", "bytes_out"},
+		}
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := NewValidatingInput(newAggregator(compound, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1), metrics.DefaultValidators(compound)...)
+
+		for _, values := range []map[string]metrics.MetricValue{
+			{"bytes_in": {Int64Value: 10}, "bytes_out": {Int64Value: 1}},
+			{"bytes_in": {Int64Value: 5}},
+		} {
+			if err := a.AddReport(metrics.MetricReport{
+				Name:      "transfer",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Values:    values,
+			}); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "transfer",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Values:    map[string]metrics.MetricValue{"bytes_sideways": {Int64Value: 1}},
+		}); err == nil || !strings.Contains(err.Error(), "undeclared value name: bytes_sideways") {
+			t.Fatalf("Expected undeclared value name error, got: %+v", err)
+		}
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(100, 0))
+		})
+
+		expected := []metrics.MetricReport{
+			{
+				Name:      "transfer",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Values: map[string]metrics.MetricValue{
+					"bytes_in":  {Int64Value: 15},
+					"bytes_out": {Int64Value: 1},
+				},
+			},
+		}
+
+		reports := mi.Reports()
+		if !equalUnordered(reports, expected) {
+			t.Fatalf("Aggregated reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
 	// Add two reports with the same name but different labels: no aggregation
 	t.Run("Different labels", func(t *testing.T) {
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
 		mi := testlib.NewMockInput()
-		a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(metrics.MetricReport{
 			Name:      "int-metric",
@@ -311,14 +741,308 @@ func TestAggregator_AddReport(t *testing.T) {
 		}
 	})
 
+	// Add reports for several metrics covered by a wildcard definition: separate aggregation per name
+	t.Run("Wildcard definition", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		wildcard := metrics.Definition{Name: "requests_*", Type: "int"}
+		a := NewValidatingInput(newAggregator(wildcard, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1), metrics.DefaultValidators(wildcard)...)
+
+		for _, name := range []string{"requests_get", "requests_post", "requests_get"} {
+			if err := a.AddReport(metrics.MetricReport{
+				Name:      name,
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Value: metrics.MetricValue{
+					Int64Value: 10,
+				},
+			}); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+		if err := a.AddReport(metrics.MetricReport{
+			Name:      "errors_get",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 10,
+			},
+		}); err == nil || err.Error() != "incorrect metric name: errors_get" {
+			t.Fatalf("Expected error with message \"incorrect metric name: errors_get\", got: %+v", err)
+		}
+		mi.DoAndWait(t, 2, func() {
+			mockClock.SetNow(time.Unix(100, 0))
+		})
+
+		expected := []metrics.MetricReport{
+			{
+				Name:      "requests_get",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Value: metrics.MetricValue{
+					Int64Value: 20,
+				},
+			},
+			{
+				Name:      "requests_post",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Value: metrics.MetricValue{
+					Int64Value: 10,
+				},
+			},
+		}
+
+		reports := mi.Reports()
+		if !equalUnordered(reports, expected) {
+			t.Fatalf("Aggregated reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	// Add reports with differing annotations: annotations don't split buckets, and are merged
+	// according to the metric's policy
+	t.Run("Annotations", func(t *testing.T) {
+		for _, policy := range []struct {
+			name     string
+			expected map[string]string
+		}{
+			{metrics.FirstAnnotations, map[string]string{"trace": "t1", "host": "h1"}},
+			{metrics.CollectAnnotations, map[string]string{"trace": "t1,t2", "host": "h1"}},
+		} {
+			mockClock := testlib.NewMockClock()
+			mockClock.SetNow(time.Unix(0, 0))
+			mi := testlib.NewMockInput()
+			def := metrics.Definition{Name: "int-metric", Type: "int", AnnotationMerge: policy.name}
+			a := newAggregator(def, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+
+			for _, annotations := range []map[string]string{
+				{"trace": "t1"},
+				{"trace": "t2", "host": "h1"},
+				{"trace": "t1"},
+				nil,
+			} {
+				if err := a.AddReport(metrics.MetricReport{
+					Name:      "int-metric",
+					StartTime: time.Unix(0, 0),
+					EndTime:   time.Unix(1, 0),
+					Labels: map[string]string{
+						"key1": "value1",
+					},
+					Value: metrics.MetricValue{
+						Int64Value: 10,
+					},
+					Annotations: annotations,
+				}); err != nil {
+					t.Fatalf("Unexpected error when adding report: %+v", err)
+				}
+			}
+			mi.DoAndWait(t, 1, func() {
+				mockClock.SetNow(time.Unix(100, 0))
+			})
+
+			expected := []metrics.MetricReport{
+				{
+					Name:      "int-metric",
+					StartTime: time.Unix(0, 0),
+					EndTime:   time.Unix(1, 0),
+					Labels: map[string]string{
+						"key1": "value1",
+					},
+					Value: metrics.MetricValue{
+						Int64Value: 40,
+					},
+					Annotations: policy.expected,
+				},
+			}
+
+			reports := mi.Reports()
+			if !equalUnordered(reports, expected) {
+				t.Fatalf("%v policy: aggregated reports: expected: %+v, got: %+v", policy.name, expected, reports)
+			}
+			a.Release()
+		}
+	})
+
+	t.Run("Flush on value", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(metric, 10*time.Second, 25, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		defer a.Release()
+
+		add := func(start int64, value int64) {
+			if err := a.AddReport(metrics.MetricReport{
+				Name:      "int-metric",
+				StartTime: time.Unix(start, 0),
+				EndTime:   time.Unix(start+1, 0),
+				Value: metrics.MetricValue{
+					Int64Value: value,
+				},
+			}); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+
+		// The third report brings the aggregated value to 30, which reaches the threshold and flushes
+		// the report before AddReport returns.
+		add(0, 10)
+		add(1, 10)
+		if reports := mi.Reports(); len(reports) != 0 {
+			t.Fatalf("Expected no flushed reports below the threshold, got: %+v", reports)
+		}
+		mockClock.SetNow(time.Unix(3, 0))
+		add(2, 10)
+		expected := []metrics.MetricReport{
+			{
+				Name:      "int-metric",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(3, 0),
+				Value: metrics.MetricValue{
+					Int64Value: 30,
+				},
+			},
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Threshold flush: expected: %+v, got: %+v", expected, reports)
+		}
+
+		// A residual amount below the threshold is flushed when the bucket's buffer time elapses.
+		add(3, 5)
+		mi.DoAndWait(t, 2, func() {
+			mockClock.SetNow(time.Unix(10, 0))
+		})
+		expected = []metrics.MetricReport{
+			{
+				Name:      "int-metric",
+				StartTime: time.Unix(3, 0),
+				EndTime:   time.Unix(4, 0),
+				Value: metrics.MetricValue{
+					Int64Value: 5,
+				},
+			},
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Residual flush: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	// The threshold applies to each aggregated report, and to each named value of a compound metric,
+	// rather than to the bucket as a whole.
+	t.Run("Flush on value per report", func(t *testing.T) {
+		compound := metrics.Definition{
+			Name:   "transfer",
+			Type:   "int",
+			Values: []string{"bytes_in", "bytes_out"},
+		}
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(compound, 10*time.Second, 25, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		defer a.Release()
+
+		add := func(tenant string, in, out int64) {
+			if err := a.AddReport(metrics.MetricReport{
+				Name:      "transfer",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Labels:    map[string]string{"tenant": tenant},
+				Values: map[string]metrics.MetricValue{
+					"bytes_in":  {Int64Value: in},
+					"bytes_out": {Int64Value: out},
+				},
+			}); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+
+		// Neither tenant has a single value at the threshold, though together they exceed it.
+		add("a", 20, 20)
+		add("b", 20, 0)
+		if reports := mi.Reports(); len(reports) != 0 {
+			t.Fatalf("Expected no flushed reports below the threshold, got: %+v", reports)
+		}
+
+		// Tenant a's bytes_in reaches the threshold, flushing only tenant a.
+		add("a", 5, 0)
+		expected := []metrics.MetricReport{
+			{
+				Name:      "transfer",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Labels:    map[string]string{"tenant": "a"},
+				Values: map[string]metrics.MetricValue{
+					"bytes_in":  {Int64Value: 25},
+					"bytes_out": {Int64Value: 20},
+				},
+			},
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Threshold flush: expected: %+v, got: %+v", expected, reports)
+		}
+
+		// Tenant b is flushed with the bucket.
+		mi.DoAndWait(t, 2, func() {
+			mockClock.SetNow(time.Unix(10, 0))
+		})
+		expected = []metrics.MetricReport{
+			{
+				Name:      "transfer",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Labels:    map[string]string{"tenant": "b"},
+				Values: map[string]metrics.MetricValue{
+					"bytes_in":  {Int64Value: 20},
+					"bytes_out": {Int64Value: 0},
+				},
+			},
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Bucket flush: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("Earliest ingest time is kept", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		defer a.Release()
+
+		for _, ingested := range []int64{30, 20, 0, 40} {
+			report := metrics.MetricReport{
+				Name:      "int-metric",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Value: metrics.MetricValue{
+					Int64Value: 10,
+				},
+			}
+			if ingested != 0 {
+				report.IngestTime = time.Unix(ingested, 0)
+			}
+			if err := a.AddReport(report); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(100, 0))
+		})
+
+		if want, got := time.Unix(20, 0), mi.Reports()[0].IngestTime; !want.Equal(got) {
+			t.Fatalf("IngestTime: want=%v, got=%v", want, got)
+		}
+	})
+
 	// Add a report that fails validation: error
 	t.Run("Report validation error", func(t *testing.T) {
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
 		mi := testlib.NewMockInput()
-		a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		vi := NewValidatingInput(a, metrics.DefaultValidators(metric)...)
 
-		if err := a.AddReport(metrics.MetricReport{
+		if err := vi.AddReport(metrics.MetricReport{
 			Name:      "int-metric",
 			StartTime: time.Unix(10, 0), // StartTime > EndTime -> error
 			EndTime:   time.Unix(1, 0),
@@ -338,7 +1062,7 @@ func TestAggregator_AddReport(t *testing.T) {
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
 		mi := testlib.NewMockInput()
-		a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(metrics.MetricReport{
 			Name:      "int-metric",
@@ -396,7 +1120,7 @@ func TestAggregator_AddReport(t *testing.T) {
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
 		mi := testlib.NewMockInput()
-		a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(metrics.MetricReport{
 			Name:      "int-metric",
@@ -470,7 +1194,7 @@ func TestAggregator_AddReport(t *testing.T) {
 		mockClock := testlib.NewMockClock()
 		mockClock.SetNow(time.Unix(0, 0))
 		mi := testlib.NewMockInput()
-		a := newAggregator(metric, bufTime, mi, persistence.NewMemoryPersistence(), mockClock)
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
 
 		if err := a.AddReport(metrics.MetricReport{
 			Name:      "int-metric",
@@ -491,6 +1215,223 @@ func TestAggregator_AddReport(t *testing.T) {
 	})
 }
 
+func TestAggregator_Flush(t *testing.T) {
+	metric := metrics.Definition{Name: "requests", Type: "int"}
+	bufTime := 10 * time.Second
+
+	// Reports for distinct label sets of a single metric are handed off concurrently, up to the
+	// configured parallelism.
+	t.Run("Concurrent handoff", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		bi := newBlockingInput()
+		a := newAggregator(metric, bufTime, 0, "", "", PersistPolicy{}, bi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 2)
+		for i := 0; i < 5; i++ {
+			if err := a.AddReport(metrics.MetricReport{
+				Name:      "requests",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(1, 0),
+				Labels:    map[string]string{"tenant": fmt.Sprint(i)},
+				Value: metrics.MetricValue{
+					Int64Value: 10,
+				},
+			}); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+
+		mockClock.SetNow(time.Unix(100, 0))
+		if err := bi.waitForInFlight(2); err != nil {
+			t.Fatal(err)
+		}
+		bi.unblock()
+		a.Release()
+
+		if want, got := 2, bi.maxInFlight(); want != got {
+			t.Fatalf("max concurrent handoffs: want=%v, got=%v", want, got)
+		}
+	})
+
+	// Each label set's reports are handed off in order, since each push finishes before the next.
+	t.Run("Per-series ordering", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(metric, bufTime, 10, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 3)
+		for i := 0; i < 3; i++ {
+			for _, tenant := range []string{"a", "b", "c"} {
+				if err := a.AddReport(metrics.MetricReport{
+					Name:      "requests",
+					StartTime: time.Unix(int64(i), 0),
+					EndTime:   time.Unix(int64(i+1), 0),
+					Labels:    map[string]string{"tenant": tenant},
+					Value: metrics.MetricValue{
+						Int64Value: 10,
+					},
+				}); err != nil {
+					t.Fatalf("Unexpected error when adding report: %+v", err)
+				}
+			}
+		}
+		a.Release()
+
+		sequences := make(map[string][]int64)
+		for _, r := range mi.Reports() {
+			sequences[r.Labels["tenant"]] = append(sequences[r.Labels["tenant"]], r.StartTime.Unix())
+		}
+		for _, tenant := range []string{"a", "b", "c"} {
+			if want, got := []int64{0, 1, 2}, sequences[tenant]; !reflect.DeepEqual(want, got) {
+				t.Fatalf("%v report order: want=%v, got=%v", tenant, want, got)
+			}
+		}
+	})
+}
+
+// blockingInput is a pipeline.Input whose AddReport blocks until unblock is called. It tracks the
+// number of concurrent AddReport calls.
+type blockingInput struct {
+	testlib.MockInput
+	release  chan bool
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func newBlockingInput() *blockingInput {
+	return &blockingInput{release: make(chan bool)}
+}
+
+func (i *blockingInput) AddReport(report metrics.MetricReport) error {
+	i.mu.Lock()
+	i.inFlight++
+	if i.inFlight > i.max {
+		i.max = i.inFlight
+	}
+	i.mu.Unlock()
+	<-i.release
+	i.mu.Lock()
+	i.inFlight--
+	i.mu.Unlock()
+	return nil
+}
+
+func (i *blockingInput) unblock() {
+	close(i.release)
+}
+
+func (i *blockingInput) maxInFlight() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.max
+}
+
+func (i *blockingInput) waitForInFlight(count int) error {
+	for n := 0; n < 500; n++ {
+		i.mu.Lock()
+		current := i.inFlight
+		i.mu.Unlock()
+		if current >= count {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("expected %v concurrent handoffs", count)
+}
+
+func TestAggregator_Concurrent(t *testing.T) {
+	metric := metrics.Definition{
+		Name: "int-metric",
+		Type: "int",
+	}
+	const goroutines = 50
+	const adds = 200
+
+	// addAll adds reports to a from many goroutines at once. Each goroutine reuses a single labels
+	// map, changing it after each add. Every report has a value of 1, and reports cover [i, i+1)
+	// seconds for distinct values of i, which arrive in no particular order.
+	addAll := func(t *testing.T, a *Aggregator) {
+		var wg sync.WaitGroup
+		errs := make(chan error, goroutines)
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				labels := map[string]string{}
+				for i := 0; i < adds; i++ {
+					labels["tenant"] = "a"
+					start := int64(g*adds + i)
+					if err := a.AddReport(metrics.MetricReport{
+						Name:      "int-metric",
+						StartTime: time.Unix(start, 0),
+						EndTime:   time.Unix(start+1, 0),
+						Labels:    labels,
+						Value:     metrics.MetricValue{Int64Value: 1},
+					}); err != nil {
+						errs <- err
+						return
+					}
+					labels["tenant"] = "reused"
+				}
+			}(g)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+	}
+
+	t.Run("Same bucket", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(metric, time.Hour, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		addAll(t, a)
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(7200, 0))
+		})
+
+		expected := []metrics.MetricReport{
+			{
+				Name:      "int-metric",
+				StartTime: time.Unix(0, 0),
+				EndTime:   time.Unix(goroutines*adds, 0),
+				Labels:    map[string]string{"tenant": "a"},
+				Value:     metrics.MetricValue{Int64Value: goroutines * adds},
+			},
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Aggregated reports: expected: %+v, got: %+v", expected, reports)
+		}
+		a.Release()
+	})
+
+	// Buckets pushed while reports are being added still account for every report exactly once.
+	t.Run("Pushes during adds", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(metric, time.Hour, 997, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		addAll(t, a)
+		a.Release()
+
+		var total int64
+		reports := mi.Reports()
+		for _, r := range reports {
+			if want, got := map[string]string{"tenant": "a"}, r.Labels; !reflect.DeepEqual(want, got) {
+				t.Fatalf("labels: want=%v, got=%v", want, got)
+			}
+			total += r.Value.Int64Value
+		}
+		if want, got := int64(goroutines*adds), total; want != got {
+			t.Fatalf("sum of pushed reports: want=%v, got=%v", want, got)
+		}
+		if len(reports) < goroutines*adds/997 {
+			t.Fatalf("expected at least %v pushed reports, got: %v", goroutines*adds/997, len(reports))
+		}
+	})
+}
+
 func equalUnordered(a, b []metrics.MetricReport) bool {
 	if len(a) != len(b) {
 		return false
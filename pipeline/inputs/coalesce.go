@@ -0,0 +1,185 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inputs
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/clock"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+	"github.com/hashicorp/go-multierror"
+)
+
+// coalesceInput is a pipeline.Input that merges reports with the same name and labels that arrive
+// within a short window, forwarding a single summed report per name and label set to its delegate.
+type coalesceInput struct {
+	delegate   pipeline.Input
+	window     time.Duration
+	validators []metrics.Validator
+	clock      clock.Clock
+	pending    []*metrics.MetricReport // must hold mu to read/write
+	timerSet   bool                    // must hold mu to read/write
+	closed     bool                    // must hold mu to read/write
+	mu         sync.Mutex
+	flushMu    sync.Mutex
+	flushErr   *multierror.Error // must hold flushMu to read/write
+	quit       chan bool
+	wait       sync.WaitGroup
+	tracker    pipeline.UsageTracker
+}
+
+// NewCoalesceInput creates an Input that sums same-key reports (those with the same name and
+// labels) arriving within window of the first such pending report, and passes the merged reports to
+// delegate when the window elapses. A merged report spans the earliest StartTime and latest EndTime
+// of its constituents, and keeps the first value of each of their annotations. Pending reports are
+// flushed when the Input is released.
+//
+// Reports are checked with the given validators when they're added, so that invalid reports are
+// rejected by AddReport rather than by the delegate after the window elapses. Since merged reports
+// are passed to the delegate asynchronously, errors returned by the delegate are logged, and
+// returned by Release.
+//
+// Unlike an Aggregator, a coalesceInput doesn't persist pending reports; it's intended as a
+// lightweight pre-merge in front of one.
+func NewCoalesceInput(delegate pipeline.Input, window time.Duration, validators ...metrics.Validator) pipeline.Input {
+	return newCoalesceInput(delegate, window, clock.NewClock(), validators...)
+}
+
+func newCoalesceInput(delegate pipeline.Input, window time.Duration, clock clock.Clock, validators ...metrics.Validator) *coalesceInput {
+	delegate.Use()
+	return &coalesceInput{
+		delegate:   delegate,
+		window:     window,
+		validators: validators,
+		clock:      clock,
+		quit:       make(chan bool),
+	}
+}
+
+func (c *coalesceInput) AddReport(report metrics.MetricReport) error {
+	if err := metrics.Validate(report, c.validators); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errors.New("coalesceInput: AddReport called on closed input")
+	}
+	if !c.merge(report) {
+		// Annotations and values are copied, since they may be modified by subsequent merges. Labels
+		// are copied, since the caller may reuse its map once AddReport returns.
+		report.Annotations = metrics.MergeAnnotations(metrics.FirstAnnotations, nil, report.Annotations)
+		report.Values = metrics.MergeValues(nil, report.Values)
+		if report.Labels != nil {
+			labels := make(map[string]string, len(report.Labels))
+			for k, v := range report.Labels {
+				labels[k] = v
+			}
+			report.Labels = labels
+		}
+		c.pending = append(c.pending, &report)
+	}
+	if !c.timerSet {
+		c.timerSet = true
+		c.startTimer()
+	}
+	return nil
+}
+
+// merge sums report into a pending report with the same key, returning false if there is none. The
+// caller must hold c.mu.
+func (c *coalesceInput) merge(report metrics.MetricReport) bool {
+	for _, p := range c.pending {
+		if p.Name != report.Name || !reflect.DeepEqual(p.Labels, report.Labels) {
+			continue
+		}
+		p.Value.Int64Value += report.Value.Int64Value
+		p.Value.DoubleValue += report.Value.DoubleValue
+		p.Values = metrics.MergeValues(p.Values, report.Values)
+		p.Annotations = metrics.MergeAnnotations(metrics.FirstAnnotations, p.Annotations, report.Annotations)
+		p.IngestTime = earliestIngest(p.IngestTime, report.IngestTime)
+		if report.StartTime.Before(p.StartTime) {
+			p.StartTime = report.StartTime
+		}
+		if report.EndTime.After(p.EndTime) {
+			p.EndTime = report.EndTime
+		}
+		return true
+	}
+	return false
+}
+
+// startTimer starts a goroutine that flushes pending reports once the window elapses, or when the
+// Input is released. The caller must hold c.mu.
+func (c *coalesceInput) startTimer() {
+	timer := c.clock.NewTimerAt(c.clock.Now().Add(c.window))
+	c.wait.Add(1)
+	go func() {
+		defer c.wait.Done()
+		select {
+		case <-timer.GetC():
+		case <-c.quit:
+			timer.Stop()
+		}
+		c.flush()
+	}()
+}
+
+func (c *coalesceInput) flush() {
+	// flushMu ensures that reports from consecutive windows reach the delegate in order.
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	reports := c.pending
+	c.pending = nil
+	c.timerSet = false
+	c.mu.Unlock()
+	for _, r := range reports {
+		if err := c.delegate.AddReport(*r); err != nil {
+			glog.Errorf("coalesceInput: error sending report: %+v", err)
+			c.flushErr = multierror.Append(c.flushErr, err)
+		}
+	}
+}
+
+// Use increments the coalesceInput's usage count.
+// See pipeline.Component.Use.
+func (c *coalesceInput) Use() {
+	c.tracker.Use()
+}
+
+// Release decrements the coalesceInput's usage count. If it reaches 0, Release flushes any pending
+// reports to the delegate and then releases it. The returned error includes any errors the delegate
+// returned for flushed reports.
+// See pipeline.Component.Release.
+func (c *coalesceInput) Release() error {
+	return c.tracker.Release(func() error {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.quit)
+		c.wait.Wait()
+		c.flush()
+		c.flushMu.Lock()
+		err := multierror.Append(c.flushErr, c.delegate.Release())
+		c.flushMu.Unlock()
+		return err.ErrorOrNil()
+	})
+}
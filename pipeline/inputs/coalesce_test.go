@@ -0,0 +1,178 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inputs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestCoalesceInput(t *testing.T) {
+	window := 1 * time.Second
+	report := func(labels map[string]string, start, end, value int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(start, 0),
+			EndTime:   time.Unix(end, 0),
+			Labels:    labels,
+			Value: metrics.MetricValue{
+				Int64Value: value,
+			},
+		}
+	}
+	fooLabels := map[string]string{"key": "foo"}
+	barLabels := map[string]string{"key": "bar"}
+
+	t.Run("Same-key reports are merged", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(100, 0))
+		mi := testlib.NewMockInput()
+		c := newCoalesceInput(mi, window, mockClock)
+		c.Use()
+		defer c.Release()
+
+		for _, r := range []metrics.MetricReport{
+			report(fooLabels, 0, 1, 10),
+			report(fooLabels, 1, 2, 5),
+			report(barLabels, 0, 1, 3),
+			report(fooLabels, 2, 3, 1),
+		} {
+			if err := c.AddReport(r); err != nil {
+				t.Fatalf("Unexpected error when adding report: %+v", err)
+			}
+		}
+
+		// Nothing is forwarded until the window elapses.
+		if got := len(mi.Reports()); got != 0 {
+			t.Fatalf("Expected no reports before window elapses, got %v", got)
+		}
+
+		mi.DoAndWait(t, 2, func() {
+			mockClock.SetNow(time.Unix(101, 0))
+		})
+
+		expected := []metrics.MetricReport{
+			report(fooLabels, 0, 3, 16),
+			report(barLabels, 0, 1, 3),
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Coalesced reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("Reports in separate windows aren't merged", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(100, 0))
+		mi := testlib.NewMockInput()
+		c := newCoalesceInput(mi, window, mockClock)
+		c.Use()
+		defer c.Release()
+
+		if err := c.AddReport(report(fooLabels, 0, 1, 10)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(101, 0))
+		})
+		if err := c.AddReport(report(fooLabels, 1, 2, 5)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		mi.DoAndWait(t, 2, func() {
+			mockClock.SetNow(time.Unix(102, 0))
+		})
+
+		expected := []metrics.MetricReport{
+			report(fooLabels, 0, 1, 10),
+			report(fooLabels, 1, 2, 5),
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Coalesced reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("Release flushes pending reports", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(100, 0))
+		mi := testlib.NewMockInput()
+		c := newCoalesceInput(mi, window, mockClock)
+		c.Use()
+
+		if err := c.AddReport(report(fooLabels, 0, 1, 10)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		if err := c.AddReport(report(fooLabels, 1, 2, 5)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		c.Release()
+
+		expected := []metrics.MetricReport{report(fooLabels, 0, 2, 15)}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Coalesced reports: expected: %+v, got: %+v", expected, reports)
+		}
+		if !mi.Released {
+			t.Fatal("Expected delegate to be released")
+		}
+		if err := c.AddReport(report(fooLabels, 2, 3, 1)); err == nil {
+			t.Fatal("Expected error when adding report to released input")
+		}
+	})
+	t.Run("Caller's labels may be reused", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(100, 0))
+		mi := testlib.NewMockInput()
+		c := newCoalesceInput(mi, window, mockClock)
+		c.Use()
+
+		labels := map[string]string{"key": "foo"}
+		if err := c.AddReport(report(labels, 0, 1, 10)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		labels["key"] = "bar"
+		c.Release()
+
+		expected := []metrics.MetricReport{report(fooLabels, 0, 1, 10)}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Coalesced reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(100, 0))
+		mi := testlib.NewMockInput()
+		def := metrics.Definition{Name: "int-metric", Type: "int"}
+		c := newCoalesceInput(mi, window, mockClock, metrics.DefaultValidators(def)...)
+		c.Use()
+
+		// Invalid reports are rejected when they're added.
+		if err := c.AddReport(report(fooLabels, 1, 0, 10)); err == nil {
+			t.Fatal("Expected error when adding invalid report")
+		}
+
+		// Errors from the delegate are returned by Release.
+		mi.SetAddError(errors.New("delegate failure"))
+		if err := c.AddReport(report(fooLabels, 0, 1, 10)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		if err := c.Release(); err == nil || !strings.Contains(err.Error(), "delegate failure") {
+			t.Fatalf("Expected delegate failure from Release, got: %v", err)
+		}
+	})
+}
@@ -15,7 +15,16 @@
 package inputs
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/clock"
 
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
@@ -26,17 +35,18 @@ import (
 // Type selector is a pipeline.Input that routes a MetricReport to another pipeline.Input based on
 // the metric name.
 type selector struct {
-	// Map of metric names to pipeline.Input objects.
+	// Map of metric names (or wildcard patterns) to pipeline.Input objects.
 	inputs  map[string]pipeline.Input
+	names   *metrics.Matcher
 	tracker pipeline.UsageTracker
 }
 
 func (s *selector) AddReport(report metrics.MetricReport) error {
-	a, ok := s.inputs[report.Name]
+	name, ok := s.names.Match(report.Name)
 	if !ok {
-		return fmt.Errorf("selector: unknown metric: %v", report.Name)
+		return &pipeline.ReportError{Kind: pipeline.ErrUnknownMetric, Name: report.Name, Err: fmt.Errorf("selector: unknown metric: %v", report.Name)}
 	}
-	return a.AddReport(report)
+	return s.inputs[name].AddReport(report)
 }
 
 // Use increments the Selector's usage count.
@@ -61,12 +71,16 @@ func (s *selector) Release() error {
 }
 
 // NewSelector creates an Input that selects from the given inputs based on metric name. The inputs
-// parameter is a map of metric name to the corresponding Input that handles it.
+// parameter is a map of metric name to the corresponding Input that handles it. Names may be
+// wildcard patterns, in which case the selection rules of metrics.BestMatch apply: an exact name
+// takes precedence over any pattern.
 func NewSelector(inputs map[string]pipeline.Input) pipeline.Input {
-	for _, a := range inputs {
+	var names []string
+	for name, a := range inputs {
 		a.Use()
+		names = append(names, name)
 	}
-	return &selector{inputs: inputs}
+	return &selector{inputs: inputs, names: metrics.NewMatcher(names)}
 }
 
 type callbackInput struct {
@@ -98,6 +112,82 @@ func NewCallbackInput(delegate pipeline.Input, shutdown func() error) pipeline.I
 	return &callbackInput{delegate: delegate, shutdown: shutdown}
 }
 
+type ingestTimeInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	clock    clock.Clock
+}
+
+func (i *ingestTimeInput) AddReport(report metrics.MetricReport) error {
+	report.IngestTime = i.clock.Now()
+	return i.delegate.AddReport(report)
+}
+
+// NewIngestTimeInput creates an Input that sets the IngestTime of incoming MetricReports to the
+// current time before passing reports to the given delegate.
+func NewIngestTimeInput(delegate pipeline.Input) pipeline.Input {
+	return newIngestTimeInput(delegate, clock.NewClock())
+}
+
+func newIngestTimeInput(delegate pipeline.Input, clock clock.Clock) pipeline.Input {
+	return &ingestTimeInput{Component: delegate, delegate: delegate, clock: clock}
+}
+
+// StaleReportError is returned by an Input created with NewMaxAgeInput when a report's EndTime is
+// older than the configured maximum age.
+type StaleReportError struct {
+	Name    string
+	EndTime time.Time
+	Cutoff  time.Time
+}
+
+func (e *StaleReportError) Error() string {
+	return fmt.Sprintf("metric %v: report too old: end time %v is before %v", e.Name, e.EndTime, e.Cutoff)
+}
+
+// Is returns true if target is pipeline.ErrValidation.
+func (e *StaleReportError) Is(target error) bool {
+	return target == pipeline.ErrValidation
+}
+
+type maxAgeInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	maxAge   time.Duration
+	clock    clock.Clock
+}
+
+func (i *maxAgeInput) AddReport(report metrics.MetricReport) error {
+	cutoff := i.clock.Now().Add(-i.maxAge)
+	if report.EndTime.Before(cutoff) {
+		return &StaleReportError{Name: report.Name, EndTime: report.EndTime, Cutoff: cutoff}
+	}
+	return i.delegate.AddReport(report)
+}
+
+// NewMaxAgeInput creates an Input that rejects reports whose EndTime is more than maxAge before the
+// current time with a *StaleReportError. Other reports are passed to the given delegate.
+func NewMaxAgeInput(delegate pipeline.Input, maxAge time.Duration) pipeline.Input {
+	return newMaxAgeInput(delegate, maxAge, clock.NewClock())
+}
+
+func newMaxAgeInput(delegate pipeline.Input, maxAge time.Duration, clock clock.Clock) pipeline.Input {
+	return &maxAgeInput{Component: delegate, delegate: delegate, maxAge: maxAge, clock: clock}
+}
+
+// invalidReport returns an error rejecting report as invalid, described by err.
+func invalidReport(report metrics.MetricReport, err error) error {
+	return &pipeline.ReportError{Kind: pipeline.ErrValidation, Name: report.Name, Err: err}
+}
+
+// earliestIngest returns the earlier of two ingest times, ignoring unset (zero) times.
+func earliestIngest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
 type labelingInput struct {
 	pipeline.Component
 	delegate pipeline.Input
@@ -124,3 +214,481 @@ func (i *labelingInput) AddReport(report metrics.MetricReport) error {
 func NewLabelingInput(delegate pipeline.Input, labels map[string]string) pipeline.Input {
 	return &labelingInput{Component: delegate, delegate: delegate, labels: labels}
 }
+
+type defaultLabelsInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	labels   map[string]string
+}
+
+func (i *defaultLabelsInput) AddReport(report metrics.MetricReport) error {
+	var labels map[string]string
+	for k, v := range i.labels {
+		if _, exists := report.Labels[k]; exists {
+			continue
+		}
+		if labels == nil {
+			// The caller's label map isn't modified.
+			labels = make(map[string]string, len(report.Labels)+len(i.labels))
+			for k, v := range report.Labels {
+				labels[k] = v
+			}
+		}
+		labels[k] = v
+	}
+	if labels != nil {
+		report.Labels = labels
+	}
+	return i.delegate.AddReport(report)
+}
+
+// NewDefaultLabelsInput creates an Input that adds each of the given labels to incoming
+// MetricReports that don't have a label with that key, before passing reports to the given
+// delegate. Unlike NewLabelingInput, a report's own labels are expected to take precedence, so
+// they're retained without a warning.
+func NewDefaultLabelsInput(delegate pipeline.Input, labels map[string]string) pipeline.Input {
+	return &defaultLabelsInput{Component: delegate, delegate: delegate, labels: labels}
+}
+
+type validatingInput struct {
+	pipeline.Component
+	delegate   pipeline.Input
+	validators []metrics.Validator
+}
+
+func (i *validatingInput) AddReport(report metrics.MetricReport) error {
+	if err := metrics.Validate(report, i.validators); err != nil {
+		return invalidReport(report, err)
+	}
+	return i.delegate.AddReport(report)
+}
+
+// NewValidatingInput creates an Input that runs each of the given validators, in order, against
+// incoming MetricReports. The first validation error is returned to the caller, as a
+// *pipeline.ReportError matching pipeline.ErrValidation, and the report is not passed to the
+// delegate.
+func NewValidatingInput(delegate pipeline.Input, validators ...metrics.Validator) pipeline.Input {
+	return &validatingInput{Component: delegate, delegate: delegate, validators: validators}
+}
+
+type valueLabelInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	metric   metrics.Definition
+	label    string
+}
+
+func (i *valueLabelInput) AddReport(report metrics.MetricReport) error {
+	text, exists := report.Labels[i.label]
+	if !exists {
+		return invalidReport(report, fmt.Errorf("metric %v: missing value label: %v", report.Name, i.label))
+	}
+	if report.Value != (metrics.MetricValue{}) {
+		return invalidReport(report, fmt.Errorf("metric %v: value must be omitted when provided by label %v", report.Name, i.label))
+	}
+	switch i.metric.Type {
+	case metrics.IntType:
+		v, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return invalidReport(report, fmt.Errorf("metric %v: label %v: invalid integer value: %q", report.Name, i.label, text))
+		}
+		report.Value.Int64Value = v
+	case metrics.DoubleType:
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return invalidReport(report, fmt.Errorf("metric %v: label %v: invalid double value: %q", report.Name, i.label, text))
+		}
+		report.Value.DoubleValue = v
+	}
+
+	// The value label is removed so that it doesn't become part of the aggregation key. The labels
+	// map is copied since it's owned by the caller.
+	labels := make(map[string]string, len(report.Labels)-1)
+	for k, v := range report.Labels {
+		if k != i.label {
+			labels[k] = v
+		}
+	}
+	report.Labels = labels
+	return i.delegate.AddReport(report)
+}
+
+// NewValueLabelInput creates an Input that reads each report's value from the label with the given
+// name, rather than from the report's Value field. The label is parsed according to the metric's
+// type and removed from the report before it's passed to the delegate. Reports that lack the label,
+// contain a value that can't be parsed, or also specify a Value are rejected.
+func NewValueLabelInput(delegate pipeline.Input, metric metrics.Definition, label string) pipeline.Input {
+	return &valueLabelInput{Component: delegate, delegate: delegate, metric: metric, label: label}
+}
+
+type quantizingInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	step     float64
+	rounding string
+}
+
+func (i *quantizingInput) AddReport(report metrics.MetricReport) error {
+	report.Value = i.quantize(report.Value)
+	if len(report.Values) > 0 {
+		// The values map is copied since it's owned by the caller.
+		values := make(map[string]metrics.MetricValue, len(report.Values))
+		for k, v := range report.Values {
+			values[k] = i.quantize(v)
+		}
+		report.Values = values
+	}
+	return i.delegate.AddReport(report)
+}
+
+func (i *quantizingInput) quantize(v metrics.MetricValue) metrics.MetricValue {
+	v.Int64Value = quantizeInt(v.Int64Value, int64(i.step), i.rounding)
+	v.DoubleValue = metrics.Round(v.DoubleValue, i.step, i.rounding)
+	return v
+}
+
+// quantizeInt rounds v to a multiple of step using integer arithmetic, so that large values don't
+// lose precision. It rounds the same way as metrics.Round.
+func quantizeInt(v, step int64, rounding string) int64 {
+	if step <= 1 {
+		return v
+	}
+	switch rounding {
+	case metrics.RoundDown:
+		return floorDiv(v, step) * step
+	case metrics.RoundNearest:
+		return floorDiv(v+step/2, step) * step
+	default:
+		return -floorDiv(-v, step) * step
+	}
+}
+
+// floorDiv returns a/b rounded towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// NewQuantizingInput creates an Input that rounds each report's value, including each named value of
+// a compound metric, to a multiple of step before passing the report to the given delegate.
+// Rounding is one of metrics.RoundUp (the default), metrics.RoundDown, or metrics.RoundNearest, and
+// double values are rounded with metrics.Round. Integer values are rounded to a multiple of step
+// truncated to an integer.
+func NewQuantizingInput(delegate pipeline.Input, step float64, rounding string) pipeline.Input {
+	return &quantizingInput{Component: delegate, delegate: delegate, step: step, rounding: rounding}
+}
+
+const (
+	// LabelConflictReject rejects a report in which two label keys normalize to the same key with
+	// different values.
+	LabelConflictReject = "reject"
+
+	// LabelConflictFirst resolves a conflict between label keys that normalize to the same key by
+	// keeping the value of the original key that sorts first.
+	LabelConflictFirst = "first"
+)
+
+// LabelNormalization configures the label rewriting of NewNormalizingInput.
+type LabelNormalization struct {
+	// CaseFold lowercases label keys.
+	CaseFold bool
+
+	// StripPrefixes lists prefixes removed from label keys. Only the first matching prefix is
+	// removed, and a key that consists only of the prefix is left unchanged.
+	StripPrefixes []string
+
+	// TrimValues trims leading and trailing whitespace from label values.
+	TrimValues bool
+
+	// OnConflict is LabelConflictReject (the default) or LabelConflictFirst.
+	OnConflict string
+}
+
+type normalizingInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	norm     LabelNormalization
+}
+
+func (i *normalizingInput) AddReport(report metrics.MetricReport) error {
+	if len(report.Labels) == 0 {
+		return i.delegate.AddReport(report)
+	}
+	// Original keys are visited in sorted order so that conflicts are resolved deterministically.
+	keys := make([]string, 0, len(report.Labels))
+	for k := range report.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	// The labels map is replaced since it's owned by the caller.
+	labels := make(map[string]string, len(report.Labels))
+	for _, k := range keys {
+		key, value := i.key(k), report.Labels[k]
+		if i.norm.TrimValues {
+			value = strings.TrimSpace(value)
+		}
+		if existing, exists := labels[key]; exists && existing != value {
+			if i.norm.OnConflict != LabelConflictFirst {
+				return invalidReport(report, fmt.Errorf("metric %v: labels normalize to the same key %v with different values", report.Name, key))
+			}
+			continue
+		}
+		labels[key] = value
+	}
+	report.Labels = labels
+	return i.delegate.AddReport(report)
+}
+
+func (i *normalizingInput) key(k string) string {
+	if i.norm.CaseFold {
+		k = strings.ToLower(k)
+	}
+	for _, prefix := range i.norm.StripPrefixes {
+		if i.norm.CaseFold {
+			prefix = strings.ToLower(prefix)
+		}
+		if strings.HasPrefix(k, prefix) && len(k) > len(prefix) {
+			return k[len(prefix):]
+		}
+	}
+	return k
+}
+
+// NewNormalizingInput creates an Input that normalizes the label keys, and optionally the label
+// values, of incoming MetricReports according to norm before passing reports to the given
+// delegate, so that reports with equivalent labels are aggregated together.
+func NewNormalizingInput(delegate pipeline.Input, norm LabelNormalization) pipeline.Input {
+	return &normalizingInput{Component: delegate, delegate: delegate, norm: norm}
+}
+
+const (
+	// ExcludedLabelDrop removes excluded labels from reports.
+	ExcludedLabelDrop = "drop"
+
+	// ExcludedLabelAnnotate moves excluded labels to the report's annotations, unless an annotation
+	// with the same key already exists.
+	ExcludedLabelAnnotate = "annotate"
+)
+
+type labelExclusionInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	keys     map[string]bool
+	policy   string
+}
+
+func (i *labelExclusionInput) AddReport(report metrics.MetricReport) error {
+	excluded := false
+	for k := range report.Labels {
+		if i.keys[k] {
+			excluded = true
+			break
+		}
+	}
+	if !excluded {
+		return i.delegate.AddReport(report)
+	}
+
+	// The labels and annotations maps are copied since they're owned by the caller.
+	labels := make(map[string]string, len(report.Labels))
+	annotations := make(map[string]string, len(report.Annotations))
+	for k, v := range report.Annotations {
+		annotations[k] = v
+	}
+	for k, v := range report.Labels {
+		if !i.keys[k] {
+			labels[k] = v
+		} else if _, exists := annotations[k]; i.policy == ExcludedLabelAnnotate && !exists {
+			annotations[k] = v
+		}
+	}
+	report.Labels = labels
+	if len(annotations) > 0 {
+		report.Annotations = annotations
+	}
+	return i.delegate.AddReport(report)
+}
+
+// NewLabelExclusionInput creates an Input that removes the labels with the given keys from
+// incoming reports before passing them to the given delegate, so that they don't split
+// aggregation. The policy is ExcludedLabelDrop (the default, if empty) or ExcludedLabelAnnotate.
+func NewLabelExclusionInput(delegate pipeline.Input, keys []string, policy string) pipeline.Input {
+	excluded := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		excluded[k] = true
+	}
+	return &labelExclusionInput{Component: delegate, delegate: delegate, keys: excluded, policy: policy}
+}
+
+type precisionInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	step     float64
+	rounding string
+}
+
+func (i *precisionInput) AddReport(report metrics.MetricReport) error {
+	report.Value.DoubleValue = metrics.Round(report.Value.DoubleValue, i.step, i.rounding)
+	if len(report.Values) > 0 {
+		// The values map is copied since it's owned by the caller.
+		values := make(map[string]metrics.MetricValue, len(report.Values))
+		for k, v := range report.Values {
+			v.DoubleValue = metrics.Round(v.DoubleValue, i.step, i.rounding)
+			values[k] = v
+		}
+		report.Values = values
+	}
+	return i.delegate.AddReport(report)
+}
+
+// NewPrecisionInput creates an Input that rounds the double values of incoming reports, including
+// each named value of a compound metric, to the given number of decimal places, using
+// metrics.Round with the given rounding. Integer values are passed to the delegate unchanged.
+func NewPrecisionInput(delegate pipeline.Input, decimals int, rounding string) pipeline.Input {
+	return &precisionInput{Component: delegate, delegate: delegate, step: math.Pow10(-decimals), rounding: rounding}
+}
+
+const (
+	// RateReplace sends each report's values as per-second rates instead of sums.
+	RateReplace = "replace"
+
+	// RateAdd sends each report unchanged, followed by a report of its per-second rates named with
+	// RateSuffix.
+	RateAdd = "add"
+
+	// RateSuffix is appended to a metric's name to name the rate reports sent with RateAdd.
+	RateSuffix = ".rate"
+)
+
+type rateInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	mode     string
+}
+
+func (i *rateInput) AddReport(report metrics.MetricReport) error {
+	seconds := report.EndTime.Sub(report.StartTime).Seconds()
+	if seconds <= 0 {
+		// The rate of an empty window is undefined.
+		if i.mode == RateAdd {
+			glog.Warningf("rateInput: %v report has an empty window; sending it without a rate", report.Name)
+			return i.delegate.AddReport(report)
+		}
+		return invalidReport(report, fmt.Errorf("rateInput: %v report has an empty window, so its rate is undefined", report.Name))
+	}
+	rate := report
+	rate.Value = perSecond(report.Value, seconds)
+	if len(report.Values) > 0 {
+		rate.Values = make(map[string]metrics.MetricValue, len(report.Values))
+		for k, v := range report.Values {
+			rate.Values[k] = perSecond(v, seconds)
+		}
+	}
+	if i.mode != RateAdd {
+		return i.delegate.AddReport(rate)
+	}
+	if err := i.delegate.AddReport(report); err != nil {
+		return err
+	}
+	rate.Name += RateSuffix
+	return i.delegate.AddReport(rate)
+}
+
+// perSecond returns v divided by seconds, as a double.
+func perSecond(v metrics.MetricValue, seconds float64) metrics.MetricValue {
+	return metrics.MetricValue{DoubleValue: (float64(v.Int64Value) + v.DoubleValue) / seconds}
+}
+
+// NewRateInput creates an Input that converts the values of incoming reports, typically aggregated
+// sums, to rates: each value divided by the length of the report's window in seconds. Rates are
+// doubles, even for int metrics. With RateReplace (the default, if mode is empty), the rates replace
+// the report's values; with RateAdd, they're sent as an additional report. A report whose window is
+// empty has no rate: with RateAdd it's sent alone, and with RateReplace it's rejected.
+func NewRateInput(delegate pipeline.Input, mode string) pipeline.Input {
+	return &rateInput{Component: delegate, delegate: delegate, mode: mode}
+}
+
+type teeInput struct {
+	raw      pipeline.Input
+	delegate pipeline.Input
+	tracker  pipeline.UsageTracker
+}
+
+func (i *teeInput) AddReport(report metrics.MetricReport) error {
+	if err := i.raw.AddReport(report); err != nil {
+		return err
+	}
+	return i.delegate.AddReport(report)
+}
+
+// Use increments the teeInput's usage count.
+// See pipeline.Component.Use.
+func (i *teeInput) Use() {
+	i.tracker.Use()
+}
+
+// Release decrements the teeInput's usage count. If it reaches 0, Release releases both of its
+// inputs concurrently and waits for the operations to finish.
+// See pipeline.Component.Release.
+func (i *teeInput) Release() error {
+	return i.tracker.Release(func() error {
+		return pipeline.ReleaseAll([]pipeline.Component{i.raw, i.delegate})
+	})
+}
+
+// NewTeeInput creates an Input that adds each incoming report to raw, such as an archive of the
+// reports an Aggregator receives, and then to delegate. A report that raw rejects isn't added to
+// delegate.
+func NewTeeInput(raw, delegate pipeline.Input) pipeline.Input {
+	raw.Use()
+	delegate.Use()
+	return &teeInput{raw: raw, delegate: delegate}
+}
+
+type samplingInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	rate     float64
+}
+
+func (i *samplingInput) AddReport(report metrics.MetricReport) error {
+	if !sampled(report, i.rate) {
+		glog.V(2).Infof("sampling: dropping report for metric %v", report.Name)
+		return nil
+	}
+	return i.delegate.AddReport(report)
+}
+
+// sampled returns true if report is sampled in at the given rate. The decision depends only on the
+// report's name, labels, and times, so a report that's added again gets the same decision.
+func sampled(report metrics.MetricReport, rate float64) bool {
+	keys := make([]string, 0, len(report.Labels))
+	for k := range report.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New64a()
+	h.Write([]byte(report.Name))
+	for _, k := range keys {
+		h.Write([]byte{0})
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(report.Labels[k]))
+	}
+	binary.Write(h, binary.BigEndian, report.StartTime.UnixNano())
+	binary.Write(h, binary.BigEndian, report.EndTime.UnixNano())
+	// The top 53 bits of the hash give a uniform fraction in [0, 1).
+	return float64(h.Sum64()>>11)/(1<<53) < rate
+}
+
+// NewSamplingInput creates an Input that passes a fraction of incoming reports, given by rate, to
+// delegate, and accepts the rest without passing them on. The decision is made once for each
+// report, so an Input placed before the point where reports fan out to several endpoints sends each
+// report to all of them or to none.
+func NewSamplingInput(delegate pipeline.Input, rate float64) pipeline.Input {
+	return &samplingInput{Component: delegate, delegate: delegate, rate: rate}
+}
@@ -15,11 +15,14 @@
 package inputs
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
 	"github.com/GoogleCloudPlatform/ubbagent/testlib"
 	"github.com/hashicorp/go-multierror"
@@ -98,6 +101,10 @@ func TestSelector(t *testing.T) {
 		if err.Error() != "selector: unknown metric: metric3" {
 			t.Fatalf("unexpected error message: %v", err.Error())
 		}
+		var re *pipeline.ReportError
+		if !errors.Is(err, pipeline.ErrUnknownMetric) || !errors.As(err, &re) || re.Name != "metric3" {
+			t.Fatalf("expected a *pipeline.ReportError matching ErrUnknownMetric, got: %#v", err)
+		}
 	})
 
 	t.Run("inputs are used and released", func(t *testing.T) {
@@ -133,6 +140,45 @@ func TestSelector(t *testing.T) {
 	})
 }
 
+func TestSelector_Wildcard(t *testing.T) {
+	wildcard := testlib.NewMockInput()
+	exact := testlib.NewMockInput()
+
+	s := NewSelector(map[string]pipeline.Input{
+		"requests_*":    wildcard,
+		"requests_cost": exact,
+	})
+
+	newReport := func(name string) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      name,
+			StartTime: time.Unix(10, 0),
+			EndTime:   time.Unix(11, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 1,
+			},
+		}
+	}
+
+	for _, name := range []string{"requests_get", "requests_post", "requests_cost"} {
+		if err := s.AddReport(newReport(name)); err != nil {
+			t.Fatalf("unexpected error adding %v: %v", name, err)
+		}
+	}
+
+	if reports := wildcard.Reports(); len(reports) != 2 || reports[0].Name != "requests_get" || reports[1].Name != "requests_post" {
+		t.Fatalf("wildcard input has unexpected reports: %+v", reports)
+	}
+	if reports := exact.Reports(); len(reports) != 1 || reports[0].Name != "requests_cost" {
+		t.Fatalf("exact input has unexpected reports: %+v", reports)
+	}
+
+	err := s.AddReport(newReport("errors_get"))
+	if err == nil || err.Error() != "selector: unknown metric: errors_get" {
+		t.Fatalf("unexpected error for unmatched report: %v", err)
+	}
+}
+
 func TestCallbackInput(t *testing.T) {
 	input := testlib.NewMockInput()
 	add1 := testlib.NewMockInput()
@@ -275,3 +321,705 @@ func TestLabelingInput(t *testing.T) {
 		}
 	})
 }
+
+func TestDefaultLabelsInput(t *testing.T) {
+	defaults := map[string]string{
+		"region": "unknown",
+		"tier":   "free",
+	}
+
+	t.Run("missing keys get defaults and present keys are preserved", func(t *testing.T) {
+		labels := map[string]string{
+			"tier":   "paid",
+			"tenant": "a",
+		}
+		report := metrics.MetricReport{
+			Name:      "metric1",
+			StartTime: time.Unix(10, 0),
+			EndTime:   time.Unix(11, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 1,
+			},
+			Labels: labels,
+		}
+
+		mockInput := testlib.NewMockInput()
+		if err := NewDefaultLabelsInput(mockInput, defaults).AddReport(report); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		if want, got := map[string]string{
+			"region": "unknown",
+			"tier":   "paid",
+			"tenant": "a",
+		}, mockInput.Reports()[0].Labels; !reflect.DeepEqual(want, got) {
+			t.Fatalf("expected labels %v, got %v", want, got)
+		}
+		if len(labels) != 2 {
+			t.Fatalf("expected the report's label map to be unmodified, got %v", labels)
+		}
+	})
+
+	t.Run("defaults added when no labels exist", func(t *testing.T) {
+		report := metrics.MetricReport{
+			Name:      "metric1",
+			StartTime: time.Unix(10, 0),
+			EndTime:   time.Unix(11, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 1,
+			},
+		}
+
+		mockInput := testlib.NewMockInput()
+		if err := NewDefaultLabelsInput(mockInput, defaults).AddReport(report); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		if want, got := defaults, mockInput.Reports()[0].Labels; !reflect.DeepEqual(want, got) {
+			t.Fatalf("expected labels %v, got %v", want, got)
+		}
+	})
+}
+
+func TestIngestTimeInput(t *testing.T) {
+	mc := testlib.NewMockClock()
+	mc.SetNow(time.Unix(1000, 0))
+	mockInput := testlib.NewMockInput()
+	input := newIngestTimeInput(mockInput, mc)
+
+	report := metrics.MetricReport{
+		Name:      "metric1",
+		StartTime: time.Unix(10, 0),
+		EndTime:   time.Unix(11, 0),
+		Value: metrics.MetricValue{
+			Int64Value: 1,
+		},
+	}
+	if err := input.AddReport(report); err != nil {
+		t.Fatalf("unexpected error adding report: %v", err)
+	}
+	if want, got := time.Unix(1000, 0), mockInput.Reports()[0].IngestTime; !want.Equal(got) {
+		t.Fatalf("IngestTime: want=%v, got=%v", want, got)
+	}
+}
+
+func TestMaxAgeInput(t *testing.T) {
+	mc := testlib.NewMockClock()
+	mc.SetNow(time.Unix(1000, 0))
+	mockInput := testlib.NewMockInput()
+	input := newMaxAgeInput(mockInput, 100*time.Second, mc)
+	newReport := func(end int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "metric1",
+			StartTime: time.Unix(end-1, 0),
+			EndTime:   time.Unix(end, 0),
+			Value: metrics.MetricValue{
+				Int64Value: 1,
+			},
+		}
+	}
+
+	t.Run("fresh report accepted", func(t *testing.T) {
+		if err := input.AddReport(newReport(900)); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		if want, got := 1, len(mockInput.Reports()); want != got {
+			t.Fatalf("len(reports): want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("old report rejected", func(t *testing.T) {
+		err := input.AddReport(newReport(899))
+		stale, ok := err.(*StaleReportError)
+		if !ok {
+			t.Fatalf("expected *StaleReportError, got: %v", err)
+		}
+		if want := time.Unix(900, 0); !stale.Cutoff.Equal(want) || stale.Name != "metric1" {
+			t.Fatalf("error: want cutoff=%v, got=%+v", want, stale)
+		}
+		if !errors.Is(err, pipeline.ErrValidation) {
+			t.Fatalf("expected error to match pipeline.ErrValidation, got: %v", err)
+		}
+		if want, got := 0, len(mockInput.Reports()); want != got {
+			t.Fatalf("len(reports): want=%v, got=%v", want, got)
+		}
+	})
+}
+
+func TestValidatingInput(t *testing.T) {
+	def := metrics.Definition{
+		Name: "metric1",
+		Type: "int",
+	}
+	requireTeam := metrics.ValidatorFunc(func(mr metrics.MetricReport) error {
+		if mr.Labels["team"] == "" {
+			return errors.New("missing team label")
+		}
+		return nil
+	})
+	validators := append(metrics.DefaultValidators(def), requireTeam)
+
+	report := metrics.MetricReport{
+		Name:      "metric1",
+		StartTime: time.Unix(10, 0),
+		EndTime:   time.Unix(11, 0),
+		Value: metrics.MetricValue{
+			Int64Value: 1,
+		},
+		Labels: map[string]string{
+			"team": "a",
+		},
+	}
+
+	t.Run("valid report is passed to delegate", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		vi := NewValidatingInput(mockInput, validators...)
+		if err := vi.AddReport(report); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		if reports := mockInput.Reports(); len(reports) != 1 || !reflect.DeepEqual(reports[0], report) {
+			t.Fatalf("expected report to be passed to delegate")
+		}
+	})
+
+	t.Run("custom validator rejects report", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		vi := NewValidatingInput(mockInput, validators...)
+		invalid := report
+		invalid.Labels = nil
+		if err := vi.AddReport(invalid); !errors.Is(err, pipeline.ErrValidation) || err.Error() != "missing team label" {
+			t.Fatalf("expected custom validation error, got: %v", err)
+		}
+		if len(mockInput.Reports()) != 0 {
+			t.Fatalf("expected no reports to be passed to delegate")
+		}
+	})
+
+	t.Run("built-in validators run before custom validators", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		vi := NewValidatingInput(mockInput, validators...)
+		invalid := report
+		invalid.Labels = nil
+		invalid.Value = metrics.MetricValue{DoubleValue: 1.5}
+		if err := vi.AddReport(invalid); err == nil || err.Error() != "metric metric1: double value specified for integer metric: 1.5" {
+			t.Fatalf("expected built-in validation error, got: %v", err)
+		}
+	})
+}
+
+func TestValueLabelInput(t *testing.T) {
+	intMetric := metrics.Definition{Name: "int-metric", Type: "int"}
+	doubleMetric := metrics.Definition{Name: "double-metric", Type: "double"}
+
+	newReport := func(name, quantity string) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      name,
+			StartTime: time.Unix(10, 0),
+			EndTime:   time.Unix(11, 0),
+			Labels: map[string]string{
+				"quantity": quantity,
+				"foo":      "bar",
+			},
+		}
+	}
+
+	t.Run("label-sourced values are aggregated", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(intMetric, 10*time.Second, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		vi := NewValueLabelInput(a, intMetric, "quantity")
+
+		for _, q := range []string{"5", "7"} {
+			if err := vi.AddReport(newReport("int-metric", q)); err != nil {
+				t.Fatalf("unexpected error adding report: %v", err)
+			}
+		}
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(100, 0))
+		})
+
+		expected := []metrics.MetricReport{
+			{
+				Name:      "int-metric",
+				StartTime: time.Unix(10, 0),
+				EndTime:   time.Unix(11, 0),
+				Labels: map[string]string{
+					"foo": "bar",
+				},
+				Value: metrics.MetricValue{
+					Int64Value: 12,
+				},
+			},
+		}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Aggregated reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("double value", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		vi := NewValueLabelInput(mockInput, doubleMetric, "quantity")
+		report := newReport("double-metric", "1.25")
+		if err := vi.AddReport(report); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		reports := mockInput.Reports()
+		if len(reports) != 1 || reports[0].Value.DoubleValue != 1.25 {
+			t.Fatalf("unexpected reports: %+v", reports)
+		}
+		if _, exists := report.Labels["quantity"]; !exists {
+			t.Fatalf("caller's labels should not be modified")
+		}
+	})
+
+	t.Run("parse failure", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		vi := NewValueLabelInput(mockInput, intMetric, "quantity")
+		err := vi.AddReport(newReport("int-metric", "1.5"))
+		if err == nil || err.Error() != `metric int-metric: label quantity: invalid integer value: "1.5"` {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(mockInput.Reports()) != 0 {
+			t.Fatalf("expected no reports to be passed to delegate")
+		}
+	})
+
+	t.Run("missing label", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		vi := NewValueLabelInput(mockInput, intMetric, "other")
+		err := vi.AddReport(newReport("int-metric", "1"))
+		if !errors.Is(err, pipeline.ErrValidation) || err.Error() != "metric int-metric: missing value label: other" {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestQuantizingInput(t *testing.T) {
+	tests := []struct {
+		name     string
+		step     float64
+		rounding string
+		value    metrics.MetricValue
+		want     metrics.MetricValue
+	}{
+		{"double up", 0.25, metrics.RoundUp, metrics.MetricValue{DoubleValue: 1.1}, metrics.MetricValue{DoubleValue: 1.25}},
+		{"double down", 0.25, metrics.RoundDown, metrics.MetricValue{DoubleValue: 1.2}, metrics.MetricValue{DoubleValue: 1}},
+		{"double nearest", 0.25, metrics.RoundNearest, metrics.MetricValue{DoubleValue: 1.4}, metrics.MetricValue{DoubleValue: 1.5}},
+		{"double exact multiple", 0.25, metrics.RoundUp, metrics.MetricValue{DoubleValue: 1.75}, metrics.MetricValue{DoubleValue: 1.75}},
+		{"double decimal step up", 0.1, metrics.RoundUp, metrics.MetricValue{DoubleValue: 1.1}, metrics.MetricValue{DoubleValue: 1.1}},
+		{"double decimal step down", 0.1, metrics.RoundDown, metrics.MetricValue{DoubleValue: 0.3}, metrics.MetricValue{DoubleValue: 0.3}},
+		{"double decimal step nearest", 0.1, metrics.RoundNearest, metrics.MetricValue{DoubleValue: 0.3}, metrics.MetricValue{DoubleValue: 0.3}},
+		{"double decimal step rounds up", 0.1, metrics.RoundUp, metrics.MetricValue{DoubleValue: 1.12}, metrics.MetricValue{DoubleValue: 1.2}},
+		{"double hundredths up", 0.01, metrics.RoundUp, metrics.MetricValue{DoubleValue: 0.07}, metrics.MetricValue{DoubleValue: 0.07}},
+		{"double hundredths down", 0.01, metrics.RoundDown, metrics.MetricValue{DoubleValue: 0.29}, metrics.MetricValue{DoubleValue: 0.29}},
+		{"double hundredths nearest", 0.01, metrics.RoundNearest, metrics.MetricValue{DoubleValue: 0.574}, metrics.MetricValue{DoubleValue: 0.57}},
+		{"double hundredths rounds down", 0.01, metrics.RoundDown, metrics.MetricValue{DoubleValue: 0.078}, metrics.MetricValue{DoubleValue: 0.07}},
+		{"int up", 5, metrics.RoundUp, metrics.MetricValue{Int64Value: 11}, metrics.MetricValue{Int64Value: 15}},
+		{"int down", 5, metrics.RoundDown, metrics.MetricValue{Int64Value: 14}, metrics.MetricValue{Int64Value: 10}},
+		{"int nearest", 5, metrics.RoundNearest, metrics.MetricValue{Int64Value: 12}, metrics.MetricValue{Int64Value: 10}},
+		{"int nearest halfway", 4, metrics.RoundNearest, metrics.MetricValue{Int64Value: 6}, metrics.MetricValue{Int64Value: 8}},
+		{"int default rounding", 5, "", metrics.MetricValue{Int64Value: 1}, metrics.MetricValue{Int64Value: 5}},
+		{"negative int up", 5, metrics.RoundUp, metrics.MetricValue{Int64Value: -11}, metrics.MetricValue{Int64Value: -10}},
+		{"negative int down", 5, metrics.RoundDown, metrics.MetricValue{Int64Value: -11}, metrics.MetricValue{Int64Value: -15}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockInput := testlib.NewMockInput()
+			qi := NewQuantizingInput(mockInput, tt.step, tt.rounding)
+			if err := qi.AddReport(metrics.MetricReport{Name: "metric", Value: tt.value}); err != nil {
+				t.Fatalf("unexpected error adding report: %v", err)
+			}
+			reports := mockInput.Reports()
+			if len(reports) != 1 || reports[0].Value != tt.want {
+				t.Fatalf("value: want=%+v, got=%+v", tt.want, reports)
+			}
+		})
+	}
+
+	t.Run("named values", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		qi := NewQuantizingInput(mockInput, 10, metrics.RoundUp)
+		values := map[string]metrics.MetricValue{"bytes_in": {Int64Value: 1}, "bytes_out": {Int64Value: 21}}
+		if err := qi.AddReport(metrics.MetricReport{Name: "transfer", Values: values}); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		want := map[string]metrics.MetricValue{"bytes_in": {Int64Value: 10}, "bytes_out": {Int64Value: 30}}
+		reports := mockInput.Reports()
+		if len(reports) != 1 || !reflect.DeepEqual(reports[0].Values, want) {
+			t.Fatalf("values: want=%+v, got=%+v", want, reports)
+		}
+		if values["bytes_in"].Int64Value != 1 {
+			t.Fatalf("caller's values were modified: %+v", values)
+		}
+	})
+}
+
+func TestNormalizingInput(t *testing.T) {
+	metric := metrics.Definition{Name: "int-metric", Type: "int"}
+	norm := LabelNormalization{CaseFold: true, StripPrefixes: []string{"X-"}}
+	newReport := func(labels map[string]string, value int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Labels:    labels,
+			Value:     metrics.MetricValue{Int64Value: value},
+		}
+	}
+
+	t.Run("differently-cased and prefixed keys aggregate together", func(t *testing.T) {
+		mockClock := testlib.NewMockClock()
+		mockClock.SetNow(time.Unix(0, 0))
+		mi := testlib.NewMockInput()
+		a := newAggregator(metric, 10*time.Second, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+		ni := NewNormalizingInput(a, norm)
+
+		for i, key := range []string{"Region", "region", "x-region", "X-REGION"} {
+			if err := ni.AddReport(newReport(map[string]string{key: "us-east1"}, int64(i+1))); err != nil {
+				t.Fatalf("unexpected error adding report: %v", err)
+			}
+		}
+		mi.DoAndWait(t, 1, func() {
+			mockClock.SetNow(time.Unix(100, 0))
+		})
+
+		expected := []metrics.MetricReport{newReport(map[string]string{"region": "us-east1"}, 10)}
+		if reports := mi.Reports(); !equalUnordered(reports, expected) {
+			t.Fatalf("Aggregated reports: expected: %+v, got: %+v", expected, reports)
+		}
+	})
+
+	t.Run("values are trimmed only when enabled", func(t *testing.T) {
+		mockInput := testlib.NewMockInput()
+		labels := map[string]string{"Region": " us-east1 "}
+		if err := NewNormalizingInput(mockInput, norm).AddReport(newReport(labels, 1)); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		if err := NewNormalizingInput(mockInput, LabelNormalization{TrimValues: true}).AddReport(newReport(labels, 1)); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		reports := mockInput.Reports()
+		if want := map[string]string{"region": " us-east1 "}; len(reports) != 2 || !reflect.DeepEqual(reports[0].Labels, want) {
+			t.Fatalf("untrimmed labels: want=%v, got=%+v", want, reports)
+		}
+		if want := map[string]string{"Region": "us-east1"}; !reflect.DeepEqual(reports[1].Labels, want) {
+			t.Fatalf("trimmed labels: want=%v, got=%v", want, reports[1].Labels)
+		}
+		if labels["Region"] != " us-east1 " {
+			t.Fatalf("caller's labels were modified: %v", labels)
+		}
+	})
+
+	t.Run("conflicting keys", func(t *testing.T) {
+		labels := map[string]string{"Region": "us-east1", "region": "us-west1", "region2": "eu"}
+
+		mockInput := testlib.NewMockInput()
+		err := NewNormalizingInput(mockInput, norm).AddReport(newReport(labels, 1))
+		if want := "metric int-metric: labels normalize to the same key region with different values"; !errors.Is(err, pipeline.ErrValidation) || err.Error() != want {
+			t.Fatalf("Expected error %q, got: %v", want, err)
+		}
+
+		first := norm
+		first.OnConflict = LabelConflictFirst
+		if err := NewNormalizingInput(mockInput, first).AddReport(newReport(labels, 1)); err != nil {
+			t.Fatalf("unexpected error adding report: %v", err)
+		}
+		reports := mockInput.Reports()
+		if want := map[string]string{"region": "us-east1", "region2": "eu"}; len(reports) != 1 || !reflect.DeepEqual(reports[0].Labels, want) {
+			t.Fatalf("labels: want=%v, got=%+v", want, reports)
+		}
+	})
+}
+
+func TestLabelExclusionInput(t *testing.T) {
+	metric := metrics.Definition{Name: "int-metric", Type: "int", AnnotationMerge: metrics.CollectAnnotations}
+	newReport := func(requestID string, value int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(int64(value), 0),
+			EndTime:   time.Unix(int64(value)+1, 0),
+			Labels:    map[string]string{"tenant": "a", "request_id": requestID},
+			Value:     metrics.MetricValue{Int64Value: value},
+		}
+	}
+
+	for _, tc := range []struct {
+		policy      string
+		annotations map[string]string
+	}{
+		{ExcludedLabelDrop, nil},
+		{ExcludedLabelAnnotate, map[string]string{"request_id": "r1,r2"}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			mockClock := testlib.NewMockClock()
+			mockClock.SetNow(time.Unix(0, 0))
+			mi := testlib.NewMockInput()
+			a := newAggregator(metric, 10*time.Second, 0, "", "", PersistPolicy{}, mi, persistence.NewMemoryPersistence(), testlib.NewMockStatsRecorder(), mockClock, 1)
+			ei := NewLabelExclusionInput(a, []string{"request_id"}, tc.policy)
+
+			// Reports differing only in the excluded label merge into one bucket.
+			first := newReport("r1", 1)
+			if err := ei.AddReport(first); err != nil {
+				t.Fatalf("unexpected error adding report: %v", err)
+			}
+			if err := ei.AddReport(newReport("r2", 2)); err != nil {
+				t.Fatalf("unexpected error adding report: %v", err)
+			}
+			mi.DoAndWait(t, 1, func() {
+				mockClock.SetNow(time.Unix(100, 0))
+			})
+
+			expected := metrics.MetricReport{
+				Name:        "int-metric",
+				StartTime:   time.Unix(1, 0),
+				EndTime:     time.Unix(3, 0),
+				Labels:      map[string]string{"tenant": "a"},
+				Annotations: tc.annotations,
+				Value:       metrics.MetricValue{Int64Value: 3},
+			}
+			if reports := mi.Reports(); len(reports) != 1 || !reports[0].Equal(expected) {
+				t.Fatalf("Aggregated reports: expected: %+v, got: %+v", expected, reports)
+			}
+			if want, got := "r1", first.Labels["request_id"]; want != got {
+				t.Fatalf("caller's labels: want request_id=%v, got=%v", want, got)
+			}
+		})
+	}
+}
+
+func TestRateInput(t *testing.T) {
+	sum := metrics.MetricReport{
+		Name:      "int-metric",
+		StartTime: time.Unix(100, 0),
+		EndTime:   time.Unix(160, 0),
+		Labels:    map[string]string{"tenant": "a"},
+		Value:     metrics.MetricValue{Int64Value: 90},
+	}
+	rate := sum
+	rate.Value = metrics.MetricValue{DoubleValue: 1.5}
+
+	t.Run("Replace", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		if err := NewRateInput(mi, RateReplace).AddReport(sum); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+		if reports := mi.Reports(); len(reports) != 1 || !reports[0].Equal(rate) {
+			t.Fatalf("reports: expected: %+v, got: %+v", rate, reports)
+		}
+	})
+
+	t.Run("Add", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		if err := NewRateInput(mi, RateAdd).AddReport(sum); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+		added := rate
+		added.Name = "int-metric.rate"
+		if reports := mi.Reports(); len(reports) != 2 || !reports[0].Equal(sum) || !reports[1].Equal(added) {
+			t.Fatalf("reports: expected: %+v, got: %+v", []metrics.MetricReport{sum, added}, reports)
+		}
+	})
+
+	t.Run("Compound values", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		compound := metrics.MetricReport{
+			Name:      "transfer",
+			StartTime: time.Unix(100, 0),
+			EndTime:   time.Unix(104, 0),
+			Values: map[string]metrics.MetricValue{
+				"bytes_in":  {Int64Value: 10},
+				"bytes_out": {DoubleValue: 2},
+			},
+		}
+		if err := NewRateInput(mi, RateReplace).AddReport(compound); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+		want := map[string]metrics.MetricValue{"bytes_in": {DoubleValue: 2.5}, "bytes_out": {DoubleValue: 0.5}}
+		if reports := mi.Reports(); len(reports) != 1 || !reflect.DeepEqual(want, reports[0].Values) {
+			t.Fatalf("values: expected: %+v, got: %+v", want, reports)
+		}
+		// The caller's values are unchanged.
+		if want, got := int64(10), compound.Values["bytes_in"].Int64Value; want != got {
+			t.Fatalf("caller's bytes_in: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("Empty window", func(t *testing.T) {
+		empty := sum
+		empty.StartTime = empty.EndTime
+
+		mi := testlib.NewMockInput()
+		if err := NewRateInput(mi, RateReplace).AddReport(empty); !errors.Is(err, pipeline.ErrValidation) {
+			t.Fatalf("expected a validation error adding a report with an empty window, got: %+v", err)
+		}
+		if reports := mi.Reports(); len(reports) != 0 {
+			t.Fatalf("expected no reports, got: %+v", reports)
+		}
+
+		// With RateAdd, the sum is still sent.
+		if err := NewRateInput(mi, RateAdd).AddReport(empty); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+		if reports := mi.Reports(); len(reports) != 1 || !reports[0].Equal(empty) {
+			t.Fatalf("reports: expected: %+v, got: %+v", empty, reports)
+		}
+	})
+}
+
+func TestTeeInput(t *testing.T) {
+	report := metrics.MetricReport{
+		Name:      "int-metric",
+		StartTime: time.Unix(100, 0),
+		EndTime:   time.Unix(160, 0),
+		Value:     metrics.MetricValue{Int64Value: 90},
+	}
+
+	t.Run("Reports are added to both inputs", func(t *testing.T) {
+		raw := testlib.NewMockInput()
+		delegate := testlib.NewMockInput()
+		i := NewTeeInput(raw, delegate)
+		if err := i.AddReport(report); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+		for _, mi := range []*testlib.MockInput{raw, delegate} {
+			if reports := mi.Reports(); len(reports) != 1 || !reports[0].Equal(report) {
+				t.Fatalf("reports: expected: %+v, got: %+v", report, reports)
+			}
+		}
+		if err := i.Release(); err != nil {
+			t.Fatalf("unexpected error releasing input: %+v", err)
+		}
+		if !raw.Released || !delegate.Released {
+			t.Fatalf("expected both inputs to be released, got raw=%v delegate=%v", raw.Released, delegate.Released)
+		}
+	})
+
+	t.Run("Rejected raw reports aren't passed on", func(t *testing.T) {
+		raw := testlib.NewMockInput()
+		raw.SetAddError(errors.New("archive full"))
+		delegate := testlib.NewMockInput()
+		if err := NewTeeInput(raw, delegate).AddReport(report); err == nil {
+			t.Fatal("expected an error adding report")
+		}
+		if reports := delegate.Reports(); len(reports) != 0 {
+			t.Fatalf("delegate reports: expected none, got: %+v", reports)
+		}
+	})
+}
+
+func TestPrecisionInput(t *testing.T) {
+	newReport := func(value metrics.MetricValue) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "double-metric",
+			StartTime: time.Unix(100, 0),
+			EndTime:   time.Unix(160, 0),
+			Value:     value,
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		decimals int
+		rounding string
+		value    float64
+		want     float64
+	}{
+		{"Noise is removed", 2, metrics.RoundUp, 3.0000000004, 3},
+		{"Up", 2, metrics.RoundUp, 1.231, 1.24},
+		{"Down", 2, metrics.RoundDown, 1.239, 1.23},
+		{"Nearest", 1, metrics.RoundNearest, 2.25, 2.3},
+		{"Whole numbers", 0, metrics.RoundNearest, 7.4, 7},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mi := testlib.NewMockInput()
+			if err := NewPrecisionInput(mi, tc.decimals, tc.rounding).AddReport(newReport(metrics.MetricValue{DoubleValue: tc.value})); err != nil {
+				t.Fatalf("unexpected error adding report: %+v", err)
+			}
+			reports := mi.Reports()
+			if len(reports) != 1 || reports[0].Value.DoubleValue != tc.want {
+				t.Fatalf("value: expected %v, got: %+v", tc.want, reports)
+			}
+		})
+	}
+
+	t.Run("Integers are unaffected", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		report := newReport(metrics.MetricValue{Int64Value: 12345})
+		if err := NewPrecisionInput(mi, 0, metrics.RoundDown).AddReport(report); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+		if reports := mi.Reports(); len(reports) != 1 || !reports[0].Equal(report) {
+			t.Fatalf("reports: expected: %+v, got: %+v", report, reports)
+		}
+	})
+
+	t.Run("Compound values", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		// Unlike the constant expression, the sum of these variables isn't exactly 0.3.
+		a, b := 0.1, 0.2
+		report := newReport(metrics.MetricValue{})
+		report.Values = map[string]metrics.MetricValue{"in": {DoubleValue: a + b}, "out": {Int64Value: 3}}
+		if err := NewPrecisionInput(mi, 3, metrics.RoundNearest).AddReport(report); err != nil {
+			t.Fatalf("unexpected error adding report: %+v", err)
+		}
+		reports := mi.Reports()
+		if want := map[string]metrics.MetricValue{"in": {DoubleValue: 0.3}, "out": {Int64Value: 3}}; len(reports) != 1 || !reflect.DeepEqual(want, reports[0].Values) {
+			t.Fatalf("values: expected: %+v, got: %+v", want, reports)
+		}
+		if report.Values["in"].DoubleValue == 0.3 {
+			t.Fatal("caller's values were modified")
+		}
+	})
+}
+
+func TestSamplingInput(t *testing.T) {
+	newReport := func(i int) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(100, 0),
+			EndTime:   time.Unix(160, 0),
+			Labels:    map[string]string{"tenant": fmt.Sprintf("tenant-%v", i)},
+			Value:     metrics.MetricValue{Int64Value: 1},
+		}
+	}
+
+	t.Run("A fraction of reports is passed on", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		si := NewSamplingInput(mi, 0.25)
+		for i := 0; i < 200; i++ {
+			if err := si.AddReport(newReport(i)); err != nil {
+				t.Fatalf("unexpected error adding report: %+v", err)
+			}
+		}
+		if got := len(mi.Reports()); got < 30 || got > 70 {
+			t.Fatalf("sampled reports: expected about 50 of 200, got: %v", got)
+		}
+	})
+
+	t.Run("The decision is the same for the same report", func(t *testing.T) {
+		first, second := testlib.NewMockInput(), testlib.NewMockInput()
+		for _, mi := range []*testlib.MockInput{first, second} {
+			si := NewSamplingInput(mi, 0.5)
+			for i := 0; i < 100; i++ {
+				if err := si.AddReport(newReport(i)); err != nil {
+					t.Fatalf("unexpected error adding report: %+v", err)
+				}
+			}
+		}
+		if !reflect.DeepEqual(first.Reports(), second.Reports()) {
+			t.Fatalf("expected the same reports to be sampled: %+v, %+v", first.Reports(), second.Reports())
+		}
+	})
+
+	t.Run("A rate of 1 passes every report", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		si := NewSamplingInput(mi, 1)
+		for i := 0; i < 100; i++ {
+			if err := si.AddReport(newReport(i)); err != nil {
+				t.Fatalf("unexpected error adding report: %+v", err)
+			}
+		}
+		if got := len(mi.Reports()); got != 100 {
+			t.Fatalf("sampled reports: expected 100, got: %v", got)
+		}
+	})
+}
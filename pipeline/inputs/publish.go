@@ -0,0 +1,107 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inputs
+
+import (
+	"sync"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+)
+
+// Publisher fans out reports to in-process subscribers. Each subscriber has a bounded buffer; when a
+// subscriber's buffer is full, reports published to it are dropped rather than blocking the
+// publisher.
+type Publisher struct {
+	bufferSize  int
+	subscribers map[chan metrics.MetricReport]bool
+	closed      bool
+	mu          sync.Mutex
+}
+
+// NewPublisher creates a new Publisher whose subscribers each buffer up to bufferSize reports.
+func NewPublisher(bufferSize int) *Publisher {
+	return &Publisher{
+		bufferSize:  bufferSize,
+		subscribers: make(map[chan metrics.MetricReport]bool),
+	}
+}
+
+// Subscribe returns a channel that receives each subsequently published report, and a function that
+// unsubscribes and closes the channel. The channel is also closed when the Publisher is closed.
+func (p *Publisher) Subscribe() (<-chan metrics.MetricReport, func()) {
+	c := make(chan metrics.MetricReport, p.bufferSize)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		close(c)
+		return c, func() {}
+	}
+	p.subscribers[c] = true
+	return c, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.subscribers[c] {
+			delete(p.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+// Publish sends report to all current subscribers without blocking.
+func (p *Publisher) Publish(report metrics.MetricReport) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.subscribers {
+		select {
+		case c <- report:
+		default:
+			glog.Warningf("Publisher: dropping report %v for slow subscriber", report.Name)
+		}
+	}
+}
+
+// Close unsubscribes all subscribers, closing their channels. Subsequent calls to Subscribe return
+// closed channels.
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.subscribers {
+		delete(p.subscribers, c)
+		close(c)
+	}
+	p.closed = true
+}
+
+type publishingInput struct {
+	pipeline.Component
+	delegate  pipeline.Input
+	publisher *Publisher
+}
+
+func (i *publishingInput) AddReport(report metrics.MetricReport) error {
+	if err := i.delegate.AddReport(report); err != nil {
+		return err
+	}
+	i.publisher.Publish(report)
+	return nil
+}
+
+// NewPublishingInput creates an Input that passes reports to the given delegate and then publishes
+// each report the delegate accepts to publisher.
+func NewPublishingInput(delegate pipeline.Input, publisher *Publisher) pipeline.Input {
+	return &publishingInput{Component: delegate, delegate: delegate, publisher: publisher}
+}
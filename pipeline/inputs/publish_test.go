@@ -0,0 +1,113 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inputs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestPublisher(t *testing.T) {
+	report := func(value int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(0, 0),
+			EndTime:   time.Unix(1, 0),
+			Value: metrics.MetricValue{
+				Int64Value: value,
+			},
+		}
+	}
+
+	t.Run("Subscribers receive published reports", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		p := NewPublisher(10)
+		i := NewPublishingInput(mi, p)
+		sub1, unsub1 := p.Subscribe()
+		sub2, unsub2 := p.Subscribe()
+		defer unsub2()
+
+		if err := i.AddReport(report(1)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		for _, sub := range []<-chan metrics.MetricReport{sub1, sub2} {
+			if got := <-sub; !got.Equal(report(1)) {
+				t.Fatalf("Subscriber received: expected %+v, got %+v", report(1), got)
+			}
+		}
+		if want, got := 1, len(mi.Reports()); want != got {
+			t.Fatalf("Delegate reports: want=%v, got=%v", want, got)
+		}
+
+		// After unsubscribing, sub1 is closed and receives nothing further.
+		unsub1()
+		unsub1()
+		if err := i.AddReport(report(2)); err != nil {
+			t.Fatalf("Unexpected error when adding report: %+v", err)
+		}
+		if _, ok := <-sub1; ok {
+			t.Fatal("Expected unsubscribed channel to be closed")
+		}
+		if got := <-sub2; !got.Equal(report(2)) {
+			t.Fatalf("Subscriber received: expected %+v, got %+v", report(2), got)
+		}
+	})
+
+	t.Run("Slow subscribers drop reports", func(t *testing.T) {
+		p := NewPublisher(1)
+		slow, _ := p.Subscribe()
+		fast, _ := p.Subscribe()
+
+		p.Publish(report(1))
+		if got := <-fast; !got.Equal(report(1)) {
+			t.Fatalf("Subscriber received: expected %+v, got %+v", report(1), got)
+		}
+		p.Publish(report(2))
+		if got := <-fast; !got.Equal(report(2)) {
+			t.Fatalf("Subscriber received: expected %+v, got %+v", report(2), got)
+		}
+
+		// The slow subscriber's buffer holds only the first report.
+		p.Close()
+		var received []metrics.MetricReport
+		for r := range slow {
+			received = append(received, r)
+		}
+		if len(received) != 1 || !received[0].Equal(report(1)) {
+			t.Fatalf("Slow subscriber received: expected [%+v], got %+v", report(1), received)
+		}
+		if _, ok := <-fast; ok {
+			t.Fatal("Expected channel to be closed by Close")
+		}
+	})
+
+	t.Run("Rejected reports aren't published", func(t *testing.T) {
+		mi := testlib.NewMockInput()
+		mi.SetAddError(errors.New("rejected"))
+		p := NewPublisher(10)
+		sub, _ := p.Subscribe()
+		if err := NewPublishingInput(mi, p).AddReport(report(1)); err == nil {
+			t.Fatal("Expected error when adding report")
+		}
+		p.Close()
+		if _, ok := <-sub; ok {
+			t.Fatal("Expected no published reports")
+		}
+	})
+}
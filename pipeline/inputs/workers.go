@@ -0,0 +1,260 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inputs
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+)
+
+// workerPoolInput is a pipeline.Input that passes reports to its delegate from a fixed number of
+// workers. Each report is assigned to a worker by its name and labels, so reports with the same key
+// are passed to the delegate in the order they were added.
+type workerPoolInput struct {
+	delegate   pipeline.Input
+	queues     []chan workItem
+	overflows  []*workerOverflow
+	closed     bool
+	closeMutex sync.RWMutex
+	wait       sync.WaitGroup
+	tracker    pipeline.UsageTracker
+}
+
+type workItem struct {
+	report metrics.MetricReport
+	result chan error
+}
+
+// Overflow configures a workerPoolInput to spill reports to persistence when a worker's queue is
+// full, rather than blocking. A zero Overflow disables spilling.
+type Overflow struct {
+	// Persistence stores spilled reports.
+	Persistence persistence.Persistence
+
+	// Size is the number of reports each worker spills before AddReport blocks.
+	Size int
+}
+
+// workerOverflow holds the reports one worker has spilled. Once a worker has spilled a report, every
+// report added to it is spilled until the overflow drains, so reports keep their order.
+type workerOverflow struct {
+	queue   persistence.Queue
+	size    int
+	spilled int
+	mutex   sync.Mutex
+	space   *sync.Cond
+	notify  chan struct{}
+}
+
+// NewWorkerPoolInput creates an Input that passes reports to delegate using the given number of
+// workers, each of which holds up to queueSize reports waiting to be processed. AddReport blocks
+// while the report's worker is full, and returns the delegate's result once the report has been
+// processed. If overflow is enabled, a report added to a full worker is instead spilled to
+// persistence and AddReport returns once it's stored; spilled reports are loaded back and processed
+// once the worker's queue is empty, and the delegate's errors for them are logged.
+func NewWorkerPoolInput(delegate pipeline.Input, workers, queueSize int, overflow Overflow) pipeline.Input {
+	delegate.Use()
+	wp := &workerPoolInput{delegate: delegate, queues: make([]chan workItem, workers)}
+	if overflow.Size > 0 {
+		wp.overflows = make([]*workerOverflow, workers)
+		for i := range wp.overflows {
+			wp.overflows[i] = newWorkerOverflow(overflow.Persistence.Queue(fmt.Sprintf("ingestion/overflow/%v", i)), overflow.Size)
+		}
+	}
+	wp.wait.Add(workers)
+	for i := range wp.queues {
+		wp.queues[i] = make(chan workItem, queueSize)
+		go wp.run(i)
+	}
+	return wp
+}
+
+func newWorkerOverflow(queue persistence.Queue, size int) *workerOverflow {
+	o := &workerOverflow{queue: queue, size: size, notify: make(chan struct{}, 1)}
+	o.space = sync.NewCond(&o.mutex)
+	// Reports spilled before a restart are processed first.
+	spilled, err := queue.Len()
+	if err != nil {
+		glog.Errorf("workerPoolInput: loading overflow: %+v", err)
+	}
+	o.spilled = spilled
+	return o
+}
+
+func (wp *workerPoolInput) AddReport(report metrics.MetricReport) error {
+	wp.closeMutex.RLock()
+	defer wp.closeMutex.RUnlock()
+	if wp.closed {
+		return errors.New("workerPoolInput: AddReport called on closed input")
+	}
+	worker := wp.worker(report)
+	item := workItem{report: report, result: make(chan error, 1)}
+	if wp.overflows != nil {
+		return wp.addOrSpill(worker, item)
+	}
+	wp.queues[worker] <- item
+	return <-item.result
+}
+
+// addOrSpill queues item on the worker, or spills it if the worker is full or has already spilled
+// reports that haven't been processed. It blocks while the worker's overflow is full.
+func (wp *workerPoolInput) addOrSpill(worker int, item workItem) error {
+	o := wp.overflows[worker]
+	o.mutex.Lock()
+	if o.spilled == 0 {
+		select {
+		case wp.queues[worker] <- item:
+			o.mutex.Unlock()
+			return <-item.result
+		default:
+		}
+	}
+	defer o.mutex.Unlock()
+	for o.spilled >= o.size {
+		o.space.Wait()
+	}
+	if err := o.queue.Enqueue(item.report); err != nil {
+		return fmt.Errorf("workerPoolInput: spilling report: %+v", err)
+	}
+	o.spilled++
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (wp *workerPoolInput) run(worker int) {
+	queue := wp.queues[worker]
+	var notify chan struct{}
+	if wp.overflows != nil {
+		notify = wp.overflows[worker].notify
+	}
+	defer wp.wait.Done()
+	for {
+		// Queued reports were all added before any spilled ones, so the overflow is only processed
+		// once the queue is empty.
+		var item workItem
+		var ok bool
+		select {
+		case item, ok = <-queue:
+		default:
+			if wp.drainOverflow(worker) {
+				continue
+			}
+			select {
+			case item, ok = <-queue:
+			case <-notify:
+				continue
+			}
+		}
+		if !ok {
+			wp.drainOverflow(worker)
+			return
+		}
+		item.result <- wp.delegate.AddReport(item.report)
+	}
+}
+
+// drainOverflow processes the worker's spilled reports, loading them back from persistence up to a
+// queue's worth at a time. It returns whether any reports were processed.
+func (wp *workerPoolInput) drainOverflow(worker int) bool {
+	if wp.overflows == nil {
+		return false
+	}
+	o := wp.overflows[worker]
+	processed := false
+	for {
+		o.mutex.Lock()
+		spilled := o.spilled
+		o.mutex.Unlock()
+		if spilled == 0 {
+			return processed
+		}
+		batch := cap(wp.queues[worker])
+		if batch < 1 || batch > spilled {
+			batch = spilled
+		}
+		var reports []metrics.MetricReport
+		if err := o.queue.PeekN(batch, &reports); err != nil {
+			glog.Errorf("workerPoolInput: loading spilled reports: %+v", err)
+			return processed
+		}
+		for _, report := range reports {
+			if err := wp.delegate.AddReport(report); err != nil {
+				glog.Errorf("workerPoolInput: error adding spilled report: %+v", err)
+			}
+			processed = true
+			if err := o.queue.Dequeue(nil); err != nil {
+				glog.Errorf("workerPoolInput: removing spilled report: %+v", err)
+				return processed
+			}
+			o.mutex.Lock()
+			o.spilled--
+			o.space.Broadcast()
+			o.mutex.Unlock()
+		}
+	}
+}
+
+// worker returns the index of the worker that processes reports with report's name and labels.
+func (wp *workerPoolInput) worker(report metrics.MetricReport) int {
+	keys := make([]string, 0, len(report.Labels))
+	for k := range report.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := fnv.New32a()
+	h.Write([]byte(report.Name))
+	for _, k := range keys {
+		h.Write([]byte{0})
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(report.Labels[k]))
+	}
+	return int(h.Sum32() % uint32(len(wp.queues)))
+}
+
+// Use increments the workerPoolInput's usage count.
+// See pipeline.Component.Use.
+func (wp *workerPoolInput) Use() {
+	wp.tracker.Use()
+}
+
+// Release decrements the workerPoolInput's usage count. If it reaches 0, Release waits for queued
+// and spilled reports to be processed, stops the workers, and releases the delegate.
+// See pipeline.Component.Release.
+func (wp *workerPoolInput) Release() error {
+	return wp.tracker.Release(func() error {
+		wp.closeMutex.Lock()
+		if !wp.closed {
+			wp.closed = true
+			for _, queue := range wp.queues {
+				close(queue)
+			}
+		}
+		wp.closeMutex.Unlock()
+		wp.wait.Wait()
+		return wp.delegate.Release()
+	})
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package inputs
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+// gatedInput is a MockInput whose AddReport waits until gate is closed. It tracks the number of
+// concurrent AddReport calls.
+type gatedInput struct {
+	*testlib.MockInput
+	gate chan struct{}
+
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (i *gatedInput) AddReport(report metrics.MetricReport) error {
+	i.mu.Lock()
+	i.active++
+	if i.active > i.maxActive {
+		i.maxActive = i.active
+	}
+	i.mu.Unlock()
+	<-i.gate
+	i.mu.Lock()
+	i.active--
+	i.mu.Unlock()
+	return i.MockInput.AddReport(report)
+}
+
+// waiting returns the number of reports that are queued or being processed by wp's delegate.
+func (i *gatedInput) waiting(wp *workerPoolInput) int {
+	i.mu.Lock()
+	n := i.active
+	i.mu.Unlock()
+	for _, queue := range wp.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+// busy returns whether the delegate is processing a report.
+func (i *gatedInput) busy() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.active > 0
+}
+
+func TestWorkerPoolInput(t *testing.T) {
+	report := func(tenant string, value int64) metrics.MetricReport {
+		return metrics.MetricReport{
+			Name:      "int-metric",
+			StartTime: time.Unix(value, 0),
+			EndTime:   time.Unix(value+1, 0),
+			Labels:    map[string]string{"tenant": tenant},
+			Value:     metrics.MetricValue{Int64Value: value},
+		}
+	}
+
+	t.Run("Same-key reports keep their order", func(t *testing.T) {
+		delegate := &gatedInput{MockInput: testlib.NewMockInput(), gate: make(chan struct{})}
+		wp := NewWorkerPoolInput(delegate, 2, 10, Overflow{}).(*workerPoolInput)
+
+		// Each report is added concurrently, once the previous ones are waiting in the pool, so that
+		// several reports for each tenant are pending at once.
+		tenants := []string{"a", "b", "c", "d"}
+		var wg sync.WaitGroup
+		added := 0
+		for v := int64(1); v <= 5; v++ {
+			for _, tenant := range tenants {
+				wg.Add(1)
+				go func(r metrics.MetricReport) {
+					defer wg.Done()
+					if err := wp.AddReport(r); err != nil {
+						t.Errorf("unexpected error adding report: %+v", err)
+					}
+				}(report(tenant, v))
+				added++
+				for delegate.waiting(wp) < added {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}
+		close(delegate.gate)
+		wg.Wait()
+
+		last := make(map[string]int64)
+		for _, r := range delegate.Reports() {
+			tenant := r.Labels["tenant"]
+			if r.Value.Int64Value != last[tenant]+1 {
+				t.Fatalf("tenant %v: report %v processed after report %v", tenant, r.Value.Int64Value, last[tenant])
+			}
+			last[tenant] = r.Value.Int64Value
+		}
+		for _, tenant := range tenants {
+			if want, got := int64(5), last[tenant]; want != got {
+				t.Fatalf("tenant %v: want %v reports, got %v", tenant, want, got)
+			}
+		}
+		if delegate.maxActive > 2 {
+			t.Fatalf("expected at most 2 concurrent reports, got %v", delegate.maxActive)
+		}
+	})
+
+	t.Run("Delegate errors are returned", func(t *testing.T) {
+		delegate := testlib.NewMockInput()
+		delegate.SetAddError(errors.New("invalid report"))
+		wp := NewWorkerPoolInput(delegate, 2, 10, Overflow{})
+		if err := wp.AddReport(report("a", 1)); err == nil || err.Error() != "invalid report" {
+			t.Fatalf("expected the delegate's error, got: %+v", err)
+		}
+	})
+
+	t.Run("A full worker spills reports that are later processed in order", func(t *testing.T) {
+		delegate := &gatedInput{MockInput: testlib.NewMockInput(), gate: make(chan struct{})}
+		p := persistence.NewMemoryPersistence()
+		wp := NewWorkerPoolInput(delegate, 1, 2, Overflow{Persistence: p, Size: 3}).(*workerPoolInput)
+
+		// The first report is processed and the next two are queued; each blocks until it's processed.
+		var wg sync.WaitGroup
+		for v := int64(1); v <= 3; v++ {
+			wg.Add(1)
+			go func(r metrics.MetricReport) {
+				defer wg.Done()
+				if err := wp.AddReport(r); err != nil {
+					t.Errorf("unexpected error adding report: %+v", err)
+				}
+			}(report("a", v))
+			for delegate.waiting(wp) < int(v) || !delegate.busy() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		// The worker is full, so the next reports are spilled and AddReport returns immediately.
+		for v := int64(4); v <= 6; v++ {
+			if err := wp.AddReport(report("a", v)); err != nil {
+				t.Fatalf("unexpected error spilling report: %+v", err)
+			}
+		}
+		if n, err := p.Queue("ingestion/overflow/0").Len(); err != nil || n != 3 {
+			t.Fatalf("expected 3 spilled reports, got %v (err: %+v)", n, err)
+		}
+
+		// The overflow is full, so the next report blocks until there's room.
+		added := make(chan error, 1)
+		go func() { added <- wp.AddReport(report("a", 7)) }()
+		select {
+		case err := <-added:
+			t.Fatalf("expected AddReport to block while the overflow is full, got: %+v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(delegate.gate)
+		wg.Wait()
+		if err := <-added; err != nil {
+			t.Fatalf("unexpected error spilling report: %+v", err)
+		}
+		wp.Use()
+		if err := wp.Release(); err != nil {
+			t.Fatalf("unexpected error releasing: %+v", err)
+		}
+
+		var values []int64
+		for _, r := range delegate.Reports() {
+			values = append(values, r.Value.Int64Value)
+		}
+		if want, got := []int64{1, 2, 3, 4, 5, 6, 7}, values; !reflect.DeepEqual(want, got) {
+			t.Fatalf("expected reports %v, got %v", want, got)
+		}
+		if n, err := p.Queue("ingestion/overflow/0").Len(); err != nil || n != 0 {
+			t.Fatalf("expected the overflow to be empty, got %v (err: %+v)", n, err)
+		}
+	})
+
+	t.Run("Spilled reports are processed after a restart", func(t *testing.T) {
+		p := persistence.NewMemoryPersistence()
+		if err := p.Queue("ingestion/overflow/0").Enqueue(report("a", 1)); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+		delegate := testlib.NewMockInput()
+		wp := NewWorkerPoolInput(delegate, 1, 2, Overflow{Persistence: p, Size: 3})
+		delegate.DoAndWait(t, 2, func() {
+			if err := wp.AddReport(report("a", 2)); err != nil {
+				t.Fatalf("unexpected error adding report: %+v", err)
+			}
+		})
+		reports := delegate.Reports()
+		if reports[0].Value.Int64Value != 1 || reports[1].Value.Int64Value != 2 {
+			t.Fatalf("expected the spilled report first, got: %+v", reports)
+		}
+	})
+
+	t.Run("Release stops the pool", func(t *testing.T) {
+		delegate := testlib.NewMockInput()
+		wp := NewWorkerPoolInput(delegate, 2, 10, Overflow{})
+		wp.Use()
+		if err := wp.Release(); err != nil {
+			t.Fatalf("unexpected error releasing: %+v", err)
+		}
+		if !delegate.Released {
+			t.Fatal("expected the delegate to be released")
+		}
+		if err := wp.AddReport(report("a", 1)); err == nil {
+			t.Fatal("expected an error adding a report after release")
+		}
+	})
+}
@@ -0,0 +1,288 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package otlp converts OpenTelemetry (OTLP) metric data into usage reports.
+package otlp
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+	"github.com/hashicorp/go-multierror"
+)
+
+// Aggregation temporalities of a Sum, as encoded by OTLP.
+const (
+	TemporalityDelta      = 1
+	TemporalityCumulative = 2
+)
+
+// The following types mirror the OTLP metrics data model, as encoded by OTLP/JSON, including only
+// the fields that the Adapter uses.
+
+// ExportMetricsServiceRequest is the body of an OTLP metrics export request.
+type ExportMetricsServiceRequest struct {
+	ResourceMetrics []ResourceMetrics `json:"resourceMetrics"`
+}
+
+// ResourceMetrics holds the metrics of a single resource, such as a service instance.
+type ResourceMetrics struct {
+	ScopeMetrics []ScopeMetrics `json:"scopeMetrics"`
+}
+
+// ScopeMetrics holds the metrics produced by a single instrumentation scope.
+type ScopeMetrics struct {
+	Metrics []Metric `json:"metrics"`
+}
+
+// Metric is a single named metric. Exactly one of its data fields is set; instrument types other
+// than Sum and Gauge are only recognized so that they can be skipped.
+type Metric struct {
+	Name                 string           `json:"name"`
+	Sum                  *Sum             `json:"sum"`
+	Gauge                *Gauge           `json:"gauge"`
+	Histogram            *json.RawMessage `json:"histogram"`
+	ExponentialHistogram *json.RawMessage `json:"exponentialHistogram"`
+	Summary              *json.RawMessage `json:"summary"`
+}
+
+// Sum is the data of a counter: values that are summed over time.
+type Sum struct {
+	DataPoints             []NumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+}
+
+// Gauge is the data of a gauge: sampled values.
+type Gauge struct {
+	DataPoints []NumberDataPoint `json:"dataPoints"`
+}
+
+// NumberDataPoint is a single value of a Sum or Gauge. Times are nanoseconds since the Unix epoch.
+// Value is AsInt if it's set, and otherwise AsDouble.
+type NumberDataPoint struct {
+	Attributes        []KeyValue `json:"attributes"`
+	StartTimeUnixNano Int64      `json:"startTimeUnixNano"`
+	TimeUnixNano      Int64      `json:"timeUnixNano"`
+	AsInt             *Int64     `json:"asInt"`
+	AsDouble          *float64   `json:"asDouble"`
+}
+
+// KeyValue is an attribute.
+type KeyValue struct {
+	Key   string   `json:"key"`
+	Value AnyValue `json:"value"`
+}
+
+// AnyValue is an attribute value. Only scalar values are supported.
+type AnyValue struct {
+	StringValue *string          `json:"stringValue"`
+	BoolValue   *bool            `json:"boolValue"`
+	IntValue    *Int64           `json:"intValue"`
+	DoubleValue *float64         `json:"doubleValue"`
+	ArrayValue  *json.RawMessage `json:"arrayValue"`
+	KvlistValue *json.RawMessage `json:"kvlistValue"`
+	BytesValue  *string          `json:"bytesValue"`
+}
+
+// Int64 is a 64-bit integer, which OTLP/JSON encodes as a decimal string. A JSON number is also
+// accepted.
+type Int64 int64
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (i *Int64) UnmarshalJSON(data []byte) error {
+	text := strings.Trim(string(data), `"`)
+	v, err := strconv.ParseInt(text, 10, 64)
+	if err != nil {
+		return fmt.Errorf("otlp: invalid integer: %s", data)
+	}
+	*i = Int64(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (i Int64) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(i), 10))
+}
+
+// Adapter converts OTLP metric data points into MetricReports, which it adds to an Input. Each data
+// point becomes a report named after its metric, labeled with its attributes:
+//
+//   - A delta Sum point reports its value over its window, from its start time to its time.
+//   - A cumulative Sum point reports the change in its value since the series' previous point,
+//     over the time between them. The first point of a series reports its whole value since the
+//     series' start time. A series restarts when its start time changes.
+//   - A Gauge point reports its value over its window, or at an instant if it has no start time.
+//
+// Other instrument types, and attributes whose values aren't scalars, are skipped with a logged
+// warning. An Adapter may be used concurrently; it doesn't Use or Release its Input.
+type Adapter struct {
+	input pipeline.Input
+
+	mu         sync.Mutex
+	cumulative map[string]NumberDataPoint // Previous point of each cumulative series.
+}
+
+// NewAdapter creates an Adapter that adds reports to input.
+func NewAdapter(input pipeline.Input) *Adapter {
+	return &Adapter{input: input, cumulative: make(map[string]NumberDataPoint)}
+}
+
+// AddJSON converts and adds the metrics of an OTLP/JSON encoded ExportMetricsServiceRequest.
+func (a *Adapter) AddJSON(data []byte) error {
+	var req ExportMetricsServiceRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return fmt.Errorf("otlp: decoding metrics: %v", err)
+	}
+	return a.Add(req.ResourceMetrics)
+}
+
+// Add converts and adds the data points of rms. Every point is added, even if adding one fails; the
+// returned error holds each failure.
+func (a *Adapter) Add(rms []ResourceMetrics) error {
+	var err *multierror.Error
+	for _, rm := range rms {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				for _, report := range a.convert(m) {
+					if adderr := a.input.AddReport(report); adderr != nil {
+						err = multierror.Append(err, adderr)
+					}
+				}
+			}
+		}
+	}
+	return err.ErrorOrNil()
+}
+
+// convert returns the reports for m's data points.
+func (a *Adapter) convert(m Metric) []metrics.MetricReport {
+	var reports []metrics.MetricReport
+	switch {
+	case m.Sum != nil && m.Sum.AggregationTemporality == TemporalityCumulative:
+		for _, p := range m.Sum.DataPoints {
+			if report, ok := a.cumulativeReport(m.Name, p); ok {
+				reports = append(reports, report)
+			}
+		}
+	case m.Sum != nil && m.Sum.AggregationTemporality == TemporalityDelta:
+		for _, p := range m.Sum.DataPoints {
+			reports = append(reports, newReport(m.Name, p, p.StartTimeUnixNano, value(p)))
+		}
+	case m.Sum != nil:
+		glog.Warningf("otlp: skipping sum %v with unspecified temporality", m.Name)
+	case m.Gauge != nil:
+		for _, p := range m.Gauge.DataPoints {
+			start := p.StartTimeUnixNano
+			if start == 0 {
+				start = p.TimeUnixNano
+			}
+			reports = append(reports, newReport(m.Name, p, start, value(p)))
+		}
+	default:
+		glog.Warningf("otlp: skipping metric %v of an unsupported instrument type", m.Name)
+	}
+	return reports
+}
+
+// cumulativeReport returns the report of the change in a cumulative series since its previous
+// point, and records p as the series' previous point. It returns false if p is out of order.
+func (a *Adapter) cumulativeReport(name string, p NumberDataPoint) (metrics.MetricReport, bool) {
+	key := seriesKey(name, p)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev, exists := a.cumulative[key]
+	if exists && prev.StartTimeUnixNano == p.StartTimeUnixNano {
+		if p.TimeUnixNano <= prev.TimeUnixNano {
+			glog.Warningf("otlp: skipping out of order point of %v", name)
+			return metrics.MetricReport{}, false
+		}
+		a.cumulative[key] = p
+		v, pv := value(p), value(prev)
+		delta := metrics.MetricValue{Int64Value: v.Int64Value - pv.Int64Value, DoubleValue: v.DoubleValue - pv.DoubleValue}
+		return newReport(name, p, prev.TimeUnixNano, delta), true
+	}
+	a.cumulative[key] = p
+	return newReport(name, p, p.StartTimeUnixNano, value(p)), true
+}
+
+// seriesKey identifies the series of a metric's point by its attributes.
+func seriesKey(name string, p NumberDataPoint) string {
+	labels := attributeLabels(name, p.Attributes, false)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(name)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\x00%v=%v", k, labels[k])
+	}
+	return b.String()
+}
+
+func newReport(name string, p NumberDataPoint, start Int64, v metrics.MetricValue) metrics.MetricReport {
+	return metrics.MetricReport{
+		Name:      name,
+		StartTime: time.Unix(0, int64(start)).UTC(),
+		EndTime:   time.Unix(0, int64(p.TimeUnixNano)).UTC(),
+		Labels:    attributeLabels(name, p.Attributes, true),
+		Value:     v,
+	}
+}
+
+func value(p NumberDataPoint) metrics.MetricValue {
+	if p.AsInt != nil {
+		return metrics.MetricValue{Int64Value: int64(*p.AsInt)}
+	}
+	if p.AsDouble != nil {
+		return metrics.MetricValue{DoubleValue: *p.AsDouble}
+	}
+	return metrics.MetricValue{}
+}
+
+// attributeLabels returns the labels of a point's scalar attributes. Others are skipped, with a
+// logged warning if warn is true.
+func attributeLabels(name string, attrs []KeyValue, warn bool) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(attrs))
+	for _, kv := range attrs {
+		v := kv.Value
+		switch {
+		case v.StringValue != nil:
+			labels[kv.Key] = *v.StringValue
+		case v.BoolValue != nil:
+			labels[kv.Key] = strconv.FormatBool(*v.BoolValue)
+		case v.IntValue != nil:
+			labels[kv.Key] = strconv.FormatInt(int64(*v.IntValue), 10)
+		case v.DoubleValue != nil:
+			labels[kv.Key] = strconv.FormatFloat(*v.DoubleValue, 'g', -1, 64)
+		default:
+			if warn {
+				glog.Warningf("otlp: metric %v: skipping attribute %v, which isn't a string, bool, or number", name, kv.Key)
+			}
+		}
+	}
+	return labels
+}
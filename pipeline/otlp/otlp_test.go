@@ -0,0 +1,166 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otlp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+// sample is an OTLP/JSON export holding every supported instrument type, plus a histogram, which
+// isn't supported.
+const sample = `{
+  "resourceMetrics": [{
+    "resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "app"}}]},
+    "scopeMetrics": [{
+      "scope": {"name": "meter"},
+      "metrics": [
+        {
+          "name": "requests",
+          "sum": {
+            "aggregationTemporality": 1,
+            "isMonotonic": true,
+            "dataPoints": [{
+              "attributes": [
+                {"key": "region", "value": {"stringValue": "us-east1"}},
+                {"key": "cached", "value": {"boolValue": false}},
+                {"key": "tags", "value": {"arrayValue": {"values": []}}}
+              ],
+              "startTimeUnixNano": "1500000000000000000",
+              "timeUnixNano": "1500000010000000000",
+              "asInt": "25"
+            }]
+          }
+        },
+        {
+          "name": "cpu",
+          "gauge": {
+            "dataPoints": [{
+              "attributes": [{"key": "core", "value": {"intValue": "3"}}],
+              "timeUnixNano": 1500000010000000000,
+              "asDouble": 0.5
+            }]
+          }
+        },
+        {
+          "name": "latency",
+          "histogram": {"aggregationTemporality": 1, "dataPoints": [{"count": "2"}]}
+        }
+      ]
+    }]
+  }]
+}`
+
+func TestAdapter(t *testing.T) {
+	start := time.Unix(1500000000, 0).UTC()
+
+	t.Run("sample is converted", func(t *testing.T) {
+		i := testlib.NewMockInput()
+		a := NewAdapter(i)
+		if err := a.AddJSON([]byte(sample)); err != nil {
+			t.Fatalf("unexpected error: %+v", err)
+		}
+
+		expected := []metrics.MetricReport{
+			{
+				Name:      "requests",
+				StartTime: start,
+				EndTime:   start.Add(10 * time.Second),
+				Labels:    map[string]string{"region": "us-east1", "cached": "false"},
+				Value:     metrics.MetricValue{Int64Value: 25},
+			},
+			{
+				Name:      "cpu",
+				StartTime: start.Add(10 * time.Second),
+				EndTime:   start.Add(10 * time.Second),
+				Labels:    map[string]string{"core": "3"},
+				Value:     metrics.MetricValue{DoubleValue: 0.5},
+			},
+		}
+		if reports := i.Reports(); !reflect.DeepEqual(reports, expected) {
+			t.Fatalf("reports: expected %+v, got %+v", expected, reports)
+		}
+	})
+
+	t.Run("cumulative sums are reported as deltas", func(t *testing.T) {
+		i := testlib.NewMockInput()
+		a := NewAdapter(i)
+		point := func(series string, startSec, endSec, value int64) NumberDataPoint {
+			v := Int64(value)
+			return NumberDataPoint{
+				Attributes:        []KeyValue{{Key: "series", Value: AnyValue{StringValue: &series}}},
+				StartTimeUnixNano: Int64(startSec * int64(time.Second)),
+				TimeUnixNano:      Int64(endSec * int64(time.Second)),
+				AsInt:             &v,
+			}
+		}
+		add := func(points ...NumberDataPoint) {
+			rms := []ResourceMetrics{{ScopeMetrics: []ScopeMetrics{{Metrics: []Metric{{
+				Name: "requests",
+				Sum:  &Sum{AggregationTemporality: TemporalityCumulative, DataPoints: points},
+			}}}}}}
+			if err := a.Add(rms); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+		}
+
+		add(point("a", 0, 10, 5), point("b", 0, 10, 7))
+		add(point("a", 0, 20, 12))
+		// Out of order: skipped.
+		add(point("a", 0, 15, 9))
+		// Restarted series.
+		add(point("a", 30, 40, 2))
+
+		report := func(series string, startSec, endSec, value int64) metrics.MetricReport {
+			return metrics.MetricReport{
+				Name:      "requests",
+				StartTime: time.Unix(startSec, 0).UTC(),
+				EndTime:   time.Unix(endSec, 0).UTC(),
+				Labels:    map[string]string{"series": series},
+				Value:     metrics.MetricValue{Int64Value: value},
+			}
+		}
+		expected := []metrics.MetricReport{
+			report("a", 0, 10, 5),
+			report("b", 0, 10, 7),
+			report("a", 10, 20, 7),
+			report("a", 30, 40, 2),
+		}
+		if reports := i.Reports(); !reflect.DeepEqual(reports, expected) {
+			t.Fatalf("reports: expected %+v, got %+v", expected, reports)
+		}
+	})
+
+	t.Run("add errors are returned", func(t *testing.T) {
+		i := testlib.NewMockInput()
+		i.SetAddError(errors.New("test"))
+		a := NewAdapter(i)
+		if err := a.AddJSON([]byte(sample)); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("invalid json is rejected", func(t *testing.T) {
+		a := NewAdapter(testlib.NewMockInput())
+		if err := a.AddJSON([]byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "x", "gauge": {"dataPoints": [{"asInt": "x"}]}}]}]}]}`)); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
@@ -39,7 +39,8 @@ type Input interface {
 	Component
 
 	// AddReport adds a report to the pipeline. It returns an error if one is known immediately,
-	// such as a report that refers to unknown metrics. See aggregator.Aggregator.
+	// such as a report that refers to unknown metrics. See aggregator.Aggregator. Errors that
+	// reject the report match ErrUnknownMetric, ErrValidation, or ErrBackpressure with errors.Is.
 	AddReport(metrics.MetricReport) error
 }
 
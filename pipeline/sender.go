@@ -39,13 +39,18 @@ type Sender interface {
 }
 
 // Type InputAdapter is an Input that converts incoming reports to StampedMetricReport
-// objects and sends them directly to a delegate Sender.
+// objects and sends them directly to a delegate Sender. Report IDs are created by IDs, or are
+// random UUIDs if IDs is nil.
 type InputAdapter struct {
 	Sender Sender
+	IDs    metrics.IDGenerator
 }
 
 func (a *InputAdapter) AddReport(report metrics.MetricReport) error {
-	return a.Sender.Send(metrics.NewStampedMetricReport(report))
+	if a.IDs == nil {
+		return a.Sender.Send(metrics.NewStampedMetricReport(report))
+	}
+	return a.Sender.Send(metrics.StampMetricReport(report, a.IDs))
 }
 
 func (a *InputAdapter) Use() {
@@ -0,0 +1,112 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package senders
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/stats"
+)
+
+// maxExactDouble is the largest magnitude of an integer that a double represents exactly.
+const maxExactDouble = 1 << 53
+
+// CoercingSender is a Sender that converts the values of reports to a single type, metrics.IntType
+// or metrics.DoubleType, before sending them to a delegate. Doubles are converted to integers
+// according to a rounding policy: metrics.RoundUp (the default), metrics.RoundDown, or
+// metrics.RoundNearest, as applied by metrics.Round. Integers are only converted to doubles that
+// represent them exactly; Send fails for a report whose value can't be converted.
+type CoercingSender struct {
+	delegate  pipeline.Sender
+	valueType string
+	rounding  string
+	recorder  stats.Recorder
+}
+
+func (s *CoercingSender) Send(report metrics.StampedMetricReport) error {
+	value, err := s.coerce(report.Value)
+	if err != nil {
+		s.fail(report)
+		return &pipeline.ReportError{Kind: pipeline.ErrValidation, Name: report.Name, Err: err}
+	}
+	report.Value = value
+	if len(report.Values) > 0 {
+		// The values map is copied since it's shared with other senders.
+		values := make(map[string]metrics.MetricValue, len(report.Values))
+		for k, v := range report.Values {
+			if values[k], err = s.coerce(v); err != nil {
+				s.fail(report)
+				return &pipeline.ReportError{Kind: pipeline.ErrValidation, Name: report.Name, Err: err}
+			}
+		}
+		report.Values = values
+	}
+	return s.delegate.Send(report)
+}
+
+// fail records a failed send to each of the delegate's endpoints.
+func (s *CoercingSender) fail(report metrics.StampedMetricReport) {
+	for _, e := range s.delegate.Endpoints() {
+		s.recorder.SendFailed(report.Id, e)
+	}
+}
+
+func (s *CoercingSender) coerce(v metrics.MetricValue) (metrics.MetricValue, error) {
+	switch s.valueType {
+	case metrics.IntType:
+		if v.DoubleValue == 0 {
+			return v, nil
+		}
+		rounded := metrics.Round(v.DoubleValue, 1, s.rounding)
+		if math.IsNaN(rounded) || rounded >= math.MaxInt64 || rounded < math.MinInt64 {
+			return v, fmt.Errorf("CoercingSender: value %v is out of range for an integer", v.DoubleValue)
+		}
+		return metrics.MetricValue{Int64Value: int64(rounded)}, nil
+	case metrics.DoubleType:
+		if v.Int64Value == 0 {
+			return v, nil
+		}
+		if v.Int64Value > maxExactDouble || v.Int64Value < -maxExactDouble {
+			return v, fmt.Errorf("CoercingSender: value %v can't be represented exactly as a double", v.Int64Value)
+		}
+		return metrics.MetricValue{DoubleValue: float64(v.Int64Value)}, nil
+	}
+	return v, nil
+}
+
+func (s *CoercingSender) Endpoints() []string {
+	return s.delegate.Endpoints()
+}
+
+// Use increments the delegate's usage count.
+// See pipeline.Component.Use.
+func (s *CoercingSender) Use() {
+	s.delegate.Use()
+}
+
+// Release decrements the delegate's usage count.
+// See pipeline.Component.Release.
+func (s *CoercingSender) Release() error {
+	return s.delegate.Release()
+}
+
+// NewCoercingSender creates a CoercingSender that sends reports with values of type valueType to
+// delegate, rounding doubles according to rounding. Failed coercions are recorded with recorder.
+func NewCoercingSender(delegate pipeline.Sender, valueType, rounding string, recorder stats.Recorder) *CoercingSender {
+	return &CoercingSender{delegate: delegate, valueType: valueType, rounding: rounding, recorder: recorder}
+}
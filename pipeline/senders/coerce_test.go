@@ -0,0 +1,115 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package senders
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/stats"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestCoercingSender(t *testing.T) {
+	newReport := func(value metrics.MetricValue) metrics.StampedMetricReport {
+		return metrics.StampedMetricReport{
+			Id: "report",
+			MetricReport: metrics.MetricReport{
+				Name:      "double-metric",
+				Value:     value,
+				StartTime: time.Unix(10, 0),
+				EndTime:   time.Unix(11, 0),
+			},
+		}
+	}
+
+	t.Run("endpoints receive the same report as different types", func(t *testing.T) {
+		legacy := testlib.NewMockSender("legacy")
+		modern := testlib.NewMockSender("modern")
+		ds := NewDispatcher([]pipeline.Sender{
+			NewCoercingSender(legacy, metrics.IntType, metrics.RoundNearest, stats.NewNoopRecorder()),
+			NewCoercingSender(modern, metrics.DoubleType, "", stats.NewNoopRecorder()),
+		}, stats.NewNoopRecorder())
+		if err := ds.Send(newReport(metrics.MetricValue{DoubleValue: 2.5})); err != nil {
+			t.Fatalf("Unexpected send error: %+v", err)
+		}
+
+		if want, got := []metrics.MetricReport{newReport(metrics.MetricValue{Int64Value: 3}).MetricReport}, legacy.Reports(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("legacy reports: want=%+v, got=%+v", want, got)
+		}
+		if want, got := []metrics.MetricReport{newReport(metrics.MetricValue{DoubleValue: 2.5}).MetricReport}, modern.Reports(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("modern reports: want=%+v, got=%+v", want, got)
+		}
+	})
+
+	t.Run("rounding", func(t *testing.T) {
+		for _, tc := range []struct {
+			rounding string
+			value    float64
+			want     int64
+		}{
+			{"", 1.2, 2},
+			{metrics.RoundUp, -1.8, -1},
+			{metrics.RoundDown, 1.8, 1},
+			{metrics.RoundDown, -1.2, -2},
+			{metrics.RoundNearest, 1.4, 1},
+			{metrics.RoundNearest, -1.5, -1},
+		} {
+			ms := testlib.NewMockSender("ms")
+			cs := NewCoercingSender(ms, metrics.IntType, tc.rounding, stats.NewNoopRecorder())
+			if err := cs.Send(newReport(metrics.MetricValue{DoubleValue: tc.value})); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+			if got := ms.Reports()[0].Value; got != (metrics.MetricValue{Int64Value: tc.want}) {
+				t.Fatalf("%q rounding of %v: want=%v, got=%+v", tc.rounding, tc.value, tc.want, got)
+			}
+		}
+	})
+
+	t.Run("named values are coerced", func(t *testing.T) {
+		ms := testlib.NewMockSender("ms")
+		cs := NewCoercingSender(ms, metrics.DoubleType, "", stats.NewNoopRecorder())
+		report := newReport(metrics.MetricValue{})
+		report.Values = map[string]metrics.MetricValue{"read": {Int64Value: 4}}
+		if err := cs.Send(report); err != nil {
+			t.Fatalf("Unexpected send error: %+v", err)
+		}
+		if want, got := map[string]metrics.MetricValue{"read": {DoubleValue: 4}}, ms.Reports()[0].Values; !reflect.DeepEqual(want, got) {
+			t.Fatalf("values: want=%+v, got=%+v", want, got)
+		}
+		if want, got := int64(4), report.Values["read"].Int64Value; want != got {
+			t.Fatalf("caller's values: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("inexact double is rejected", func(t *testing.T) {
+		ms := testlib.NewMockSender("ms")
+		sr := testlib.NewMockStatsRecorder()
+		cs := NewCoercingSender(ms, metrics.DoubleType, "", sr)
+		if err := cs.Send(newReport(metrics.MetricValue{Int64Value: 1<<53 + 1})); !errors.Is(err, pipeline.ErrValidation) {
+			t.Fatalf("Expected validation error, got: %+v", err)
+		}
+		if want, got := []testlib.RecordedEntry{{Id: "report", Handler: "ms"}}, sr.Failed(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.failed: want=%+v, got=%+v", want, got)
+		}
+		if want, got := 0, len(ms.Reports()); want != got {
+			t.Fatalf("len(ms.Reports()): want=%v, got=%v", want, got)
+		}
+	})
+}
@@ -32,7 +32,8 @@ type Dispatcher struct {
 }
 
 // Send fans out to each Sender in parallel and returns any errors. Send blocks
-// until all sub-sends have finished.
+// until all sub-sends have finished. If any of the errors is a *pipeline.ReportError, the returned
+// error is a *pipeline.ReportError of the same Kind.
 func (d *Dispatcher) Send(report metrics.StampedMetricReport) error {
 
 	// First, register that each report will be handled by this Dispatcher's endpoints.
@@ -52,7 +53,13 @@ func (d *Dispatcher) Send(report metrics.StampedMetricReport) error {
 		}(i, ps)
 	}
 	wg.Wait()
-	return multierror.Append(nil, errors...).ErrorOrNil()
+	err := multierror.Append(nil, errors...).ErrorOrNil()
+	for _, e := range errors {
+		if re, ok := e.(*pipeline.ReportError); ok {
+			return &pipeline.ReportError{Kind: re.Kind, Name: report.Name, Err: err}
+		}
+	}
+	return err
 }
 
 // Use increments the Dispatcher's usage count.
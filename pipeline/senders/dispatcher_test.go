@@ -16,12 +16,14 @@ package senders
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
 	"github.com/GoogleCloudPlatform/ubbagent/stats"
 	"github.com/GoogleCloudPlatform/ubbagent/testlib"
@@ -73,6 +75,24 @@ func TestDispatcher(t *testing.T) {
 		}
 	})
 
+	t.Run("report errors keep their kind", func(t *testing.T) {
+		ms1 := testlib.NewMockSender("ms1")
+		ms2 := testlib.NewMockSender("ms2")
+		ms2.SetSendError(&pipeline.ReportError{Kind: pipeline.ErrBackpressure, Name: report.Name, Err: errors.New("queue full")})
+		ds := NewDispatcher([]pipeline.Sender{ms1, ms2}, stats.NewNoopRecorder())
+		err := ds.Send(report)
+		if !errors.Is(err, pipeline.ErrBackpressure) {
+			t.Fatalf("Expected a backpressure error, got: %+v", err)
+		}
+		var re *pipeline.ReportError
+		if !errors.As(err, &re) || re.Name != "int-metric" {
+			t.Fatalf("Expected a *pipeline.ReportError for int-metric, got: %+v", err)
+		}
+		if !strings.Contains(err.Error(), "queue full") {
+			t.Fatalf("Expected error message to contain 'queue full', got: %v", err.Error())
+		}
+	})
+
 	t.Run("dispatcher returns aggregated endpoints", func(t *testing.T) {
 		ms1 := testlib.NewMockSender("ms1")
 		ms2 := testlib.NewMockSender("ms2")
@@ -83,6 +103,49 @@ func TestDispatcher(t *testing.T) {
 		}
 	})
 
+	t.Run("failing endpoints are retried independently", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		start := time.Unix(5000, 0)
+		mc.SetNow(start)
+
+		// Sends to the analytics endpoint fail, and are retried on its own, slower schedule.
+		billing := testlib.NewMockEndpoint("billing")
+		analytics := testlib.NewMockEndpoint("analytics")
+		analytics.SetSendErr(errors.New("unavailable"))
+		bs := newRetryingSender(billing, persist, stats.NewNoopRecorder(), mc, time.Second, time.Minute, time.Hour, 0, 0, 0, time.Second, 0, 0, nil, nil)
+		defer bs.Release()
+		as := newRetryingSender(analytics, persist, stats.NewNoopRecorder(), mc, time.Minute, time.Hour, time.Hour, 0, 0, 0, time.Second, 0, 0, nil, nil)
+		defer as.Release()
+		ds := NewDispatcher([]pipeline.Sender{bs, as}, stats.NewNoopRecorder())
+
+		// Each report reaches billing as soon as it's sent, while analytics' backlog grows.
+		for i := 0; i < 3; i++ {
+			r := report
+			r.Id = fmt.Sprintf("report%v", i)
+			billing.DoAndWait(t, int32(i+1), func() {
+				if err := ds.Send(r); err != nil {
+					t.Fatalf("Unexpected send error: %+v", err)
+				}
+			})
+			if want, got := 1, len(billing.Reports()); want != got {
+				t.Fatalf("len(billing.Reports()): want=%v, got=%v", want, got)
+			}
+		}
+		if want, got := int32(1), analytics.Calls(); want != got {
+			t.Fatalf("analytics.Calls(): want=%v, got=%v", want, got)
+		}
+
+		// Analytics is retried only after its minimum delay, and then delivers its backlog.
+		analytics.SetSendErr(nil)
+		analytics.DoAndWait(t, 4, func() {
+			mc.SetNow(start.Add(2 * time.Minute))
+		})
+		if want, got := 3, len(analytics.Reports()); want != got {
+			t.Fatalf("len(analytics.Reports()): want=%v, got=%v", want, got)
+		}
+	})
+
 	t.Run("multiple usages", func(t *testing.T) {
 		s := testlib.NewMockSender("sender")
 		ds := NewDispatcher([]pipeline.Sender{s}, stats.NewNoopRecorder())
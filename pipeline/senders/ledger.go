@@ -0,0 +1,86 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package senders
+
+import (
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/golang/glog"
+)
+
+// sentLedger is a persisted record of the IDs of reports that were successfully sent to an
+// endpoint. It allows a RetryingSender to skip reports that were already sent prior to a restart.
+// The ledger is bounded both in size and by age: it retains at most size entries, and entries older
+// than ttl are discarded. A ledger with a size of 0 is disabled and records nothing.
+type sentLedger struct {
+	value   persistence.Value
+	size    int
+	ttl     time.Duration
+	entries []sentEntry
+}
+
+type sentEntry struct {
+	Id       string
+	SentTime time.Time
+}
+
+// newSentLedger creates a sentLedger stored in value, loading any previously-stored entries.
+func newSentLedger(value persistence.Value, size int, ttl time.Duration) *sentLedger {
+	l := &sentLedger{value: value, size: size, ttl: ttl}
+	if size <= 0 {
+		return l
+	}
+	if err := value.Load(&l.entries); err != nil && err != persistence.ErrNotFound {
+		// The ledger is an optimization; losing it means duplicates may be sent, but isn't fatal.
+		glog.Errorf("sentLedger: loading sent report IDs: %+v", err)
+		l.entries = nil
+	}
+	return l
+}
+
+// contains returns whether a report with the given ID was sent within the ledger's TTL.
+func (l *sentLedger) contains(id string, now time.Time) bool {
+	for _, e := range l.entries {
+		if e.Id == id && !l.expired(e, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// add records that the report with the given ID was sent at time now, discarding expired entries
+// and the oldest entries beyond the ledger's size, and persists the result.
+func (l *sentLedger) add(id string, now time.Time) error {
+	if l.size <= 0 {
+		return nil
+	}
+	entries := make([]sentEntry, 0, len(l.entries)+1)
+	for _, e := range l.entries {
+		if !l.expired(e, now) {
+			entries = append(entries, e)
+		}
+	}
+	entries = append(entries, sentEntry{Id: id, SentTime: now})
+	if len(entries) > l.size {
+		entries = entries[len(entries)-l.size:]
+	}
+	l.entries = entries
+	return l.value.Store(l.entries)
+}
+
+func (l *sentLedger) expired(e sentEntry, now time.Time) bool {
+	return l.ttl > 0 && now.Sub(e.SentTime) > l.ttl
+}
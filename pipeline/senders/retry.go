@@ -17,6 +17,7 @@ package senders
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"math/rand"
 	"path"
 	"sync"
@@ -31,57 +32,196 @@ import (
 )
 
 const (
-	persistPrefix = "epqueue"
+	persistPrefix       = "epqueue"
+	ledgerPersistPrefix = "sentids"
+	quarantinePrefix    = "quarantine"
 )
 
 var minRetryDelay = flag.Duration("min_retry_delay", 2*time.Second, "minimum exponential backoff delay")
 var maxRetryDelay = flag.Duration("max_retry_delay", 60*time.Second, "maximum exponential backoff delay")
 var maxQueueTime = flag.Duration("max_queue_time", 3*time.Hour, "maximum amount of time to keep an entry in the retry queue")
+var sentLedgerSize = flag.Int("sent_ledger_size", 1000, "maximum number of sent report IDs remembered per endpoint to skip duplicates across restarts; 0 disables")
+var sentLedgerTTL = flag.Duration("sent_ledger_ttl", 24*time.Hour, "maximum amount of time to remember a sent report ID")
+var maxQueueSize = flag.Int("max_queue_size", 0, "maximum number of reports held in each endpoint's retry queue; 0 is unbounded")
+var quarantineThreshold = flag.Int("quarantine_threshold", 0, "number of consecutive attempts to send a report that fail with the same retryable error before it's quarantined; 0 disables")
+var batchDelay = flag.Duration("batch_delay", time.Second, "maximum amount of time a report waits for others to batch with, for endpoints that send batches")
 
 // RetryingSender is a Sender handles sending reports to remote endpoints.
 // It buffers reports and retries in the event of a send failure, using exponential backoff between
 // retry attempts. Minimum and maximum delays are configurable via the "retrymin" and "retrymax"
-// flags.
+// flags. The IDs of successfully sent reports are persisted in a bounded ledger, configurable via the
+// "sent_ledger_size" and "sent_ledger_ttl" flags, and reports whose IDs are found in the ledger are
+// skipped rather than sent again.
+//
+// Retry delays and queue limits may be overridden per endpoint with RetrySettings, so that an
+// endpoint that's failing, or has a backlog, is retried on its own schedule without affecting the
+// senders of other endpoints.
+//
+// The retry queue is persisted, along with each queued report's attempt count and next retry time,
+// so that retries resume on their original schedule after a restart. If "max_queue_size" is set,
+// the queue holds at most that many reports and Send returns an error matching
+// pipeline.ErrBackpressure when it's full.
+//
+// A metric may have a TTL. A queued report of that metric which was ingested more than TTL ago is
+// dropped rather than sent, and recorded with stats.Recorder.SendStale.
+//
+// If the endpoint is a pipeline.Batcher, up to its MaxBatch queued reports are sent at a time. A
+// newly queued report waits up to "batch_delay" for a full batch to accumulate before it's sent.
+// Both may be overridden per endpoint with BatchSettings. Reports waiting for a batch are sent when
+// the sender is released, unless it's retrying a failed send or paused.
+//
+// If "quarantine_threshold" is set, a report whose sends fail that many consecutive times with the
+// same retryable error, such as one the endpoint can't serialize, is moved to a separate quarantine
+// queue so that it doesn't hold up the reports behind it. Quarantined reports are recorded with
+// stats.Recorder.SendFailed and kept in persistence for inspection. A report that fails while sent
+// in a batch is retried alone, so that only the report that's failing is quarantined.
+//
+// Sending is paused while the sender's Switch, if any, is paused.
+//
+// Drain sends the queued reports before the sender is released, rather than leaving them persisted
+// until the next start.
 type RetryingSender struct {
 	endpoint    pipeline.Endpoint
 	queue       persistence.Queue
+	ledger      *sentLedger
+	quarantine  persistence.Queue
 	recorder    stats.Recorder
 	clock       clock.Clock
 	lastAttempt time.Time
 	delay       time.Duration
 	minDelay    time.Duration
 	maxDelay    time.Duration
+	maxAge      time.Duration // Maximum queue time.
+	maxSize     int
+	quarantineN int              // Quarantine threshold, or 0 if disabled.
+	queueLen    int              // Cached length of queue, or -1 until it's loaded.
+	batcher     pipeline.Batcher // Nil if the endpoint doesn't send batches.
+	maxBatch    int
+	batchDelay  time.Duration
+	batchStart  time.Time // When the oldest report awaiting a batch was queued, or zero.
+	ttls        map[string]time.Duration
+	ttlNames    *metrics.Matcher
+	pause       *Switch
+	resumed     <-chan struct{}
 	add         chan addMsg
+	drain       chan drainMsg
+	draining    *drainMsg // The pending Drain, if any.
 	closed      bool
 	closeMutex  sync.RWMutex
 	wait        sync.WaitGroup
 	tracker     pipeline.UsageTracker
 }
 
+// RetrySettings override the retrying of a RetryingSender. Zero values use the defaults.
+type RetrySettings struct {
+	// The minimum and maximum exponential backoff delays. Default to "min_retry_delay" and
+	// "max_retry_delay".
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	// The maximum amount of time a report is kept in the retry queue. Defaults to "max_queue_time".
+	MaxQueueTime time.Duration
+
+	// The maximum number of reports held in the retry queue. Defaults to "max_queue_size".
+	MaxQueueSize int
+}
+
+// BatchSettings override the batching of a RetryingSender whose endpoint sends batches. Zero
+// values use the defaults.
+type BatchSettings struct {
+	// The maximum amount of time a report waits for others to batch with. Defaults to "batch_delay".
+	Delay time.Duration
+
+	// The maximum number of reports sent in a batch, which is further limited by the endpoint's
+	// MaxBatch. A MaxSize of 1 disables batching.
+	MaxSize int
+}
+
 type addMsg struct {
 	entry  queueEntry
 	result chan error
 }
 
+type drainMsg struct {
+	deadline time.Time
+	result   chan error
+}
+
 type queueEntry struct {
-	Report   pipeline.EndpointReport
-	SendTime time.Time
+	Report    pipeline.EndpointReport
+	SendTime  time.Time
+	Attempts  int
+	NextRetry time.Time
+
+	// IngestTime is stored separately since it isn't serialized as part of the report.
+	IngestTime time.Time
+
+	// The error of the most recent failed attempt, and the number of consecutive attempts that
+	// failed with it.
+	LastError string
+	Repeats   int
 }
 
-// NewRetryingSender creates a new RetryingSender for endpoint, storing state in persistence.
-func NewRetryingSender(endpoint pipeline.Endpoint, persistence persistence.Persistence, recorder stats.Recorder) *RetryingSender {
-	return newRetryingSender(endpoint, persistence, recorder, clock.NewClock(), *minRetryDelay, *maxRetryDelay)
+// quarantinedEntry is a report that was moved to the quarantine queue.
+type quarantinedEntry struct {
+	Report         pipeline.EndpointReport
+	Error          string
+	Attempts       int
+	QuarantineTime time.Time
 }
 
-func newRetryingSender(endpoint pipeline.Endpoint, persistence persistence.Persistence, recorder stats.Recorder, clock clock.Clock, minDelay, maxDelay time.Duration) *RetryingSender {
+// NewRetryingSender creates a new RetryingSender for endpoint, storing state in persistence. The
+// ttls map holds metric TTLs keyed by metric name or pattern, where 0 means no TTL; it may be nil.
+// The pause Switch may also be nil.
+func NewRetryingSender(endpoint pipeline.Endpoint, persistence persistence.Persistence, recorder stats.Recorder, ttls map[string]time.Duration, retry RetrySettings, batch BatchSettings, pause *Switch) *RetryingSender {
+	if retry.MinDelay <= 0 {
+		retry.MinDelay = *minRetryDelay
+	}
+	if retry.MaxDelay <= 0 {
+		retry.MaxDelay = *maxRetryDelay
+	}
+	if retry.MaxQueueTime <= 0 {
+		retry.MaxQueueTime = *maxQueueTime
+	}
+	if retry.MaxQueueSize <= 0 {
+		retry.MaxQueueSize = *maxQueueSize
+	}
+	if batch.Delay <= 0 {
+		batch.Delay = *batchDelay
+	}
+	return newRetryingSender(endpoint, persistence, recorder, clock.NewClock(), retry.MinDelay, retry.MaxDelay, retry.MaxQueueTime, *sentLedgerSize, *sentLedgerTTL, retry.MaxQueueSize, batch.Delay, batch.MaxSize, *quarantineThreshold, ttls, pause)
+}
+
+func newRetryingSender(endpoint pipeline.Endpoint, persistence persistence.Persistence, recorder stats.Recorder, clock clock.Clock, minDelay, maxDelay, maxAge time.Duration, ledgerSize int, ledgerTTL time.Duration, maxSize int, batchDelay time.Duration, maxBatch int, quarantineN int, ttls map[string]time.Duration, pause *Switch) *RetryingSender {
 	rs := &RetryingSender{
-		endpoint: endpoint,
-		queue:    persistence.Queue(persistenceName(endpoint.Name())),
-		recorder: recorder,
-		clock:    clock,
-		minDelay: minDelay,
-		maxDelay: maxDelay,
-		add:      make(chan addMsg, 1),
+		endpoint:    endpoint,
+		queue:       persistence.Queue(persistenceName(endpoint.Name())),
+		ledger:      newSentLedger(persistence.Value(ledgerPersistenceName(endpoint.Name())), ledgerSize, ledgerTTL),
+		quarantine:  persistence.Queue(quarantinePersistenceName(endpoint.Name())),
+		recorder:    recorder,
+		clock:       clock,
+		minDelay:    minDelay,
+		maxDelay:    maxDelay,
+		maxAge:      maxAge,
+		maxSize:     maxSize,
+		quarantineN: quarantineN,
+		queueLen:    -1,
+		batchDelay:  batchDelay,
+		ttls:        ttls,
+		ttlNames:    newTTLMatcher(ttls),
+		pause:       pause,
+		resumed:     pause.listen(),
+		add:         make(chan addMsg, 1),
+		drain:       make(chan drainMsg),
+	}
+	if b, ok := endpoint.(pipeline.Batcher); ok {
+		rs.maxBatch = b.MaxBatch()
+		if maxBatch > 0 && maxBatch < rs.maxBatch {
+			rs.maxBatch = maxBatch
+		}
+		if rs.maxBatch > 1 {
+			rs.batcher = b
+		}
 	}
 	endpoint.Use()
 	rs.wait.Add(1)
@@ -99,11 +239,11 @@ func (rs *RetryingSender) Send(report metrics.StampedMetricReport) error {
 	epr, err := rs.endpoint.BuildReport(report)
 	if err != nil {
 		rs.recorder.SendFailed(report.Id, rs.endpoint.Name())
-		return err
+		return &pipeline.ReportError{Kind: pipeline.ErrValidation, Name: report.Name, Err: err}
 	}
 
 	msg := addMsg{
-		entry:  queueEntry{epr, rs.clock.Now()},
+		entry:  queueEntry{Report: epr, SendTime: rs.clock.Now(), IngestTime: report.IngestTime},
 		result: make(chan error),
 	}
 	rs.add <- msg
@@ -116,6 +256,20 @@ func (rs *RetryingSender) Send(report metrics.StampedMetricReport) error {
 	return err
 }
 
+// Drain sends the reports in the retry queue, without waiting for batches to fill, and returns once
+// the queue is empty. Failed sends are retried as usual. If reports are still queued after timeout,
+// such as while the endpoint is failing, Drain returns an error and they stay queued.
+func (rs *RetryingSender) Drain(timeout time.Duration) error {
+	rs.closeMutex.RLock()
+	defer rs.closeMutex.RUnlock()
+	if rs.closed {
+		return errors.New("RetryingSender: Drain called on closed sender")
+	}
+	msg := drainMsg{deadline: rs.clock.Now().Add(timeout), result: make(chan error, 1)}
+	rs.drain <- msg
+	return <-msg.result
+}
+
 func (rs *RetryingSender) Endpoints() []string {
 	return []string{rs.endpoint.Name()}
 }
@@ -145,14 +299,20 @@ func (rs *RetryingSender) Release() error {
 }
 
 func (rs *RetryingSender) run(start time.Time) {
-	// Start with an initial call to maybeSend() to start sending any persisted state.
+	// Restore the retry schedule of a persisted report that previously failed, then make an initial
+	// call to maybeSend() to start sending any persisted state.
+	rs.restoreRetry()
 	rs.maybeSend(start)
 	for {
 		var timer clock.Timer
-		if rs.delay == 0 {
+		if rs.pause.Paused() || (rs.delay == 0 && rs.batchStart.IsZero()) {
 			// A delay of 0 means we're not retrying. Disable the retry timer; We'll wakeup when a new
-			// report is sent.
+			// report is sent. While paused, the timer would only fire into a maybeSend that returns
+			// without sending, so it's also disabled; resuming wakes us and re-arms it.
 			timer = clock.NewStoppedTimer()
+		} else if rs.delay == 0 {
+			// Queued reports are waiting for a batch. Send them when the batch delay runs out.
+			timer = rs.clock.NewTimerAt(rs.batchStart.Add(rs.batchDelay))
 		} else {
 			// Compute the next retry time, which is the current time + current delay + [0,1000) ms jitter
 			now := rs.clock.Now()
@@ -160,10 +320,14 @@ func (rs *RetryingSender) run(start time.Time) {
 			nextFire := now.Add(rs.delay - now.Sub(rs.lastAttempt)).Add(jitter)
 			timer = rs.clock.NewTimerAt(nextFire)
 		}
+		deadline := clock.NewStoppedTimer()
+		if rs.draining != nil {
+			deadline = rs.clock.NewTimerAt(rs.draining.deadline)
+		}
 		select {
 		case msg, ok := <-rs.add:
 			if ok {
-				err := rs.queue.Enqueue(msg.entry)
+				err := rs.enqueue(msg.entry)
 				if err != nil {
 					msg.result <- err
 					break
@@ -171,25 +335,66 @@ func (rs *RetryingSender) run(start time.Time) {
 
 				// Successfully queued the message
 				msg.result <- nil
+				if rs.batcher != nil && rs.batchStart.IsZero() {
+					rs.batchStart = msg.entry.SendTime
+				}
 				rs.maybeSend(msg.entry.SendTime)
 			} else {
-				// Channel was closed.
+				// Channel was closed. Send any reports still waiting for a batch.
+				if !rs.batchStart.IsZero() {
+					rs.batchStart = time.Time{}
+					rs.maybeSend(rs.clock.Now())
+				}
 				rs.wait.Done()
 				return
 			}
 		case now := <-timer.GetC():
 			rs.maybeSend(now)
+		case <-rs.resumed:
+			rs.maybeSend(rs.clock.Now())
+		case msg := <-rs.drain:
+			rs.draining = &msg
+			rs.batchStart = time.Time{}
+			rs.maybeSend(rs.clock.Now())
+		case <-deadline.GetC():
 		}
 		timer.Stop()
+		deadline.Stop()
+		rs.checkDrain(rs.clock.Now())
 	}
 }
 
+// checkDrain completes the pending Drain, if any, once the retry queue is empty, or with an error
+// once its deadline has passed.
+func (rs *RetryingSender) checkDrain(now time.Time) {
+	if rs.draining == nil {
+		return
+	}
+	size, err := rs.length()
+	if err == nil && size > 0 {
+		if now.Before(rs.draining.deadline) {
+			return
+		}
+		err = fmt.Errorf("RetryingSender: %v reports still queued for endpoint %v after draining", size, rs.endpoint.Name())
+	}
+	rs.draining.result <- err
+	rs.draining = nil
+}
+
 // maybeSend retries a pending send if the required time delay has elapsed.
 func (rs *RetryingSender) maybeSend(now time.Time) {
+	if rs.pause.Paused() {
+		// Reports stay queued until sending resumes.
+		return
+	}
 	if now.Before(rs.lastAttempt.Add(rs.delay)) {
 		// Not time yet.
 		return
 	}
+	if rs.delay == 0 && rs.awaitingBatch(now) {
+		return
+	}
+	rs.batchStart = time.Time{}
 	for {
 		entry := &queueEntry{}
 		if loaderr := rs.queue.Peek(entry); loaderr == persistence.ErrNotFound {
@@ -198,34 +403,83 @@ func (rs *RetryingSender) maybeSend(now time.Time) {
 			// We failed to load from the persistent queue. This isn't recoverable.
 			panic("RetryingSender.maybeSend: loading from retry queue: " + loaderr.Error())
 		}
-		if senderr := rs.endpoint.Send(entry.Report); senderr != nil {
-			// We've encountered a send error. If the error is considered transient and the entry hasn't
-			// reached its maximum queue time, we'll leave it in the queue and retry. Otherwise it's
-			// removed from the queue, logged, and recorded as a failure.
-			expired := rs.clock.Now().Sub(entry.SendTime) > *maxQueueTime
-			if !expired && rs.endpoint.IsTransient(senderr) {
-				// Set next attempt
-				rs.lastAttempt = now
-				rs.delay = bounded(rs.delay*2, rs.minDelay, rs.maxDelay)
-				glog.Warningf("RetryingSender.maybeSend [%[1]T - transient; will retry]: %[1]s", senderr)
-				break
-			} else if expired {
-				glog.Errorf("RetryingSender.maybeSend [%[1]T - retry expired]: %[1]s", senderr)
-				rs.recorder.SendFailed(entry.Report.Id, rs.endpoint.Name())
+		batch := []*queueEntry{entry}
+		if rs.ledger.contains(entry.Report.Id, rs.clock.Now()) {
+			// This report was already sent, likely prior to a restart. Consider it delivered.
+			glog.Warningf("RetryingSender.maybeSend: skipping previously sent report %v", entry.Report.Id)
+			rs.recorder.SendSucceeded(entry.Report.Id, rs.endpoint.Name())
+		} else if rs.isStale(entry) {
+			glog.Warningf("RetryingSender.maybeSend: dropping stale report %v", entry.Report.Id)
+			rs.recorder.SendStale(entry.Report.Id, rs.endpoint.Name())
+		} else {
+			batch = rs.nextBatch(entry)
+			if senderr := rs.send(batch); senderr != nil {
+				// We've encountered a send error. If the error is considered transient and the entry
+				// hasn't reached its maximum queue time, we'll leave the batch in the queue and retry; its
+				// retry state is kept with its first entry. Otherwise the batch is removed from the
+				// queue, logged, and recorded as a failure.
+				expired := rs.clock.Now().Sub(entry.SendTime) > rs.maxAge
+				transient := !expired && rs.endpoint.IsTransient(senderr)
+				if transient {
+					if entry.LastError == senderr.Error() {
+						entry.Repeats++
+					} else {
+						entry.LastError = senderr.Error()
+						entry.Repeats = 1
+					}
+				}
+				if transient && !rs.isPoison(batch) {
+					// Set next attempt, and persist it so that the retry schedule survives a restart.
+					entry.Attempts++
+					rs.lastAttempt = now
+					rs.delay = rs.backoff(entry.Attempts)
+					if after, ok := rs.retryAfter(senderr, now); ok && after > rs.delay {
+						// The endpoint's service asked us to wait longer, e.g. with a Retry-After header.
+						rs.delay = after
+					}
+					entry.NextRetry = now.Add(rs.delay)
+					if uperr := rs.queue.Update(entry); uperr != nil {
+						glog.Errorf("RetryingSender.maybeSend: persisting retry state: %+v", uperr)
+						rs.recorder.PersistFailed(persistenceName(rs.endpoint.Name()))
+					}
+					glog.Warningf("RetryingSender.maybeSend [%[1]T - transient; will retry]: %[1]s", senderr)
+					break
+				} else if expired {
+					glog.Errorf("RetryingSender.maybeSend [%[1]T - retry expired]: %[1]s", senderr)
+				} else if transient {
+					glog.Errorf("RetryingSender.maybeSend [%[1]T - failed %[2]v times; quarantining report %[3]v]: %[1]s", senderr, entry.Repeats, entry.Report.Id)
+					rs.quarantineEntry(entry, now)
+				} else {
+					glog.Errorf("RetryingSender.maybeSend [%[1]T - will NOT retry]: %[1]s", senderr)
+				}
+				for _, e := range batch {
+					rs.recorder.SendFailed(e.Report.Id, rs.endpoint.Name())
+				}
 			} else {
-				glog.Errorf("RetryingSender.maybeSend [%[1]T - will NOT retry]: %[1]s", senderr)
-				rs.recorder.SendFailed(entry.Report.Id, rs.endpoint.Name())
+				// Send was successful.
+				for _, e := range batch {
+					if lerr := rs.ledger.add(e.Report.Id, rs.clock.Now()); lerr != nil {
+						glog.Errorf("RetryingSender.maybeSend: recording sent report: %+v", lerr)
+						rs.recorder.PersistFailed(ledgerPersistenceName(rs.endpoint.Name()))
+					}
+					if !e.IngestTime.IsZero() {
+						rs.recorder.SendLatency(e.Report.Name, rs.endpoint.Name(), rs.clock.Now().Sub(e.IngestTime))
+					}
+					rs.recorder.SendSucceeded(e.Report.Id, rs.endpoint.Name())
+				}
 			}
-		} else {
-			// Send was successful.
-			rs.recorder.SendSucceeded(entry.Report.Id, rs.endpoint.Name())
 		}
 
-		// At this point we've either successfully sent the report or encountered a non-transient error.
-		// In either scenario, the report is removed from the queue and the retry delay is reset.
-		if poperr := rs.queue.Dequeue(nil); poperr != nil {
-			// We failed to pop the sent entry off the queue. This isn't recoverable.
-			panic("RetryingSender.maybeSend: dequeuing from retry queue: " + poperr.Error())
+		// At this point we've either successfully sent the batch or encountered a non-transient error.
+		// In either scenario, the batch is removed from the queue and the retry delay is reset.
+		for range batch {
+			if poperr := rs.queue.Dequeue(nil); poperr != nil {
+				// We failed to pop the sent entry off the queue. This isn't recoverable.
+				panic("RetryingSender.maybeSend: dequeuing from retry queue: " + poperr.Error())
+			}
+			if rs.queueLen > 0 {
+				rs.queueLen--
+			}
 		}
 
 		rs.lastAttempt = now
@@ -233,6 +487,165 @@ func (rs *RetryingSender) maybeSend(now time.Time) {
 	}
 }
 
+// awaitingBatch returns true if the endpoint sends batches and the queued reports should wait for
+// more to accumulate: the queue holds less than a full batch, and the oldest waiting report was
+// queued less than the batch delay ago.
+func (rs *RetryingSender) awaitingBatch(now time.Time) bool {
+	if rs.batcher == nil || rs.draining != nil || rs.batchStart.IsZero() || !now.Before(rs.batchStart.Add(rs.batchDelay)) {
+		return false
+	}
+	size, err := rs.length()
+	if err != nil {
+		glog.Errorf("RetryingSender: loading retry queue length: %+v", err)
+		return false
+	}
+	return size < rs.maxBatch
+}
+
+// nextBatch returns the entries to send starting with head, the entry at the front of the queue. If
+// the endpoint sends batches, it's followed by up to maxBatch-1 more queued entries, stopping before
+// any that was already sent or is stale, which are handled individually.
+func (rs *RetryingSender) nextBatch(head *queueEntry) []*queueEntry {
+	batch := []*queueEntry{head}
+	if rs.batcher == nil || (rs.quarantineN > 0 && head.Attempts > 0) {
+		return batch
+	}
+	var queued []*queueEntry
+	if err := rs.queue.PeekN(rs.maxBatch, &queued); err != nil {
+		glog.Errorf("RetryingSender.maybeSend: loading batch from retry queue: %+v", err)
+		return batch
+	}
+	for _, entry := range queued[1:] {
+		if rs.ledger.contains(entry.Report.Id, rs.clock.Now()) || rs.isStale(entry) {
+			break
+		}
+		batch = append(batch, entry)
+	}
+	return batch
+}
+
+// send sends batch's reports: with the endpoint's SendBatch if there's more than one, or with Send.
+func (rs *RetryingSender) send(batch []*queueEntry) error {
+	if len(batch) == 1 {
+		return rs.endpoint.Send(batch[0].Report)
+	}
+	reports := make([]pipeline.EndpointReport, len(batch))
+	for i, entry := range batch {
+		reports[i] = entry.Report
+	}
+	return rs.batcher.SendBatch(reports)
+}
+
+// isPoison returns true if batch is a single report that has failed enough consecutive times with
+// the same error to be quarantined.
+func (rs *RetryingSender) isPoison(batch []*queueEntry) bool {
+	return rs.quarantineN > 0 && len(batch) == 1 && batch[0].Repeats >= rs.quarantineN
+}
+
+// quarantineEntry adds entry to the quarantine queue. The caller removes it from the retry queue.
+func (rs *RetryingSender) quarantineEntry(entry *queueEntry, now time.Time) {
+	q := quarantinedEntry{
+		Report:         entry.Report,
+		Error:          entry.LastError,
+		Attempts:       entry.Attempts + 1,
+		QuarantineTime: now,
+	}
+	if err := rs.quarantine.Enqueue(q); err != nil {
+		glog.Errorf("RetryingSender.maybeSend: quarantining report %v: %+v", entry.Report.Id, err)
+		rs.recorder.PersistFailed(quarantinePersistenceName(rs.endpoint.Name()))
+	}
+}
+
+// isStale returns true if entry has outlived its metric's TTL. TTLs may be keyed by metric name
+// patterns; see metrics.BestMatch.
+func (rs *RetryingSender) isStale(entry *queueEntry) bool {
+	if len(rs.ttls) == 0 || entry.IngestTime.IsZero() {
+		return false
+	}
+	match, ok := rs.ttlNames.Match(entry.Report.Name)
+	if !ok || rs.ttls[match] <= 0 {
+		return false
+	}
+	return rs.clock.Now().Sub(entry.IngestTime) > rs.ttls[match]
+}
+
+func newTTLMatcher(ttls map[string]time.Duration) *metrics.Matcher {
+	names := make([]string, 0, len(ttls))
+	for name := range ttls {
+		names = append(names, name)
+	}
+	return metrics.NewMatcher(names)
+}
+
+// enqueue adds entry to the back of the retry queue, unless the queue is full. The queue's length is
+// loaded from persistence once and tracked from then on, since loading it decodes the whole queue.
+func (rs *RetryingSender) enqueue(entry queueEntry) error {
+	if rs.maxSize > 0 {
+		if _, err := rs.length(); err != nil {
+			return err
+		}
+		if rs.queueLen >= rs.maxSize {
+			err := fmt.Errorf("RetryingSender: retry queue for endpoint %v is full (%v reports)", rs.endpoint.Name(), rs.queueLen)
+			return &pipeline.ReportError{Kind: pipeline.ErrBackpressure, Name: entry.Report.Name, Err: err}
+		}
+	}
+	if err := rs.queue.Enqueue(entry); err != nil {
+		rs.recorder.PersistFailed(persistenceName(rs.endpoint.Name()))
+		return err
+	}
+	if rs.queueLen >= 0 {
+		rs.queueLen++
+	}
+	return nil
+}
+
+// length returns the length of the retry queue, loading it from persistence on first use.
+func (rs *RetryingSender) length() (int, error) {
+	if rs.queueLen < 0 {
+		size, err := rs.queue.Len()
+		if err != nil {
+			return 0, err
+		}
+		rs.queueLen = size
+	}
+	return rs.queueLen, nil
+}
+
+// restoreRetry loads the retry state of the report at the head of the queue, if it has already been
+// attempted, so that the next attempt happens at its persisted retry time.
+func (rs *RetryingSender) restoreRetry() {
+	entry := &queueEntry{}
+	if err := rs.queue.Peek(entry); err != nil {
+		if err != persistence.ErrNotFound {
+			glog.Errorf("RetryingSender: loading retry state: %+v", err)
+		}
+		return
+	}
+	if entry.Attempts == 0 {
+		return
+	}
+	rs.delay = rs.backoff(entry.Attempts)
+	rs.lastAttempt = entry.NextRetry.Add(-rs.delay)
+}
+
+// retryAfter returns the delay requested by a send error, if the endpoint is a
+// pipeline.RetryAdvisor.
+func (rs *RetryingSender) retryAfter(err error, now time.Time) (time.Duration, bool) {
+	if a, ok := rs.endpoint.(pipeline.RetryAdvisor); ok {
+		return a.RetryAfter(err, now)
+	}
+	return 0, false
+}
+
+// backoff returns the retry delay following the given number of failed attempts.
+func (rs *RetryingSender) backoff(attempts int) time.Duration {
+	delay := rs.minDelay
+	for i := 1; i < attempts && delay < rs.maxDelay; i++ {
+		delay *= 2
+	}
+	return bounded(delay, rs.minDelay, rs.maxDelay)
+}
+
 func bounded(val, min, max time.Duration) time.Duration {
 	if val < min {
 		return min
@@ -246,3 +659,11 @@ func bounded(val, min, max time.Duration) time.Duration {
 func persistenceName(name string) string {
 	return path.Join(persistPrefix, name)
 }
+
+func ledgerPersistenceName(name string) string {
+	return path.Join(ledgerPersistPrefix, name)
+}
+
+func quarantinePersistenceName(name string) string {
+	return path.Join(quarantinePrefix, name)
+}
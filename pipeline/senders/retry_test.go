@@ -16,20 +16,100 @@ package senders
 
 import (
 	"errors"
+	"net/http"
 	"reflect"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/metrics"
 	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/endpoints"
 	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+	"google.golang.org/api/googleapi"
 )
 
 const (
 	testMinDelay = 2 * time.Second
 	testMaxDelay = 60 * time.Second
+
+	testLedgerSize = 100
+	testLedgerTTL  = 24 * time.Hour
+
+	testMaxQueueSize = 100
+	testMaxQueueTime = 3 * time.Hour
+	testBatchDelay   = time.Second
 )
 
+// batchingEndpoint is a MockEndpoint that's a pipeline.Batcher, recording the size of each batch.
+type batchingEndpoint struct {
+	*testlib.MockEndpoint
+	maxBatch int
+
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (ep *batchingEndpoint) SendBatch(reports []pipeline.EndpointReport) error {
+	ep.mu.Lock()
+	ep.sizes = append(ep.sizes, len(reports))
+	ep.mu.Unlock()
+	for _, r := range reports {
+		if err := ep.Send(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ep *batchingEndpoint) MaxBatch() int {
+	return ep.maxBatch
+}
+
+func (ep *batchingEndpoint) batchSizes() []int {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return append([]int(nil), ep.sizes...)
+}
+
+// poisonEndpoint is a MockEndpoint that fails to send the report with a given ID, as if it couldn't
+// be serialized.
+type poisonEndpoint struct {
+	*testlib.MockEndpoint
+	poison string
+}
+
+func (ep *poisonEndpoint) Send(report pipeline.EndpointReport) error {
+	if report.Id == ep.poison {
+		ep.MockEndpoint.SetSendErr(errors.New("serializing report: unsupported value"))
+		defer ep.MockEndpoint.SetSendErr(nil)
+	}
+	return ep.MockEndpoint.Send(report)
+}
+
+// retryAfterEndpoint is a MockEndpoint that's a pipeline.RetryAdvisor, honoring the Retry-After
+// header of a googleapi.Error like the HTTP endpoints do.
+type retryAfterEndpoint struct {
+	*testlib.MockEndpoint
+}
+
+func (ep *retryAfterEndpoint) RetryAfter(err error, now time.Time) (time.Duration, bool) {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok || gerr.Code != http.StatusTooManyRequests {
+		return 0, false
+	}
+	value := gerr.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
 func TestRetryingSender(t *testing.T) {
 	report1 := metrics.StampedMetricReport{
 		Id: "report1",
@@ -63,7 +143,7 @@ func TestRetryingSender(t *testing.T) {
 		persist := persistence.NewMemoryPersistence()
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
-		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		buildErr := errors.New("build failure")
 		ep.SetBuildErr(buildErr)
 		err := rs.Send(report1)
@@ -76,7 +156,7 @@ func TestRetryingSender(t *testing.T) {
 		persist := persistence.NewMemoryPersistence()
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
-		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		mc.SetNow(time.Unix(2000, 0))
 		ep.DoAndWait(t, 1, func() {
 			if err := rs.Send(report1); err != nil {
@@ -94,7 +174,7 @@ func TestRetryingSender(t *testing.T) {
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
 		ep.SetSendErr(errors.New("send failure"))
-		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		now := time.Unix(3000, 0)
 		mc.SetNow(now)
 		if err := rs.Send(report1); err != nil {
@@ -117,11 +197,57 @@ func TestRetryingSender(t *testing.T) {
 		}
 	})
 
+	t.Run("retry waits for the endpoint's Retry-After delay", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mockep := testlib.NewMockEndpoint("mockep")
+		ep := &retryAfterEndpoint{mockep}
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		now := time.Unix(5000, 0)
+		mc.SetNow(now)
+
+		// A 429 asking for 30 seconds delays the retry past the 2 second backoff.
+		mockep.SetSendErr(&googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"30"}}})
+		mockep.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		expectedNext := now.Add(30 * time.Second)
+		now = waitForNewTimer(mc, expectedNext, expectedNext.Add(1*time.Second), t)
+
+		// An HTTP date is measured from the sender's clock.
+		date := now.Add(45 * time.Second).UTC().Format(http.TimeFormat)
+		mockep.SetSendErr(&googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {date}}})
+		mockep.DoAndWait(t, 2, func() {
+			mc.SetNow(now)
+		})
+		expectedNext = now.Add(44 * time.Second)
+		now = waitForNewTimer(mc, expectedNext, expectedNext.Add(2*time.Second), t)
+
+		// A shorter Retry-After doesn't shorten the exponential backoff, which is now 8 seconds.
+		mockep.SetSendErr(&googleapi.Error{Code: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"1"}}})
+		mockep.DoAndWait(t, 3, func() {
+			mc.SetNow(now)
+		})
+		expectedNext = now.Add(8 * time.Second)
+		now = waitForNewTimer(mc, expectedNext, expectedNext.Add(1*time.Second), t)
+
+		mockep.SetSendErr(nil)
+		mockep.DoAndWait(t, 4, func() {
+			mc.SetNow(now)
+		})
+		if want, got := 1, len(mockep.Reports()); want != got {
+			t.Fatalf("Report count: want=%v, got=%v", want, got)
+		}
+		rs.Release()
+	})
+
 	t.Run("queue is cleared after success", func(t *testing.T) {
 		persist := persistence.NewMemoryPersistence()
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
-		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		ep.SetSendErr(errors.New("send failure"))
 		mc.SetNow(time.Unix(4000, 0))
 
@@ -158,7 +284,7 @@ func TestRetryingSender(t *testing.T) {
 		persist := persistence.NewMemoryPersistence()
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
-		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		ep.SetSendErr(errors.New("non-fatal"))
 		mc.SetNow(time.Unix(4000, 0))
 
@@ -205,12 +331,53 @@ func TestRetryingSender(t *testing.T) {
 		}
 	})
 
+	t.Run("classified permanent error bypasses retries", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mockep := testlib.NewMockEndpoint("mockep")
+		ep := endpoints.NewClassifyingEndpoint(mockep, endpoints.NewStatusCodeClassifier(nil, []int{400}))
+		sr := testlib.NewMockStatsRecorder()
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		now := time.Unix(4000, 0)
+		mc.SetNow(now)
+
+		// A 400 is classified as permanent, so the report is dropped after a single attempt.
+		mockep.SetSendErr(&googleapi.Error{Code: 400})
+		sr.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		if want, got := []testlib.RecordedEntry{{Id: report1.Id, Handler: "mockep"}}, sr.Failed(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.failed: want=%+v, got=%+v", want, got)
+		}
+		if want, got := int32(1), mockep.Calls(); want != got {
+			t.Fatalf("Expected %v send calls, got: %v", want, got)
+		}
+
+		// A 500 isn't overridden, and the endpoint considers it transient, so it's retried.
+		mockep.SetSendErr(&googleapi.Error{Code: 500})
+		mockep.DoAndWait(t, 2, func() {
+			if err := rs.Send(report2); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		expectedNext := now.Add(testMinDelay)
+		mockep.DoAndWait(t, 3, func() {
+			mc.SetNow(waitForNewTimer(mc, expectedNext, expectedNext.Add(1*time.Second), t))
+		})
+		if want, got := 1, len(sr.Failed()); want != got {
+			t.Fatalf("len(sr.failed): want=%+v, got=%+v", want, got)
+		}
+		rs.Release()
+	})
+
 	t.Run("failing entry expires", func(t *testing.T) {
 		persist := persistence.NewMemoryPersistence()
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
 		sr := testlib.NewMockStatsRecorder()
-		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		ep.SetSendErr(errors.New("send failure"))
 		mc.SetNow(time.Unix(4000, 0))
 
@@ -258,7 +425,7 @@ func TestRetryingSender(t *testing.T) {
 		persist := persistence.NewMemoryPersistence()
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
-		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		ep.SetSendErr(errors.New("send failure"))
 		mc.SetNow(time.Unix(5000, 0))
 
@@ -274,7 +441,7 @@ func TestRetryingSender(t *testing.T) {
 		ep = testlib.NewMockEndpoint("mockep")
 		ep.DoAndWait(t, 1, func() {
 			mc.SetNow(time.Unix(5500, 0))
-			rs = newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay)
+			rs = newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		})
 
 		// The sender should have cleared its queue. Our sent chan should be length 2.
@@ -283,12 +450,604 @@ func TestRetryingSender(t *testing.T) {
 		}
 	})
 
+	t.Run("retries resume on schedule after restart", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		ep := testlib.NewMockEndpoint("mockep")
+		ep.SetSendErr(errors.New("send failure"))
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		now := time.Unix(5000, 0)
+		mc.SetNow(now)
+
+		// Fail twice, leaving the next retry 4 seconds after the second attempt.
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		now = waitForNewTimer(mc, now.Add(2*time.Second), now.Add(3*time.Second), t)
+		ep.DoAndWait(t, 2, func() {
+			mc.SetNow(now)
+		})
+		waitForNewTimer(mc, now.Add(4*time.Second), now.Add(5*time.Second), t)
+		rs.Release()
+
+		entry := queueEntry{}
+		if err := persist.Queue(persistenceName("mockep")).Peek(&entry); err != nil {
+			t.Fatalf("Unexpected error loading queue: %+v", err)
+		}
+		if want, got := 2, entry.Attempts; want != got {
+			t.Fatalf("entry.Attempts: want=%v, got=%v", want, got)
+		}
+		if want, got := now.Add(4*time.Second), entry.NextRetry; !want.Equal(got) {
+			t.Fatalf("entry.NextRetry: want=%v, got=%v", want, got)
+		}
+
+		// A new sender restarting before the next retry time waits for it rather than sending
+		// immediately, and continues the backoff from the persisted attempt count. A new clock is used
+		// so that timers left by the previous sender aren't mistaken for the new sender's.
+		mc = testlib.NewMockClock()
+		ep = testlib.NewMockEndpoint("mockep")
+		ep.SetSendErr(errors.New("send failure"))
+		mc.SetNow(now.Add(1 * time.Second))
+		rs = newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		now = waitForNewTimer(mc, now.Add(4*time.Second), now.Add(5*time.Second), t)
+		if want, got := int32(0), ep.Calls(); want != got {
+			t.Fatalf("Expected %v send calls, got: %v", want, got)
+		}
+		ep.DoAndWait(t, 1, func() {
+			mc.SetNow(now)
+		})
+		waitForNewTimer(mc, now.Add(8*time.Second), now.Add(9*time.Second), t)
+
+		// Once the endpoint recovers, the report is sent and removed from the queue.
+		ep.SetSendErr(nil)
+		ep.DoAndWait(t, 2, func() {
+			mc.SetNow(now.Add(9 * time.Second))
+		})
+		rs.Release()
+		if err := persist.Queue(persistenceName("mockep")).Peek(&entry); err != persistence.ErrNotFound {
+			t.Fatalf("Expected empty queue, got: %+v", err)
+		}
+	})
+
+	t.Run("retry queue is bounded", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		ep := testlib.NewMockEndpoint("mockep")
+		ep.SetSendErr(errors.New("send failure"))
+		sr := testlib.NewMockStatsRecorder()
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, 2, testBatchDelay, 0, 0, nil, nil)
+		defer rs.Release()
+		mc.SetNow(time.Unix(5000, 0))
+
+		if err := rs.Send(report1); err != nil {
+			t.Fatalf("Unexpected send error: %+v", err)
+		}
+		if err := rs.Send(report2); err != nil {
+			t.Fatalf("Unexpected send error: %+v", err)
+		}
+		sr.DoAndWait(t, 1, func() {
+			if err := rs.Send(report3); !errors.Is(err, pipeline.ErrBackpressure) {
+				t.Fatalf("Expected a backpressure error sending to a full queue, got: %+v", err)
+			}
+		})
+		if want, got := []testlib.RecordedEntry{{Id: report3.Id, Handler: "mockep"}}, sr.Failed(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.failed: want=%+v, got=%+v", want, got)
+		}
+
+		// Once the queue drains, there's room again.
+		ep.DoAndWait(t, 3, func() {
+			ep.SetSendErr(nil)
+			mc.SetNow(time.Unix(5500, 0))
+		})
+		ep.DoAndWait(t, 4, func() {
+			if err := rs.Send(report3); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+	})
+
+	t.Run("previously sent reports are skipped after restart", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mc.SetNow(time.Unix(5000, 0))
+		ep := testlib.NewMockEndpoint("mockep")
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		rs.Release()
+
+		// A new sender with the same persistence should skip report1, but still send report2.
+		ep = testlib.NewMockEndpoint("mockep")
+		sr := testlib.NewMockStatsRecorder()
+		rs = newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		sr.DoAndWait(t, 2, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+			if err := rs.Send(report2); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		rs.Release()
+
+		if got := ep.Reports(); len(got) != 1 || got[0].Id != report2.Id {
+			t.Fatalf("sent reports: want=[%v], got=%+v", report2.Id, got)
+		}
+		if want, got := []testlib.RecordedEntry{{Id: report1.Id, Handler: "mockep"}, {Id: report2.Id, Handler: "mockep"}}, sr.Succeeded(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.succeeded: want=%+v, got=%+v", want, got)
+		}
+
+		// Once the ledger's TTL has elapsed, report1 is no longer considered a duplicate.
+		mc.SetNow(time.Unix(5000, 0).Add(testLedgerTTL + time.Second))
+		ep = testlib.NewMockEndpoint("mockep")
+		rs = newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		rs.Release()
+	})
+
+	t.Run("sent ledger is bounded", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		now := time.Unix(5000, 0)
+		l := newSentLedger(persist.Value("ledger"), 2, testLedgerTTL)
+		for _, id := range []string{"a", "b", "c"} {
+			if err := l.add(id, now); err != nil {
+				t.Fatalf("Unexpected ledger error: %+v", err)
+			}
+		}
+
+		// The oldest entry is discarded, and the bound also applies to the reloaded ledger.
+		l = newSentLedger(persist.Value("ledger"), 2, testLedgerTTL)
+		if l.contains("a", now) {
+			t.Fatal("expected ledger to discard oldest entry")
+		}
+		if !l.contains("b", now) || !l.contains("c", now) {
+			t.Fatal("expected ledger to contain most recent entries")
+		}
+	})
+
+	t.Run("send latency is recorded", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		ep := testlib.NewMockEndpoint("mockep")
+		ep.SetSendErr(errors.New("send failure"))
+		sr := testlib.NewMockStatsRecorder()
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		defer rs.Release()
+
+		// The report was ingested 10 seconds before it's first sent, and the first send fails.
+		ingested := report1
+		ingested.IngestTime = time.Unix(4990, 0)
+		now := time.Unix(5000, 0)
+		mc.SetNow(now)
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(ingested); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		now = waitForNewTimer(mc, now.Add(testMinDelay), now.Add(testMinDelay+time.Second), t)
+		ep.SetSendErr(nil)
+		sr.DoAndWait(t, 1, func() {
+			mc.SetNow(now)
+		})
+
+		// A report without an ingest time doesn't record latency.
+		sr.DoAndWait(t, 2, func() {
+			if err := rs.Send(report2); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+
+		want := []testlib.RecordedLatency{{Metric: "int-metric", Handler: "mockep", Latency: now.Sub(ingested.IngestTime)}}
+		if got := sr.Latencies(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.latencies: want=%+v, got=%+v", want, got)
+		}
+	})
+
+	t.Run("stale report is dropped", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		ep := testlib.NewMockEndpoint("mockep")
+		ep.SetSendErr(errors.New("send failure"))
+		sr := testlib.NewMockStatsRecorder()
+		ttls := map[string]time.Duration{"int-metric": time.Minute, "other-*": 0}
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, ttls, nil)
+		defer rs.Release()
+
+		// The first attempt fails, leaving the report queued.
+		ingested := report1
+		ingested.IngestTime = time.Unix(5000, 0)
+		now := time.Unix(5000, 0)
+		mc.SetNow(now)
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(ingested); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+
+		// By the time the retry is due, the report has outlived its TTL.
+		ep.SetSendErr(nil)
+		waitForNewTimer(mc, now.Add(testMinDelay), now.Add(testMinDelay+time.Second), t)
+		sr.DoAndWait(t, 1, func() {
+			mc.SetNow(now.Add(2 * time.Minute))
+		})
+		if want, got := []testlib.RecordedEntry{{Id: report1.Id, Handler: "mockep"}}, sr.Stale(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.stale: want=%+v, got=%+v", want, got)
+		}
+		if want, got := 0, len(ep.Reports()); want != got {
+			t.Fatalf("len(ep.Reports()): want=%+v, got=%+v", want, got)
+		}
+		if want, got := 0, len(sr.Failed()); want != got {
+			t.Fatalf("len(sr.failed): want=%+v, got=%+v", want, got)
+		}
+
+		// A report within its TTL is still sent.
+		fresh := report2
+		fresh.IngestTime = now.Add(2 * time.Minute)
+		sr.DoAndWait(t, 2, func() {
+			if err := rs.Send(fresh); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		if want, got := 1, len(ep.Reports()); want != got {
+			t.Fatalf("len(ep.Reports()): want=%+v, got=%+v", want, got)
+		}
+	})
+
+	t.Run("paused senders queue reports until resumed", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mc.SetNow(time.Unix(5000, 0))
+		pause := NewSwitch(true)
+		ep1 := testlib.NewMockEndpoint("ep1")
+		ep2 := testlib.NewMockEndpoint("ep2")
+		rs1 := newRetryingSender(ep1, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, pause)
+		rs2 := newRetryingSender(ep2, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, pause)
+		defer rs1.Release()
+		defer rs2.Release()
+
+		for _, r := range []metrics.StampedMetricReport{report1, report2} {
+			for _, rs := range []*RetryingSender{rs1, rs2} {
+				if err := rs.Send(r); err != nil {
+					t.Fatalf("Unexpected send error: %+v", err)
+				}
+			}
+		}
+		if want, got := int32(0), ep1.Calls()+ep2.Calls(); want != got {
+			t.Fatalf("Expected %v send calls while paused, got: %v", want, got)
+		}
+		for _, name := range []string{"ep1", "ep2"} {
+			if size, err := persist.Queue(persistenceName(name)).Len(); err != nil || size != 2 {
+				t.Fatalf("%v queue: want 2 reports, got: %v (err: %v)", name, size, err)
+			}
+		}
+
+		// Resuming sends the backlog to every endpoint.
+		ep1.DoAndWait(t, 2, func() {
+			ep2.DoAndWait(t, 2, pause.Resume)
+		})
+		if want, got := 2, len(ep1.Reports()); want != got {
+			t.Fatalf("len(ep1.Reports()): want=%v, got=%v", want, got)
+		}
+		if want, got := 2, len(ep2.Reports()); want != got {
+			t.Fatalf("len(ep2.Reports()): want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("pending retry waits for resume", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mc.SetNow(time.Unix(5000, 0))
+		pause := NewSwitch(false)
+		ep := testlib.NewMockEndpoint("mockep")
+		ep.SetSendErr(errors.New("send failure"))
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, pause)
+		defer rs.Release()
+
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+
+		// The retry comes due while paused, so it isn't attempted.
+		pause.Pause()
+		ep.SetSendErr(nil)
+		mc.SetNow(time.Unix(5500, 0))
+		if want, got := int32(1), ep.Calls(); want != got {
+			t.Fatalf("Expected %v send calls while paused, got: %v", want, got)
+		}
+
+		// Resuming attempts the overdue retry.
+		ep.DoAndWait(t, 2, pause.Resume)
+		if want, got := 1, len(ep.Reports()); want != got {
+			t.Fatalf("len(ep.Reports()): want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("reports are batched", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mc.SetNow(time.Unix(6000, 0))
+		ep := &batchingEndpoint{MockEndpoint: testlib.NewMockEndpoint("mockep"), maxBatch: 3}
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+		defer rs.Release()
+
+		// The first two reports wait for a full batch.
+		for _, r := range []metrics.StampedMetricReport{report1, report2} {
+			if err := rs.Send(r); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		}
+		if want, got := int32(0), ep.Calls(); want != got {
+			t.Fatalf("Expected %v send calls before the batch is full, got: %v", want, got)
+		}
+
+		// The third fills the batch, which is sent at once.
+		ep.DoAndWait(t, 3, func() {
+			if err := rs.Send(report3); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		if want, got := []int{3}, ep.batchSizes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("batch sizes: want=%v, got=%v", want, got)
+		}
+
+		// A lone report is sent once the batch delay has passed.
+		report4 := report1
+		report4.Id = "report4"
+		if err := rs.Send(report4); err != nil {
+			t.Fatalf("Unexpected send error: %+v", err)
+		}
+		ep.DoAndWait(t, 4, func() {
+			mc.SetNow(time.Unix(6000, 0).Add(testBatchDelay))
+		})
+		if want, got := 4, len(ep.Reports()); want != got {
+			t.Fatalf("len(ep.Reports()): want=%v, got=%v", want, got)
+		}
+		if want, got := []int{3}, ep.batchSizes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("batch sizes: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("batch settings are independent per endpoint", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		start := time.Unix(7000, 0)
+		mc.SetNow(start)
+
+		// A dashboard endpoint sends small batches often; a warehouse endpoint sends large ones rarely.
+		// Both endpoints would accept batches of 10.
+		dashboard := &batchingEndpoint{MockEndpoint: testlib.NewMockEndpoint("dashboard"), maxBatch: 10}
+		warehouse := &batchingEndpoint{MockEndpoint: testlib.NewMockEndpoint("warehouse"), maxBatch: 10}
+		rs1 := newRetryingSender(dashboard, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, 100*time.Millisecond, 2, 0, nil, nil)
+		defer rs1.Release()
+		rs2 := newRetryingSender(warehouse, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, time.Minute, 0, 0, nil, nil)
+		defer rs2.Release()
+
+		// The dashboard's batches are full at 2 reports; the warehouse keeps waiting.
+		dashboard.DoAndWait(t, 2, func() {
+			for _, r := range []metrics.StampedMetricReport{report1, report2, report3} {
+				if err := rs1.Send(r); err != nil {
+					t.Fatalf("Unexpected send error: %+v", err)
+				}
+				if err := rs2.Send(r); err != nil {
+					t.Fatalf("Unexpected send error: %+v", err)
+				}
+			}
+		})
+		if want, got := []int{2}, dashboard.batchSizes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("dashboard batch sizes: want=%v, got=%v", want, got)
+		}
+
+		// The dashboard's remaining report is sent after its flush interval.
+		dashboard.DoAndWait(t, 3, func() {
+			mc.SetNow(start.Add(100 * time.Millisecond))
+		})
+		if want, got := int32(0), warehouse.Calls(); want != got {
+			t.Fatalf("Expected %v warehouse send calls before its flush interval, got: %v", want, got)
+		}
+
+		// The warehouse sends all of its reports in one batch after its flush interval.
+		warehouse.DoAndWait(t, 3, func() {
+			mc.SetNow(start.Add(time.Minute))
+		})
+		if want, got := []int{3}, warehouse.batchSizes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("warehouse batch sizes: want=%v, got=%v", want, got)
+		}
+		if want, got := []int{2}, dashboard.batchSizes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("dashboard batch sizes: want=%v, got=%v", want, got)
+		}
+	})
+
+	t.Run("pending batches are sent on release", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mc.SetNow(time.Unix(8000, 0))
+		ep := &batchingEndpoint{MockEndpoint: testlib.NewMockEndpoint("mockep"), maxBatch: 10}
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, time.Hour, 0, 0, nil, nil)
+
+		for _, r := range []metrics.StampedMetricReport{report1, report2} {
+			if err := rs.Send(r); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		}
+		if want, got := int32(0), ep.Calls(); want != got {
+			t.Fatalf("Expected %v send calls before release, got: %v", want, got)
+		}
+		if err := rs.Release(); err != nil {
+			t.Fatalf("Unexpected release error: %+v", err)
+		}
+		if want, got := []int{2}, ep.batchSizes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("batch sizes: want=%v, got=%v", want, got)
+		}
+		if size, err := persist.Queue(persistenceName("mockep")).Len(); err != nil || size != 0 {
+			t.Fatalf("Expected an empty retry queue after release, got: %v (%v)", size, err)
+		}
+	})
+
+	t.Run("drain sends queued reports without waiting for a batch", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		mc.SetNow(time.Unix(8500, 0))
+		ep := &batchingEndpoint{MockEndpoint: testlib.NewMockEndpoint("mockep"), maxBatch: 10}
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, time.Hour, 0, 0, nil, nil)
+
+		for _, r := range []metrics.StampedMetricReport{report1, report2} {
+			if err := rs.Send(r); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		}
+		if err := rs.Drain(time.Minute); err != nil {
+			t.Fatalf("Unexpected drain error: %+v", err)
+		}
+		if want, got := []int{2}, ep.batchSizes(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("batch sizes: want=%v, got=%v", want, got)
+		}
+		if size, err := persist.Queue(persistenceName("mockep")).Len(); err != nil || size != 0 {
+			t.Fatalf("Expected an empty retry queue after drain, got: %v (%v)", size, err)
+		}
+		if err := rs.Release(); err != nil {
+			t.Fatalf("Unexpected release error: %+v", err)
+		}
+		if err := rs.Drain(time.Minute); err == nil {
+			t.Fatalf("Expected an error draining a released sender")
+		}
+	})
+
+	t.Run("drain times out while the endpoint is failing", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		now := time.Unix(8700, 0)
+		mc.SetNow(now)
+		ep := testlib.NewMockEndpoint("mockep")
+		ep.SetSendErr(errors.New("send failure"))
+		rs := newRetryingSender(ep, persist, testlib.NewMockStatsRecorder(), mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
+
+		if err := rs.Send(report1); err != nil {
+			t.Fatalf("Unexpected send error: %+v", err)
+		}
+		result := make(chan error)
+		go func() {
+			result <- rs.Drain(time.Second)
+		}()
+		// The drain deadline comes before the first retry.
+		deadline := waitForNewTimer(mc, now.Add(time.Second), now.Add(time.Second+time.Millisecond), t)
+		mc.SetNow(deadline)
+		if err := <-result; err == nil {
+			t.Fatalf("Expected a drain timeout error")
+		}
+		if err := rs.Release(); err != nil {
+			t.Fatalf("Unexpected release error: %+v", err)
+		}
+		if size, err := persist.Queue(persistenceName("mockep")).Len(); err != nil || size != 1 {
+			t.Fatalf("Expected the failing report to stay queued, got: %v (%v)", size, err)
+		}
+	})
+
+	t.Run("poison reports are quarantined", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		start := time.Unix(9000, 0)
+		mc.SetNow(start)
+		ep := &poisonEndpoint{MockEndpoint: testlib.NewMockEndpoint("mockep"), poison: report1.Id}
+		sr := testlib.NewMockStatsRecorder()
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 3, nil, nil)
+		defer rs.Release()
+
+		// The poison report fails, holding up the report behind it.
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		if err := rs.Send(report2); err != nil {
+			t.Fatalf("Unexpected send error: %+v", err)
+		}
+		ep.DoAndWait(t, 2, func() {
+			mc.SetNow(start.Add(time.Minute))
+		})
+		if want, got := 0, len(ep.Reports()); want != got {
+			t.Fatalf("len(ep.Reports()): want=%v, got=%v", want, got)
+		}
+
+		// Its third failure quarantines it, and the next report is sent.
+		sr.DoAndWait(t, 2, func() {
+			mc.SetNow(start.Add(2 * time.Minute))
+		})
+		if want, got := []testlib.RecordedEntry{{Id: report1.Id, Handler: "mockep"}}, sr.Failed(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.Failed(): want=%+v, got=%+v", want, got)
+		}
+		if want, got := []testlib.RecordedEntry{{Id: report2.Id, Handler: "mockep"}}, sr.Succeeded(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.Succeeded(): want=%+v, got=%+v", want, got)
+		}
+
+		var quarantined quarantinedEntry
+		if err := persist.Queue(quarantinePersistenceName("mockep")).Peek(&quarantined); err != nil {
+			t.Fatalf("Unexpected error loading quarantined report: %+v", err)
+		}
+		if want, got := report1.Id, quarantined.Report.Id; want != got {
+			t.Fatalf("quarantined report: want=%v, got=%v", want, got)
+		}
+		if want, got := "serializing report: unsupported value", quarantined.Error; want != got {
+			t.Fatalf("quarantined error: want=%v, got=%v", want, got)
+		}
+		if want, got := 3, quarantined.Attempts; want != got {
+			t.Fatalf("quarantined attempts: want=%v, got=%v", want, got)
+		}
+		if size, err := persist.Queue(persistenceName("mockep")).Len(); err != nil || size != 0 {
+			t.Fatalf("Expected an empty retry queue, got: %v (%v)", size, err)
+		}
+	})
+
+	t.Run("changing errors aren't quarantined", func(t *testing.T) {
+		persist := persistence.NewMemoryPersistence()
+		mc := testlib.NewMockClock()
+		start := time.Unix(10000, 0)
+		mc.SetNow(start)
+		ep := testlib.NewMockEndpoint("mockep")
+		sr := testlib.NewMockStatsRecorder()
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 2, nil, nil)
+		defer rs.Release()
+
+		ep.SetSendErr(errors.New("connection refused"))
+		ep.DoAndWait(t, 1, func() {
+			if err := rs.Send(report1); err != nil {
+				t.Fatalf("Unexpected send error: %+v", err)
+			}
+		})
+		ep.SetSendErr(errors.New("connection reset"))
+		ep.DoAndWait(t, 2, func() {
+			mc.SetNow(start.Add(time.Minute))
+		})
+
+		// Two failures, but with different errors; the report is retried until it's sent.
+		ep.SetSendErr(nil)
+		sr.DoAndWait(t, 1, func() {
+			mc.SetNow(start.Add(2 * time.Minute))
+		})
+		if want, got := []testlib.RecordedEntry{{Id: report1.Id, Handler: "mockep"}}, sr.Succeeded(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("sr.Succeeded(): want=%+v, got=%+v", want, got)
+		}
+		if want, got := 0, len(sr.Failed()); want != got {
+			t.Fatalf("len(sr.Failed()): want=%v, got=%v", want, got)
+		}
+	})
+
 	t.Run("send stats are registered", func(t *testing.T) {
 		persist := persistence.NewMemoryPersistence()
 		mc := testlib.NewMockClock()
 		ep := testlib.NewMockEndpoint("mockep")
 		sr := testlib.NewMockStatsRecorder()
-		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persist, sr, mc, testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 		mc.SetNow(time.Unix(4000, 0))
 
 		if err := rs.Send(report1); err != nil {
@@ -335,7 +1094,7 @@ func TestRetryingSender(t *testing.T) {
 	t.Run("multiple usages", func(t *testing.T) {
 		ep := testlib.NewMockEndpoint("mockep")
 		sr := testlib.NewMockStatsRecorder()
-		rs := newRetryingSender(ep, persistence.NewMemoryPersistence(), sr, testlib.NewMockClock(), testMinDelay, testMaxDelay)
+		rs := newRetryingSender(ep, persistence.NewMemoryPersistence(), sr, testlib.NewMockClock(), testMinDelay, testMaxDelay, testMaxQueueTime, testLedgerSize, testLedgerTTL, testMaxQueueSize, testBatchDelay, 0, 0, nil, nil)
 
 		// Test multiple usages of the RetryingSender.
 		rs.Use()
@@ -0,0 +1,77 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package senders
+
+import (
+	"sync"
+)
+
+// A Switch pauses and resumes sending for the RetryingSenders that share it. While paused, senders
+// continue to queue reports, up to their maximum queue size, but don't send them. Resuming wakes each
+// sender so that it sends its backlog. A nil *Switch is never paused.
+type Switch struct {
+	mu        sync.Mutex
+	paused    bool
+	listeners []chan struct{}
+}
+
+// Pause stops sending until Resume is called.
+func (s *Switch) Pause() {
+	s.mu.Lock()
+	s.paused = true
+	s.mu.Unlock()
+}
+
+// Resume restarts sending and wakes each sender sharing the Switch.
+func (s *Switch) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = false
+	for _, l := range s.listeners {
+		// A sender that hasn't handled a previous wakeup doesn't need another one.
+		select {
+		case l <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Paused returns true if sending is paused.
+func (s *Switch) Paused() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// listen returns a channel that receives a value when sending resumes. The channel is nil, and never
+// receives, for a nil Switch.
+func (s *Switch) listen() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := make(chan struct{}, 1)
+	s.listeners = append(s.listeners, l)
+	return l
+}
+
+// NewSwitch creates a new Switch, which is initially paused if paused is true.
+func NewSwitch(paused bool) *Switch {
+	return &Switch{paused: paused}
+}
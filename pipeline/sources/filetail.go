@@ -0,0 +1,276 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/clock"
+	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+)
+
+const (
+	fileTailPersistencePrefix = "filetail/"
+	defaultFileTailPoll       = time.Second
+
+	// The number of bytes at the start of a file that identify it, to tell whether the file found
+	// after a restart is the one that was being read.
+	fileTailHeadSize = 256
+
+	// Longer lines are skipped as malformed.
+	maxFileTailLine = 1 << 20
+)
+
+// fileTailState is the persisted position of a FileTail: the offset of the first unread line, and
+// the first bytes of the file.
+type fileTailState struct {
+	Offset int64
+	Head   []byte
+}
+
+// FileTail is a pipeline.Source that follows a file of newline-delimited JSON reports, adding each
+// complete line to an Input as it's appended. The file is checked for new lines periodically. When
+// it's rotated, that is, when its path names a new file, the rest of the old file is read before
+// the new one is followed from its start; a truncated file is also followed from its start.
+//
+// The position of the first unread line is persisted after each check, so that a restarted FileTail
+// resumes where it left off, unless the file was replaced in the meantime. Reports added just
+// before a crash may be added again. Lines that aren't valid reports are skipped, and counted.
+type FileTail struct {
+	name      string
+	cfg       config.FileTail
+	input     pipeline.Input
+	value     persistence.Value
+	clock     clock.Clock
+	file      *os.File
+	info      os.FileInfo
+	state     fileTailState
+	resumed   bool
+	malformed int64
+	close     chan bool
+	wait      sync.WaitGroup
+	sdOnce    sync.Once
+}
+
+// NewFileTail creates a FileTail source with the given name, which adds reports to input and
+// persists its position in p.
+func NewFileTail(name string, cfg config.FileTail, input pipeline.Input, p persistence.Persistence) *FileTail {
+	return newFileTail(name, cfg, input, p, clock.NewClock())
+}
+
+func newFileTail(name string, cfg config.FileTail, input pipeline.Input, p persistence.Persistence, clock clock.Clock) *FileTail {
+	input.Use()
+	t := &FileTail{
+		name:  name,
+		cfg:   cfg,
+		input: input,
+		value: p.Value(fileTailPersistencePrefix + name),
+		clock: clock,
+		close: make(chan bool, 1),
+	}
+	if err := t.value.Load(&t.state); err != nil && err != persistence.ErrNotFound {
+		glog.Errorf("fileTail %v: loading position: %+v", name, err)
+	}
+	t.wait.Add(1)
+	go t.run()
+	return t
+}
+
+// Malformed returns the number of lines that were skipped because they aren't valid reports.
+func (t *FileTail) Malformed() int64 {
+	return atomic.LoadInt64(&t.malformed)
+}
+
+func (t *FileTail) Shutdown() (err error) {
+	t.sdOnce.Do(func() {
+		t.close <- true
+		t.wait.Wait()
+		if t.file != nil {
+			t.file.Close()
+		}
+		err = t.input.Release()
+	})
+	return
+}
+
+func (t *FileTail) run() {
+	interval := defaultFileTailPoll
+	if t.cfg.PollIntervalMillis > 0 {
+		interval = time.Duration(t.cfg.PollIntervalMillis) * time.Millisecond
+	}
+	running := true
+	for running {
+		timer := t.clock.NewTimer(interval)
+		select {
+		case <-timer.GetC():
+			t.poll()
+		case <-t.close:
+			running = false
+		}
+		timer.Stop()
+	}
+	t.wait.Done()
+}
+
+// poll adds the lines appended since the last poll.
+func (t *FileTail) poll() {
+	if t.file == nil && !t.open() {
+		return
+	}
+	if info, err := t.file.Stat(); err == nil && t.truncated(info) {
+		glog.Warningf("fileTail %v: %v was truncated; reading from its start", t.name, t.cfg.Path)
+		t.state = fileTailState{}
+	}
+	// Finish the open file, even if it has been rotated away, before checking for a new one.
+	t.read()
+	if info, err := os.Stat(t.cfg.Path); err == nil && !os.SameFile(info, t.info) {
+		glog.Infof("fileTail %v: %v was rotated; reading the new file", t.name, t.cfg.Path)
+		t.file.Close()
+		t.file = nil
+		t.state = fileTailState{}
+		if t.open() {
+			t.read()
+		}
+	}
+}
+
+// open opens the file. The first time, it resumes from the persisted position if the file is the
+// one that was being read.
+func (t *FileTail) open() bool {
+	f, err := os.Open(t.cfg.Path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("fileTail %v: opening %v: %+v", t.name, t.cfg.Path, err)
+		}
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		glog.Warningf("fileTail %v: %+v", t.name, err)
+		f.Close()
+		return false
+	}
+	t.file, t.info = f, info
+	if !t.resumed {
+		t.resumed = true
+		if t.truncated(info) {
+			glog.Warningf("fileTail %v: %v was replaced while stopped; reading from its start", t.name, t.cfg.Path)
+			t.state = fileTailState{}
+		}
+	}
+	return true
+}
+
+// truncated returns whether the open file no longer holds the data before the current offset:
+// either it's shorter than the offset, or its first bytes have changed.
+func (t *FileTail) truncated(info os.FileInfo) bool {
+	if t.state.Offset == 0 {
+		return false
+	}
+	return info.Size() < t.state.Offset || !bytes.Equal(t.head(len(t.state.Head)), t.state.Head)
+}
+
+// head returns up to n bytes from the start of the file.
+func (t *FileTail) head(n int) []byte {
+	buf := make([]byte, n)
+	read, _ := t.file.ReadAt(buf, 0)
+	return buf[:read]
+}
+
+// read adds the complete lines after the current offset, and persists the new position.
+func (t *FileTail) read() {
+	start := t.state.Offset
+	buf := make([]byte, 64*1024)
+	var line []byte
+	skipping := false
+	for {
+		n, err := t.file.ReadAt(buf, t.state.Offset+int64(len(line)))
+		chunk := buf[:n]
+		for len(chunk) > 0 {
+			i := bytes.IndexByte(chunk, '\n')
+			if i < 0 {
+				if len(line)+len(chunk) > maxFileTailLine {
+					// Skip the rest of a line that's too long. It's counted once it ends.
+					skipping = true
+					t.state.Offset += int64(len(line) + len(chunk))
+					line = line[:0]
+				} else {
+					line = append(line, chunk...)
+				}
+				break
+			}
+			line = append(line, chunk[:i]...)
+			t.state.Offset += int64(len(line) + 1)
+			if skipping {
+				t.skip("line too long")
+				skipping = false
+			} else {
+				t.add(line)
+			}
+			line = line[:0]
+			chunk = chunk[i+1:]
+		}
+		if err == io.EOF || n == 0 {
+			break
+		}
+		if err != nil {
+			glog.Warningf("fileTail %v: reading %v: %+v", t.name, t.cfg.Path, err)
+			break
+		}
+	}
+	if t.state.Offset == start {
+		return
+	}
+	if len(t.state.Head) < fileTailHeadSize {
+		n := int64(fileTailHeadSize)
+		if t.state.Offset < n {
+			n = t.state.Offset
+		}
+		t.state.Head = t.head(int(n))
+	}
+	if err := t.value.Store(t.state); err != nil {
+		glog.Errorf("fileTail %v: persisting position: %+v", t.name, err)
+	}
+}
+
+// add adds the report on a line, if any.
+func (t *FileTail) add(line []byte) {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return
+	}
+	var report metrics.MetricReport
+	if err := json.Unmarshal(line, &report); err != nil {
+		t.skip(err.Error())
+		return
+	}
+	if err := t.input.AddReport(report); err != nil {
+		glog.Errorf("fileTail %v: error adding report: %+v", t.name, err)
+	}
+}
+
+func (t *FileTail) skip(reason string) {
+	count := atomic.AddInt64(&t.malformed, 1)
+	glog.Warningf("fileTail %v: skipping malformed line (%v skipped): %v", t.name, count, reason)
+}
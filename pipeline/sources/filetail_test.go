@@ -0,0 +1,171 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/GoogleCloudPlatform/ubbagent/persistence"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestFileTail(t *testing.T) {
+	line := func(value int64) string {
+		return fmt.Sprintf(`{"name": "int-metric", "startTime": "2018-01-01T00:00:00Z", "endTime": "2018-01-01T00:00:01Z", "value": {"int64Value": %v}}`+"\n", value)
+	}
+	appendTo := func(t *testing.T, path, text string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("opening %v: %+v", path, err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(text); err != nil {
+			t.Fatalf("writing %v: %+v", path, err)
+		}
+	}
+	setup := func(t *testing.T) (string, func()) {
+		dir, err := ioutil.TempDir("", "filetail_test")
+		if err != nil {
+			t.Fatalf("creating temp dir: %+v", err)
+		}
+		return filepath.Join(dir, "usage.ndjson"), func() { os.RemoveAll(dir) }
+	}
+	// poll fires the tail's pending poll timer.
+	poll := func(t *testing.T, mc testlib.MockClock) {
+		for i := 0; i < 5000; i++ {
+			if next := mc.GetNextFireTime(); next.After(mc.Now()) {
+				mc.SetNow(next)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("no poll timer set")
+	}
+	values := func(i *testlib.MockInput) (values []int64) {
+		for _, r := range i.Reports() {
+			values = append(values, r.Value.Int64Value)
+		}
+		return
+	}
+	expectValues := func(t *testing.T, i *testlib.MockInput, expected ...int64) {
+		if got := values(i); fmt.Sprint(got) != fmt.Sprint(expected) {
+			t.Fatalf("values: expected %v, got %v", expected, got)
+		}
+	}
+
+	t.Run("appended lines are added", func(t *testing.T) {
+		path, cleanup := setup(t)
+		defer cleanup()
+		appendTo(t, path, line(1)+line(2))
+		mc := testlib.NewMockClock()
+		i := testlib.NewMockInput()
+		ft := newFileTail("tail", config.FileTail{Path: path}, i, persistence.NewMemoryPersistence(), mc)
+		defer ft.Shutdown()
+
+		i.DoAndWait(t, 2, func() { poll(t, mc) })
+		expectValues(t, i, 1, 2)
+
+		// A partial line is added once it's complete.
+		partial := line(4)
+		appendTo(t, path, line(3)+partial[:10])
+		i.DoAndWait(t, 3, func() { poll(t, mc) })
+		expectValues(t, i, 3)
+		appendTo(t, path, partial[10:])
+		i.DoAndWait(t, 4, func() { poll(t, mc) })
+		expectValues(t, i, 4)
+	})
+
+	t.Run("malformed lines are skipped", func(t *testing.T) {
+		path, cleanup := setup(t)
+		defer cleanup()
+		appendTo(t, path, line(1)+"not json\n\n"+line(2))
+		mc := testlib.NewMockClock()
+		i := testlib.NewMockInput()
+		ft := newFileTail("tail", config.FileTail{Path: path}, i, persistence.NewMemoryPersistence(), mc)
+		defer ft.Shutdown()
+
+		i.DoAndWait(t, 2, func() { poll(t, mc) })
+		expectValues(t, i, 1, 2)
+		if want, got := int64(1), ft.Malformed(); want != got {
+			t.Fatalf("Malformed: expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("rotated and truncated files are followed", func(t *testing.T) {
+		path, cleanup := setup(t)
+		defer cleanup()
+		appendTo(t, path, line(1))
+		mc := testlib.NewMockClock()
+		i := testlib.NewMockInput()
+		ft := newFileTail("tail", config.FileTail{Path: path}, i, persistence.NewMemoryPersistence(), mc)
+		defer ft.Shutdown()
+		i.DoAndWait(t, 1, func() { poll(t, mc) })
+		expectValues(t, i, 1)
+
+		// The rest of the rotated file is read before the new one.
+		appendTo(t, path, line(2))
+		if err := os.Rename(path, path+".1"); err != nil {
+			t.Fatalf("rotating: %+v", err)
+		}
+		appendTo(t, path+".1", line(3))
+		appendTo(t, path, line(4))
+		i.DoAndWait(t, 4, func() { poll(t, mc) })
+		expectValues(t, i, 2, 3, 4)
+
+		if err := os.Truncate(path, 0); err != nil {
+			t.Fatalf("truncating: %+v", err)
+		}
+		appendTo(t, path, line(5))
+		i.DoAndWait(t, 5, func() { poll(t, mc) })
+		expectValues(t, i, 5)
+	})
+
+	t.Run("restart resumes from the persisted offset", func(t *testing.T) {
+		path, cleanup := setup(t)
+		defer cleanup()
+		p := persistence.NewMemoryPersistence()
+		appendTo(t, path, line(1)+line(2))
+		mc := testlib.NewMockClock()
+		i := testlib.NewMockInput()
+		ft := newFileTail("tail", config.FileTail{Path: path}, i, p, mc)
+		i.DoAndWait(t, 2, func() { poll(t, mc) })
+		expectValues(t, i, 1, 2)
+		ft.Shutdown()
+
+		appendTo(t, path, line(3))
+		i2 := testlib.NewMockInput()
+		ft = newFileTail("tail", config.FileTail{Path: path}, i2, p, mc)
+		i2.DoAndWait(t, 1, func() { poll(t, mc) })
+		expectValues(t, i2, 3)
+		ft.Shutdown()
+
+		// A file replaced while the tail was stopped is read from its start.
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("removing: %+v", err)
+		}
+		appendTo(t, path, line(7)+line(8)+line(9)+line(10))
+		i3 := testlib.NewMockInput()
+		ft = newFileTail("tail", config.FileTail{Path: path}, i3, p, mc)
+		defer ft.Shutdown()
+		i3.DoAndWait(t, 4, func() { poll(t, mc) })
+		expectValues(t, i3, 7, 8, 9, 10)
+	})
+}
@@ -0,0 +1,137 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/clock"
+	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
+	"github.com/golang/glog"
+)
+
+// AgentVersion is the agent version included in liveness reports. It's set at link time.
+var AgentVersion = "unknown"
+
+const defaultLivenessMetric = "agent-liveness"
+
+// Liveness is a pipeline.Source that periodically sends a report about the agent itself directly
+// to an endpoint's sender. Each report has a value of 1 and covers the time since the previous one.
+// Its labels hold the agent version, the agent's uptime in seconds, and the number of reports
+// added through the Input returned by Count.
+type Liveness struct {
+	cfg       config.Liveness
+	sender    pipeline.Sender
+	clock     clock.Clock
+	started   time.Time
+	processed int64
+	close     chan bool
+	wait      sync.WaitGroup
+	sdOnce    sync.Once
+}
+
+// NewLiveness creates a Liveness that sends reports to sender, which is typically the configured
+// endpoint's RetryingSender.
+func NewLiveness(cfg config.Liveness, sender pipeline.Sender) *Liveness {
+	return newLiveness(cfg, sender, clock.NewClock())
+}
+
+func newLiveness(cfg config.Liveness, sender pipeline.Sender, clock clock.Clock) *Liveness {
+	sender.Use()
+	l := &Liveness{
+		cfg:     cfg,
+		sender:  sender,
+		clock:   clock,
+		started: clock.Now(),
+		close:   make(chan bool, 1),
+	}
+	l.wait.Add(1)
+	go l.run()
+	return l
+}
+
+// Count returns an Input that passes reports to delegate, counting those it accepts.
+func (l *Liveness) Count(delegate pipeline.Input) pipeline.Input {
+	return &countingInput{Component: delegate, delegate: delegate, count: &l.processed}
+}
+
+func (l *Liveness) Shutdown() (err error) {
+	l.sdOnce.Do(func() {
+		l.close <- true
+		l.wait.Wait()
+		err = l.sender.Release()
+	})
+	return
+}
+
+func (l *Liveness) run() {
+	interval := time.Duration(l.cfg.IntervalSeconds) * time.Second
+	start := l.started
+	end := start.Add(interval)
+	running := true
+	for running {
+		timer := l.clock.NewTimerAt(end)
+		select {
+		case <-timer.GetC():
+			if err := l.sender.Send(metrics.NewStampedMetricReport(l.report(start, end))); err != nil {
+				glog.Errorf("liveness: error sending report: %+v", err)
+			}
+			start = end
+			end = end.Add(interval)
+		case <-l.close:
+			running = false
+		}
+		timer.Stop()
+	}
+	l.wait.Done()
+}
+
+func (l *Liveness) report(start, end time.Time) metrics.MetricReport {
+	name := l.cfg.Metric
+	if name == "" {
+		name = defaultLivenessMetric
+	}
+	return metrics.MetricReport{
+		Name:      name,
+		StartTime: start,
+		EndTime:   end,
+		Value:     metrics.MetricValue{Int64Value: 1},
+		Labels: map[string]string{
+			"version":          AgentVersion,
+			"uptimeSeconds":    strconv.FormatInt(int64(end.Sub(l.started)/time.Second), 10),
+			"reportsProcessed": strconv.FormatInt(atomic.LoadInt64(&l.processed), 10),
+		},
+	}
+}
+
+// countingInput is a pipeline.Input that counts the reports its delegate accepts.
+type countingInput struct {
+	pipeline.Component
+	delegate pipeline.Input
+	count    *int64
+}
+
+func (c *countingInput) AddReport(report metrics.MetricReport) error {
+	err := c.delegate.AddReport(report)
+	if err == nil {
+		atomic.AddInt64(c.count, 1)
+	}
+	return err
+}
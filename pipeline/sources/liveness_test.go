@@ -0,0 +1,103 @@
+// Copyright 2018 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sources
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/ubbagent/config"
+	"github.com/GoogleCloudPlatform/ubbagent/metrics"
+	"github.com/GoogleCloudPlatform/ubbagent/testlib"
+)
+
+func TestLiveness(t *testing.T) {
+	cfg := config.Liveness{Endpoint: "disk", IntervalSeconds: 60}
+
+	t.Run("sender used and released", func(t *testing.T) {
+		s := testlib.NewMockSender("disk")
+		l := newLiveness(cfg, s, testlib.NewMockClock())
+		if !s.Used {
+			t.Fatalf("expected s.Used == true")
+		}
+		l.Shutdown()
+		if !s.Released {
+			t.Fatalf("expected s.Released == true")
+		}
+	})
+
+	t.Run("a report is sent each interval", func(t *testing.T) {
+		mc := testlib.NewMockClock()
+		start := mc.Now()
+		s := testlib.NewMockSender("disk")
+		l := newLiveness(cfg, s, mc)
+		defer l.Shutdown()
+
+		counted := l.Count(testlib.NewMockInput())
+		for i := 0; i < 3; i++ {
+			if err := counted.AddReport(metrics.MetricReport{Name: "int-metric"}); err != nil {
+				t.Fatalf("unexpected error: %+v", err)
+			}
+		}
+		s.DoAndWait(t, 1, func() {
+			mc.SetNow(start.Add(60 * time.Second))
+		})
+		s.DoAndWait(t, 2, func() {
+			mc.SetNow(start.Add(120 * time.Second))
+		})
+
+		reports := s.Reports()
+		if len(reports) != 2 {
+			t.Fatalf("expected 2 reports, got %v", len(reports))
+		}
+		expected := metrics.MetricReport{
+			Name:      "agent-liveness",
+			StartTime: start.Add(60 * time.Second),
+			EndTime:   start.Add(120 * time.Second),
+			Value:     metrics.MetricValue{Int64Value: 1},
+			Labels: map[string]string{
+				"version":          "unknown",
+				"uptimeSeconds":    "120",
+				"reportsProcessed": "3",
+			},
+		}
+		if !reflect.DeepEqual(expected, reports[1]) {
+			t.Fatalf("expected %+v, got %+v", expected, reports[1])
+		}
+		if reports[0].StartTime != start || reports[0].EndTime != reports[1].StartTime {
+			t.Fatalf("coverage gap: %+v", reports)
+		}
+	})
+
+	t.Run("rejected reports aren't counted", func(t *testing.T) {
+		mc := testlib.NewMockClock()
+		s := testlib.NewMockSender("disk")
+		l := newLiveness(config.Liveness{Endpoint: "disk", IntervalSeconds: 60, Metric: "alive"}, s, mc)
+		defer l.Shutdown()
+
+		i := testlib.NewMockInput()
+		i.SetAddError(errors.New("invalid report"))
+		l.Count(i).AddReport(metrics.MetricReport{Name: "int-metric"})
+		s.DoAndWait(t, 1, func() {
+			mc.SetNow(mc.Now().Add(60 * time.Second))
+		})
+		report := s.Reports()[0]
+		if report.Name != "alive" || report.Labels["reportsProcessed"] != "0" {
+			t.Fatalf("unexpected report: %+v", report)
+		}
+	})
+}
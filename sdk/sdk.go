@@ -22,21 +22,32 @@ import (
 	"github.com/GoogleCloudPlatform/ubbagent/persistence"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline"
 	"github.com/GoogleCloudPlatform/ubbagent/pipeline/builder"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/inputs"
+	"github.com/GoogleCloudPlatform/ubbagent/pipeline/senders"
 	"github.com/GoogleCloudPlatform/ubbagent/stats"
 )
 
+// subscriberBufferSize is the number of flushed reports buffered for each subscriber. Reports
+// published to a subscriber whose buffer is full are dropped.
+const subscriberBufferSize = 100
+
 // Agent is a convenience type that encapsulates a pipeline.Input and a stats.Provider and provides
 // programmatic interfaces similar to those provided by the standalone agent: init, add report,
 // get status, shutdown. Agent is used by the various language-specific SDK implementations
 // contained under this package.
 type Agent struct {
-	input    pipeline.Input
-	provider stats.Provider
+	input       pipeline.Input
+	provider    stats.Provider
+	publisher   *inputs.Publisher
+	persistence persistence.Persistence
+	pause       *senders.Switch
+	persister   *inputs.Persister
+	shutdown    *builder.ShutdownStatus
 }
 
 // NewAgent creates a new Agent. The configuration is passed as YAML or JSON in configData. The
 // state directory is passed as stateDir. If stateDir is empty, state will not be persisted.
-func NewAgent(configData []byte, stateDir string) (*Agent, error) {
+func NewAgent(configData []byte, stateDir string, opts ...builder.Option) (*Agent, error) {
 	cfg, err := parseConfig(configData)
 	if err != nil {
 		return nil, err
@@ -53,25 +64,71 @@ func NewAgent(configData []byte, stateDir string) (*Agent, error) {
 		}
 	}
 
+	p, err = builder.NewPersistence(cfg, p, opts...)
+	if err != nil {
+		return nil, err
+	}
+
 	basic := stats.NewBasic()
-	input, err := builder.Build(cfg, p, basic)
+	publisher := inputs.NewPublisher(subscriberBufferSize)
+	pause := senders.NewSwitch(false)
+	persister := inputs.NewPersister()
+	shutdown := builder.NewShutdownStatus()
+	opts = append(opts, builder.WithPublisher(publisher), builder.WithPauseSwitch(pause), builder.WithPersister(persister), builder.WithShutdownStatus(shutdown))
+	input, err := builder.Build(cfg, p, basic, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Agent{input, basic}, nil
+	return &Agent{input, basic, publisher, p, pause, persister, shutdown}, nil
 }
 
-// Shutdown terminates this agent.
+// Shutdown terminates this agent. Subscriber channels are closed once any remaining reports have
+// been flushed.
 func (agent *Agent) Shutdown() error {
 	err := agent.input.Release()
+	agent.publisher.Close()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// AddReport adds a new usage report.
+// ShutdownStatus describes what Shutdown did, such as the number of reports it flushed and sent and
+// the components that failed, so that callers can tell whether the shutdown was clean. It's complete
+// once Shutdown returns.
+func (agent *Agent) ShutdownStatus() builder.ShutdownResult {
+	return agent.shutdown.Result()
+}
+
+// Subscribe returns a channel that receives each report the agent subsequently flushes to its
+// endpoints, along with a function that unsubscribes and closes the channel. Each subscriber buffers
+// a limited number of reports; reports are dropped for a subscriber that doesn't keep up.
+func (agent *Agent) Subscribe() (<-chan metrics.MetricReport, func()) {
+	return agent.publisher.Subscribe()
+}
+
+// ExportState returns the agent's complete state, including pending aggregations and queued sends,
+// as a JSON document. Aggregations are persisted first, so the export includes every report added
+// before the call. The state can be restored into a new agent using builder.WithState.
+func (agent *Agent) ExportState() ([]byte, error) {
+	agent.persister.Persist()
+	return builder.ExportState(agent.persistence)
+}
+
+// Pause stops sending reports to endpoints. Reports are still accepted, aggregated, and queued, up
+// to each endpoint's maximum queue size.
+func (agent *Agent) Pause() {
+	agent.pause.Pause()
+}
+
+// Resume restarts sending reports to endpoints, starting with any reports queued while paused.
+func (agent *Agent) Resume() {
+	agent.pause.Resume()
+}
+
+// AddReport adds a new usage report. A rejected report's error matches pipeline.ErrUnknownMetric,
+// pipeline.ErrValidation, or pipeline.ErrBackpressure with errors.Is.
 func (agent *Agent) AddReport(report metrics.MetricReport) error {
 	return agent.input.AddReport(report)
 }
@@ -87,7 +144,9 @@ func (agent *Agent) AddReportJson(reportData []byte) error {
 
 // GetStatus returns a stats.Snapshot object containing current agent status.
 func (agent *Agent) GetStatus() stats.Snapshot {
-	return agent.provider.Snapshot()
+	status := agent.provider.Snapshot()
+	status.Paused = agent.pause.Paused()
+	return status
 }
 
 // GetStatusJson returns a stats.Snapshot object serialized as JSON.
@@ -107,6 +166,17 @@ func SerializeStatus(status stats.Snapshot) (data []byte, err error) {
 	return json.Marshal(status)
 }
 
+// ValidateConfig parses and validates the configuration passed as YAML or JSON in configData, as
+// NewAgent does, and checks that each of its endpoints can be constructed (see
+// builder.CheckEndpoints). It doesn't create any state or send any reports.
+func ValidateConfig(configData []byte) error {
+	cfg, err := parseConfig(configData)
+	if err != nil {
+		return err
+	}
+	return builder.CheckEndpoints(cfg)
+}
+
 func parseConfig(configData []byte) (*config.Config, error) {
 	cfg, err := config.Parse(configData)
 	if err != nil {
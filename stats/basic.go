@@ -17,7 +17,9 @@ package stats
 import (
 	"flag"
 	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/GoogleCloudPlatform/ubbagent/clock"
 	"github.com/golang/glog"
@@ -34,6 +36,7 @@ type Basic struct {
 	pending      map[string]*pendingSend
 	pendingCount int64
 	current      Snapshot
+	latency      map[latencyKey]*LatencyHistogram
 }
 
 func (s *Basic) Register(id string, handlers []string) {
@@ -72,6 +75,10 @@ func (s *Basic) SendSucceeded(id string, handler string) {
 	p.handlerSuccess(handler)
 	if p.isSuccessful() {
 		delete(s.pending, id)
+		if p.stale {
+			// Part of the report was dropped, so the send as a whole didn't succeed.
+			return
+		}
 		// Reset the "current" failure count: the number of failures since the last success
 		s.current.CurrentFailureCount = 0
 		// Set the last success time
@@ -93,10 +100,58 @@ func (s *Basic) SendFailed(id string, handler string) {
 	}
 }
 
+func (s *Basic) SendStale(id string, handler string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// A stale report is neither a success nor a failure; it's counted separately, once per report,
+	// even if it goes stale on several handlers. Other handlers may still be sending it.
+	p, exists := s.pending[id]
+	if !exists {
+		glog.Warningf("stats.Basic: ignoring SendStale from handler %v of unknown report id %v", handler, id)
+		return
+	}
+	if !p.stale {
+		p.stale = true
+		s.current.StaleCount++
+	}
+	p.handlerSuccess(handler)
+	if p.isSuccessful() {
+		delete(s.pending, id)
+	}
+}
+
+func (s *Basic) SendLatency(metric string, handler string, latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := latencyKey{metric, handler}
+	h, exists := s.latency[key]
+	if !exists {
+		h = &LatencyHistogram{Metric: metric, Endpoint: handler}
+		s.latency[key] = h
+	}
+	h.observe(latency)
+}
+
+func (s *Basic) PersistFailed(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.current.PersistFailureCount++
+}
+
 func (s *Basic) Snapshot() Snapshot {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	return s.current
+	snapshot := s.current
+	for _, h := range s.latency {
+		copied := *h
+		copied.Counts = append([]int64(nil), h.Counts...)
+		snapshot.Latency = append(snapshot.Latency, copied)
+	}
+	sort.Slice(snapshot.Latency, func(i, j int) bool {
+		a, b := snapshot.Latency[i], snapshot.Latency[j]
+		return a.Metric < b.Metric || (a.Metric == b.Metric && a.Endpoint < b.Endpoint)
+	})
+	return snapshot
 }
 
 func NewBasic() *Basic {
@@ -104,12 +159,23 @@ func NewBasic() *Basic {
 }
 
 func newBasic(clock clock.Clock) *Basic {
-	return &Basic{pending: make(map[string]*pendingSend), clock: clock}
+	return &Basic{
+		pending: make(map[string]*pendingSend),
+		latency: make(map[latencyKey]*LatencyHistogram),
+		clock:   clock,
+	}
+}
+
+type latencyKey struct {
+	metric  string
+	handler string
 }
 
 type pendingSend struct {
 	handlers map[string]bool
 	order    int64
+	// stale is set once any handler drops the report as stale.
+	stale bool
 }
 
 func (ps *pendingSend) handlerSuccess(handler string) {
@@ -125,5 +191,5 @@ func newPendingSend(handlers []string, order int64) *pendingSend {
 	for _, h := range handlers {
 		hm[h] = true
 	}
-	return &pendingSend{hm, order}
+	return &pendingSend{handlers: hm, order: order}
 }
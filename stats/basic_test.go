@@ -16,6 +16,7 @@ package stats
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
@@ -110,3 +111,90 @@ func TestSimple(t *testing.T) {
 		t.Fatalf("Pending set length should have been trimmed to %v, but was %v", *maxPendingSends, len(s.pending))
 	}
 }
+
+func TestBasic_SendLatency(t *testing.T) {
+	s := newBasic(testlib.NewMockClock())
+	s.SendLatency("metric2", "handler1", 30*time.Second)
+	s.SendLatency("metric1", "handler2", 500*time.Millisecond)
+	s.SendLatency("metric1", "handler1", 10*time.Second)
+	s.SendLatency("metric1", "handler1", 4*time.Hour)
+
+	snap := s.Snapshot()
+	if want, got := 3, len(snap.Latency); want != got {
+		t.Fatalf("len(snap.Latency): want=%v, got=%v", want, got)
+	}
+	h := snap.Latency[0]
+	if h.Metric != "metric1" || h.Endpoint != "handler1" {
+		t.Fatalf("snap.Latency[0]: want metric1/handler1, got %v/%v", h.Metric, h.Endpoint)
+	}
+	// 10 seconds falls in the second bucket; 4 hours exceeds every bound.
+	if want, got := []int64{0, 1, 0, 0, 0, 0, 0, 1}, h.Counts; !reflect.DeepEqual(want, got) {
+		t.Fatalf("h.Counts: want=%v, got=%v", want, got)
+	}
+	if want, got := int64(2), h.Count; want != got {
+		t.Fatalf("h.Count: want=%v, got=%v", want, got)
+	}
+	if want, got := 4*time.Hour+10*time.Second, h.Sum; want != got {
+		t.Fatalf("h.Sum: want=%v, got=%v", want, got)
+	}
+	if want, got := "handler2", snap.Latency[1].Endpoint; want != got {
+		t.Fatalf("snap.Latency[1].Endpoint: want=%v, got=%v", want, got)
+	}
+	if want, got := "metric2", snap.Latency[2].Metric; want != got {
+		t.Fatalf("snap.Latency[2].Metric: want=%v, got=%v", want, got)
+	}
+
+	// Snapshots are copies.
+	snap.Latency[0].Counts[0] = 100
+	if s.Snapshot().Latency[0].Counts[0] != 0 {
+		t.Fatal("expected snapshot modification not to affect recorded latency")
+	}
+}
+
+func TestBasic_SendStale(t *testing.T) {
+	s := newBasic(testlib.NewMockClock())
+	s.Register("report1", []string{"handler1", "handler2"})
+	s.SendSucceeded("report1", "handler1")
+	s.SendStale("report1", "handler2")
+
+	// A stale drop isn't a failure, and the report is no longer pending.
+	snap := s.Snapshot()
+	if want, got := 1, snap.StaleCount; want != got {
+		t.Fatalf("snap.StaleCount: want=%v, got=%v", want, got)
+	}
+	if want, got := 0, snap.TotalFailureCount; want != got {
+		t.Fatalf("snap.TotalFailureCount: want=%v, got=%v", want, got)
+	}
+	if want, got := 0, len(s.pending); want != got {
+		t.Fatalf("len(s.pending): want=%v, got=%v", want, got)
+	}
+
+	// A report that goes stale on several handlers is counted once, and stays pending until every
+	// handler is done with it.
+	s.Register("report2", []string{"handler1", "handler2", "handler3"})
+	s.SendStale("report2", "handler1")
+	s.SendStale("report2", "handler2")
+	if want, got := 1, len(s.pending); want != got {
+		t.Fatalf("len(s.pending): want=%v, got=%v", want, got)
+	}
+	s.SendSucceeded("report2", "handler3")
+	snap = s.Snapshot()
+	if want, got := 2, snap.StaleCount; want != got {
+		t.Fatalf("snap.StaleCount: want=%v, got=%v", want, got)
+	}
+	if want, got := 0, len(s.pending); want != got {
+		t.Fatalf("len(s.pending): want=%v, got=%v", want, got)
+	}
+	if !snap.LastReportSuccess.IsZero() {
+		t.Fatalf("snap.LastReportSuccess: want zero, got=%v", snap.LastReportSuccess)
+	}
+}
+
+func TestBasic_PersistFailed(t *testing.T) {
+	s := newBasic(testlib.NewMockClock())
+	s.PersistFailed("aggregator/metric1")
+	s.PersistFailed("aggregator/metric1")
+	if want, got := 2, s.Snapshot().PersistFailureCount; want != got {
+		t.Fatalf("PersistFailureCount: want=%v, got=%v", want, got)
+	}
+}
@@ -19,12 +19,20 @@ import "time"
 // A Recorder records the result of sending a metrics.StampedMetricReport to one or more endpoints.
 //
 // A Recorder expects the following flow:
-// 1. The Register method is called prior to performing a send. The method is passed the ID of the
-//    StampedMetricReport being sent and a list of the handlers that will perform the operation.
-//    Register is called by the first Sender in a pipeline, generally a sender.Dispatcher.
-// 2. As each handler succeeds or fails in performing its portion of the overall operation, it
-//    registers the result using the SendSucceeded and SendFailed methods. The handlers are
-//    generally instances of sender.RetryingSender, wrapping endpoints.
+//  1. The Register method is called prior to performing a send. The method is passed the ID of the
+//     StampedMetricReport being sent and a list of the handlers that will perform the operation.
+//     Register is called by the first Sender in a pipeline, generally a sender.Dispatcher.
+//  2. As each handler succeeds or fails in performing its portion of the overall operation, it
+//     registers the result using the SendSucceeded and SendFailed methods. The handlers are
+//     generally instances of sender.RetryingSender, wrapping endpoints.
+//  3. A handler that drops a report because it outlived its TTL records this using the SendStale
+//     method, instead of SendSucceeded or SendFailed.
+//  4. When a handler succeeds in sending a report with a known ingest time, it records the elapsed
+//     time since ingestion using the SendLatency method.
+//
+// Separately, a component that fails to write persistent state, such as an Aggregator's open bucket
+// or a RetryingSender's queue, records the failure using the PersistFailed method, passing the name
+// of the persisted value or queue.
 //
 // The id value should be set to the value of a StampedMetricReport.Id. A handler should generally
 // be set to the name of an endpoint handling part of the send operation.
@@ -32,6 +40,9 @@ type Recorder interface {
 	Register(id string, handlers []string)
 	SendSucceeded(id string, handler string)
 	SendFailed(id string, handler string)
+	SendStale(id string, handler string)
+	SendLatency(metric string, handler string, latency time.Duration)
+	PersistFailed(name string)
 }
 
 // A Provider provides recorded stats in the form of a Snapshot.
@@ -50,6 +61,59 @@ type Snapshot struct {
 
 	// The number of failures since the last success.
 	TotalFailureCount int `json:"totalFailureCount"`
+
+	// The number of reports dropped because they outlived their TTL.
+	StaleCount int `json:"staleCount"`
+
+	// The number of failed writes of persistent state, such as while the disk is full.
+	PersistFailureCount int `json:"persistFailureCount"`
+
+	// Whether sending is paused. Recorders don't track this; it's set by the agent.
+	Paused bool `json:"paused"`
+
+	// Histograms of the time between ingesting reports and successfully sending them, per metric
+	// and endpoint. Ordered by metric, then endpoint.
+	Latency []LatencyHistogram `json:"latency,omitempty"`
+}
+
+// LatencyBounds are the upper bounds of the buckets of a LatencyHistogram. A final bucket counts
+// latencies greater than the last bound.
+var LatencyBounds = []time.Duration{
+	1 * time.Second,
+	10 * time.Second,
+	1 * time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	1 * time.Hour,
+	3 * time.Hour,
+}
+
+// LatencyHistogram is a histogram of send latencies for a single metric and endpoint.
+type LatencyHistogram struct {
+	Metric   string `json:"metric"`
+	Endpoint string `json:"endpoint"`
+
+	// Counts contains len(LatencyBounds)+1 buckets. Counts[i] is the number of latencies no greater
+	// than LatencyBounds[i] (and greater than the previous bound), and the last bucket counts the
+	// latencies greater than every bound.
+	Counts []int64 `json:"counts"`
+
+	// The number of latencies observed, and their sum.
+	Count int64         `json:"count"`
+	Sum   time.Duration `json:"sum"`
+}
+
+func (h *LatencyHistogram) observe(latency time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int64, len(LatencyBounds)+1)
+	}
+	i := 0
+	for i < len(LatencyBounds) && latency > LatencyBounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += latency
 }
 
 // NewNoopRecorder returns a Recorder that does nothing.
@@ -59,6 +123,9 @@ func NewNoopRecorder() Recorder {
 
 type noopRecorder struct{}
 
-func (*noopRecorder) Register(string, []string)    {}
-func (*noopRecorder) SendSucceeded(string, string) {}
-func (*noopRecorder) SendFailed(string, string)    {}
+func (*noopRecorder) Register(string, []string)                 {}
+func (*noopRecorder) SendSucceeded(string, string)              {}
+func (*noopRecorder) SendFailed(string, string)                 {}
+func (*noopRecorder) SendStale(string, string)                  {}
+func (*noopRecorder) SendLatency(string, string, time.Duration) {}
+func (*noopRecorder) PersistFailed(string)                      {}
@@ -246,6 +246,9 @@ type MockStatsRecorder struct {
 	registered map[string][]string
 	succeeded  []RecordedEntry
 	failed     []RecordedEntry
+	stale      []RecordedEntry
+	latencies  []RecordedLatency
+	persists   []string
 }
 
 type RecordedEntry struct {
@@ -253,6 +256,12 @@ type RecordedEntry struct {
 	Handler string
 }
 
+type RecordedLatency struct {
+	Metric  string
+	Handler string
+	Latency time.Duration
+}
+
 func (sr *MockStatsRecorder) Register(id string, handlers []string) {
 	sr.mu.Lock()
 	if sr.registered == nil {
@@ -276,6 +285,25 @@ func (sr *MockStatsRecorder) SendFailed(id string, handler string) {
 	sr.called()
 }
 
+func (sr *MockStatsRecorder) SendStale(id string, handler string) {
+	sr.mu.Lock()
+	sr.stale = append(sr.stale, RecordedEntry{id, handler})
+	sr.mu.Unlock()
+	sr.called()
+}
+
+func (sr *MockStatsRecorder) SendLatency(metric string, handler string, latency time.Duration) {
+	sr.mu.Lock()
+	sr.latencies = append(sr.latencies, RecordedLatency{metric, handler, latency})
+	sr.mu.Unlock()
+}
+
+func (sr *MockStatsRecorder) PersistFailed(name string) {
+	sr.mu.Lock()
+	sr.persists = append(sr.persists, name)
+	sr.mu.Unlock()
+}
+
 func (sr *MockStatsRecorder) Registered() map[string][]string {
 	sr.mu.RLock()
 	defer sr.mu.RUnlock()
@@ -294,6 +322,25 @@ func (sr *MockStatsRecorder) Failed() []RecordedEntry {
 	return sr.failed
 }
 
+func (sr *MockStatsRecorder) Stale() []RecordedEntry {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.stale
+}
+
+func (sr *MockStatsRecorder) Latencies() []RecordedLatency {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.latencies
+}
+
+// PersistFailures returns the names passed to PersistFailed, in order.
+func (sr *MockStatsRecorder) PersistFailures() []string {
+	sr.mu.RLock()
+	defer sr.mu.RUnlock()
+	return sr.persists
+}
+
 func NewMockStatsRecorder() *MockStatsRecorder {
 	sr := &MockStatsRecorder{}
 	sr.wfcInit()